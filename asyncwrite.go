@@ -0,0 +1,211 @@
+package mgo
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// AsyncWriter inserts documents into a collection in the background,
+// queueing them and flushing them to the server in batches. This trades
+// per-document error reporting for throughput, and is meant for workloads
+// such as logging or telemetry where an occasional lost document is
+// acceptable.
+//
+// Errors are not reported to the code inserting the documents. Instead,
+// they are accounted for in the counters returned by Stats, and the last
+// one seen is returned by Err and Close. The level of acknowledgement
+// requested for each batch is the one of the session the writer was
+// created from (see Session.SetSafe), so with an unsafe session documents
+// are truly fired and forgotten.
+//
+// An AsyncWriter is safe for concurrent use by multiple goroutines.
+type AsyncWriter struct {
+	session *Session
+	c       *Collection
+	opts    AsyncWriteOptions
+	queue   chan interface{}
+	done    chan struct{}
+
+	closing sync.RWMutex
+	closed  bool
+
+	m     sync.Mutex
+	stats AsyncWriteStats
+	err   error
+}
+
+// AsyncWriteOptions holds the options for creating an AsyncWriter.
+// Zero values pick the defaults.
+type AsyncWriteOptions struct {
+	// QueueSize defines how many documents may be waiting to be flushed.
+	// Defaults to 10000.
+	QueueSize int
+
+	// BatchSize defines how many documents are sent to the server at
+	// once, at most. Defaults to 1000, which is also the maximum.
+	BatchSize int
+
+	// FlushInterval defines how long documents may wait in the queue
+	// before being flushed in an incomplete batch. Defaults to 100ms.
+	FlushInterval time.Duration
+
+	// DropWhenFull causes documents inserted while the queue is full to
+	// be dropped and counted, rather than blocking Insert until there's
+	// room for them in the queue.
+	DropWhenFull bool
+}
+
+// AsyncWriteStats holds the counters of an AsyncWriter.
+type AsyncWriteStats struct {
+	Queued  int // Documents accepted into the queue
+	Flushed int // Documents written to the server
+	Failed  int // Documents rejected by the server or lost to errors
+	Dropped int // Documents dropped because the queue was full
+}
+
+const (
+	defaultAsyncQueueSize     = 10000
+	defaultAsyncFlushInterval = 100 * time.Millisecond
+	maxAsyncBatchSize         = 1000
+)
+
+var errAsyncWriterClosed = errors.New("async writer is closed")
+
+// AsyncWriter returns a writer inserting documents into the collection
+// in the background, over a copy of the collection session. The writer
+// must be closed when done, so that queued documents are flushed and the
+// resources it uses are released.
+func (c *Collection) AsyncWriter(opts AsyncWriteOptions) *AsyncWriter {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = defaultAsyncQueueSize
+	}
+	if opts.BatchSize <= 0 || opts.BatchSize > maxAsyncBatchSize {
+		opts.BatchSize = maxAsyncBatchSize
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = defaultAsyncFlushInterval
+	}
+	session := c.Database.Session.Copy()
+	w := &AsyncWriter{
+		session: session,
+		c:       c.With(session),
+		opts:    opts,
+		queue:   make(chan interface{}, opts.QueueSize),
+		done:    make(chan struct{}),
+	}
+	go w.loop()
+	return w
+}
+
+// Insert queues the provided documents for insertion. Unless the writer
+// was created with the DropWhenFull option, Insert blocks while the queue
+// is full. An error is returned only if the writer was closed.
+func (w *AsyncWriter) Insert(docs ...interface{}) error {
+	w.closing.RLock()
+	defer w.closing.RUnlock()
+	if w.closed {
+		return errAsyncWriterClosed
+	}
+	queued, dropped := 0, 0
+	for _, doc := range docs {
+		if !w.opts.DropWhenFull {
+			w.queue <- doc
+			queued++
+			continue
+		}
+		select {
+		case w.queue <- doc:
+			queued++
+		default:
+			dropped++
+		}
+	}
+	w.m.Lock()
+	w.stats.Queued += queued
+	w.stats.Dropped += dropped
+	w.m.Unlock()
+	return nil
+}
+
+// Stats returns a snapshot of the writer counters.
+func (w *AsyncWriter) Stats() AsyncWriteStats {
+	w.m.Lock()
+	defer w.m.Unlock()
+	return w.stats
+}
+
+// Err returns the last error that happened while flushing documents,
+// or nil if none did.
+func (w *AsyncWriter) Err() error {
+	w.m.Lock()
+	defer w.m.Unlock()
+	return w.err
+}
+
+// Close flushes all the documents still queued, waits for them to be
+// written, and releases the resources used by the writer. It returns
+// the last error that happened while flushing documents, if any.
+func (w *AsyncWriter) Close() error {
+	w.closing.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.closing.Unlock()
+	<-w.done
+	return w.Err()
+}
+
+func (w *AsyncWriter) loop() {
+	defer close(w.done)
+	defer w.session.Close()
+
+	ticker := time.NewTicker(w.opts.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]interface{}, 0, w.opts.BatchSize)
+	for {
+		select {
+		case doc, ok := <-w.queue:
+			if !ok {
+				w.flush(batch)
+				return
+			}
+			batch = append(batch, doc)
+			if len(batch) < w.opts.BatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		w.flush(batch)
+		batch = make([]interface{}, 0, w.opts.BatchSize)
+	}
+}
+
+func (w *AsyncWriter) flush(batch []interface{}) {
+	if len(batch) == 0 {
+		return
+	}
+	// Continue on errors, so that a bad document doesn't prevent the
+	// rest of the batch from being written.
+	lerr, err := w.c.writeOp(&insertOp{w.c.FullName, batch, 1}, false)
+	failed := 0
+	if err != nil {
+		failed = len(batch)
+		if lerr != nil && len(lerr.ecases) > 0 && lerr.ecases[0].Index >= 0 {
+			failed = len(lerr.ecases)
+		}
+		logf("Async writer for %s failed to write %d document(s): %v", w.c.FullName, failed, err)
+	}
+	w.m.Lock()
+	w.stats.Flushed += len(batch) - failed
+	w.stats.Failed += failed
+	if err != nil {
+		w.err = err
+	}
+	w.m.Unlock()
+}
@@ -29,6 +29,7 @@ package mgo
 import (
 	"crypto/md5"
 	"crypto/sha1"
+	"crypto/x509"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -237,7 +238,7 @@ func (socket *mongoSocket) loginClassic(cred Credential) error {
 
 type authX509Cmd struct {
 	Authenticate int
-	User         string
+	User         string `bson:",omitempty"`
 	Mechanism    string
 }
 
@@ -465,3 +466,137 @@ func (socket *mongoSocket) dropLogout(cred Credential) (found bool) {
 	}
 	return false
 }
+
+// An Authenticator authenticates connections established with the servers.
+//
+// When set in DialInfo, Auth is called once for every new connection, before
+// it's used by any session. The db parameter holds the database to
+// authenticate against, as defined by the Source field of DialInfo.
+type Authenticator interface {
+	Auth(conn AuthConn, db string) error
+}
+
+// AuthConn is a connection being authenticated by an Authenticator.
+type AuthConn interface {
+	// Run runs the cmd command against the db database on the connection
+	// and unmarshals the reply into result, if not nil.
+	Run(db string, cmd, result interface{}) error
+
+	// Addr returns the address of the server the connection is established with.
+	Addr() string
+}
+
+// authConn is the AuthConn provided to authenticators by the driver.
+type authConn struct {
+	socket *mongoSocket
+}
+
+func (conn *authConn) Run(db string, cmd, result interface{}) error {
+	var raw bson.Raw
+	return conn.socket.loginRun(db, cmd, &raw, func() error {
+		if err := checkQueryError(db+".$cmd", raw.Data); err != nil {
+			return err
+		}
+		if result != nil {
+			return raw.Unmarshal(result)
+		}
+		return nil
+	})
+}
+
+func (conn *authConn) Addr() string {
+	return conn.socket.addr
+}
+
+// authenticate authenticates the socket with auth, unless it was already
+// authenticated before.
+func (socket *mongoSocket) authenticate(auth Authenticator, db string) error {
+	socket.Lock()
+	authenticated := socket.authenticated
+	socket.Unlock()
+	if authenticated {
+		return nil
+	}
+
+	debugf("Socket %p to %s: authenticating: db=%q", socket, socket.addr, db)
+	if err := auth.Auth(&authConn{socket}, db); err != nil {
+		debugf("Socket %p to %s: authentication error: %s", socket, socket.addr, err)
+		return err
+	}
+	debugf("Socket %p to %s: authentication successful", socket, socket.addr)
+
+	socket.Lock()
+	socket.authenticated = true
+	socket.Unlock()
+	return nil
+}
+
+// ScramAuthenticator authenticates connections using the SCRAM-SHA-1
+// mechanism.
+type ScramAuthenticator struct {
+	Username string
+	Password string
+}
+
+// Auth implements the Authenticator interface.
+func (a *ScramAuthenticator) Auth(conn AuthConn, db string) error {
+	sasl := saslNewScram(Credential{Username: a.Username, Password: a.Password})
+	defer sasl.Close()
+
+	start := 1
+	res := saslResult{}
+	for {
+		payload, done, err := sasl.Step(res.Payload)
+		if err != nil {
+			return err
+		}
+		if done && res.Done {
+			return nil
+		}
+		cmd := saslCmd{
+			Start:          start,
+			Continue:       1 - start,
+			ConversationId: res.ConversationId,
+			Mechanism:      "SCRAM-SHA-1",
+			Payload:        payload,
+		}
+		start = 0
+		if err := conn.Run(db, &cmd, &res); err != nil {
+			return err
+		}
+		if done && res.Done {
+			return nil
+		}
+	}
+}
+
+// X509Authenticator authenticates connections using the MONGODB-X509
+// mechanism, with the client certificate presented during the TLS handshake.
+// The connections must be established over TLS with the client certificate,
+// as defined by the DialServer function in DialInfo.
+//
+// Relevant documentation:
+//
+//     https://docs.mongodb.com/manual/tutorial/configure-x509-client-authentication/
+//
+type X509Authenticator struct {
+	// Certificate optionally holds the client certificate, from which
+	// the user name is derived. If nil, the server infers the user name
+	// from the certificate presented, which requires MongoDB 3.4 or newer.
+	Certificate *x509.Certificate
+}
+
+// Auth implements the Authenticator interface. Users authenticated with
+// certificates are always defined in the $external database, so db is
+// ignored.
+func (a *X509Authenticator) Auth(conn AuthConn, db string) error {
+	cmd := authX509Cmd{Authenticate: 1, Mechanism: "MONGODB-X509"}
+	if a.Certificate != nil {
+		user, err := getRFC2253NameStringFromCert(a.Certificate)
+		if err != nil {
+			return err
+		}
+		cmd.User = user
+	}
+	return conn.Run("$external", &cmd, nil)
+}
@@ -146,6 +146,40 @@ func (s *S) TestAuthLoginLogoutAll(c *C) {
 	c.Assert(err, ErrorMatches, "unauthorized|need to login|not authorized .*")
 }
 
+func (s *S) TestAuthLoginSurvivesOutage(c *C) {
+	if *fast {
+		c.Skip("-fast")
+	}
+
+	session, err := mgo.Dial("localhost:40002")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	session.SetMode(mgo.Monotonic, true)
+	admindb := session.DB("admin")
+	err = admindb.Login("root", "rapadura")
+	c.Assert(err, IsNil)
+
+	coll := session.DB("mydb").C("mycoll")
+	err = coll.Insert(M{"n": 1})
+	c.Assert(err, IsNil)
+
+	s.Stop("localhost:40002")
+	s.StartAll()
+
+	// The session resumes with the same credentials and mode,
+	// without logging in again.
+	err = coll.Insert(M{"n": 2})
+	c.Assert(err, IsNil)
+	c.Assert(session.Mode(), Equals, mgo.Monotonic)
+	_, pinned := session.PinnedServer()
+	c.Assert(pinned, Equals, true)
+
+	n, err := coll.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+}
+
 func (s *S) TestAuthUpsertUserErrors(c *C) {
 	session, err := mgo.Dial("localhost:40002")
 	c.Assert(err, IsNil)
@@ -895,6 +929,43 @@ func (s *S) TestAuthScramSha1URL(c *C) {
 	c.Assert(err, Equals, mgo.ErrNotFound)
 }
 
+func (s *S) TestAuthScramAuthenticator(c *C) {
+	if !s.versionAtLeast(2, 7, 7) {
+		c.Skip("SCRAM-SHA-1 tests depend on 2.7.7")
+	}
+	session, err := mgo.DialWithInfo(&mgo.DialInfo{
+		Addrs:         []string{"localhost:40002"},
+		Authenticator: &mgo.ScramAuthenticator{Username: "root", Password: "rapadura"},
+	})
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	mycoll := session.DB("admin").C("mycoll")
+	err = mycoll.Find(nil).One(nil)
+	c.Assert(err, Equals, mgo.ErrNotFound)
+
+	// Connection authentication isn't dropped by logging the session out.
+	session.LogoutAll()
+	err = mycoll.Find(nil).One(nil)
+	c.Assert(err, Equals, mgo.ErrNotFound)
+}
+
+func (s *S) TestAuthScramAuthenticatorWrongCredentials(c *C) {
+	if !s.versionAtLeast(2, 7, 7) {
+		c.Skip("SCRAM-SHA-1 tests depend on 2.7.7")
+	}
+	session, err := mgo.DialWithInfo(&mgo.DialInfo{
+		Addrs:         []string{"localhost:40002"},
+		Authenticator: &mgo.ScramAuthenticator{Username: "root", Password: "wrong"},
+		Timeout:       3 * time.Second,
+	})
+	if session != nil {
+		session.Close()
+	}
+	c.Assert(err, ErrorMatches, "auth fail(s|ed)|.*Authentication failed.")
+	c.Assert(session, IsNil)
+}
+
 func (s *S) TestAuthX509Cred(c *C) {
 	session, err := mgo.Dial("localhost:40001")
 	c.Assert(err, IsNil)
@@ -1031,6 +1102,72 @@ func (s *S) TestAuthX509CredRDNConstruction(c *C) {
 	c.Logf("Authenticated!")
 }
 
+func (s *S) TestAuthX509Authenticator(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+	binfo, err := session.BuildInfo()
+	c.Assert(err, IsNil)
+	if binfo.OpenSSLVersion == "" {
+		c.Skip("server does not support SSL")
+	}
+
+	clientCertPEM, err := ioutil.ReadFile("harness/certs/client.pem")
+	c.Assert(err, IsNil)
+
+	clientCert, err := tls.X509KeyPair(clientCertPEM, clientCertPEM)
+	c.Assert(err, IsNil)
+
+	clientCert.Leaf, err = x509.ParseCertificate(clientCert.Certificate[0])
+	c.Assert(err, IsNil)
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{clientCert},
+	}
+	dialServer := func(addr *mgo.ServerAddr) (net.Conn, error) {
+		return tls.Dial("tcp", addr.String(), tlsConfig)
+	}
+
+	var host = "localhost:40003"
+	session, err = mgo.DialWithInfo(&mgo.DialInfo{
+		Addrs:      []string{host},
+		DialServer: dialServer,
+		Username:   "root",
+		Password:   "rapadura",
+	})
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	// This needs to be kept in sync with client.pem
+	x509Subject := "CN=localhost,OU=Client,O=MGO,L=MGO,ST=MGO,C=GO"
+
+	var x509User = mgo.User{
+		Username:     x509Subject,
+		OtherDBRoles: map[string][]mgo.Role{"admin": {mgo.RoleRoot}},
+	}
+	err = session.DB("$external").UpsertUser(&x509User)
+	c.Assert(err, IsNil)
+
+	authenticators := []*mgo.X509Authenticator{{Certificate: clientCert.Leaf}}
+	if s.versionAtLeast(3, 4) {
+		// The server infers the user name from the certificate.
+		authenticators = append(authenticators, &mgo.X509Authenticator{})
+	}
+	for _, auth := range authenticators {
+		session, err := mgo.DialWithInfo(&mgo.DialInfo{
+			Addrs:         []string{host},
+			DialServer:    dialServer,
+			Authenticator: auth,
+		})
+		c.Assert(err, IsNil)
+		defer session.Close()
+
+		_, err = session.DatabaseNames()
+		c.Assert(err, IsNil)
+	}
+}
+
 var (
 	plainFlag = flag.String("plain", "", "Host to test PLAIN authentication against (depends on custom environment)")
 	plainUser = "einstein"
@@ -579,8 +579,12 @@ func Marshal(in interface{}) (out []byte, err error) {
 // allocating a new byte slice it tries to use the received byte slice and
 // only allocates more memory if necessary to fit the marshaled value.
 func MarshalBuffer(in interface{}, buf []byte) (out []byte, err error) {
+	return marshalBuffer(in, buf, nil)
+}
+
+func marshalBuffer(in interface{}, buf []byte, registry *Registry) (out []byte, err error) {
 	defer handleErr(&err)
-	e := &encoder{buf}
+	e := &encoder{out: buf, registry: registry}
 	e.addDoc(reflect.ValueOf(in))
 	return e.out, nil
 }
@@ -621,6 +625,10 @@ func MarshalBuffer(in interface{}, buf []byte) (out []byte, err error) {
 //
 // Pointer values are initialized when necessary.
 func Unmarshal(in []byte, out interface{}) (err error) {
+	return unmarshal(in, out, nil)
+}
+
+func unmarshal(in []byte, out interface{}, registry *Registry) (err error) {
 	if raw, ok := out.(*Raw); ok {
 		raw.Kind = 3
 		raw.Data = in
@@ -633,6 +641,7 @@ func Unmarshal(in []byte, out interface{}) (err error) {
 		fallthrough
 	case reflect.Map:
 		d := newDecoder(in)
+		d.registry = registry
 		d.readDocTo(v)
 		if d.i < len(d.in) {
 			return errors.New("document is corrupted")
@@ -1110,6 +1110,106 @@ func (s *S) TestMarshalWithGetterNil(c *C) {
 	c.Assert(m, DeepEquals, bson.M{"_": "<value is nil>"})
 }
 
+// --------------------------------------------------------------------------
+// Registry tests.
+
+type amount struct {
+	cents int64
+}
+
+type docWithAmounts struct {
+	Price  amount
+	Prices []amount
+	ByName map[string]amount
+	Ptr    *amount
+}
+
+func amountRegistry() *bson.Registry {
+	registry := bson.NewRegistry()
+	registry.Register(reflect.TypeOf(amount{}),
+		func(v interface{}) (interface{}, error) {
+			return fmt.Sprintf("%d.%02d", v.(amount).cents/100, v.(amount).cents%100), nil
+		},
+		func(raw bson.Raw) (interface{}, error) {
+			var s string
+			if err := raw.Unmarshal(&s); err != nil {
+				return nil, err
+			}
+			var units, cents int64
+			if _, err := fmt.Sscanf(s, "%d.%d", &units, &cents); err != nil {
+				return nil, err
+			}
+			return amount{units*100 + cents}, nil
+		})
+	return registry
+}
+
+func (s *S) TestRegistryRoundTrip(c *C) {
+	registry := amountRegistry()
+	doc := docWithAmounts{
+		Price:  amount{1234},
+		Prices: []amount{{5}, {100}},
+		ByName: map[string]amount{"a": {250}},
+		Ptr:    &amount{99},
+	}
+	data, err := registry.Marshal(doc)
+	c.Assert(err, IsNil)
+
+	m := bson.M{}
+	err = bson.Unmarshal(data, m)
+	c.Assert(err, IsNil)
+	c.Assert(m["price"], Equals, "12.34")
+	c.Assert(m["prices"], DeepEquals, []interface{}{"0.05", "1.00"})
+	c.Assert(m["byname"], DeepEquals, bson.M{"a": "2.50"})
+	c.Assert(m["ptr"], Equals, "0.99")
+
+	var result docWithAmounts
+	err = registry.Unmarshal(data, &result)
+	c.Assert(err, IsNil)
+	c.Assert(result, DeepEquals, doc)
+}
+
+func (s *S) TestRegistryLeavesDefaultsAlone(c *C) {
+	registry := amountRegistry()
+	doc := docWithAmounts{Price: amount{1234}}
+
+	data, err := bson.Marshal(doc)
+	c.Assert(err, IsNil)
+	m := bson.M{}
+	err = bson.Unmarshal(data, m)
+	c.Assert(err, IsNil)
+	c.Assert(m["price"], DeepEquals, bson.M{})
+
+	data, err = registry.Marshal(doc)
+	c.Assert(err, IsNil)
+	var result docWithAmounts
+	err = bson.Unmarshal(data, &result)
+	c.Assert(err, IsNil)
+	c.Assert(result.Price, Equals, amount{})
+}
+
+func (s *S) TestRegistryErrors(c *C) {
+	registry := bson.NewRegistry()
+	registry.Register(reflect.TypeOf(amount{}),
+		func(v interface{}) (interface{}, error) {
+			return nil, errors.New("oops")
+		},
+		func(raw bson.Raw) (interface{}, error) {
+			return nil, &bson.TypeError{Type: reflect.TypeOf(amount{}), Kind: raw.Kind}
+		})
+
+	_, err := registry.Marshal(docWithAmounts{})
+	c.Assert(err, ErrorMatches, "oops")
+
+	// Incompatible values are skipped, as with setters.
+	data, err := bson.Marshal(bson.M{"price": "1.00"})
+	c.Assert(err, IsNil)
+	result := map[string]amount{}
+	err = registry.Unmarshal(data, result)
+	c.Assert(err, IsNil)
+	c.Assert(result, HasLen, 0)
+}
+
 // --------------------------------------------------------------------------
 // Cross-type conversion tests.
 
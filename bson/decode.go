@@ -40,15 +40,16 @@ import (
 )
 
 type decoder struct {
-	in      []byte
-	i       int
-	docType reflect.Type
+	in       []byte
+	i        int
+	docType  reflect.Type
+	registry *Registry
 }
 
 var typeM = reflect.TypeOf(M{})
 
 func newDecoder(in []byte) *decoder {
-	return &decoder{in, 0, typeM}
+	return &decoder{in: in, docType: typeM}
 }
 
 // --------------------------------------------------------------------------
@@ -226,7 +227,7 @@ func (d *decoder) readDocTo(out reflect.Value) {
 	}
 	for d.in[d.i] != '\x00' {
 		kind := d.readByte()
-		name := d.readCStr()
+		name := d.readCStrBytes()
 		if d.i >= end {
 			corrupted()
 		}
@@ -235,7 +236,7 @@ func (d *decoder) readDocTo(out reflect.Value) {
 		case reflect.Map:
 			e := reflect.New(elemType).Elem()
 			if d.readElemTo(e, kind) {
-				k := reflect.ValueOf(name)
+				k := reflect.ValueOf(string(name))
 				if convertKey {
 					mapKeyType := out.Type().Key()
 					mapKeyKind := mapKeyType.Kind()
@@ -277,7 +278,7 @@ func (d *decoder) readDocTo(out reflect.Value) {
 				out.SetMapIndex(k, e)
 			}
 		case reflect.Struct:
-			if info, ok := fieldsMap[name]; ok {
+			if info, ok := fieldsMap[string(name)]; ok {
 				if info.Inline == nil {
 					d.readElemTo(out.Field(info.Num), kind)
 				} else {
@@ -289,7 +290,7 @@ func (d *decoder) readDocTo(out reflect.Value) {
 				}
 				e := reflect.New(elemType).Elem()
 				if d.readElemTo(e, kind) {
-					inlineMap.SetMapIndex(reflect.ValueOf(name), e)
+					inlineMap.SetMapIndex(reflect.ValueOf(string(name)), e)
 				}
 			} else {
 				d.dropElem(kind)
@@ -354,7 +355,6 @@ func (d *decoder) readArrayDocTo(out reflect.Value) {
 }
 
 func (d *decoder) readSliceDoc(t reflect.Type) interface{} {
-	tmp := make([]reflect.Value, 0, 8)
 	elemType := t.Elem()
 	if elemType == typeRawDocElem {
 		d.dropElem(ElementArray)
@@ -369,6 +369,12 @@ func (d *decoder) readSliceDoc(t reflect.Type) interface{} {
 	if end <= d.i || end > len(d.in) || d.in[end-1] != '\x00' {
 		corrupted()
 	}
+
+	// Elements are unmarshalled straight into the resulting slice, which
+	// is sized by counting them first.
+	count := d.countElems(end)
+	slice := reflect.MakeSlice(t, count, count)
+	n := 0
 	for d.in[d.i] != '\x00' {
 		kind := d.readByte()
 		for d.i < end && d.in[d.i] != '\x00' {
@@ -378,9 +384,11 @@ func (d *decoder) readSliceDoc(t reflect.Type) interface{} {
 			corrupted()
 		}
 		d.i++
-		e := reflect.New(elemType).Elem()
-		if d.readElemTo(e, kind) {
-			tmp = append(tmp, e)
+		if n == count {
+			corrupted()
+		}
+		if d.readElemTo(slice.Index(n), kind) {
+			n++
 		}
 		if d.i >= end {
 			corrupted()
@@ -390,15 +398,34 @@ func (d *decoder) readSliceDoc(t reflect.Type) interface{} {
 	if d.i != end {
 		corrupted()
 	}
-
-	n := len(tmp)
-	slice := reflect.MakeSlice(t, n, n)
-	for i := 0; i != n; i++ {
-		slice.Index(i).Set(tmp[i])
+	if n < slice.Len() {
+		slice = slice.Slice3(0, n, n)
 	}
 	return slice.Interface()
 }
 
+// countElems returns the number of elements from the current position up
+// to the terminating null byte of the document or array ending at end,
+// without unmarshalling them.
+func (d *decoder) countElems(end int) int {
+	n := 0
+	for i := d.i; i < end && d.in[i] != '\x00'; n++ {
+		kind := d.in[i]
+		i++
+		for i < end && d.in[i] != '\x00' {
+			i++
+		}
+		i++
+		size, err := BSONElementSize(kind, i, d.in)
+		if err != nil {
+			// Leave reporting the problem to the unmarshalling.
+			return n + 1
+		}
+		i += size
+	}
+	return n
+}
+
 func BSONElementSize(kind byte, offset int, buffer []byte) (int, error) {
 	switch kind {
 	case ElementFloat64: // Float64
@@ -631,6 +658,18 @@ func (d *decoder) readElemTo(out reflect.Value, kind byte) (good bool) {
 		return true
 	}
 
+	if decode := d.registry.decoder(outt); decode != nil {
+		return decodeTo(decode, d.readRaw(kind), out)
+	}
+	if outt.Kind() == reflect.Ptr && kind != ElementNil && d.registry.decoder(outt.Elem()) != nil {
+		elem := reflect.New(outt.Elem())
+		good = d.readElemTo(elem.Elem(), kind)
+		if good {
+			out.Set(elem)
+		}
+		return good
+	}
+
 	if kind == ElementDocument {
 		// Delegate unmarshaling of documents.
 		outt := out.Type()
@@ -674,6 +713,39 @@ func (d *decoder) readElemTo(out reflect.Value, kind byte) (good bool) {
 		return false
 	}
 
+	// Set the most common scalar kinds directly, rather than boxing them
+	// into the interface value below only to unbox them again.
+	switch outt.Kind() {
+	case reflect.String:
+		switch {
+		case kind == ElementString:
+			out.SetString(d.readStr())
+			return true
+		case kind == ElementObjectId && outt == typeObjectId:
+			out.SetString(string(d.readBytes(12)))
+			return true
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		switch {
+		case kind == ElementInt32:
+			out.SetInt(int64(d.readInt32()))
+			return true
+		case kind == ElementInt64 && outt != typeTimeDuration:
+			out.SetInt(d.readInt64())
+			return true
+		}
+	case reflect.Float32, reflect.Float64:
+		if kind == ElementFloat64 {
+			out.SetFloat(d.readFloat64())
+			return true
+		}
+	case reflect.Bool:
+		if kind == ElementBool {
+			out.SetBool(d.readBool())
+			return true
+		}
+	}
+
 	var in interface{}
 
 	switch kind {
@@ -973,6 +1045,12 @@ func (d *decoder) readStr() string {
 }
 
 func (d *decoder) readCStr() string {
+	return string(d.readCStrBytes())
+}
+
+// readCStrBytes works like readCStr, but returns the string bytes within
+// the input, so that looking them up doesn't require allocating a string.
+func (d *decoder) readCStrBytes() []byte {
 	start := d.i
 	end := start
 	l := len(d.in)
@@ -985,7 +1063,7 @@ func (d *decoder) readCStr() string {
 	if d.i > l {
 		corrupted()
 	}
-	return string(d.in[start:end])
+	return d.in[start:end]
 }
 
 func (d *decoder) readBool() bool {
@@ -152,7 +152,8 @@ func getGetter(outt reflect.Type, out reflect.Value) Getter {
 // Marshaling of the document value itself.
 
 type encoder struct {
-	out []byte
+	out      []byte
+	registry *Registry
 }
 
 func (e *encoder) addDoc(v reflect.Value) {
@@ -358,6 +359,15 @@ func (e *encoder) addElem(name string, v reflect.Value, minSize bool) {
 		return
 	}
 
+	if encode := e.registry.encoder(v.Type()); encode != nil {
+		encv, err := encode(v.Interface())
+		if err != nil {
+			panic(err)
+		}
+		e.addElem(name, reflect.ValueOf(encv), minSize)
+		return
+	}
+
 	if getter := getGetter(v.Type(), v); getter != nil {
 		getv, err := getter.GetBSON()
 		if err != nil {
@@ -0,0 +1,135 @@
+package bson
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// EncodeFunc returns the value to be marshalled in place of v, in the same
+// way as the GetBSON method of a Getter does.
+type EncodeFunc func(v interface{}) (interface{}, error)
+
+// DecodeFunc returns the value to be stored in place of the one unmarshalled
+// from raw, in the same way as the SetBSON method of a Setter would set it.
+// Returning ErrSetZero sets the value to its zero value, and returning a
+// *TypeError reports the raw value as incompatible, which causes the value
+// to be left untouched.
+type DecodeFunc func(raw Raw) (interface{}, error)
+
+// Registry holds the functions used for marshalling and unmarshalling given
+// types, which take precedence over the default handling of the type, and
+// over its GetBSON and SetBSON methods. This allows choosing the
+// representation of types that can't or shouldn't implement the Getter and
+// Setter interfaces, such as types defined in other packages.
+//
+// Registered functions are consulted for the fields of structs, the values
+// of maps and the elements of slices and arrays, at any depth, but not for
+// the value provided to Marshal or Unmarshal itself.
+//
+// A Registry is safe for concurrent use, including while types are being
+// registered.
+type Registry struct {
+	m        sync.RWMutex
+	encoders map[reflect.Type]EncodeFunc
+	decoders map[reflect.Type]DecodeFunc
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		encoders: make(map[reflect.Type]EncodeFunc),
+		decoders: make(map[reflect.Type]DecodeFunc),
+	}
+}
+
+// Register sets the functions used for marshalling and unmarshalling values
+// of type t. Either function may be nil, in which case the default handling
+// is used in that direction. For example:
+//
+//     registry.Register(reflect.TypeOf(Amount{}),
+//         func(v interface{}) (interface{}, error) {
+//             return v.(Amount).String(), nil
+//         },
+//         func(raw bson.Raw) (interface{}, error) {
+//             var s string
+//             if err := raw.Unmarshal(&s); err != nil {
+//                 return nil, err
+//             }
+//             return ParseAmount(s)
+//         })
+//
+func (r *Registry) Register(t reflect.Type, encode EncodeFunc, decode DecodeFunc) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if encode == nil {
+		delete(r.encoders, t)
+	} else {
+		r.encoders[t] = encode
+	}
+	if decode == nil {
+		delete(r.decoders, t)
+	} else {
+		r.decoders[t] = decode
+	}
+}
+
+// Marshal behaves like the Marshal function of this package, using the
+// functions registered for the types found in the value.
+func (r *Registry) Marshal(in interface{}) ([]byte, error) {
+	return marshalBuffer(in, make([]byte, 0, initialBufferSize), r)
+}
+
+// Unmarshal behaves like the Unmarshal function of this package, using the
+// functions registered for the types found in out.
+func (r *Registry) Unmarshal(in []byte, out interface{}) error {
+	return unmarshal(in, out, r)
+}
+
+// encoder returns the function registered for marshalling values of type t,
+// or nil if there's none. A nil registry has no functions registered.
+func (r *Registry) encoder(t reflect.Type) EncodeFunc {
+	if r == nil {
+		return nil
+	}
+	r.m.RLock()
+	defer r.m.RUnlock()
+	return r.encoders[t]
+}
+
+// decoder returns the function registered for unmarshalling values of type
+// t, or nil if there's none. A nil registry has no functions registered.
+func (r *Registry) decoder(t reflect.Type) DecodeFunc {
+	if r == nil {
+		return nil
+	}
+	r.m.RLock()
+	defer r.m.RUnlock()
+	return r.decoders[t]
+}
+
+// decodeTo sets out to the value returned by decode for raw, and reports
+// whether raw was compatible with it.
+func decodeTo(decode DecodeFunc, raw Raw, out reflect.Value) bool {
+	v, err := decode(raw)
+	if err == ErrSetZero {
+		out.Set(reflect.Zero(out.Type()))
+		return true
+	}
+	if err != nil {
+		if _, ok := err.(*TypeError); ok {
+			return false
+		}
+		panic(err)
+	}
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() {
+		out.Set(reflect.Zero(out.Type()))
+		return true
+	}
+	if !rv.Type().AssignableTo(out.Type()) {
+		panic(fmt.Sprintf("registered decoder for %v returned a %v value", out.Type(), rv.Type()))
+	}
+	out.Set(rv)
+	return true
+}
@@ -27,8 +27,30 @@ type Bulk struct {
 	opcount int
 	actions []bulkAction
 	ordered bool
+	dups    DuplicateMode
 }
 
+// DuplicateMode defines how a bulk operation handles inserted documents
+// that conflict with existing documents on a unique index.
+type DuplicateMode int
+
+const (
+	// DuplicatesFail reports inserted duplicates as errors, and in
+	// ordered mode stops the bulk operation at the first one of them.
+	// This is the default mode.
+	DuplicatesFail DuplicateMode = iota
+
+	// DuplicatesSkip leaves the existing documents untouched and goes
+	// on with the remaining operations.
+	DuplicatesSkip
+
+	// DuplicatesUpsert replaces the existing document having the same
+	// _id as the inserted duplicate, and goes on with the remaining
+	// operations. Duplicates without an _id field are reported as
+	// errors.
+	DuplicatesUpsert
+)
+
 type bulkOp int
 
 const (
@@ -52,6 +74,11 @@ type BulkResult struct {
 	Matched  int
 	Modified int // Available only for MongoDB 2.6+
 
+	// Duplicates holds the positions of the inserted documents found to
+	// be duplicates, in increasing order. It's only set when the bulk
+	// operation doesn't run in DuplicatesFail mode.
+	Duplicates []int
+
 	// Be conservative while we understand exactly how to report these
 	// results in a useful and convenient way, and also how to emulate
 	// them with prior servers.
@@ -142,6 +169,32 @@ func (b *Bulk) Unordered() {
 	b.ordered = false
 }
 
+// SetDuplicates defines how inserted documents that conflict with
+// existing ones on a unique index are handled. See DuplicateMode for
+// the available modes.
+//
+// The positions of the duplicates are reported in the Duplicates field
+// of the BulkResult. Unacknowledged writes, with a nil Safe on the
+// session, never report duplicates.
+//
+// For example, an import job that may run again over data it already
+// imported may skip the documents it finds to be there:
+//
+//     bulk := collection.Bulk()
+//     bulk.SetDuplicates(mgo.DuplicatesSkip)
+//     bulk.Insert(docs...)
+//     result, err := bulk.Run()
+//     if err != nil {
+//         return err
+//     }
+//     for _, i := range result.Duplicates {
+//         log.Printf("document %d was already imported", i)
+//     }
+//
+func (b *Bulk) SetDuplicates(mode DuplicateMode) {
+	b.dups = mode
+}
+
 func (b *Bulk) action(op bulkOp, opcount int) *bulkAction {
 	var action *bulkAction
 	if len(b.actions) > 0 && b.actions[len(b.actions)-1].op == op {
@@ -314,10 +367,14 @@ func (b *Bulk) Run() (*BulkResult, error) {
 		sort.Sort(bulkErrorCases(berr.ecases))
 		return nil, &berr
 	}
+	sort.Ints(result.Duplicates)
 	return &result, nil
 }
 
 func (b *Bulk) runInsert(action *bulkAction, result *BulkResult, berr *BulkError) bool {
+	if b.dups != DuplicatesFail {
+		return b.runInsertDups(action, result, berr)
+	}
 	op := &insertOp{b.c.FullName, action.docs, 0}
 	if !b.ordered {
 		op.flags = 1 // ContinueOnError
@@ -326,6 +383,81 @@ func (b *Bulk) runInsert(action *bulkAction, result *BulkResult, berr *BulkError
 	return b.checkSuccess(action, berr, lerr, err)
 }
 
+// runInsertDups runs the insert action handling the duplicates it finds
+// as defined by the duplicate mode. In ordered mode the server stops at
+// the first error, so the remaining documents are sent again after each
+// duplicate is handled.
+func (b *Bulk) runInsertDups(action *bulkAction, result *BulkResult, berr *BulkError) bool {
+	docs, idxs := action.docs, action.idxs
+	ok := true
+	for len(docs) > 0 {
+		op := &insertOp{b.c.FullName, docs, 0}
+		if !b.ordered {
+			op.flags = 1 // ContinueOnError
+		}
+		lerr, err := b.c.writeOp(op, b.ordered)
+		if err == nil {
+			return ok
+		}
+		if lerr == nil || len(lerr.ecases) == 0 {
+			for _, idx := range idxs {
+				berr.ecases = append(berr.ecases, BulkErrorCase{idx, err})
+			}
+			return false
+		}
+		next := len(docs)
+		for _, ecase := range lerr.ecases {
+			idx := ecase.Index
+			if idx < 0 {
+				// Servers older than 2.6 don't tell which document
+				// failed, so there's no way to handle it.
+				berr.ecases = append(berr.ecases, BulkErrorCase{-1, ecase.Err})
+				return false
+			}
+			err := ecase.Err
+			if IsDup(err) {
+				result.Duplicates = append(result.Duplicates, idxs[idx])
+				err = b.handleDup(docs[idx], result, err)
+			}
+			if err != nil {
+				berr.ecases = append(berr.ecases, BulkErrorCase{idxs[idx], err})
+				ok = false
+				if b.ordered {
+					return false
+				}
+			} else if b.ordered {
+				next = idx + 1
+			}
+		}
+		docs, idxs = docs[next:], idxs[next:]
+	}
+	return ok
+}
+
+// handleDup handles the inserted duplicate doc that failed with err, and
+// returns the error it must be reported with, if any.
+func (b *Bulk) handleDup(doc interface{}, result *BulkResult, err error) error {
+	if b.dups != DuplicatesUpsert {
+		return nil
+	}
+	id := fieldValue(docFields(doc), "_id")
+	if id == nil {
+		return err
+	}
+	lerr, err := b.c.writeOp(bulkUpdateOp{&updateOp{
+		Collection: b.c.FullName,
+		Selector:   bson.D{{Name: "_id", Value: id}},
+		Update:     doc,
+		Flags:      1,
+		Upsert:     true,
+	}}, b.ordered)
+	if lerr != nil {
+		result.Matched += lerr.N
+		result.Modified += lerr.modified
+	}
+	return err
+}
+
 func (b *Bulk) runUpdate(action *bulkAction, result *BulkResult, berr *BulkError) bool {
 	lerr, err := b.c.writeOp(bulkUpdateOp(action.docs), b.ordered)
 	if lerr != nil {
@@ -93,6 +93,40 @@ func (s *S) TestBulkInsertErrorUnordered(c *C) {
 	c.Assert(res, DeepEquals, []doc{{1}, {2}, {3}})
 }
 
+func (s *S) TestBulkInsertDuplicates(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	err = coll.Insert(M{"_id": 2, "n": 0}, M{"_id": 4, "n": 0})
+	c.Assert(err, IsNil)
+
+	bulk := coll.Bulk()
+	bulk.SetDuplicates(mgo.DuplicatesSkip)
+	bulk.Insert(M{"_id": 1, "n": 1}, M{"_id": 2, "n": 1}, M{"_id": 3, "n": 1}, M{"_id": 4, "n": 1})
+	r, err := bulk.Run()
+	c.Assert(err, IsNil)
+	c.Assert(r.Duplicates, DeepEquals, []int{1, 3})
+
+	bulk = coll.Bulk()
+	bulk.Unordered()
+	bulk.SetDuplicates(mgo.DuplicatesUpsert)
+	bulk.Insert(M{"_id": 4, "n": 2}, M{"_id": 5, "n": 2})
+	r, err = bulk.Run()
+	c.Assert(err, IsNil)
+	c.Assert(r.Duplicates, DeepEquals, []int{0})
+
+	type doc struct {
+		Id int `bson:"_id"`
+		N  int
+	}
+	var res []doc
+	err = coll.Find(nil).Sort("_id").All(&res)
+	c.Assert(err, IsNil)
+	c.Assert(res, DeepEquals, []doc{{1, 1}, {2, 0}, {3, 1}, {4, 2}, {5, 2}})
+}
+
 func (s *S) TestBulkInsertErrorUnorderedSplitBatch(c *C) {
 	// The server has a batch limit of 1000 documents when using write commands.
 	// This artificial limit did not exist with the old wire protocol, so to
@@ -453,6 +487,45 @@ func (s *S) TestBulkMixedUnordered(c *C) {
 	c.Assert(res, DeepEquals, []doc{{2}, {3}, {4}})
 }
 
+func (s *S) TestBulkMixedErrorUnordered(c *C) {
+	if !s.versionAtLeast(2, 6) {
+		c.Skip("2.4- has poor bulk reporting")
+	}
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+
+	bulk := coll.Bulk()
+	bulk.Unordered()
+	bulk.Insert(M{"_id": 1, "n": 1}, M{"_id": 2, "n": 2})
+	bulk.Insert(M{"_id": 1, "n": 10})
+	bulk.Update(M{"_id": 2}, M{"$inc": M{"n": 1}})
+	bulk.Update(M{"_id": 2}, M{"$set": M{"_id": 3}})
+	bulk.Insert(M{"_id": 4, "n": 4})
+	bulk.Remove(M{"_id": 1})
+	r, err := bulk.Run()
+	c.Assert(err, NotNil)
+	c.Assert(r, IsNil)
+
+	ecases := err.(*mgo.BulkError).Cases()
+	c.Assert(ecases, HasLen, 2)
+	c.Check(ecases[0].Err, ErrorMatches, ".*duplicate.*")
+	c.Check(ecases[0].Index, Equals, 2)
+	c.Check(ecases[1].Err, ErrorMatches, ".*_id.*")
+	c.Check(ecases[1].Index, Equals, 4)
+
+	type doc struct {
+		Id int `bson:"_id"`
+		N  int
+	}
+	var res []doc
+	err = coll.Find(nil).Sort("_id").All(&res)
+	c.Assert(err, IsNil)
+	c.Assert(res, DeepEquals, []doc{{2, 3}, {4, 4}})
+}
+
 func (s *S) TestBulkUpsert(c *C) {
 	session, err := mgo.Dial("localhost:40001")
 	c.Assert(err, IsNil)
@@ -524,3 +597,61 @@ func (s *S) TestBulkRemoveAll(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(res, DeepEquals, []doc{{3}})
 }
+
+func (s *S) TestAsyncWriter(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	w := coll.AsyncWriter(mgo.AsyncWriteOptions{BatchSize: 100})
+	for i := 0; i < 2500; i++ {
+		c.Assert(w.Insert(M{"n": i}), IsNil)
+	}
+	c.Assert(w.Close(), IsNil)
+	c.Assert(w.Stats(), Equals, mgo.AsyncWriteStats{Queued: 2500, Flushed: 2500})
+
+	n, err := coll.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2500)
+
+	c.Assert(w.Insert(M{"n": 2500}), ErrorMatches, "async writer is closed")
+	c.Assert(w.Close(), IsNil)
+}
+
+func (s *S) TestAsyncWriterDropWhenFull(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	w := coll.AsyncWriter(mgo.AsyncWriteOptions{QueueSize: 1, DropWhenFull: true})
+	docs := make([]interface{}, 1000)
+	for i := range docs {
+		docs[i] = M{"n": i}
+	}
+	c.Assert(w.Insert(docs...), IsNil)
+	c.Assert(w.Close(), IsNil)
+
+	stats := w.Stats()
+	c.Assert(stats.Queued+stats.Dropped, Equals, 1000)
+	c.Assert(stats.Flushed, Equals, stats.Queued)
+
+	n, err := coll.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, stats.Flushed)
+}
+
+func (s *S) TestAsyncWriterErrors(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	w := coll.AsyncWriter(mgo.AsyncWriteOptions{})
+	c.Assert(w.Insert(M{"_id": 1}, M{"_id": 1}, M{"_id": 2}), IsNil)
+	err = w.Close()
+	c.Assert(mgo.IsDup(err), Equals, true)
+	c.Assert(w.Err(), Equals, err)
+	c.Assert(w.Stats(), Equals, mgo.AsyncWriteStats{Queued: 3, Flushed: 2, Failed: 1})
+}
@@ -347,11 +347,7 @@ func runKillCursorsOnSession(session *Session, cursorId int64) error {
 	if err != nil {
 		return err
 	}
-	err = socket.Query(&killCursorsOp{[]int64{cursorId}})
-	if err != nil {
-		return err
-	}
-	socket.Release()
+	defer socket.Release()
 
-	return nil
+	return socket.Query(&killCursorsOp{[]int64{cursorId}})
 }
@@ -29,6 +29,7 @@ package mgo
 import (
 	"errors"
 	"fmt"
+	"math"
 	"net"
 	"runtime"
 	"strconv"
@@ -60,6 +61,26 @@ type mongoCluster struct {
 	sync         chan bool
 	dial         dialer
 	dialInfo     *DialInfo
+	groupsOnce   sync.Once
+	groups       map[string]int // Resolved address => seed group priority.
+	pinned       string         // Address of the master pinned with PinPrimary.
+	depths       map[string]int // Resolved address => discovery depth.
+	retryBudget  *retryBudget
+
+	// Settings replaced by Reconfigure, and how many times it was called.
+	generation    int
+	authenticator Authenticator
+	creds         []Credential
+
+	// Most recent election seen from a primary. See addServer.
+	maxSetVersion int
+	maxElectionId bson.ObjectId
+
+	// Logical sessions released by closed sessions, for reuse.
+	serverSessions []*serverSession
+
+	// Kind of deployment the known servers make. See updateTopology.
+	topology TopologyType
 }
 
 func newCluster(userSeeds []string, info *DialInfo) *mongoCluster {
@@ -68,6 +89,8 @@ func newCluster(userSeeds []string, info *DialInfo) *mongoCluster {
 		references: 1,
 		dial:       dialer{info.Dial, info.DialServer},
 		dialInfo:   info,
+
+		retryBudget: newRetryBudget(info),
 	}
 	cluster.serverSynced.L = cluster.RWMutex.RLocker()
 	cluster.sync = make(chan bool, 1)
@@ -93,15 +116,87 @@ func (cluster *mongoCluster) Release() {
 	}
 	cluster.references--
 	debugf("Cluster %p released (refs=%d)", cluster, cluster.references)
-	if cluster.references == 0 {
-		for _, server := range cluster.servers.Slice() {
-			server.Close()
-		}
-		// Wake up the sync loop so it can die.
-		cluster.syncServers()
-		stats.cluster(-1)
+	if cluster.references > 0 {
+		cluster.Unlock()
+		return
 	}
+	ids := cluster.takeServerSessions()
+	sessionsServer := cluster.sessionsServer()
+	dialInfo := cluster.dialInfo
+	servers := cluster.servers.Slice()
+	// Wake up the sync loop so it can die.
+	cluster.syncServers()
+	stats.cluster(-1)
 	cluster.Unlock()
+
+	// The pooled logical sessions are ended before the connections are
+	// closed, without holding the cluster lock while doing so.
+	endServerSessions(sessionsServer, dialInfo, ids)
+	for _, server := range servers {
+		server.Close()
+	}
+}
+
+// Reconfigure makes the cluster establish new connections with dial, if
+// set, and authenticate them with authenticator, if set, and with creds in
+// place of any session credential for the same user and database. Idle
+// connections are closed, and the ones in use are closed once released.
+func (cluster *mongoCluster) Reconfigure(dial dialer, authenticator Authenticator, creds []Credential) {
+	cluster.Lock()
+	if dial.isSet() {
+		cluster.dial = dial
+	}
+	if authenticator != nil {
+		cluster.authenticator = authenticator
+	}
+	for _, cred := range creds {
+		cluster.creds = replaceCredential(cluster.creds, cred)
+	}
+	cluster.generation++
+	for _, server := range cluster.servers.Slice() {
+		server.reconfigure(cluster.dial, cluster.generation)
+	}
+	cluster.Unlock()
+}
+
+// replaceCredential returns creds with cred in place of the one for the
+// same user and database, or with cred appended if there's none.
+func replaceCredential(creds []Credential, cred Credential) []Credential {
+	for i := range creds {
+		if creds[i].Source == cred.Source && creds[i].Username == cred.Username {
+			creds[i] = cred
+			return creds
+		}
+	}
+	return append(creds, cred)
+}
+
+// Authenticator returns the authenticator set by Reconfigure, if any.
+func (cluster *mongoCluster) Authenticator() Authenticator {
+	cluster.RLock()
+	defer cluster.RUnlock()
+	return cluster.authenticator
+}
+
+// Credential returns the credential set by Reconfigure in place of cred,
+// or cred itself if there's none.
+func (cluster *mongoCluster) Credential(cred Credential) Credential {
+	cluster.RLock()
+	defer cluster.RUnlock()
+	for _, c := range cluster.creds {
+		if c.Source == cred.Source && c.Username == cred.Username {
+			return c
+		}
+	}
+	return cred
+}
+
+// HasTaggedServer returns whether any of the known servers that may be
+// picked for reads in the given mode matches serverTags.
+func (cluster *mongoCluster) HasTaggedServer(mode Mode, serverTags []bson.D) bool {
+	cluster.RLock()
+	defer cluster.RUnlock()
+	return cluster.servers.BestFit(mode, serverTags, cluster.dialInfo.localThreshold()) != nil
 }
 
 func (cluster *mongoCluster) LiveServers() (servers []string) {
@@ -113,10 +208,297 @@ func (cluster *mongoCluster) LiveServers() (servers []string) {
 	return servers
 }
 
+// TopologyType returns the kind of deployment the known servers make.
+func (cluster *mongoCluster) TopologyType() TopologyType {
+	cluster.RLock()
+	defer cluster.RUnlock()
+	return cluster.topology
+}
+
+// updateTopology recomputes the kind of deployment the known servers make,
+// as they're added, change roles, or are removed. Any mongos makes it a
+// sharded cluster, and otherwise any server reporting a replica set name
+// makes it a replica set. It must be called with the cluster lock held.
+func (cluster *mongoCluster) updateTopology() {
+	topology := TopologyUnknown
+	for _, server := range cluster.servers.Slice() {
+		info := server.Info()
+		switch {
+		case info.Mongos:
+			topology = TopologySharded
+		case topology == TopologySharded:
+		case info.SetName != "":
+			topology = TopologyReplicaSet
+		case topology == TopologyUnknown:
+			topology = TopologySingle
+		}
+	}
+	if topology != cluster.topology {
+		debugf("Cluster %p topology changed from %s to %s", cluster, cluster.topology, topology)
+		cluster.topology = topology
+	}
+}
+
+// awaitRestarts waits for the servers that closed connections cleanly
+// within the restart window, as restarting servers do, to answer again.
+// It returns whether there were any such servers and all of them came
+// back in time.
+func (cluster *mongoCluster) awaitRestarts() bool {
+	var restarting []*mongoServer
+	cluster.RLock()
+	for _, server := range cluster.servers.Slice() {
+		if server.Restarting() {
+			restarting = append(restarting, server)
+		}
+	}
+	cluster.RUnlock()
+	for _, server := range restarting {
+		if !cluster.awaitRestart(server) {
+			return false
+		}
+	}
+	return len(restarting) > 0
+}
+
+func (cluster *mongoCluster) awaitRestart(server *mongoServer) bool {
+	// Don't ever hit the pool limit while waiting.
+	config := cluster.dialInfo.Copy()
+	config.PoolLimit = 0
+
+	for server.Restarting() {
+		socket, _, err := server.AcquireSocket(config)
+		if err == errServerClosed {
+			return false
+		}
+		if err == nil {
+			var result isMasterResult
+			err = cluster.isMaster(socket, &result)
+			socket.dialInfo = cluster.dialInfo
+			socket.Release()
+			if err == nil {
+				server.Restarted()
+				logf("Server %s answered again after restarting", server.Addr)
+				return true
+			}
+		}
+		time.Sleep(restartPollDelay)
+	}
+	return false
+}
+
+const (
+	defaultRetryBudgetRatio = 0.1
+	defaultRetryBudgetBurst = 10
+)
+
+// retryBudget is a token bucket limiting the retries of the operations
+// performed on a cluster. See DialInfo.RetryBudgetRatio.
+type retryBudget struct {
+	m      sync.Mutex
+	ratio  float64
+	burst  float64
+	tokens float64
+}
+
+func newRetryBudget(info *DialInfo) *retryBudget {
+	budget := &retryBudget{
+		ratio: info.RetryBudgetRatio,
+		burst: float64(info.RetryBudgetBurst),
+	}
+	if budget.ratio <= 0 {
+		budget.ratio = defaultRetryBudgetRatio
+	}
+	if budget.burst <= 0 {
+		budget.burst = defaultRetryBudgetBurst
+	}
+	budget.tokens = budget.burst
+	return budget
+}
+
+// deposit accounts for an operation which may be retried.
+func (budget *retryBudget) deposit() {
+	budget.m.Lock()
+	budget.tokens = math.Min(budget.tokens+budget.ratio, budget.burst)
+	budget.m.Unlock()
+}
+
+// withdraw takes a retry from the budget, and returns whether there was one
+// left. Retries are accounted for in the stats either way.
+func (budget *retryBudget) withdraw() bool {
+	budget.m.Lock()
+	ok := budget.tokens >= 1
+	if ok {
+		budget.tokens--
+	}
+	budget.m.Unlock()
+	stats.noticeRetry(ok)
+	return ok
+}
+
+// PinPrimary forces sockets acquired for talking to the master to come
+// from the server at addr, which must be a known master, until the pin
+// is cleared with UnpinPrimary. The pin is also cleared if the server
+// stops being a known master, and normal selection is then resumed.
+func (cluster *mongoCluster) PinPrimary(addr string) error {
+	cluster.Lock()
+	defer cluster.Unlock()
+	if cluster.pinnedMaster(addr) == nil {
+		return fmt.Errorf("cannot pin primary to %s: not a known master", addr)
+	}
+	cluster.pinned = addr
+	log("Pinned primary to ", addr, ".")
+	return nil
+}
+
+// UnpinPrimary clears the pin set with PinPrimary, if any.
+func (cluster *mongoCluster) UnpinPrimary() {
+	cluster.Lock()
+	if cluster.pinned != "" {
+		log("Unpinned primary from ", cluster.pinned, ".")
+		cluster.pinned = ""
+	}
+	cluster.Unlock()
+}
+
+// snapshot returns the servers currently known to the cluster. It must be
+// called with the cluster lock held.
+func (cluster *mongoCluster) snapshot() *TopologySnapshot {
+	snapshot := &TopologySnapshot{}
+	for _, server := range cluster.servers.Slice() {
+		snapshot.Servers = append(snapshot.Servers, server.Addr)
+		snapshot.Details = append(snapshot.Details, server.serverInfo())
+	}
+	if cluster.masters.Len() > 0 {
+		snapshot.Primary = cluster.masters.Get(0).Addr
+	}
+	return snapshot
+}
+
+// selectServer returns the known server picked by selector among the ones
+// in snapshot, or nil if there's none.
+func (cluster *mongoCluster) selectServer(selector ServerSelector, snapshot *TopologySnapshot, write bool) *mongoServer {
+	selected := selector(snapshot, write)
+	if selected == nil {
+		return nil
+	}
+	cluster.RLock()
+	defer cluster.RUnlock()
+	for _, server := range cluster.servers.Slice() {
+		if server.Addr == selected.Addr {
+			return server
+		}
+	}
+	return nil
+}
+
+// pinnedMaster returns the known master at addr, which may be either the
+// address it was discovered with or its resolved address, or nil if there
+// is none. It must be called with the cluster lock held.
+func (cluster *mongoCluster) pinnedMaster(addr string) *mongoServer {
+	for _, server := range cluster.masters.Slice() {
+		if server.Addr == addr || server.ResolvedAddr == addr {
+			return server
+		}
+	}
+	return nil
+}
+
+// VotingMembers returns the number of data-bearing replica set members
+// currently alive in the cluster, as seen in the last synchronization.
+// Arbiters and hidden members are never discovered, and members that
+// are recovering are left out since they can't acknowledge writes.
+func (cluster *mongoCluster) VotingMembers() (n int) {
+	cluster.RLock()
+	defer cluster.RUnlock()
+	for _, server := range cluster.servers.Slice() {
+		server.RLock()
+		if server.info.SetName != "" && !server.recovering {
+			n++
+		}
+		server.RUnlock()
+	}
+	return n
+}
+
+// SeedStatus holds the outcome of probing one of the seed servers.
+// See Session.ProbeSeeds for details.
+type SeedStatus struct {
+	Addr      string        // Seed address as provided when dialing
+	Reachable bool          // Whether the seed replied to the probe
+	Master    bool          // Whether the seed is a primary or a mongos
+	Secondary bool          // Whether the seed is a secondary
+	Mongos    bool          // Whether the seed is a mongos router
+	SetName   string        // Replica set name reported by the seed
+	RTT       time.Duration // Round trip time of the probe
+	Err       error         // Reason why the seed isn't reachable
+}
+
+// Probe connects to each of the seeds provided by the user and runs the
+// hello or isMaster command on it, concurrently and within the given
+// timeout per seed. The servers used for probing are independent from
+// the ones tracked by the cluster, so its state is left untouched.
+func (cluster *mongoCluster) Probe(timeout time.Duration) []SeedStatus {
+	cluster.RLock()
+	seeds := cluster.userSeeds
+	info := cluster.dialInfo.Copy()
+	dial := cluster.dial
+	cluster.RUnlock()
+
+	info.Timeout = timeout
+	info.ReadTimeout = timeout
+	info.WriteTimeout = timeout
+	info.PoolLimit = 0
+	info.MaxIdleTimeMS = 0
+
+	statuses := make([]SeedStatus, len(seeds))
+	var wg sync.WaitGroup
+	for i, addr := range seeds {
+		wg.Add(1)
+		go func(status *SeedStatus, addr string) {
+			defer wg.Done()
+			status.Addr = addr
+			status.Err = cluster.probe(addr, dial, info, status)
+			status.Reachable = status.Err == nil
+		}(&statuses[i], addr)
+	}
+	wg.Wait()
+	return statuses
+}
+
+func (cluster *mongoCluster) probe(addr string, dial dialer, info *DialInfo, status *SeedStatus) error {
+	tcpaddr, err := resolveAddr(addr)
+	if err != nil {
+		return err
+	}
+	// The sync channel is never read, so that failures while probing
+	// don't trigger a synchronization of the cluster.
+	server := newServer(addr, tcpaddr, make(chan bool, 1), dial, info, 0)
+	defer server.Close()
+
+	socket, _, err := server.AcquireSocket(info)
+	if err != nil {
+		return err
+	}
+	defer socket.Release()
+
+	var result isMasterResult
+	start := time.Now()
+	if err = cluster.isMaster(socket, &result); err != nil {
+		return err
+	}
+	status.RTT = time.Since(start)
+	status.Master = result.IsMaster
+	status.Secondary = result.Secondary
+	status.Mongos = result.Msg == "isdbgrid"
+	status.SetName = result.SetName
+	return nil
+}
+
 func (cluster *mongoCluster) removeServer(server *mongoServer) {
 	cluster.Lock()
 	cluster.masters.Remove(server)
 	other := cluster.servers.Remove(server)
+	cluster.updateTopology()
 	cluster.Unlock()
 	if other != nil {
 		other.CloseIdle()
@@ -125,6 +507,8 @@ func (cluster *mongoCluster) removeServer(server *mongoServer) {
 	server.CloseIdle()
 }
 
+// isMasterResult holds the reply to either the hello or the isMaster
+// command. See normalize.
 type isMasterResult struct {
 	IsMaster       bool
 	Secondary      bool
@@ -134,15 +518,45 @@ type isMasterResult struct {
 	Tags           bson.D
 	Msg            string
 	SetName        string `bson:"setName"`
+	ArbiterOnly    bool   `bson:"arbiterOnly"`
 	MaxWireVersion int    `bson:"maxWireVersion"`
+
+	SetVersion int           `bson:"setVersion"`
+	ElectionId bson.ObjectId `bson:"electionId"`
+
+	MaxBsonObjectSize   int `bson:"maxBsonObjectSize"`
+	MaxMessageSizeBytes int `bson:"maxMessageSizeBytes"`
+	MaxWriteBatchSize   int `bson:"maxWriteBatchSize"`
+
+	LogicalSessionTimeoutMinutes int `bson:"logicalSessionTimeoutMinutes"`
+
+	// Replaces IsMaster in replies to the hello command.
+	IsWritablePrimary bool `bson:"isWritablePrimary"`
+}
+
+// normalize fills the fields of result that are named differently
+// depending on the command that was answered.
+func (result *isMasterResult) normalize() {
+	if result.IsWritablePrimary {
+		result.IsMaster = true
+	}
 }
 
+// helloWireVersion is the wire version of the first MongoDB release with the
+// hello command. It's also tried with servers of unknown version, falling
+// back to isMaster, as some earlier patch releases support it as well.
+const helloWireVersion = 9
+
 func (cluster *mongoCluster) isMaster(socket *mongoSocket, result *isMasterResult) error {
 	// Monotonic let's it talk to a slave and still hold the socket.
 	session := newSession(Monotonic, cluster, cluster.dialInfo)
 	session.setSocket(socket)
 
-	var cmd = bson.D{{Name: "isMaster", Value: 1}}
+	cmdName := "hello"
+	if info := socket.ServerInfo(); info.MaxWireVersion > 0 && info.MaxWireVersion < helloWireVersion {
+		cmdName = "isMaster"
+	}
+	var cmd = bson.D{{Name: cmdName, Value: 1}}
 
 	// Send client metadata to the server to identify this socket if this is
 	// the first isMaster call only.
@@ -174,7 +588,16 @@ func (cluster *mongoCluster) isMaster(socket *mongoSocket, result *isMasterResul
 	})
 
 	err := session.runOnSocket(socket, cmd, result)
+	if cmdName == "hello" && isNoCmd(err) {
+		// The server rejected the command, including the handshake
+		// arguments, so send them again.
+		cmd[0].Name = "isMaster"
+		err = session.runOnSocket(socket, cmd, result)
+	}
 	session.Close()
+	if err == nil {
+		result.normalize()
+	}
 	return err
 }
 
@@ -190,7 +613,7 @@ func (cluster *mongoCluster) syncServer(server *mongoServer) (info *mongoServerI
 	var result isMasterResult
 	var tryerr error
 	for retry := 0; ; retry++ {
-		if retry == 3 || retry == 1 && cluster.dialInfo.FailFast {
+		if (retry >= 3 || retry >= 1 && cluster.dialInfo.FailFast) && !server.Restarting() {
 			return nil, nil, tryerr
 		}
 		if retry > 0 {
@@ -212,7 +635,11 @@ func (cluster *mongoCluster) syncServer(server *mongoServer) (info *mongoServerI
 			logf("SYNC Failed to get socket to %s: %v", addr, err)
 			continue
 		}
+		start := time.Now()
 		err = cluster.isMaster(socket, &result)
+		if err == nil {
+			server.recordPing(time.Since(start))
+		}
 
 		// Restore the correct dial config before returning it to the pool
 		socket.dialInfo = cluster.dialInfo
@@ -243,18 +670,39 @@ func (cluster *mongoCluster) syncServer(server *mongoServer) (info *mongoServerI
 		debugf("SYNC %s is a slave.", addr)
 	} else if cluster.dialInfo.Direct {
 		logf("SYNC %s in unknown state. Pretending it's a slave due to direct connection.", addr)
+	} else if result.SetName != "" && !result.ArbiterOnly {
+		// Members in states such as RECOVERING or ROLLBACK are neither
+		// primaries nor secondaries, but are expected to come back.
+		delay := server.setRecovering(true)
+		logf("SYNC %s is recovering. Will check it again in %v.", addr, delay)
 	} else {
 		logf("SYNC %s is neither a master nor a slave.", addr)
 		// Let stats track it as whatever was known before.
 		return nil, nil, errors.New(addr + " is not a master nor slave")
 	}
 
+	if result.IsMaster || result.Secondary {
+		if recovering, _ := server.Recovering(); recovering {
+			server.setRecovering(false)
+			logf("SYNC %s is no longer recovering.", addr)
+		}
+	}
+
 	info = &mongoServerInfo{
 		Master:         result.IsMaster,
 		Mongos:         result.Msg == "isdbgrid",
 		Tags:           result.Tags,
 		SetName:        result.SetName,
 		MaxWireVersion: result.MaxWireVersion,
+		SetVersion:     result.SetVersion,
+		ElectionId:     result.ElectionId,
+		Members:        len(result.Hosts) + len(result.Passives),
+
+		MaxBsonObjectSize:   result.MaxBsonObjectSize,
+		MaxMessageSizeBytes: result.MaxMessageSizeBytes,
+		MaxWriteBatchSize:   result.MaxWriteBatchSize,
+
+		LogicalSessionTimeout: time.Duration(result.LogicalSessionTimeoutMinutes) * time.Minute,
 	}
 
 	hosts = make([]string, 0, 1+len(result.Hosts)+len(result.Passives))
@@ -278,6 +726,9 @@ const (
 
 func (cluster *mongoCluster) addServer(server *mongoServer, info *mongoServerInfo, syncKind syncKind) {
 	cluster.Lock()
+	if info.Master && info.ElectionId != "" {
+		info = cluster.checkElection(server, info)
+	}
 	current := cluster.servers.Search(server.ResolvedAddr)
 	if current == nil {
 		if syncKind == partialSync {
@@ -286,6 +737,11 @@ func (cluster *mongoCluster) addServer(server *mongoServer, info *mongoServerInf
 			log("SYNC Discarding unknown server ", server.Addr, " due to partial sync.")
 			return
 		}
+		if server.generation != cluster.generation {
+			// The cluster was reconfigured before the server was
+			// added to it, perhaps while it was being synced.
+			server.reconfigure(cluster.dial, cluster.generation)
+		}
 		cluster.servers.Add(server)
 		if info.Master {
 			cluster.masters.Add(server)
@@ -308,11 +764,48 @@ func (cluster *mongoCluster) addServer(server *mongoServer, info *mongoServerInf
 		}
 	}
 	server.SetInfo(info)
+	cluster.updateTopology()
 	debugf("SYNC Broadcasting availability of server %s", server.Addr)
 	cluster.serverSynced.Broadcast()
 	cluster.Unlock()
 }
 
+// checkElection compares the election details reported by server, which
+// claims to be the primary of its replica set, against the most recent
+// ones seen. During elections, a primary that stepped down may still claim
+// to be the primary for a while, so only the one elected most recently,
+// going by the set version and then by the election id, is trusted.
+// A stale claim is ignored, and any other master superseded by this one
+// is demoted until it's synchronized again. The returned info is the one
+// to be used for server. It must be called with the cluster lock held.
+func (cluster *mongoCluster) checkElection(server *mongoServer, info *mongoServerInfo) *mongoServerInfo {
+	if info.SetVersion < cluster.maxSetVersion ||
+		info.SetVersion == cluster.maxSetVersion && info.ElectionId < cluster.maxElectionId {
+		logf("SYNC Server %s claims to be the primary with a stale election; treating it as a slave.", server.Addr)
+		demoted := *info
+		demoted.Master = false
+		return &demoted
+	}
+	cluster.maxSetVersion = info.SetVersion
+	cluster.maxElectionId = info.ElectionId
+
+	for _, other := range cluster.masters.Slice() {
+		if other == server {
+			continue
+		}
+		otherInfo := other.Info()
+		if otherInfo.SetName != info.SetName {
+			continue
+		}
+		logf("SYNC Server %s was superseded by %s as the primary; treating it as a slave.", other.Addr, server.Addr)
+		cluster.masters.Remove(other)
+		demoted := *otherInfo
+		demoted.Master = false
+		other.SetInfo(&demoted)
+	}
+	return info
+}
+
 func (cluster *mongoCluster) getKnownAddrs() []string {
 	cluster.RLock()
 	max := len(cluster.userSeeds) + len(cluster.dynaSeeds) + cluster.servers.Len()
@@ -354,6 +847,9 @@ func (cluster *mongoCluster) syncServers() {
 const syncServersDelay = 30 * time.Second
 const syncShortDelay = 500 * time.Millisecond
 
+// How long to wait between attempts to reach a restarting server.
+const restartPollDelay = 50 * time.Millisecond
+
 // syncServersLoop loops while the cluster is alive to keep its idea of
 // the server topology up-to-date. It must be called just once from
 // newCluster.  The loop iterates once syncServersDelay has passed, or
@@ -376,6 +872,9 @@ func (cluster *mongoCluster) syncServersLoop() {
 		cluster.Unlock()
 
 		cluster.syncServersIteration(direct)
+		if !direct {
+			cluster.warmStandby()
+		}
 
 		// We just synchronized, so consume any outstanding requests.
 		select {
@@ -422,14 +921,48 @@ func (cluster *mongoCluster) syncServersLoop() {
 	debugf("SYNC Cluster %p is stopping its sync loop.", cluster)
 }
 
+// warmStandby opens connections to the standby secondary until it has
+// DialInfo.StandbyPoolSize idle ones, so that writes don't have to wait for
+// new connections to be established should it become the primary.
+func (cluster *mongoCluster) warmStandby() {
+	n := cluster.dialInfo.StandbyPoolSize
+	if n <= 0 {
+		return
+	}
+	cluster.RLock()
+	standby := cluster.servers.Standby()
+	cluster.RUnlock()
+	if standby != nil {
+		debugf("SYNC Cluster %p keeping %d standby connections to %s.", cluster, n, standby.Addr)
+		standby.warm(n, cluster.dialInfo)
+	}
+}
+
 func (cluster *mongoCluster) server(addr string, tcpaddr *net.TCPAddr) *mongoServer {
 	cluster.RLock()
 	server := cluster.servers.Search(tcpaddr.String())
+	dial := cluster.dial
 	cluster.RUnlock()
 	if server != nil {
 		return server
 	}
-	return newServer(addr, tcpaddr, cluster.sync, cluster.dial, cluster.dialInfo)
+	return newServer(addr, tcpaddr, cluster.sync, dial, cluster.dialInfo, cluster.groupPriority(tcpaddr))
+}
+
+// groupPriority returns the priority of the seed group the server with
+// the given address is in, or zero if it is in none.
+func (cluster *mongoCluster) groupPriority(tcpaddr *net.TCPAddr) int {
+	cluster.groupsOnce.Do(func() {
+		cluster.groups = make(map[string]int)
+		for _, group := range cluster.dialInfo.SeedGroups {
+			for _, groupAddr := range group.Addrs {
+				if tcpaddr, err := resolveAddr(groupAddr); err == nil {
+					cluster.groups[tcpaddr.String()] = group.Priority
+				}
+			}
+		}
+	})
+	return cluster.groups[tcpaddr.String()]
 }
 
 func resolveAddr(addr string) (*net.TCPAddr, error) {
@@ -492,6 +1025,47 @@ func resolveAddr(addr string) (*net.TCPAddr, error) {
 	return tcpaddr, nil
 }
 
+// Servers being synchronized across all clusters in the process, and the
+// limit set with SetGlobalSyncConcurrency.
+var (
+	globalSyncMutex sync.Mutex
+	globalSyncCond  = sync.NewCond(&globalSyncMutex)
+	globalSyncs     int
+	globalSyncLimit int
+)
+
+// SetGlobalSyncConcurrency limits how many servers may be contacted at once
+// for checking the cluster topology, across all clusters in the process.
+// Further checks wait for others to finish before dialing their server.
+// This keeps topology discovery from swamping the process when many
+// clusters, or many servers in a cluster, are having trouble at once.
+// A limit of zero, the default, disables it.
+func SetGlobalSyncConcurrency(n int) {
+	globalSyncMutex.Lock()
+	globalSyncLimit = n
+	globalSyncMutex.Unlock()
+	globalSyncCond.Broadcast()
+}
+
+// acquireSync waits until a server may be synchronized without exceeding
+// the global sync concurrency, and accounts for it. It must be paired with
+// a call to releaseSync.
+func acquireSync() {
+	globalSyncMutex.Lock()
+	for globalSyncLimit > 0 && globalSyncs >= globalSyncLimit {
+		globalSyncCond.Wait()
+	}
+	globalSyncs++
+	globalSyncMutex.Unlock()
+}
+
+func releaseSync() {
+	globalSyncMutex.Lock()
+	globalSyncs--
+	globalSyncMutex.Unlock()
+	globalSyncCond.Signal()
+}
+
 type pendingAdd struct {
 	server *mongoServer
 	info   *mongoServerInfo
@@ -505,10 +1079,11 @@ func (cluster *mongoCluster) syncServersIteration(direct bool) {
 	notYetAdded := make(map[string]pendingAdd)
 	addIfFound := make(map[string]bool)
 	seen := make(map[string]bool)
+	depths := make(map[string]int)
 	syncKind := partialSync
 
-	var spawnSync func(addr string, byMaster bool)
-	spawnSync = func(addr string, byMaster bool) {
+	var spawnSync func(addr string, byMaster bool, depth int)
+	spawnSync = func(addr string, byMaster bool, depth int) {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
@@ -519,6 +1094,14 @@ func (cluster *mongoCluster) syncServersIteration(direct bool) {
 				return
 			}
 			resolvedAddr := tcpaddr.String()
+			if depth < 0 {
+				// Previously discovered, so keep it as far from the
+				// seeds as it was found to be, rather than letting
+				// discovery creep further on every iteration.
+				cluster.RLock()
+				depth = cluster.depths[resolvedAddr]
+				cluster.RUnlock()
+			}
 
 			m.Lock()
 			if byMaster {
@@ -534,15 +1117,41 @@ func (cluster *mongoCluster) syncServersIteration(direct bool) {
 				m.Unlock()
 				return
 			}
+			if !cluster.dialInfo.discoverableDepth(depth) {
+				m.Unlock()
+				debugf("SYNC Not discovering %s beyond the maximum discovery depth.", addr)
+				return
+			}
 			seen[resolvedAddr] = true
+			depths[resolvedAddr] = depth
 			m.Unlock()
 
 			server := cluster.server(addr, tcpaddr)
+			if recovering, retry := server.Recovering(); recovering && time.Now().Before(retry) {
+				debugf("SYNC Skipping %s until it's due for another check while recovering.", addr)
+				return
+			}
+			acquireSync()
 			info, hosts, err := cluster.syncServer(server)
+			releaseSync()
+			if err == errGlobalConnLimit {
+				// The limit is about the whole process rather than the
+				// server, so it's kept as it is until connections free up.
+				logf("SYNC Keeping %s in the cluster while the global connection limit is reached.", addr)
+				return
+			}
 			if err != nil {
+				cluster.RLock()
+				known := cluster.servers.Search(resolvedAddr) == server
+				cluster.RUnlock()
+				if known && !server.syncFailed(cluster.dialInfo.syncFailureThreshold()) {
+					logf("SYNC Keeping %s in the cluster until it fails more checks.", addr)
+					return
+				}
 				cluster.removeServer(server)
 				return
 			}
+			server.syncSucceeded()
 
 			m.Lock()
 			add := direct || info.Master || addIfFound[resolvedAddr]
@@ -557,15 +1166,26 @@ func (cluster *mongoCluster) syncServersIteration(direct bool) {
 			}
 			if !direct {
 				for _, addr := range hosts {
-					spawnSync(addr, info.Master)
+					spawnSync(addr, info.Master, depth+1)
 				}
 			}
 		}()
 	}
 
+	cluster.RLock()
+	userSeeds := make(map[string]bool, len(cluster.userSeeds))
+	for _, addr := range cluster.userSeeds {
+		userSeeds[addr] = true
+	}
+	cluster.RUnlock()
+
 	knownAddrs := cluster.getKnownAddrs()
 	for _, addr := range knownAddrs {
-		spawnSync(addr, false)
+		if userSeeds[addr] {
+			spawnSync(addr, false, 0)
+		} else {
+			spawnSync(addr, false, -1)
+		}
 	}
 	wg.Wait()
 
@@ -582,22 +1202,42 @@ func (cluster *mongoCluster) syncServersIteration(direct bool) {
 	}
 
 	cluster.Lock()
+	for addr, depth := range cluster.depths {
+		if _, ok := depths[addr]; !ok && cluster.servers.Search(addr) != nil {
+			depths[addr] = depth
+		}
+	}
+	cluster.depths = depths
 	mastersLen := cluster.masters.Len()
 	logf("SYNC Synchronization completed: %d master(s) and %d slave(s) alive.", mastersLen, cluster.servers.Len()-mastersLen)
 
 	// Update dynamic seeds, but only if we have any good servers. Otherwise,
 	// leave them alone for better chances of a successful sync in the future.
 	if syncKind == completeSync {
-		dynaSeeds := make([]string, cluster.servers.Len())
-		for i, server := range cluster.servers.Slice() {
-			dynaSeeds[i] = server.Addr
-		}
-		cluster.dynaSeeds = dynaSeeds
-		debugf("SYNC New dynamic seeds: %#v\n", dynaSeeds)
+		cluster.updateDynaSeeds()
 	}
 	cluster.Unlock()
 }
 
+// updateDynaSeeds replaces the dynamic seeds with the addresses of the
+// servers currently alive in the cluster, so that the addresses of removed
+// members don't survive across synchronizations. Servers that are
+// recovering or that failed their last check are left out as well.
+// The cluster lock must be held by the caller.
+func (cluster *mongoCluster) updateDynaSeeds() {
+	dynaSeeds := make([]string, 0, cluster.servers.Len())
+	for _, server := range cluster.servers.Slice() {
+		server.RLock()
+		usable := !server.recovering && server.syncFailures == 0
+		server.RUnlock()
+		if usable {
+			dynaSeeds = append(dynaSeeds, server.Addr)
+		}
+	}
+	cluster.dynaSeeds = dynaSeeds
+	debugf("SYNC New dynamic seeds: %#v\n", dynaSeeds)
+}
+
 // AcquireSocketWithPoolTimeout returns a socket to a server in the cluster.  If slaveOk is
 // true, it will attempt to return a socket to a slave server.  If it is
 // false, the socket will necessarily be to a master server.
@@ -608,7 +1248,7 @@ func (cluster *mongoCluster) AcquireSocketWithPoolTimeout(mode Mode, slaveOk boo
 		cluster.RLock()
 		for {
 			mastersLen := cluster.masters.Len()
-			slavesLen := cluster.servers.Len() - mastersLen
+			slavesLen := cluster.servers.Len() - mastersLen - cluster.servers.RecoveringLen()
 			debugf("Cluster has %d known masters and %d known slaves.", mastersLen, slavesLen)
 			if mastersLen > 0 && !(slaveOk && mode == Secondary) || slavesLen > 0 && slaveOk {
 				break
@@ -616,6 +1256,11 @@ func (cluster *mongoCluster) AcquireSocketWithPoolTimeout(mode Mode, slaveOk boo
 			if mastersLen > 0 && mode == Secondary && cluster.masters.HasMongos() {
 				break
 			}
+			if mastersLen == 0 && !slaveOk && info != nil && info.FailFastNoPrimary && cluster.syncCount > 0 {
+				cluster.syncServers()
+				cluster.RUnlock()
+				return nil, ErrNoPrimary
+			}
 			if started.IsZero() {
 				// Initialize after fast path above.
 				started = time.Now()
@@ -632,13 +1277,46 @@ func (cluster *mongoCluster) AcquireSocketWithPoolTimeout(mode Mode, slaveOk boo
 		}
 
 		var server *mongoServer
-		if slaveOk {
-			server = cluster.servers.BestFit(mode, serverTags)
+		var lostPin string
+		var snapshot *TopologySnapshot
+		if info != nil && info.ServerSelector != nil {
+			snapshot = cluster.snapshot()
+		} else if slaveOk {
+			server = cluster.servers.BestFit(mode, serverTags, cluster.dialInfo.localThreshold())
+		} else if cluster.pinned != "" {
+			server = cluster.pinnedMaster(cluster.pinned)
+			if server == nil {
+				lostPin = cluster.pinned
+				server = cluster.masters.BestFit(mode, nil, cluster.dialInfo.localThreshold())
+			}
 		} else {
-			server = cluster.masters.BestFit(mode, nil)
+			server = cluster.masters.BestFit(mode, nil, cluster.dialInfo.localThreshold())
 		}
 		cluster.RUnlock()
 
+		if lostPin != "" {
+			cluster.Lock()
+			if cluster.pinned == lostPin {
+				logf("Pinned primary %s is not a known master anymore; unpinning it", lostPin)
+				cluster.pinned = ""
+			}
+			cluster.Unlock()
+		}
+
+		if snapshot != nil {
+			server = cluster.selectServer(info.ServerSelector, snapshot, !slaveOk)
+			if server == nil {
+				if started.IsZero() {
+					started = time.Now()
+				} else if syncTimeout != 0 && started.Before(time.Now().Add(-syncTimeout)) {
+					return nil, errNoServerSelected
+				}
+				cluster.syncServers()
+				time.Sleep(1e8)
+				continue
+			}
+		}
+
 		if server == nil {
 			// Must have failed the requested tags. Sleep to avoid spinning.
 			time.Sleep(1e8)
@@ -646,7 +1324,7 @@ func (cluster *mongoCluster) AcquireSocketWithPoolTimeout(mode Mode, slaveOk boo
 		}
 
 		s, abended, err := server.AcquireSocketWithBlocking(info)
-		if err == errPoolTimeout {
+		if err == errPoolTimeout || err == errGlobalConnLimit {
 			// No need to remove servers from the topology if acquiring a socket fails for this reason.
 			return nil, err
 		}
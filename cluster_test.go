@@ -239,6 +239,295 @@ func (s *S) TestModeMonotonic(c *C) {
 	c.Assert(stats.SocketsInUse, Equals, 0)
 }
 
+func (s *S) TestRunPrimaryCommands(c *C) {
+	// Must necessarily connect to a slave, otherwise the
+	// master connection will be available first.
+	session, err := mgo.Dial("localhost:40012")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	session.SetMode(mgo.Monotonic, false)
+
+	var result struct{ IsMaster bool }
+	err = session.Run("ismaster", &result)
+	c.Assert(err, IsNil)
+	c.Assert(result.IsMaster, Equals, false)
+
+	// Running on the primary explicitly.
+	err = session.DB("admin").RunOnPrimary("ismaster", &result)
+	c.Assert(err, IsNil)
+	c.Assert(result.IsMaster, Equals, true)
+
+	session.SetMode(mgo.Monotonic, true)
+	err = session.Run("ismaster", &result)
+	c.Assert(err, IsNil)
+	c.Assert(result.IsMaster, Equals, false)
+
+	// Commands known to require the primary are sent there.
+	err = session.DB("mydb").Run(bson.D{{Name: "create", Value: "mycoll"}}, nil)
+	c.Assert(err, IsNil)
+	err = session.Run("ismaster", &result)
+	c.Assert(err, IsNil)
+	c.Assert(result.IsMaster, Equals, true)
+}
+
+func (s *S) TestPinnedServer(c *C) {
+	session, err := mgo.Dial("localhost:40012")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	session.SetMode(mgo.Monotonic, true)
+	_, pinned := session.PinnedServer()
+	c.Assert(pinned, Equals, false)
+
+	result := &struct{ Host string }{}
+	err = session.Run("serverStatus", result)
+	c.Assert(err, IsNil)
+	slave := hostPort(result.Host)
+
+	addr, pinned := session.PinnedServer()
+	c.Assert(pinned, Equals, true)
+	c.Assert(hostPort(addr), Equals, slave)
+
+	// Reads keep going to the same server.
+	for i := 0; i < 10; i++ {
+		err = session.Run("serverStatus", result)
+		c.Assert(err, IsNil)
+		c.Assert(hostPort(result.Host), Equals, slave)
+	}
+
+	// A write moves a Monotonic session over to the master.
+	err = session.DB("mydb").C("mycoll").Insert(M{"a": 1})
+	c.Assert(err, IsNil)
+	err = session.Run("serverStatus", result)
+	c.Assert(err, IsNil)
+	addr, pinned = session.PinnedServer()
+	c.Assert(pinned, Equals, true)
+	c.Assert(hostPort(addr), Equals, hostPort(result.Host))
+	c.Assert(hostPort(addr), Not(Equals), slave)
+
+	session.Refresh()
+	_, pinned = session.PinnedServer()
+	c.Assert(pinned, Equals, false)
+}
+
+func (s *S) TestQuerySetMode(c *C) {
+	session, err := mgo.Dial("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	for i := 0; i < 10; i++ {
+		err = coll.Insert(M{"n": i})
+		c.Assert(err, IsNil)
+	}
+	master, _ := session.PinnedServer()
+
+	// Wait until all secondaries have the data.
+	session.SetSafe(&mgo.Safe{W: 3, WTimeout: 5000})
+	c.Assert(coll.Insert(M{"n": 10}), IsNil)
+
+	var m sync.Mutex
+	var addrs []string
+	mgo.SetCommandMonitor(&mgo.CommandMonitor{
+		Started: func(event *mgo.CommandStartedEvent) {
+			if (event.CommandName == "find" || event.CommandName == "getMore") && event.DatabaseName == "mydb" {
+				m.Lock()
+				addrs = append(addrs, event.ServerAddress)
+				m.Unlock()
+			}
+		},
+	})
+	defer mgo.SetCommandMonitor(nil)
+
+	var result struct{ N int }
+	iter := coll.Find(nil).Batch(2).SetMode(mgo.Secondary).Iter()
+	n := 0
+	for iter.Next(&result) {
+		n++
+	}
+	c.Assert(iter.Close(), IsNil)
+	c.Assert(n, Equals, 11)
+
+	// The session itself keeps reading from the master.
+	addr, pinned := session.PinnedServer()
+	c.Assert(pinned, Equals, true)
+	c.Assert(addr, Equals, master)
+
+	m.Lock()
+	defer m.Unlock()
+	if !s.versionAtLeast(3, 2) {
+		// No find and getMore commands to look at.
+		return
+	}
+	c.Assert(len(addrs) > 1, Equals, true)
+	for _, a := range addrs {
+		c.Assert(a, Equals, addrs[0])
+	}
+	c.Assert(addrs[0], Not(Equals), master)
+}
+
+func (s *S) TestVotingMembers(c *C) {
+	session, err := mgo.Dial("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	for len(session.LiveServers()) != 3 {
+		c.Log("Waiting for all servers to be alive...")
+		time.Sleep(100 * time.Millisecond)
+	}
+	c.Assert(session.VotingMembers(), Equals, 3)
+
+	standalone, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer standalone.Close()
+	c.Assert(standalone.VotingMembers(), Equals, 0)
+}
+
+func (s *S) TestMajorityAcknowledged(c *C) {
+	session, err := mgo.Dial("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	for len(session.LiveServers()) != 3 {
+		c.Log("Waiting for all servers to be alive...")
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	coll := session.DB("mydb").C("mycoll")
+	for _, test := range []struct {
+		safe         mgo.Safe
+		acknowledged int
+		majority     bool
+	}{
+		{mgo.Safe{}, 1, false},
+		{mgo.Safe{W: 2, WTimeout: 10000}, 2, true},
+		{mgo.Safe{WMode: "majority", WTimeout: 10000}, 2, true},
+	} {
+		session.SetSafe(&test.safe)
+		info, err := coll.Upsert(M{"_id": 1}, M{"$inc": M{"n": 1}})
+		c.Assert(err, IsNil)
+		c.Assert(info.Acknowledged, Equals, test.acknowledged)
+		majority, err := info.MajorityAcknowledged()
+		c.Assert(err, IsNil)
+		c.Assert(majority, Equals, test.majority)
+	}
+
+	standalone, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer standalone.Close()
+	info, err := standalone.DB("mydb").C("mycoll").Upsert(M{"_id": 1}, M{"$inc": M{"n": 1}})
+	c.Assert(err, IsNil)
+	c.Assert(info.Acknowledged, Equals, 1)
+	majority, err := info.MajorityAcknowledged()
+	c.Assert(err, IsNil)
+	c.Assert(majority, Equals, true)
+}
+
+func (s *S) TestProbeSeeds(c *C) {
+	// 40009 isn't used by the test servers.
+	session, err := mgo.Dial("localhost:40011,localhost:40012,localhost:40009")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	live := session.LiveServers()
+
+	statuses := session.ProbeSeeds(2 * time.Second)
+	c.Assert(statuses, HasLen, 3)
+
+	c.Assert(statuses[0].Addr, Equals, "localhost:40011")
+	c.Assert(statuses[0].Reachable, Equals, true)
+	c.Assert(statuses[0].Master, Equals, true)
+	c.Assert(statuses[0].SetName, Equals, "rs1")
+	c.Assert(statuses[0].RTT > 0, Equals, true)
+
+	c.Assert(statuses[1].Addr, Equals, "localhost:40012")
+	c.Assert(statuses[1].Reachable, Equals, true)
+	c.Assert(statuses[1].Secondary, Equals, true)
+
+	c.Assert(statuses[2].Addr, Equals, "localhost:40009")
+	c.Assert(statuses[2].Reachable, Equals, false)
+	c.Assert(statuses[2].Err, NotNil)
+
+	// Probing has no effect on the servers known to the session.
+	c.Assert(session.LiveServers(), DeepEquals, live)
+}
+
+func (s *S) TestLinearizableReadConcern(c *C) {
+	if !s.versionAtLeast(3, 4) {
+		c.Skip("linearizable read concern depends on 3.4+")
+	}
+	session, err := mgo.Dial("localhost:40012")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	err = coll.Insert(M{"n": 1})
+	c.Assert(err, IsNil)
+
+	// Linearizable reads go to the primary even when slaves are allowed.
+	session.SetMode(mgo.Monotonic, true)
+	var result struct{ N int }
+	err = coll.Find(M{"n": 1}).SetReadConcern("linearizable").One(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result.N, Equals, 1)
+
+	session.SetMode(mgo.Secondary, true)
+	err = coll.Find(M{"n": 1}).SetReadConcern("linearizable").One(&result)
+	c.Assert(err, ErrorMatches, "linearizable read concern may not be used with Secondary mode")
+	err = coll.Pipe([]M{{"$match": M{"n": 1}}}).SetReadConcern("linearizable").One(&result)
+	c.Assert(err, ErrorMatches, "linearizable read concern may not be used with Secondary mode")
+}
+
+func (s *S) TestReplicaSetConfig(c *C) {
+	if !s.versionAtLeast(3, 0) {
+		c.Skip("replSetGetConfig depends on 3.0+")
+	}
+	session, err := mgo.Dial("localhost:40012")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	session.SetMode(mgo.Monotonic, true)
+
+	config, err := session.ReplicaSetConfig()
+	c.Assert(err, IsNil)
+	c.Assert(config.Name, Equals, "rs1")
+	c.Assert(config.Version > 0, Equals, true)
+	c.Assert(config.Members, HasLen, 3)
+
+	for i, member := range config.Members {
+		c.Assert(member.Id, Equals, i+1)
+		c.Assert(member.Host, Equals, fmt.Sprintf("127.0.0.1:%d", 40011+i))
+		c.Assert(member.Votes, Equals, 1)
+		c.Assert(member.Hidden, Equals, false)
+		c.Assert(member.ArbiterOnly, Equals, false)
+		c.Assert(member.Tags, DeepEquals, bson.D{{Name: "rs1", Value: string(rune('a' + i))}})
+	}
+	c.Assert(config.Members[0].Priority, Equals, 1.0)
+	c.Assert(config.Members[1].Priority, Equals, 0.0)
+}
+
+func (s *S) TestWaitForReplication(c *C) {
+	if !s.versionAtLeast(3, 6) {
+		c.Skip("write optimes are reported by 3.6+")
+	}
+	session, err := mgo.Dial("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	err = session.DB("mydb").C("mycoll").Insert(M{"a": 1})
+	c.Assert(err, IsNil)
+	opTime := session.LastError().OpTime
+	c.Assert(opTime, Not(Equals), bson.MongoTimestamp(0))
+
+	caughtUp, _, err := session.WaitForReplication("127.0.0.1:40012", opTime, 10*time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(caughtUp, Equals, true)
+
+	_, _, err = session.WaitForReplication("127.0.0.1:40099", opTime, time.Second)
+	c.Assert(err, ErrorMatches, "replica set member 127.0.0.1:40099 not found")
+}
+
 func (s *S) TestModeMonotonicAfterStrong(c *C) {
 	// Test that a strong session shifting to a monotonic
 	// one preserves the socket untouched.
@@ -473,6 +762,96 @@ func (s *S) TestModeStrongFallover(c *C) {
 	c.Assert(err, IsNil)
 }
 
+func (s *S) TestPinPrimary(c *C) {
+	if *fast {
+		c.Skip("-fast")
+	}
+
+	session, err := mgo.Dial("localhost:40021")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	result := &struct{ Host string }{}
+	err = session.Run("serverStatus", result)
+	c.Assert(err, IsNil)
+	master := "localhost:" + hostPort(result.Host)
+
+	slave := "localhost:40022"
+	if master == slave {
+		slave = "localhost:40023"
+	}
+	err = session.PinPrimary(slave)
+	c.Assert(err, ErrorMatches, "cannot pin primary to "+slave+": not a known master")
+
+	err = session.PinPrimary(master)
+	c.Assert(err, IsNil)
+	session.Refresh()
+
+	err = session.DB("mydb").C("mycoll").Insert(M{"n": 1})
+	c.Assert(err, IsNil)
+	err = session.Run("serverStatus", result)
+	c.Assert(err, IsNil)
+	c.Assert("localhost:"+hostPort(result.Host), Equals, master)
+
+	// Kill the pinned master. The pin must be dropped once a new master
+	// is elected, rather than blocking writes forever.
+	s.Stop(master)
+	session.Refresh()
+	session.SetSyncTimeout(3 * time.Minute)
+
+	err = session.DB("mydb").C("mycoll").Insert(M{"n": 2})
+	c.Assert(err, IsNil)
+	err = session.Run("serverStatus", result)
+	c.Assert(err, IsNil)
+	c.Assert("localhost:"+hostPort(result.Host), Not(Equals), master)
+
+	session.UnpinPrimary()
+}
+
+func (s *S) TestFreezeTopology(c *C) {
+	if *fast {
+		c.Skip("-fast")
+	}
+
+	session, err := mgo.Dial("localhost:40021")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	for len(session.LiveServers()) != 3 {
+		c.Log("Waiting for all servers to be alive...")
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	snapshot, err := session.FreezeTopology()
+	c.Assert(err, IsNil)
+	c.Assert(snapshot.Primary, Not(Equals), "")
+	c.Assert(snapshot.Servers, HasLen, 3)
+
+	coll := session.DB("mydb").C("mycoll")
+	err = coll.Insert(M{"n": 1})
+	c.Assert(err, IsNil)
+
+	// Sessions created afterwards are frozen too.
+	copied := session.Copy()
+	defer copied.Close()
+
+	// Kill the primary. Writes must fail rather than going to the new
+	// primary once it's elected.
+	s.Stop(snapshot.Primary)
+	session.Refresh()
+	session.SetSyncTimeout(3 * time.Minute)
+
+	err = coll.Insert(M{"n": 2})
+	c.Assert(err, Equals, mgo.ErrTopologyChanged)
+	err = copied.DB("mydb").C("mycoll").Insert(M{"n": 2})
+	c.Assert(err, Equals, mgo.ErrTopologyChanged)
+
+	session.UnfreezeTopology()
+	err = coll.Insert(M{"n": 2})
+	c.Assert(err, IsNil)
+	c.Assert(session.TopologySnapshot().Primary, Not(Equals), snapshot.Primary)
+}
+
 func (s *S) TestModePrimaryHiccup(c *C) {
 	if *fast {
 		c.Skip("-fast")
@@ -524,6 +903,41 @@ func (s *S) TestModePrimaryHiccup(c *C) {
 	c.Assert(err, IsNil)
 }
 
+func (s *S) TestRetryReadsPrimaryHiccup(c *C) {
+	if *fast {
+		c.Skip("-fast")
+	}
+
+	session, err := mgo.Dial("localhost:40021")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	err = coll.Insert(M{"n": 42})
+	c.Assert(err, IsNil)
+
+	result := &struct{ Host string }{}
+	err = session.Run("serverStatus", result)
+	c.Assert(err, IsNil)
+
+	// Kill the master, but bring it back immediately.
+	session.SetRetryReads(true)
+	session.SetSyncTimeout(3 * time.Minute)
+	host := result.Host
+	s.Stop(host)
+	s.StartAll()
+
+	// The broken connection is dropped and the query is run again.
+	var doc struct{ N int }
+	err = coll.Find(nil).One(&doc)
+	c.Assert(err, IsNil)
+	c.Assert(doc.N, Equals, 42)
+
+	n, err := coll.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+}
+
 func (s *S) TestModeMonotonicFallover(c *C) {
 	if *fast {
 		c.Skip("-fast")
@@ -1092,6 +1506,106 @@ func (s *S) TestSocketTimeoutOnInactiveSocket(c *C) {
 	c.Assert(session.Ping(), IsNil)
 }
 
+// keepAliveRecorder wraps a TCP connection, recording how keepalive probes
+// were configured on it.
+type keepAliveRecorder struct {
+	*net.TCPConn
+	m       sync.Mutex
+	enabled bool
+	period  time.Duration
+}
+
+func (conn *keepAliveRecorder) SetKeepAlive(keepalive bool) error {
+	conn.m.Lock()
+	conn.enabled = keepalive
+	conn.m.Unlock()
+	return conn.TCPConn.SetKeepAlive(keepalive)
+}
+
+func (conn *keepAliveRecorder) SetKeepAlivePeriod(d time.Duration) error {
+	conn.m.Lock()
+	conn.period = d
+	conn.m.Unlock()
+	return conn.TCPConn.SetKeepAlivePeriod(d)
+}
+
+func (conn *keepAliveRecorder) settings() (enabled bool, period time.Duration) {
+	conn.m.Lock()
+	defer conn.m.Unlock()
+	return conn.enabled, conn.period
+}
+
+func (s *S) TestKeepAlive(c *C) {
+	var m sync.Mutex
+	var conns []*keepAliveRecorder
+	dial := func(addr *mgo.ServerAddr) (net.Conn, error) {
+		conn, err := net.DialTCP("tcp", nil, addr.TCPAddr())
+		if err != nil {
+			return nil, err
+		}
+		recorder := &keepAliveRecorder{TCPConn: conn}
+		m.Lock()
+		conns = append(conns, recorder)
+		m.Unlock()
+		return recorder, nil
+	}
+	dialed := func() []*keepAliveRecorder {
+		m.Lock()
+		defer m.Unlock()
+		dialed := conns
+		conns = nil
+		return dialed
+	}
+
+	for _, test := range []struct {
+		keepAlive time.Duration
+		enabled   bool
+		period    time.Duration
+	}{
+		{0, false, 0}, // Left as configured by the dialer.
+		{time.Second, true, time.Second},
+		{-1, false, 0},
+	} {
+		info := &mgo.DialInfo{
+			Addrs:      []string{"localhost:40001"},
+			Timeout:    5 * time.Second,
+			KeepAlive:  test.keepAlive,
+			DialServer: dial,
+		}
+		session, err := mgo.DialWithInfo(info)
+		c.Assert(err, IsNil)
+		c.Assert(session.Ping(), IsNil)
+		first := dialed()
+		c.Assert(first, Not(HasLen), 0)
+		for _, conn := range first {
+			enabled, period := conn.settings()
+			c.Assert(enabled, Equals, test.enabled)
+			c.Assert(period, Equals, test.period)
+		}
+
+		// New connections made for the session use the new setting. Copies
+		// holding on to their connections make sure new ones are needed.
+		session.SetKeepAlive(3 * time.Minute)
+		var copies []*mgo.Session
+		for i := 0; i < 3; i++ {
+			copied := session.Copy()
+			c.Assert(copied.Ping(), IsNil)
+			copies = append(copies, copied)
+		}
+		updated := 0
+		for _, conn := range dialed() {
+			if enabled, period := conn.settings(); enabled && period == 3*time.Minute {
+				updated++
+			}
+		}
+		c.Assert(updated > 0, Equals, true)
+		for _, copied := range copies {
+			copied.Close()
+		}
+		session.Close()
+	}
+}
+
 func (s *S) TestDialWithReplicaSetName(c *C) {
 	seedLists := [][]string{
 		// rs1 primary and rs2 primary
@@ -1609,6 +2123,16 @@ func (s *S) TestPoolLimitSimple(c *C) {
 		c.Assert(stats.TimesWaitedForPool, Equals, 1)
 		c.Assert(stats.PoolTimeouts, Equals, 0)
 		c.Assert(stats.TotalPoolWaitTime > 300*time.Millisecond, Equals, true)
+		c.Assert(stats.MaxPoolWaitTime, Equals, stats.TotalPoolWaitTime)
+		c.Assert(stats.PoolWaitPercentile(50), Equals, stats.MaxPoolWaitTime)
+		waits := 0
+		for i, n := range stats.PoolWaitHistogram {
+			waits += n
+			if n > 0 {
+				c.Assert(i > 0 && mgo.PoolWaitBounds()[i-1] < stats.MaxPoolWaitTime, Equals, true)
+			}
+		}
+		c.Assert(waits, Equals, 1)
 	}
 }
 
@@ -1689,6 +2213,31 @@ func (s *S) TestPoolLimitTimeout(c *C) {
 	c.Assert(stats.TotalPoolWaitTime < 1100*time.Millisecond, Equals, true)
 }
 
+func (s *S) TestGlobalConnLimit(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	// Put one socket in use.
+	c.Assert(session.Ping(), IsNil)
+
+	mgo.SetGlobalConnLimit(mgo.GlobalConnCount())
+	defer mgo.SetGlobalConnLimit(0)
+
+	// Another socket can't be established over the limit.
+	copy := session.Copy()
+	defer copy.Close()
+	err = copy.Ping()
+	c.Assert(err, ErrorMatches, "global connection limit reached")
+
+	// But sockets already alive may still be reused.
+	session.Refresh()
+	c.Assert(copy.Ping(), IsNil)
+
+	mgo.SetGlobalConnLimit(0)
+	c.Assert(session.Ping(), IsNil)
+}
+
 func (s *S) TestSetModeEventualIterBug(c *C) {
 	session1, err := mgo.Dial("localhost:40011")
 	c.Assert(err, IsNil)
@@ -2065,6 +2614,49 @@ func (s *S) TestSelectServers(c *C) {
 	c.Assert(hostPort(result.Host), Equals, "40013")
 }
 
+func (s *S) TestQuerySetReadTags(c *C) {
+	if !s.versionAtLeast(2, 2) {
+		c.Skip("read preferences introduced in 2.2")
+	}
+
+	session, err := mgo.Dial("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	session.SetMode(mgo.Eventual, true)
+	session.SelectServers(bson.D{{Name: "rs1", Value: "b"}})
+	coll := session.DB("mydb").C("readtags")
+
+	// Wait for all members to be known.
+	for len(session.LiveServers()) != 3 {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	find := func(tags bson.D, fallback bool) string {
+		q12a := s.countQueries(c, "localhost:40012")
+		q13a := s.countQueries(c, "localhost:40013")
+		err := coll.Find(nil).SetReadTags([]bson.D{tags}, fallback).One(nil)
+		c.Assert(err, Equals, mgo.ErrNotFound)
+		q12b := s.countQueries(c, "localhost:40012")
+		q13b := s.countQueries(c, "localhost:40013")
+		switch {
+		case q12b-q12a == 1 && q13b == q13a:
+			return "40012"
+		case q13b-q13a == 1 && q12b == q12a:
+			return "40013"
+		}
+		c.Fatalf("query went to an unexpected server")
+		return ""
+	}
+
+	// The query tags override the session ones.
+	c.Assert(find(bson.D{{Name: "rs1", Value: "c"}}, false), Equals, "40013")
+	c.Assert(find(bson.D{{Name: "rs1", Value: "c"}}, true), Equals, "40013")
+
+	// Falls back to the session tags when no server matches.
+	c.Assert(find(bson.D{{Name: "rs1", Value: "z"}}, true), Equals, "40012")
+}
+
 func (s *S) TestSelectServersWithMongos(c *C) {
 	if !s.versionAtLeast(2, 2) {
 		c.Skip("read preferences introduced in 2.2")
@@ -2252,3 +2844,49 @@ func (s *S) TestConnectServerFailed(c *C) {
 	}
 	c.Assert(opErr, IsNil)
 }
+
+func (s *S) TestForEachShard(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	_, err = session.Shards()
+	c.Assert(err, ErrorMatches, "not connected to a mongos router")
+
+	mongos, err := mgo.Dial("localhost:40202")
+	c.Assert(err, IsNil)
+	defer mongos.Close()
+
+	shards, err := mongos.Shards()
+	c.Assert(err, IsNil)
+	c.Assert(len(shards) > 0, Equals, true)
+
+	coll := mongos.DB("mydb").C("mycoll")
+	for i := 0; i != 10; i++ {
+		err = coll.Insert(bson.M{"n": i})
+		c.Assert(err, IsNil)
+	}
+
+	var m sync.Mutex
+	seen := make(map[int]bool)
+	err = coll.Find(nil).ForEachShard(func(shard mgo.Shard, iter *mgo.Iter) error {
+		var result struct{ N int }
+		for iter.Next(&result) {
+			m.Lock()
+			seen[result.N] = true
+			m.Unlock()
+		}
+		return iter.Err()
+	})
+	c.Assert(err, IsNil)
+	c.Assert(seen, HasLen, 10)
+
+	ch := make(chan struct{ N int })
+	errc := coll.Find(nil).ShardChannel(ch, nil)
+	n := 0
+	for range ch {
+		n++
+	}
+	c.Assert(<-errc, IsNil)
+	c.Assert(n, Equals, 10)
+}
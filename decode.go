@@ -0,0 +1,111 @@
+package mgo
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// decodeFieldSet returns the set of field names to decode, or nil if all
+// of them must be decoded.
+func decodeFieldSet(fields []string) map[string]bool {
+	if len(fields) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(fields))
+	for _, name := range fields {
+		set[name] = true
+	}
+	return set
+}
+
+// onlyFields returns doc without the top-level elements not named in
+// fields, or doc itself if fields is nil. The elements left out are
+// skipped over by their size, with their values never decoded. Malformed
+// documents are returned unchanged, for the decoder to report the error.
+func onlyFields(doc []byte, fields map[string]bool) []byte {
+	if fields == nil || len(doc) < 5 {
+		return doc
+	}
+	size := int(int32(binary.LittleEndian.Uint32(doc)))
+	if size < 5 || size > len(doc) {
+		return doc
+	}
+	out := make([]byte, 4, size)
+	for i := 4; i < size-1; {
+		kind := doc[i]
+		end := bytes.IndexByte(doc[i+1:size], 0)
+		if end < 0 {
+			return doc
+		}
+		name := doc[i+1 : i+1+end]
+		start := i + 1 + end + 1
+		n := elementSize(kind, doc[start:size-1])
+		if n < 0 {
+			return doc
+		}
+		if fields[string(name)] {
+			out = append(out, doc[i:start+n]...)
+		}
+		i = start + n
+	}
+	out = append(out, 0)
+	binary.LittleEndian.PutUint32(out, uint32(len(out)))
+	return out
+}
+
+// elementSize returns the size of the value of an element of the given
+// kind at the start of data, or -1 if the kind is unknown or the value
+// doesn't fit in data.
+func elementSize(kind byte, data []byte) int {
+	length := func() int {
+		if len(data) < 4 {
+			return -1
+		}
+		return int(int32(binary.LittleEndian.Uint32(data)))
+	}
+	var n int
+	switch kind {
+	case 0x06, 0x0A, 0x7F, 0xFF: // Undefined, null, max and min keys.
+		n = 0
+	case 0x08: // Boolean.
+		n = 1
+	case 0x10: // Int32.
+		n = 4
+	case 0x01, 0x09, 0x11, 0x12: // Double, datetime, timestamp, int64.
+		n = 8
+	case 0x07: // ObjectId.
+		n = 12
+	case 0x13: // Decimal128.
+		n = 16
+	case 0x03, 0x04, 0x0F: // Document, array, code with scope.
+		n = length()
+	case 0x02, 0x0D, 0x0E: // String, JavaScript code, symbol.
+		if n = length(); n >= 0 {
+			n += 4
+		}
+	case 0x05: // Binary.
+		if n = length(); n >= 0 {
+			n += 5
+		}
+	case 0x0C: // DBPointer.
+		if n = length(); n >= 0 {
+			n += 4 + 12
+		}
+	case 0x0B: // Regular expression, as two C strings.
+		pattern := bytes.IndexByte(data, 0)
+		if pattern < 0 {
+			return -1
+		}
+		options := bytes.IndexByte(data[pattern+1:], 0)
+		if options < 0 {
+			return -1
+		}
+		n = pattern + 1 + options + 1
+	default:
+		return -1
+	}
+	if n < 0 || n > len(data) {
+		return -1
+	}
+	return n
+}
@@ -0,0 +1,210 @@
+package mgo
+
+import (
+	"math"
+	"math/big"
+	"sync"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// ParallelExport reads all documents in the collection by splitting the
+// range of their _id values into up to the given number of ranges, and
+// reading the ranges concurrently. The fn function is called with every
+// document read, one at a time, so it may serialize them without further
+// synchronization, but documents from different ranges are interleaved
+// in no particular order. If fn returns an error, reading stops and the
+// error is returned.
+//
+// The _id range is split evenly between the lowest and the highest _id
+// when both are ObjectIds or both are numbers. Any other collection is
+// read as a single range.
+//
+// Every range is read with its own copy of the session, so the server
+// each range is read from is selected by the session mode, as with any
+// other query.
+//
+// Note that the export is not a point-in-time snapshot of the collection:
+// documents inserted, updated or removed while the export is running may
+// or may not be seen, as with any other query.
+//
+// For example:
+//
+//     session.SetMode(mgo.SecondaryPreferred, true)
+//     err := session.DB("mydb").C("mycoll").ParallelExport(8, func(doc bson.Raw) error {
+//         _, err := out.Write(doc.Data)
+//         return err
+//     })
+//
+func (c *Collection) ParallelExport(ranges int, fn func(doc bson.Raw) error) error {
+	if ranges < 1 {
+		ranges = 1
+	}
+	var min, max struct {
+		Id interface{} `bson:"_id"`
+	}
+	err := c.Find(nil).Select(bson.M{"_id": 1}).Sort("_id").One(&min)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err == nil {
+		err = c.Find(nil).Select(bson.M{"_id": 1}).Sort("-_id").One(&max)
+	}
+	if err != nil {
+		return err
+	}
+
+	var m sync.Mutex
+	var firstErr error
+	done := make(chan struct{})
+	fail := func(err error) {
+		m.Lock()
+		if firstErr == nil {
+			firstErr = err
+			close(done)
+		}
+		m.Unlock()
+	}
+
+	queries := idRanges(min.Id, max.Id, ranges)
+	var wg sync.WaitGroup
+	wg.Add(len(queries))
+	for _, query := range queries {
+		go func(query interface{}) {
+			defer wg.Done()
+			session := c.Database.Session.Copy()
+			defer session.Close()
+			iter := c.With(session).Find(query).Iter()
+			var doc bson.Raw
+			for iter.Next(&doc) {
+				select {
+				case <-done:
+					iter.Close()
+					return
+				default:
+				}
+				m.Lock()
+				err := firstErr
+				if err == nil {
+					err = fn(doc)
+				}
+				m.Unlock()
+				if err != nil {
+					fail(err)
+					iter.Close()
+					return
+				}
+			}
+			if err := iter.Close(); err != nil {
+				fail(err)
+			}
+		}(query)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// idRanges returns the queries matching up to n consecutive ranges of _id
+// values between min and max, both included, or a single query matching
+// all documents if the range can't be split.
+func idRanges(min, max interface{}, n int) []interface{} {
+	bounds := splitIds(min, max, n)
+	if len(bounds) < 2 {
+		return []interface{}{nil}
+	}
+	queries := make([]interface{}, 0, len(bounds)-1)
+	for i := 0; i+1 < len(bounds); i++ {
+		op := "$lt"
+		if i+2 == len(bounds) {
+			op = "$lte"
+		}
+		queries = append(queries, bson.D{{Name: "_id", Value: bson.D{
+			{Name: "$gte", Value: bounds[i]},
+			{Name: op, Value: bounds[i+1]},
+		}}})
+	}
+	return queries
+}
+
+// splitIds returns up to n+1 increasing _id values evenly splitting the
+// range between min and max, both included, or nil if the range can't be
+// split. Values are only split if both are ObjectIds or both are numbers,
+// which guarantees all _id values in the range are of the same kind, as
+// the _id index orders values of different kinds separately.
+func splitIds(min, max interface{}, n int) []interface{} {
+	if minId, ok := min.(bson.ObjectId); ok {
+		maxId, ok := max.(bson.ObjectId)
+		if !ok || !minId.Valid() || !maxId.Valid() {
+			return nil
+		}
+		return splitInts(new(big.Int).SetBytes([]byte(minId)), new(big.Int).SetBytes([]byte(maxId)), n, func(i *big.Int) interface{} {
+			id := make([]byte, 12)
+			data := i.Bytes()
+			copy(id[len(id)-len(data):], data)
+			return bson.ObjectId(id)
+		})
+	}
+	minInt, minIsInt := intValue(min)
+	maxInt, maxIsInt := intValue(max)
+	if minIsInt && maxIsInt {
+		return splitInts(big.NewInt(minInt), big.NewInt(maxInt), n, func(i *big.Int) interface{} {
+			return i.Int64()
+		})
+	}
+	minFloat, minIsNum := floatValue(min)
+	maxFloat, maxIsNum := floatValue(max)
+	if !minIsNum || !maxIsNum || math.IsNaN(minFloat) || math.IsNaN(maxFloat) || math.IsInf(minFloat, 0) || math.IsInf(maxFloat, 0) || minFloat > maxFloat {
+		return nil
+	}
+	bounds := []interface{}{minFloat}
+	for i := 1; i < n; i++ {
+		bound := minFloat + (maxFloat-minFloat)*float64(i)/float64(n)
+		if bound > bounds[len(bounds)-1].(float64) && bound < maxFloat {
+			bounds = append(bounds, bound)
+		}
+	}
+	return append(bounds, maxFloat)
+}
+
+// splitInts returns up to n+1 distinct increasing values evenly split
+// between min and max, both included, converted with conv.
+func splitInts(min, max *big.Int, n int, conv func(i *big.Int) interface{}) []interface{} {
+	if min.Cmp(max) > 0 {
+		return nil
+	}
+	span := new(big.Int).Sub(max, min)
+	bounds := []interface{}{conv(min)}
+	last := new(big.Int).Set(min)
+	for i := 1; i < n; i++ {
+		bound := new(big.Int).Mul(span, big.NewInt(int64(i)))
+		bound.Quo(bound, big.NewInt(int64(n)))
+		bound.Add(bound, min)
+		if bound.Cmp(last) > 0 && bound.Cmp(max) < 0 {
+			bounds = append(bounds, conv(bound))
+			last = bound
+		}
+	}
+	return append(bounds, conv(max))
+}
+
+func intValue(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case int:
+		return int64(v), true
+	case int64:
+		return v, true
+	}
+	return 0, false
+}
+
+func floatValue(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
@@ -0,0 +1,166 @@
+package mgo
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// ---------------------------------------------------------------------------
+// Geospatial queries.
+
+// Point is a position given by its longitude and latitude, in that order,
+// as with GeoJSON coordinates.
+type Point [2]float64
+
+// LineString is a GeoJSON line made of two or more points.
+type LineString []Point
+
+// Polygon is a GeoJSON polygon made of one or more linear rings, each of
+// them starting and ending with the same point, with at least four points
+// in total. The first ring is the exterior of the polygon, and any further
+// rings are holes within it.
+type Polygon [][]Point
+
+// Geometry is a GeoJSON object used in geospatial queries: a Point,
+// a LineString or a Polygon.
+type Geometry interface {
+	geoJSON() (bson.D, error)
+}
+
+func (p Point) check() error {
+	if p[0] < -180 || p[0] > 180 {
+		return fmt.Errorf("invalid point %v: longitude must be between -180 and 180", p)
+	}
+	if p[1] < -90 || p[1] > 90 {
+		return fmt.Errorf("invalid point %v: latitude must be between -90 and 90", p)
+	}
+	return nil
+}
+
+func (p Point) geoJSON() (bson.D, error) {
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+	return bson.D{{Name: "type", Value: "Point"}, {Name: "coordinates", Value: p}}, nil
+}
+
+func (l LineString) geoJSON() (bson.D, error) {
+	if len(l) < 2 {
+		return nil, fmt.Errorf("invalid line string: must have at least 2 points, got %d", len(l))
+	}
+	for _, p := range l {
+		if err := p.check(); err != nil {
+			return nil, err
+		}
+	}
+	return bson.D{{Name: "type", Value: "LineString"}, {Name: "coordinates", Value: l}}, nil
+}
+
+func (p Polygon) geoJSON() (bson.D, error) {
+	if len(p) == 0 {
+		return nil, errors.New("invalid polygon: must have at least one ring")
+	}
+	for i, ring := range p {
+		if len(ring) < 4 {
+			return nil, fmt.Errorf("invalid polygon: ring %d must have at least 4 points, got %d", i, len(ring))
+		}
+		if ring[0] != ring[len(ring)-1] {
+			return nil, fmt.Errorf("invalid polygon: ring %d is not closed, it starts at %v and ends at %v", i, ring[0], ring[len(ring)-1])
+		}
+		for _, point := range ring {
+			if err := point.check(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return bson.D{{Name: "type", Value: "Polygon"}, {Name: "coordinates", Value: p}}, nil
+}
+
+// GeoNear returns the condition matching documents with a GeoJSON location
+// that is at most maxDistance meters away from point, sorted from nearest
+// to farthest. A maxDistance of zero sets no limit. The queried field must
+// have a 2dsphere index. For example:
+//
+//     near, err := mgo.GeoNear(mgo.Point{-73.97, 40.77}, 500)
+//     if err != nil {
+//         return err
+//     }
+//     iter := collection.Find(bson.M{"location": near}).Iter()
+//
+// Relevant documentation:
+//
+//     https://docs.mongodb.com/manual/reference/operator/query/near/
+//
+func GeoNear(point Point, maxDistance float64) (bson.D, error) {
+	if maxDistance < 0 {
+		return nil, fmt.Errorf("invalid maximum distance: %v", maxDistance)
+	}
+	geometry, err := point.geoJSON()
+	if err != nil {
+		return nil, err
+	}
+	near := bson.D{{Name: "$geometry", Value: geometry}}
+	if maxDistance > 0 {
+		near = append(near, bson.DocElem{Name: "$maxDistance", Value: maxDistance})
+	}
+	return bson.D{{Name: "$near", Value: near}}, nil
+}
+
+// GeoWithin returns the condition matching documents with a GeoJSON location
+// entirely within polygon. For example:
+//
+//     within, err := mgo.GeoWithin(mgo.Polygon{{
+//         {0, 0}, {3, 6}, {6, 1}, {0, 0},
+//     }})
+//     if err != nil {
+//         return err
+//     }
+//     iter := collection.Find(bson.M{"location": within}).Iter()
+//
+// Relevant documentation:
+//
+//     https://docs.mongodb.com/manual/reference/operator/query/geoWithin/
+//
+func GeoWithin(polygon Polygon) (bson.D, error) {
+	geometry, err := polygon.geoJSON()
+	if err != nil {
+		return nil, err
+	}
+	return bson.D{{Name: "$geoWithin", Value: bson.D{{Name: "$geometry", Value: geometry}}}}, nil
+}
+
+// GeoWithinBox returns the condition matching documents with legacy
+// coordinate pairs within the rectangle with the given bottom left and
+// upper right corners. The queried field may have a 2d index.
+//
+// Relevant documentation:
+//
+//     https://docs.mongodb.com/manual/reference/operator/query/box/
+//
+func GeoWithinBox(bottomLeft, upperRight Point) (bson.D, error) {
+	if bottomLeft[0] > upperRight[0] || bottomLeft[1] > upperRight[1] {
+		return nil, fmt.Errorf("invalid box: bottom left corner %v is not below and left of upper right corner %v", bottomLeft, upperRight)
+	}
+	box := []Point{bottomLeft, upperRight}
+	return bson.D{{Name: "$geoWithin", Value: bson.D{{Name: "$box", Value: box}}}}, nil
+}
+
+// GeoIntersects returns the condition matching documents with a GeoJSON
+// location that intersects with geometry.
+//
+// Relevant documentation:
+//
+//     https://docs.mongodb.com/manual/reference/operator/query/geoIntersects/
+//
+func GeoIntersects(geometry Geometry) (bson.D, error) {
+	if geometry == nil {
+		return nil, errors.New("invalid geometry: nil")
+	}
+	doc, err := geometry.geoJSON()
+	if err != nil {
+		return nil, err
+	}
+	return bson.D{{Name: "$geoIntersects", Value: bson.D{{Name: "$geometry", Value: doc}}}}, nil
+}
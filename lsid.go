@@ -0,0 +1,242 @@
+package mgo
+
+import (
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// serverSession is a logical session started on the server, identified by
+// its lsid. Once the session using it is closed, it's returned to the
+// cluster pool so that further sessions may reuse it rather than starting
+// new ones, as the server keeps a record of every logical session until
+// it times out.
+type serverSession struct {
+	id        bson.Raw
+	txnNumber int64
+	lastUse   time.Time
+}
+
+// maxEndSessions is the maximum number of logical sessions ended by a
+// single endSessions command.
+const maxEndSessions = 10000
+
+// sessionFreeCommands holds the names of commands that must not carry
+// the logical session id, as they establish connections or sessions.
+var sessionFreeCommands = map[string]bool{
+	"hello":        true,
+	"isMaster":     true,
+	"ismaster":     true,
+	"saslStart":    true,
+	"saslContinue": true,
+	"getnonce":     true,
+	"authenticate": true,
+	"startSession": true,
+	"endSessions":  true,
+}
+
+// supportsSessions returns whether the server supports logical sessions.
+func (info *mongoServerInfo) supportsSessions() bool {
+	return info.MaxWireVersion >= 6 && info.LogicalSessionTimeout > 0
+}
+
+// acquireServerSession takes the most recently used logical session out
+// of the pool, or returns nil if there's none left that won't time out
+// on the server within the next minute.
+func (cluster *mongoCluster) acquireServerSession(timeout time.Duration) *serverSession {
+	cluster.Lock()
+	defer cluster.Unlock()
+	for n := len(cluster.serverSessions); n > 0; n-- {
+		ss := cluster.serverSessions[n-1]
+		cluster.serverSessions = cluster.serverSessions[:n-1]
+		if time.Since(ss.lastUse) < timeout-time.Minute {
+			return ss
+		}
+	}
+	return nil
+}
+
+// releaseServerSession returns ss to the pool for reuse.
+func (cluster *mongoCluster) releaseServerSession(ss *serverSession) {
+	ss.lastUse = time.Now()
+	cluster.Lock()
+	if cluster.references > 0 {
+		// Sessions released after the cluster was closed are left
+		// to time out on the server.
+		cluster.serverSessions = append(cluster.serverSessions, ss)
+	}
+	cluster.Unlock()
+}
+
+// takeServerSessions empties the pool of logical sessions, returning their
+// ids. It must be called with the cluster lock held.
+func (cluster *mongoCluster) takeServerSessions() []bson.Raw {
+	if len(cluster.serverSessions) == 0 {
+		return nil
+	}
+	ids := make([]bson.Raw, 0, len(cluster.serverSessions))
+	for _, ss := range cluster.serverSessions {
+		ids = append(ids, ss.id)
+	}
+	cluster.serverSessions = nil
+	return ids
+}
+
+// sessionsServer returns the server to end pooled logical sessions on, the
+// master if possible, or nil if no known server supports logical sessions.
+// It must be called with the cluster lock held.
+func (cluster *mongoCluster) sessionsServer() *mongoServer {
+	var server *mongoServer
+	for _, s := range cluster.servers.Slice() {
+		if info := s.Info(); info.supportsSessions() && (server == nil || info.Master) {
+			server = s
+		}
+	}
+	return server
+}
+
+// endServerSessions asks server to end the logical sessions with the given
+// ids, as they'd otherwise remain on the server until they time out. Only
+// an idle connection to server is used, so that closing the cluster never
+// waits for a new one to be established, and the sessions are left to time
+// out when there's none. The commands are written out, but their replies
+// aren't waited for, as the connections are closed along with the cluster
+// right after.
+func endServerSessions(server *mongoServer, info *DialInfo, ids []bson.Raw) {
+	if server == nil || len(ids) == 0 {
+		return
+	}
+	socket := server.idleSocket(info)
+	if socket == nil {
+		return
+	}
+	defer socket.Release()
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > maxEndSessions {
+			n = maxEndSessions
+		}
+		op := &queryOp{
+			collection: "admin.$cmd",
+			query:      bson.D{{Name: "endSessions", Value: ids[:n]}},
+			limit:      -1,
+			replyFunc:  func(err error, reply *replyOp, docNum int, docData []byte) {},
+		}
+		if socket.Query(op) != nil {
+			return
+		}
+		ids = ids[n:]
+	}
+	debugf("Ended pooled logical sessions on %s", server.Addr)
+}
+
+// serverSession returns the logical session of s, taking it from the
+// cluster pool or starting a new one on socket if s has none yet.
+func (s *Session) serverSession(socket *mongoSocket) (*serverSession, error) {
+	s.m.RLock()
+	ss := s.lsid
+	cluster := s.cluster()
+	s.m.RUnlock()
+	if ss != nil {
+		return ss, nil
+	}
+
+	ss = cluster.acquireServerSession(socket.ServerInfo().LogicalSessionTimeout)
+	if ss == nil {
+		var result struct {
+			Id bson.Raw `bson:"id"`
+		}
+		if err := s.DB("admin").run(socket, "startSession", &result); err != nil {
+			return nil, err
+		}
+		ss = &serverSession{id: result.Id}
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.lsid != nil {
+		// Another goroutine got there first.
+		cluster.releaseServerSession(ss)
+		return s.lsid, nil
+	}
+	s.lsid = ss
+	return ss, nil
+}
+
+// prepareServerSession makes sure s has a logical session once socket is
+// acquired, if the server supports them. Failing to obtain one isn't an
+// error, as operations still work without it.
+func (s *Session) prepareServerSession(socket *mongoSocket) {
+	if !socket.ServerInfo().supportsSessions() {
+		return
+	}
+	if _, err := s.serverSession(socket); err != nil {
+		debugf("Session %p couldn't start a logical session: %v", s, err)
+	}
+}
+
+// sessionId returns the id of the logical session of s, or nil if it has
+// none.
+func (s *Session) sessionId() *bson.Raw {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	if s.lsid == nil {
+		return nil
+	}
+	return &s.lsid.id
+}
+
+// appendSessionId returns the command op is about to send with the lsid
+// field appended, if the command may carry it on socket.
+func (op *queryOp) appendSessionId(socket *mongoSocket) interface{} {
+	if !strings.HasSuffix(op.collection, ".$cmd") || !socket.ServerInfo().supportsSessions() {
+		return op.query
+	}
+	if sessionFreeCommands[commandName(op.query)] {
+		return op.query
+	}
+	var cmd bson.D
+	switch query := op.query.(type) {
+	case bson.D:
+		if unacknowledged(query) {
+			// There would be no reply to tell that the session was used.
+			return op.query
+		}
+		cmd = make(bson.D, len(query), len(query)+1)
+		copy(cmd, query)
+	default:
+		var raw bson.RawD
+		data, err := bson.Marshal(op.query)
+		if err == nil {
+			err = bson.Unmarshal(data, &raw)
+		}
+		if err != nil {
+			// Leave it to the caller to report the marshalling error.
+			return op.query
+		}
+		cmd = make(bson.D, 0, len(raw)+1)
+		for _, elem := range raw {
+			cmd = append(cmd, bson.DocElem{Name: elem.Name, Value: elem.Value})
+		}
+	}
+	return append(cmd, bson.DocElem{Name: "lsid", Value: op.lsid})
+}
+
+// unacknowledged returns whether cmd is a write command with a write
+// concern of w: 0.
+func unacknowledged(cmd bson.D) bool {
+	for _, elem := range cmd {
+		if elem.Name != "writeConcern" {
+			continue
+		}
+		if concern, ok := elem.Value.(bson.D); ok {
+			for _, field := range concern {
+				if field.Name == "w" && field.Value == 0 {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,335 @@
+package mgo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// ---------------------------------------------------------------------------
+// Command monitoring.
+
+// CommandMonitor holds functions called as commands are sent to servers and
+// their replies are received. Any of the functions may be nil.
+//
+// The functions are called synchronously from the goroutines sending
+// and receiving data on the connection, so they should return quickly.
+type CommandMonitor struct {
+	Started   func(event *CommandStartedEvent)
+	Succeeded func(event *CommandSucceededEvent)
+	Failed    func(event *CommandFailedEvent)
+}
+
+// CommandStartedEvent is delivered right before a command is sent.
+type CommandStartedEvent struct {
+	CommandName   string
+	DatabaseName  string
+	ServerAddress string
+	RequestId     uint32
+	Command       bson.Raw
+}
+
+// CommandSucceededEvent is delivered when a successful reply is received.
+type CommandSucceededEvent struct {
+	CommandName   string
+	DatabaseName  string
+	ServerAddress string
+	RequestId     uint32
+	Duration      time.Duration
+	Reply         bson.Raw
+}
+
+// CommandFailedEvent is delivered when a command fails, either because a
+// network error happened or because the server replied with an error.
+type CommandFailedEvent struct {
+	CommandName   string
+	DatabaseName  string
+	ServerAddress string
+	RequestId     uint32
+	Duration      time.Duration
+	Err           error
+}
+
+var globalMonitor *CommandMonitor
+
+// SetCommandMonitor sets the monitor notified about every command sent to
+// the servers in any cluster, including the commands issued internally by
+// the driver to keep track of the cluster topology. Setting it to nil, the
+// default, disables command monitoring.
+//
+// As with SetLogger, the monitor is supposed to be set up once when the
+// application starts.
+func SetCommandMonitor(monitor *CommandMonitor) {
+	if raceDetector {
+		globalMutex.Lock()
+		defer globalMutex.Unlock()
+	}
+	globalMonitor = monitor
+}
+
+func commandMonitor() *CommandMonitor {
+	if raceDetector {
+		globalMutex.Lock()
+		defer globalMutex.Unlock()
+	}
+	return globalMonitor
+}
+
+// monitoredCommand tracks a single command for the command monitor.
+type monitoredCommand struct {
+	m       sync.Mutex
+	monitor *CommandMonitor
+	event   CommandStartedEvent
+	started time.Time
+	done    bool
+}
+
+// newMonitoredCommand returns a monitoredCommand for the serialized command
+// doc sent to the given collection, or nil if op isn't a command.
+func newMonitoredCommand(monitor *CommandMonitor, socket *mongoSocket, collection string, doc []byte) *monitoredCommand {
+	if !strings.HasSuffix(collection, ".$cmd") {
+		return nil
+	}
+	mc := &monitoredCommand{monitor: monitor}
+	mc.event.DatabaseName = collection[:len(collection)-5]
+	mc.event.ServerAddress = socket.addr
+	mc.event.Command = bson.Raw{Kind: 0x03, Data: append([]byte(nil), doc...)}
+
+	var elems bson.RawD
+	if mc.event.Command.Unmarshal(&elems) == nil && len(elems) > 0 {
+		if elems[0].Name == "$query" {
+			// Wrapped with query options when talking to a mongos.
+			mc.event.Command = elems[0].Value
+			elems = nil
+			mc.event.Command.Unmarshal(&elems)
+		}
+		if len(elems) > 0 {
+			mc.event.CommandName = elems[0].Name
+		}
+	}
+	return mc
+}
+
+// start notifies the monitor that the command is about to be sent.
+func (mc *monitoredCommand) start(requestId uint32) {
+	mc.m.Lock()
+	mc.event.RequestId = requestId
+	mc.started = time.Now()
+	mc.m.Unlock()
+	if mc.monitor.Started != nil {
+		mc.monitor.Started(&mc.event)
+	}
+}
+
+// replyFunc wraps replyFunc so that the monitor is notified about the
+// outcome of the command before replyFunc is called.
+func (mc *monitoredCommand) replyFunc(replyFunc replyFunc) replyFunc {
+	return func(err error, reply *replyOp, docNum int, docData []byte) {
+		mc.finish(err, docData)
+		replyFunc(err, reply, docNum, docData)
+	}
+}
+
+// finish notifies the monitor about the outcome of the command, unless it
+// was never sent or the monitor was already notified.
+func (mc *monitoredCommand) finish(err error, docData []byte) {
+	mc.m.Lock()
+	notify := !mc.started.IsZero() && !mc.done
+	mc.done = true
+	started := mc.started
+	mc.m.Unlock()
+	if !notify {
+		return
+	}
+
+	duration := time.Since(started)
+	if err == nil {
+		err = checkQueryError(mc.event.DatabaseName+".$cmd", docData)
+	}
+	if err != nil {
+		if mc.monitor.Failed != nil {
+			mc.monitor.Failed(&CommandFailedEvent{
+				CommandName:   mc.event.CommandName,
+				DatabaseName:  mc.event.DatabaseName,
+				ServerAddress: mc.event.ServerAddress,
+				RequestId:     mc.event.RequestId,
+				Duration:      duration,
+				Err:           err,
+			})
+		}
+		return
+	}
+	if mc.monitor.Succeeded != nil {
+		mc.monitor.Succeeded(&CommandSucceededEvent{
+			CommandName:   mc.event.CommandName,
+			DatabaseName:  mc.event.DatabaseName,
+			ServerAddress: mc.event.ServerAddress,
+			RequestId:     mc.event.RequestId,
+			Duration:      duration,
+			Reply:         bson.Raw{Kind: 0x03, Data: docData},
+		})
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Slow operations.
+
+// SlowOperation holds the details of an operation that took longer than the
+// threshold set with Session.SetSlowOperationThreshold.
+type SlowOperation struct {
+	// CommandName is the name of the command, such as "find" or "insert",
+	// or "query" for a query sent to servers older than 3.2.
+	CommandName string
+
+	// Namespace is the database and collection the operation applied to,
+	// or only the database if the command doesn't name a collection.
+	Namespace string
+
+	ServerAddress string
+	Duration      time.Duration
+
+	// Err is set if the operation failed without a reply from the server.
+	Err error
+}
+
+// slowOpWatch holds the settings of Session.SetSlowOperationThreshold.
+type slowOpWatch struct {
+	threshold time.Duration
+	callback  func(op *SlowOperation)
+}
+
+// replyFunc wraps replyFunc so that the callback is notified if the first
+// reply to the serialized doc sent to collection arrives after the threshold.
+func (w *slowOpWatch) replyFunc(socket *mongoSocket, collection string, doc []byte, replyFunc replyFunc) replyFunc {
+	name, ns := commandSummary(collection, doc)
+	addr := socket.addr
+	started := time.Now()
+	var once sync.Once
+	return func(err error, reply *replyOp, docNum int, docData []byte) {
+		once.Do(func() {
+			if duration := time.Since(started); duration > w.threshold {
+				w.callback(&SlowOperation{
+					CommandName:   name,
+					Namespace:     ns,
+					ServerAddress: addr,
+					Duration:      duration,
+					Err:           err,
+				})
+			}
+		})
+		replyFunc(err, reply, docNum, docData)
+	}
+}
+
+// commandSummary returns the name of the command serialized in doc and
+// the namespace it applies to, without decoding the whole document.
+func commandSummary(collection string, doc []byte) (name, ns string) {
+	if !strings.HasSuffix(collection, ".$cmd") {
+		return "query", collection
+	}
+	db := collection[:len(collection)-5]
+	kind, name, value := firstElement(doc)
+	if kind == 0x03 && name == "$query" {
+		// Wrapped with query options when talking to a mongos.
+		kind, name, value = firstElement(value)
+	}
+	if kind == 0x02 && len(value) > 5 {
+		return name, db + "." + string(value[4:len(value)-1])
+	}
+	return name, db
+}
+
+// firstElement returns the kind, name and value of the first element of
+// the document doc. Only string and document values are returned.
+func firstElement(doc []byte) (kind byte, name string, value []byte) {
+	if len(doc) < 6 {
+		return 0, "", nil
+	}
+	kind = doc[4]
+	end := bytes.IndexByte(doc[5:], 0)
+	if end < 0 {
+		return 0, "", nil
+	}
+	name = string(doc[5 : 5+end])
+	rest := doc[5+end+1:]
+	if (kind == 0x02 || kind == 0x03) && len(rest) >= 4 {
+		n := int(binary.LittleEndian.Uint32(rest))
+		if kind == 0x02 {
+			n += 4
+		}
+		if n <= len(rest) {
+			value = rest[:n]
+		}
+	}
+	return kind, name, value
+}
+
+// ---------------------------------------------------------------------------
+// Connection pool monitoring.
+
+// PoolMonitor holds functions called as the connection pools of servers are
+// created, and as their connections are established, checked out for use,
+// checked in once released, and closed. Any of the functions may be nil.
+//
+// The functions are called synchronously from the goroutines using the
+// pools, so they should return quickly.
+type PoolMonitor struct {
+	PoolCreated              func(event *PoolEvent)
+	ConnectionCreated        func(event *PoolEvent)
+	ConnectionCheckedOut     func(event *PoolEvent)
+	ConnectionCheckOutFailed func(event *PoolEvent)
+	ConnectionCheckedIn      func(event *PoolEvent)
+	ConnectionClosed         func(event *PoolEvent)
+}
+
+// PoolEvent is delivered to the functions of a PoolMonitor.
+type PoolEvent struct {
+	ServerAddress string
+
+	// ConnectionId identifies the connection within the process, and is
+	// zero for PoolCreated and ConnectionCheckOutFailed events.
+	ConnectionId uint64
+
+	// Reason is one of the PoolReason constants for ConnectionClosed and
+	// ConnectionCheckOutFailed events, and empty otherwise.
+	Reason string
+}
+
+// Reasons reported by ConnectionClosed and ConnectionCheckOutFailed events.
+const (
+	PoolReasonIdle       = "idle"       // Idle for longer than DialInfo.MaxIdleTimeMS.
+	PoolReasonStale      = "stale"      // Established before Session.Reconfigure.
+	PoolReasonPoolClosed = "poolClosed" // The server was closed or left the cluster.
+	PoolReasonError      = "error"      // A network or protocol error happened.
+	PoolReasonPoolLimit  = "poolLimit"  // DialInfo.PoolLimit was reached.
+	PoolReasonTimeout    = "timeout"    // DialInfo.PoolTimeout elapsed.
+)
+
+var globalPoolMonitor *PoolMonitor
+
+// SetPoolMonitor sets the monitor notified about the connection pools of
+// the servers in any cluster, including the connections used internally by
+// the driver to keep track of the cluster topology. Setting it to nil, the
+// default, disables pool monitoring.
+//
+// As with SetLogger, the monitor is supposed to be set up once when the
+// application starts.
+func SetPoolMonitor(monitor *PoolMonitor) {
+	if raceDetector {
+		globalMutex.Lock()
+		defer globalMutex.Unlock()
+	}
+	globalPoolMonitor = monitor
+}
+
+func poolMonitor() *PoolMonitor {
+	if raceDetector {
+		globalMutex.Lock()
+		defer globalMutex.Unlock()
+	}
+	return globalPoolMonitor
+}
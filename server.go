@@ -28,6 +28,7 @@ package mgo
 
 import (
 	"errors"
+	"math/rand"
 	"net"
 	"sort"
 	"sync"
@@ -61,14 +62,20 @@ type mongoServer struct {
 	sync          chan bool
 	dial          dialer
 	pingValue     time.Duration
-	pingIndex     int
-	pingWindow    [6]time.Duration
 	info          *mongoServerInfo
 	pingCount     uint32
 	closed        bool
 	abended       bool
+	recovering    bool
+	groupPriority int // Of the seed group the server is in; immutable.
+	recoverDelay  time.Duration
+	recoverRetry  time.Time
+	syncFailures  int        // Consecutive failed topology checks.
+	restartedAt   time.Time  // When the server last closed a connection cleanly.
+	buildInfo     *BuildInfo // Cached by Session.BuildInfo until a restart.
 	poolWaiter    *sync.Cond
 	dialInfo      *DialInfo
+	generation    int // Of the pool, bumped by reconfigure.
 }
 
 type dialer struct {
@@ -86,22 +93,57 @@ type mongoServerInfo struct {
 	Tags           bson.D
 	MaxWireVersion int
 	SetName        string
+
+	// Election details advertised by replica set primaries, used to tell
+	// which one is authoritative when more than one claims to be primary.
+	SetVersion int
+	ElectionId bson.ObjectId
+
+	// Members holds how many data-bearing members the replica set
+	// configuration lists, hidden members aside, or zero if unknown.
+	Members int
+
+	// Size limits advertised by the server, or zero if unknown.
+	MaxBsonObjectSize   int
+	MaxMessageSizeBytes int
+	MaxWriteBatchSize   int
+
+	// LogicalSessionTimeout is how long the server keeps an idle logical
+	// session, or zero if it doesn't support logical sessions.
+	LogicalSessionTimeout time.Duration
 }
 
 var defaultServerInfo mongoServerInfo
 
-func newServer(addr string, tcpaddr *net.TCPAddr, syncChan chan bool, dial dialer, info *DialInfo) *mongoServer {
+// defaultMaxWriteBatchSize is the maximum number of operations sent in a
+// single write command to servers that don't advertise their limit.
+const defaultMaxWriteBatchSize = 1000
+
+// maxWriteBatchSize returns the maximum number of operations the server
+// accepts in a single write command.
+func (info *mongoServerInfo) maxWriteBatchSize() int {
+	if info.MaxWriteBatchSize > 0 {
+		return info.MaxWriteBatchSize
+	}
+	return defaultMaxWriteBatchSize
+}
+
+func newServer(addr string, tcpaddr *net.TCPAddr, syncChan chan bool, dial dialer, info *DialInfo, groupPriority int) *mongoServer {
 	server := &mongoServer{
-		Addr:         addr,
-		ResolvedAddr: tcpaddr.String(),
-		tcpaddr:      tcpaddr,
-		sync:         syncChan,
-		dial:         dial,
-		info:         &defaultServerInfo,
-		pingValue:    time.Hour, // Push it back before an actual ping.
-		dialInfo:     info,
+		Addr:          addr,
+		ResolvedAddr:  tcpaddr.String(),
+		tcpaddr:       tcpaddr,
+		sync:          syncChan,
+		dial:          dial,
+		info:          &defaultServerInfo,
+		pingValue:     time.Hour, // Push it back before an actual ping.
+		dialInfo:      info,
+		groupPriority: groupPriority,
 	}
 	server.poolWaiter = sync.NewCond(server)
+	if monitor := poolMonitor(); monitor != nil && monitor.PoolCreated != nil {
+		monitor.PoolCreated(&PoolEvent{ServerAddress: addr})
+	}
 	go server.pinger(true)
 	if info.MaxIdleTimeMS != 0 {
 		go server.poolShrinker()
@@ -133,6 +175,23 @@ func (server *mongoServer) AcquireSocketWithBlocking(info *DialInfo) (socket *mo
 }
 
 func (server *mongoServer) acquireSocketInternal(info *DialInfo, shouldBlock bool) (socket *mongoSocket, abended bool, err error) {
+	if monitor := poolMonitor(); monitor != nil && monitor.ConnectionCheckOutFailed != nil {
+		defer func() {
+			if err == nil {
+				return
+			}
+			reason := PoolReasonError
+			switch err {
+			case errServerClosed:
+				reason = PoolReasonPoolClosed
+			case errPoolLimit:
+				reason = PoolReasonPoolLimit
+			case errPoolTimeout:
+				reason = PoolReasonTimeout
+			}
+			monitor.ConnectionCheckOutFailed(&PoolEvent{ServerAddress: server.Addr, Reason: reason})
+		}()
+	}
 	for {
 		server.Lock()
 		abended = server.abended
@@ -223,23 +282,49 @@ func (server *mongoServer) acquireSocketInternal(info *DialInfo, shouldBlock boo
 	}
 }
 
+// idleSocket returns an idle socket from the pool, acquired as AcquireSocket
+// would do, or nil if there's none. Unlike AcquireSocket, it never
+// establishes a new connection.
+func (server *mongoServer) idleSocket(info *DialInfo) *mongoSocket {
+	for {
+		server.Lock()
+		n := len(server.unusedSockets)
+		if server.closed || n == 0 {
+			server.Unlock()
+			return nil
+		}
+		socket := server.unusedSockets[n-1]
+		server.unusedSockets[n-1] = nil // Help GC.
+		server.unusedSockets = server.unusedSockets[:n-1]
+		serverInfo := server.info
+		server.Unlock()
+		if socket.InitialAcquire(serverInfo, info) == nil {
+			return socket
+		}
+	}
+}
+
 // Connect establishes a new connection to the server. This should
 // generally be done through server.AcquireSocket().
 func (server *mongoServer) Connect(info *DialInfo) (*mongoSocket, error) {
 	server.RLock()
 	master := server.info.Master
 	dial := server.dial
+	generation := server.generation
 	server.RUnlock()
 
+	if err := reserveConn(); err != nil {
+		logf("Not connecting to %s: %v", server.Addr, err)
+		return nil, err
+	}
+
 	logf("Establishing new connection to %s (timeout=%s)...", server.Addr, info.Timeout)
 	var conn net.Conn
 	var err error
 	switch {
 	case !dial.isSet():
 		conn, err = net.DialTimeout("tcp", server.ResolvedAddr, info.Timeout)
-		if tcpconn, ok := conn.(*net.TCPConn); ok {
-			tcpconn.SetKeepAlive(true)
-		} else if err == nil {
+		if _, ok := conn.(*net.TCPConn); !ok && err == nil {
 			panic("internal error: obtained TCP connection is not a *net.TCPConn!?")
 		}
 	case dial.old != nil:
@@ -250,13 +335,46 @@ func (server *mongoServer) Connect(info *DialInfo) (*mongoSocket, error) {
 		panic("dialer is set, but both dial.old and dial.new are nil")
 	}
 	if err != nil {
+		releaseConn()
 		logf("Connection to %s failed: %v", server.Addr, err.Error())
 		return nil, err
 	}
 	logf("Connection to %s established.", server.Addr)
+	if !dial.isSet() || info.KeepAlive != 0 {
+		// Connections made by custom dialers are left as configured
+		// there, unless a period is explicitly requested.
+		setKeepAlive(conn, info.KeepAlive)
+	}
 
 	stats.conn(+1, master)
-	return newSocket(server, conn, info), nil
+	socket := newSocket(server, conn, info)
+	socket.generation = generation
+	return socket, nil
+}
+
+// keepAliveConn is implemented by connections supporting TCP keepalive
+// probes, such as *net.TCPConn.
+type keepAliveConn interface {
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+}
+
+// setKeepAlive configures TCP keepalive probes on conn as defined by
+// period, if conn supports them. See DialInfo.KeepAlive.
+func setKeepAlive(conn net.Conn, period time.Duration) {
+	tcpconn, ok := conn.(keepAliveConn)
+	if !ok {
+		return
+	}
+	if period < 0 {
+		tcpconn.SetKeepAlive(false)
+		return
+	}
+	if period == 0 {
+		period = DefaultKeepAlive
+	}
+	tcpconn.SetKeepAlive(true)
+	tcpconn.SetKeepAlivePeriod(period)
 }
 
 // Close forces closing all sockets that are alive, whether
@@ -293,12 +411,41 @@ func (server *mongoServer) close(waitForIdle bool) {
 	}
 }
 
-// RecycleSocket puts socket back into the unused cache.
+// reconfigure makes the server dial new connections with dial from now on,
+// and starts a new generation of its pool. Idle sockets from the previous
+// generation are closed right away, and the ones in use are closed rather
+// than recycled once released, so in-flight operations complete on them
+// while still counting towards the pool limit.
+func (server *mongoServer) reconfigure(dial dialer, generation int) {
+	server.Lock()
+	server.dial = dial
+	server.generation = generation
+	unusedSockets := server.unusedSockets
+	server.unusedSockets = nil
+	for _, s := range unusedSockets {
+		server.liveSockets = removeSocket(server.liveSockets, s)
+	}
+	server.poolWaiter.Broadcast()
+	server.Unlock()
+	logf("Connections to %s reconfigured (%d idle sockets closing).", server.Addr, len(unusedSockets))
+	for _, s := range unusedSockets {
+		s.closeFor(PoolReasonStale)
+	}
+}
+
+// RecycleSocket puts socket back into the unused cache, or closes it if
+// the server was reconfigured since it was established.
 func (server *mongoServer) RecycleSocket(socket *mongoSocket) {
 	server.Lock()
+	stale := false
 	if !server.closed {
-		socket.lastTimeUsed = coarseTime.Now() // A rough approximation of the current time - see courseTime
-		server.unusedSockets = append(server.unusedSockets, socket)
+		if socket.generation != server.generation {
+			server.liveSockets = removeSocket(server.liveSockets, socket)
+			stale = true
+		} else {
+			socket.lastTimeUsed = coarseTime.Now() // A rough approximation of the current time - see courseTime
+			server.unusedSockets = append(server.unusedSockets, socket)
+		}
 	}
 	// If anybody is waiting for a connection, they should try now.
 	// Note that this _has_ to be broadcast, not signal; the signature of AcquireSocket
@@ -309,6 +456,9 @@ func (server *mongoServer) RecycleSocket(socket *mongoSocket) {
 	// is underneath their particular value for poolLimit.
 	server.poolWaiter.Broadcast()
 	server.Unlock()
+	if stale {
+		socket.closeFor(PoolReasonStale)
+	}
 }
 
 func removeSocket(sockets []*mongoSocket, socket *mongoSocket) []*mongoSocket {
@@ -349,6 +499,21 @@ func (server *mongoServer) SetInfo(info *mongoServerInfo) {
 	server.Unlock()
 }
 
+// BuildInfo returns the build details of the server cached with
+// SetBuildInfo, or nil if there are none.
+func (server *mongoServer) BuildInfo() *BuildInfo {
+	server.RLock()
+	defer server.RUnlock()
+	return server.buildInfo
+}
+
+// SetBuildInfo caches the build details of the server until it restarts.
+func (server *mongoServer) SetBuildInfo(info *BuildInfo) {
+	server.Lock()
+	server.buildInfo = info
+	server.Unlock()
+}
+
 func (server *mongoServer) Info() *mongoServerInfo {
 	server.Lock()
 	info := server.info
@@ -356,6 +521,22 @@ func (server *mongoServer) Info() *mongoServerInfo {
 	return info
 }
 
+// serverInfo returns the details of server given to server selectors.
+func (server *mongoServer) serverInfo() ServerInfo {
+	server.RLock()
+	defer server.RUnlock()
+	return ServerInfo{
+		Addr:           server.Addr,
+		Master:         server.info.Master,
+		Mongos:         server.info.Mongos,
+		Recovering:     server.recovering,
+		SetName:        server.info.SetName,
+		Tags:           server.info.Tags,
+		MaxWireVersion: server.info.MaxWireVersion,
+		PingTime:       server.pingValue,
+	}
+}
+
 func (server *mongoServer) hasTags(serverTags []bson.D) bool {
 NextTagSet:
 	for _, tags := range serverTags {
@@ -405,24 +586,15 @@ func (server *mongoServer) pinger(loop bool) {
 			start := time.Now()
 			_, _ = socket.SimpleQuery(&op)
 			delay := time.Since(start)
-
-			server.pingWindow[server.pingIndex] = delay
-			server.pingIndex = (server.pingIndex + 1) % len(server.pingWindow)
-			server.pingCount++
-			var max time.Duration
-			for i := 0; i < len(server.pingWindow) && uint32(i) < server.pingCount; i++ {
-				if server.pingWindow[i] > max {
-					max = server.pingWindow[i]
-				}
-			}
 			socket.Release()
-			server.Lock()
+
+			ping := server.recordPing(delay)
+			server.RLock()
 			if server.closed {
 				loop = false
 			}
-			server.pingValue = max
-			server.Unlock()
-			logf("Ping for %s is %d ms", server.Addr, max/time.Millisecond)
+			server.RUnlock()
+			logf("Ping for %s is %d ms", server.Addr, ping/time.Millisecond)
 		} else if err == errServerClosed {
 			return
 		}
@@ -432,6 +604,109 @@ func (server *mongoServer) pinger(loop bool) {
 	}
 }
 
+// syncFailed records that a topology check of the server failed, and
+// reports whether it has now failed at least threshold times in a row.
+func (server *mongoServer) syncFailed(threshold int) bool {
+	server.Lock()
+	defer server.Unlock()
+	server.syncFailures++
+	return server.syncFailures >= threshold
+}
+
+// syncSucceeded records that a topology check of the server succeeded,
+// resetting the count of consecutive failures.
+func (server *mongoServer) syncSucceeded() {
+	server.Lock()
+	server.syncFailures = 0
+	server.Unlock()
+}
+
+// The delay before a recovering server is synchronized again starts at
+// recoveringMinDelay and doubles on every attempt, up to recoveringMaxDelay.
+const (
+	recoveringMinDelay = time.Second
+	recoveringMaxDelay = syncServersDelay
+)
+
+// setRecovering records whether the server is in a transient state, such as
+// RECOVERING or ROLLBACK, in which it is a replica set member that can serve
+// neither reads nor writes. It returns the delay before the server should be
+// synchronized again, which grows while the server remains recovering.
+func (server *mongoServer) setRecovering(recovering bool) (delay time.Duration) {
+	server.Lock()
+	defer server.Unlock()
+	if !recovering {
+		server.recovering = false
+		server.recoverDelay = 0
+		server.recoverRetry = time.Time{}
+		return 0
+	}
+	if server.recoverDelay == 0 {
+		server.recoverDelay = recoveringMinDelay
+	} else if server.recoverDelay *= 2; server.recoverDelay > recoveringMaxDelay {
+		server.recoverDelay = recoveringMaxDelay
+	}
+	server.recovering = true
+	server.recoverRetry = time.Now().Add(server.recoverDelay)
+	return server.recoverDelay
+}
+
+// Recovering returns whether the server was found to be recovering when
+// last synchronized, and when it's due to be synchronized again.
+func (server *mongoServer) Recovering() (recovering bool, retry time.Time) {
+	server.RLock()
+	defer server.RUnlock()
+	return server.recovering, server.recoverRetry
+}
+
+// restartWindow is how long a server that closed a connection cleanly, as
+// servers do when shutting down, is given to answer again before it's
+// considered to be down.
+const restartWindow = time.Second
+
+// NoteRestart records that the server closed a connection cleanly, which
+// usually means it is restarting rather than unreachable.
+func (server *mongoServer) NoteRestart() {
+	server.Lock()
+	server.restartedAt = time.Now()
+	server.buildInfo = nil // It may have been upgraded.
+	server.Unlock()
+}
+
+// Restarted records that the server answered again after restarting.
+func (server *mongoServer) Restarted() {
+	server.Lock()
+	server.restartedAt = time.Time{}
+	server.Unlock()
+}
+
+// Restarting returns whether the server closed a connection cleanly within
+// the restart window, and thus may come back shortly.
+func (server *mongoServer) Restarting() bool {
+	server.RLock()
+	defer server.RUnlock()
+	return !server.restartedAt.IsZero() && time.Since(server.restartedAt) < restartWindow
+}
+
+// pingSmoothing is the weight given to the most recent round trip time
+// when updating the smoothed estimate kept in pingValue.
+const pingSmoothing = 0.2
+
+// recordPing folds rtt into the round trip time estimate of the server and
+// returns the updated estimate. The estimate is an exponentially weighted
+// moving average, so a single slow sample doesn't move it much.
+func (server *mongoServer) recordPing(rtt time.Duration) time.Duration {
+	server.Lock()
+	defer server.Unlock()
+	if server.pingCount == 0 {
+		server.pingValue = rtt
+	} else {
+		server.pingValue += time.Duration(pingSmoothing * float64(rtt-server.pingValue))
+	}
+	server.pingCount++
+	return server.pingValue
+}
+
 func (server *mongoServer) poolShrinker() {
 	ticker := time.NewTicker(1 * time.Minute)
 	for _ = range ticker.C {
@@ -474,8 +749,36 @@ func (server *mongoServer) poolShrinker() {
 		server.Unlock()
 
 		for _, s := range tbr {
-			s.Close()
+			s.closeFor(PoolReasonIdle)
+		}
+	}
+}
+
+// warm establishes new connections until the server has at least n idle
+// ones in its pool, or the pool limit in info is reached, so that they're
+// ready for use as soon as they're needed.
+func (server *mongoServer) warm(n int, info *DialInfo) {
+	for {
+		server.RLock()
+		done := server.closed || len(server.unusedSockets) >= n || info.PoolLimit > 0 && len(server.liveSockets) >= info.PoolLimit
+		server.RUnlock()
+		if done {
+			return
+		}
+		socket, err := server.Connect(info)
+		if err != nil {
+			return
+		}
+		server.Lock()
+		if server.closed {
+			server.Unlock()
+			socket.Release()
+			socket.Close()
+			return
 		}
+		server.liveSockets = append(server.liveSockets, socket)
+		server.Unlock()
+		socket.Release()
 	}
 }
 
@@ -505,6 +808,9 @@ func (s mongoServerSlice) Search(resolvedAddr string) (i int, ok bool) {
 	return i, i != n && s[i].ResolvedAddr == resolvedAddr
 }
 
+// mongoServers holds a set of servers sorted by their resolved address, so
+// that they are always iterated over in the same order no matter in which
+// order they were discovered.
 type mongoServers struct {
 	slice mongoServerSlice
 }
@@ -557,15 +863,73 @@ func (servers *mongoServers) HasMongos() bool {
 	return false
 }
 
+// RecoveringLen returns how many of the servers are recovering.
+func (servers *mongoServers) RecoveringLen() (n int) {
+	for _, s := range servers.slice {
+		if recovering, _ := s.Recovering(); recovering {
+			n++
+		}
+	}
+	return n
+}
+
+// Standby returns the secondary most suitable for keeping connections ready
+// for the case it's elected as the new primary, which is the nearest one in
+// the seed group with the highest priority, or nil if there's none.
+func (servers *mongoServers) Standby() *mongoServer {
+	var best *mongoServer
+	var priority int
+	var nearest time.Duration
+	for _, next := range servers.slice {
+		next.RLock()
+		switch {
+		case next.recovering || next.info.Master || next.info.Mongos:
+		case best == nil || next.groupPriority > priority || next.groupPriority == priority && next.pingValue < nearest:
+			best = next
+			priority = next.groupPriority
+			nearest = next.pingValue
+		}
+		next.RUnlock()
+	}
+	return best
+}
+
 // BestFit returns the best guess of what would be the most interesting
 // server to perform operations on at this point in time.
-func (servers *mongoServers) BestFit(mode Mode, serverTags []bson.D) *mongoServer {
+//
+// Only servers in the seed group with the highest priority that has a
+// usable server are considered. Servers whose round trip times differ by
+// no more than threshold are considered equally near. In the Nearest mode,
+// only servers within threshold of the nearest one are eligible.
+func (servers *mongoServers) BestFit(mode Mode, serverTags []bson.D, threshold time.Duration) *mongoServer {
+	var priority int
+	var nearest time.Duration = -1
+	found := false
+	for _, next := range servers.slice {
+		next.RLock()
+		switch {
+		case next.recovering:
+		case len(serverTags) != 0 && !next.info.Mongos && !next.hasTags(serverTags):
+		case mode == Secondary && next.info.Master && !next.info.Mongos:
+		case !found || next.groupPriority > priority:
+			found = true
+			priority = next.groupPriority
+			nearest = next.pingValue
+		case next.groupPriority == priority && next.pingValue < nearest:
+			nearest = next.pingValue
+		}
+		next.RUnlock()
+	}
+	if mode != Nearest {
+		nearest = -1
+	}
 	var best *mongoServer
+	ties := 1 // Servers as suitable as best seen so far.
 	for _, next := range servers.slice {
 		if best == nil {
 			best = next
 			best.RLock()
-			if len(serverTags) != 0 && !next.info.Mongos && !best.hasTags(serverTags) {
+			if best.recovering || len(serverTags) != 0 && !next.info.Mongos && !best.hasTags(serverTags) || best.groupPriority < priority || nearest >= 0 && best.pingValue > nearest+threshold {
 				best.RUnlock()
 				best = nil
 			}
@@ -574,21 +938,37 @@ func (servers *mongoServers) BestFit(mode Mode, serverTags []bson.D) *mongoServe
 		next.RLock()
 		swap := false
 		switch {
+		case next.recovering:
+			// Can't serve operations until it recovers.
 		case len(serverTags) != 0 && !next.info.Mongos && !next.hasTags(serverTags):
 			// Must have requested tags.
 		case mode == Secondary && next.info.Master && !next.info.Mongos:
 			// Must be a secondary or mongos.
+		case next.groupPriority < priority:
+			// Must be in the preferred seed group.
+		case nearest >= 0 && next.pingValue > nearest+threshold:
+			// Must be within the local threshold of the nearest server.
 		case next.info.Master != best.info.Master && mode != Nearest:
 			// Prefer slaves, unless the mode is PrimaryPreferred.
 			swap = (mode == PrimaryPreferred) != best.info.Master
-		case absDuration(next.pingValue-best.pingValue) > 15*time.Millisecond:
+		case absDuration(next.pingValue-best.pingValue) > threshold:
 			// Prefer nearest server.
 			swap = next.pingValue < best.pingValue
 		case len(next.liveSockets)-len(next.unusedSockets) < len(best.liveSockets)-len(best.unusedSockets):
 			// Prefer servers with less connections.
 			swap = true
+		case mode == Nearest && len(next.liveSockets)-len(next.unusedSockets) == len(best.liveSockets)-len(best.unusedSockets):
+			// Pick randomly among equally suitable servers, so the load
+			// is spread in the Nearest mode.
+			ties++
+			if selectionIntn(ties) == 0 {
+				best.RUnlock()
+				best = next
+				continue
+			}
 		}
 		if swap {
+			ties = 1
 			best.RUnlock()
 			best = next
 		} else {
@@ -601,6 +981,31 @@ func (servers *mongoServers) BestFit(mode Mode, serverTags []bson.D) *mongoServe
 	return best
 }
 
+var (
+	selectionMutex sync.Mutex
+	selectionRand  = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// SetSelectionRand sets the source of randomness used to pick among
+// equally suitable servers when selecting one for an operation. Given
+// a source with a fixed seed, such as rand.NewSource(1), server selection
+// becomes deterministic, which is useful for reproducible tests. Setting
+// it to nil restores the default source, seeded with the current time.
+func SetSelectionRand(src rand.Source) {
+	if src == nil {
+		src = rand.NewSource(time.Now().UnixNano())
+	}
+	selectionMutex.Lock()
+	selectionRand = rand.New(src)
+	selectionMutex.Unlock()
+}
+
+func selectionIntn(n int) int {
+	selectionMutex.Lock()
+	defer selectionMutex.Unlock()
+	return selectionRand.Intn(n)
+}
+
 func absDuration(d time.Duration) time.Duration {
 	if d < 0 {
 		return -d
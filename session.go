@@ -35,6 +35,7 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"math"
 	"net"
 	"net/url"
@@ -81,6 +82,12 @@ const (
 	// To override this value set DialInfo.PoolLimit.
 	DefaultConnectionPoolLimit = 4096
 
+	// DefaultKeepAlive defines the default period between TCP keepalive
+	// probes sent on idle connections.
+	//
+	// To override this value set DialInfo.KeepAlive.
+	DefaultKeepAlive = 2 * time.Minute
+
 	zeroDuration = time.Duration(0)
 )
 
@@ -109,7 +116,19 @@ type Session struct {
 	m                sync.RWMutex
 	queryConfig      query
 	bypassValidation bool
+	writeInterceptor WriteInterceptor
+	registry         Registry
+	frozen           *TopologySnapshot
 	slaveOk          bool
+	retryReads       bool
+	maxTimeMS        int
+	slowOps          *slowOpWatch
+	lsid             *serverSession
+	txn              *transaction
+	lastError        *LastError // Result of the most recent write.
+	lastRequestId    uint32
+	allowedDbs       map[string]bool
+	allowedNs        map[string]bool
 
 	dialInfo *DialInfo
 }
@@ -142,12 +161,25 @@ type Query struct {
 	m       sync.Mutex
 	session *Session
 	query   // Enables default settings in session.
+
+	mode    Mode // Read preference mode, if hasMode is set.
+	hasMode bool
+	tags    *queryTags
+}
+
+// queryTags holds the server tags selecting the server a query is sent to,
+// overriding the ones of the session. See Query.SetReadTags.
+type queryTags struct {
+	tags     []bson.D
+	fallback bool
 }
 
 type query struct {
 	op       queryOp
 	prefetch float64
 	limit    int32
+
+	decodeFields map[string]bool // Set with Query.DecodeOnly.
 }
 
 type getLastError struct {
@@ -181,6 +213,10 @@ type Iter struct {
 	isFindCmd      bool
 	isChangeStream bool
 	maxTimeMS      int64
+	comment        string
+	raw            []byte    // Undecoded data of the last result from Next.
+	lsid           *bson.Raw // Logical session the cursor was created in.
+	decodeFields   map[string]bool
 }
 
 var (
@@ -189,6 +225,28 @@ var (
 	// ErrCursor error returned when trying to retrieve documents from
 	// an invalid cursor
 	ErrCursor = errors.New("invalid cursor")
+	// ErrTopologyChanged error returned when the server an operation
+	// would be sent to doesn't match the topology frozen with
+	// Session.FreezeTopology
+	ErrTopologyChanged = errors.New("topology changed since it was frozen")
+	// ErrNoPrimary error returned when a socket to the primary was
+	// requested on a session set to fail fast without a primary (see
+	// Session.SetFailFastNoPrimary) while none is known. This usually
+	// means an election is in progress, so the operation may be retried
+	// shortly.
+	ErrNoPrimary = errors.New("no primary available, election likely in progress")
+
+	errCollationNotSupported        = errors.New("collation requires MongoDB 3.4 or newer")
+	errBypassValidationNotSupported = errors.New("bypassing document validation requires MongoDB 3.2 or newer")
+	errArrayFiltersNotSupported     = errors.New("array filters require MongoDB 3.6 or newer")
+	errValidatorNotSupported        = errors.New("document validation requires MongoDB 3.2 or newer")
+	errLinearizableSecondary        = errors.New("linearizable read concern may not be used with Secondary mode")
+	errMajorityUnknown              = errors.New("cannot tell how many members make a majority of the replica set")
+	errTextScoreWithoutText         = errors.New("text score requires a text search (see Query.Text)")
+	errTextSearchHint               = errors.New("text search can't be used with a hint")
+	errTextSearchNatural            = errors.New("text search can't be sorted in natural order")
+	errTextSearchSnapshot           = errors.New("text search can't be used with snapshot mode")
+	errTextSearchTailable           = errors.New("text search can't be used with a tailable cursor")
 )
 
 const (
@@ -290,6 +348,12 @@ const (
 //        before being removed and closed. If maxIdleTimeMS is 0, connections will never be
 //        closed due to inactivity.
 //
+//     localThresholdMS=<millisecond>
+//
+//        How much farther than the nearest server, in milliseconds of round trip
+//        time, a server may be and still be used for reads in the Nearest mode.
+//        Defaults to 15.
+//
 //     appName=<appName>
 //
 //        The identifier of this client application. This parameter is used to
@@ -350,6 +414,7 @@ func ParseURL(url string) (*DialInfo, error) {
 	var readPreferenceTagSets []bson.D
 	minPoolSize := 0
 	maxIdleTimeMS := 0
+	var localThreshold time.Duration
 	safe := Safe{}
 	for _, opt := range uinfo.options {
 		switch opt.key {
@@ -434,6 +499,15 @@ func ParseURL(url string) (*DialInfo, error) {
 			if maxIdleTimeMS < 0 {
 				return nil, errors.New("bad value (negative) for maxIdleTimeMS: " + opt.value)
 			}
+		case "localThresholdMS":
+			threshold, err := strconv.Atoi(opt.value)
+			if err != nil {
+				return nil, errors.New("bad value for localThresholdMS: " + opt.value)
+			}
+			if threshold < 0 {
+				return nil, errors.New("bad value (negative) for localThresholdMS: " + opt.value)
+			}
+			localThreshold = time.Duration(threshold) * time.Millisecond
 		case "connect":
 			if opt.value == "direct" {
 				direct = true
@@ -471,6 +545,7 @@ func ParseURL(url string) (*DialInfo, error) {
 		ReplicaSetName: setName,
 		MinPoolSize:    minPoolSize,
 		MaxIdleTimeMS:  maxIdleTimeMS,
+		LocalThreshold: localThreshold,
 	}
 	if ssl && info.DialServer == nil {
 		// Set DialServer only if nil, we don't want to override user's settings.
@@ -528,6 +603,12 @@ type DialInfo struct {
 	Username string
 	Password string
 
+	// Authenticator optionally defines how every new connection is
+	// authenticated, before the credentials of sessions are applied to it.
+	// Unlike with Session.Login, the authentication lasts for as long as
+	// the connection does. See the Authenticator interface.
+	Authenticator Authenticator
+
 	// PoolLimit defines the per-server socket pool limit. Defaults to
 	// DefaultConnectionPoolLimit. See Session.SetPoolLimit for details.
 	PoolLimit int
@@ -577,11 +658,25 @@ type DialInfo struct {
 	// distinguish it from a slow server, so the timeout stays relevant.
 	FailFast bool
 
+	// FailFastNoPrimary causes operations requiring the primary to fail
+	// with ErrNoPrimary when none is currently known, rather than waiting
+	// for one to be elected. See Session.SetFailFastNoPrimary for details.
+	FailFastNoPrimary bool
+
 	// Direct informs whether to establish connections only with the
 	// specified seed servers, or to obtain information for the whole
 	// cluster and establish connections with further servers too.
 	Direct bool
 
+	// KeepAlive defines the period between TCP keepalive probes sent on
+	// idle connections, so that connections silently dropped by load
+	// balancers or NAT devices are detected before they're next used.
+	// Defaults to DefaultKeepAlive on connections made by the driver,
+	// while connections made by DialServer are left as that function
+	// configured them. A negative value disables keepalive probes. See
+	// Session.SetKeepAlive for details.
+	KeepAlive time.Duration
+
 	// MinPoolSize defines The minimum number of connections in the connection pool.
 	// Defaults to 0.
 	MinPoolSize int
@@ -590,6 +685,68 @@ type DialInfo struct {
 	// before being removed and closed.
 	MaxIdleTimeMS int
 
+	// StandbyPoolSize defines how many idle connections are kept open to a
+	// secondary of a replica set, so that writes may be sent over them as
+	// soon as the secondary is elected as the new primary, rather than
+	// waiting for new connections to be established after the failover.
+	// The secondary is the nearest one in the seed group with the highest
+	// priority, and its connections are opened again as needed whenever the
+	// cluster topology is checked. Defaults to zero, keeping no standby
+	// connections.
+	StandbyPoolSize int
+
+	// LocalThreshold defines how much farther than the nearest server, in
+	// terms of smoothed round trip time, a server may be and still be picked
+	// for reads in the Nearest mode. Defaults to 15 milliseconds.
+	LocalThreshold time.Duration
+
+	// SyncFailureThreshold defines how many topology checks of a known
+	// server, the periodic heartbeats made with the hello or isMaster
+	// commands, must fail in a row before the server is removed from the
+	// cluster. The count is reset whenever a check succeeds, so momentary
+	// network blips may be tolerated without hiding real outages.
+	// Defaults to 1, removing servers on the first failure.
+	SyncFailureThreshold int
+
+	// RetryBudgetRatio and RetryBudgetBurst define the budget limiting
+	// retries to a fraction of the operations performed on the cluster,
+	// so that retries don't amplify the load on a cluster that is already
+	// struggling. Every read run by a session retrying reads, outside of
+	// transactions, adds the ratio to the budget, up to the burst, and
+	// every retry takes one from it.
+	// Once less than one is left, operations fail without being retried
+	// until enough operations refill the budget. The budget starts full.
+	//
+	// The ratio defaults to 0.1, and the burst to 10. A ratio of 1 or
+	// more never denies retries. Denied retries are counted in
+	// Stats.RetriesDenied. See Session.SetRetryReads.
+	RetryBudgetRatio float64
+	RetryBudgetBurst int
+
+	// MaxDiscoveryDepth limits how far the servers advertised by other
+	// servers are followed when discovering the cluster topology, in hops
+	// away from the seeds. With a depth of 1, only servers advertised by
+	// the seeds themselves are discovered. Set it to SeedsOnlyDiscovery to
+	// only ever talk to the seeds. Defaults to zero, imposing no limit.
+	//
+	// This keeps discovery bounded when servers advertise host lists that
+	// are misconfigured or can't be trusted.
+	MaxDiscoveryDepth int
+
+	// SeedGroups optionally groups servers by priority, so that reads are
+	// sent to servers in the group with the highest priority that has a
+	// usable server, falling back to lower priority groups only when none
+	// of the servers in higher priority groups qualify. Servers in no group
+	// have priority zero. The addresses in the groups are seeds as well.
+	//
+	// This is useful, for instance, to keep reads within the members of a
+	// local region while any of them is available.
+	SeedGroups []SeedGroup
+
+	// ServerSelector optionally replaces the built-in selection of the
+	// server new connections are acquired from. See ServerSelector.
+	ServerSelector ServerSelector
+
 	// DialServer optionally specifies the dial function for establishing
 	// connections with the MongoDB servers.
 	DialServer func(addr *ServerAddr) (net.Conn, error)
@@ -598,6 +755,13 @@ type DialInfo struct {
 	Dial func(addr net.Addr) (net.Conn, error)
 }
 
+// SeedGroup holds the addresses of servers sharing the same priority.
+// See DialInfo.SeedGroups for details.
+type SeedGroup struct {
+	Priority int
+	Addrs    []string
+}
+
 // Copy returns a deep-copy of i.
 func (i *DialInfo) Copy() *DialInfo {
 	var readPreference *ReadPreference
@@ -619,6 +783,7 @@ func (i *DialInfo) Copy() *DialInfo {
 		Mechanism:      i.Mechanism,
 		Username:       i.Username,
 		Password:       i.Password,
+		Authenticator:  i.Authenticator,
 		PoolLimit:      i.PoolLimit,
 		PoolTimeout:    i.PoolTimeout,
 		ReadTimeout:    i.ReadTimeout,
@@ -627,18 +792,74 @@ func (i *DialInfo) Copy() *DialInfo {
 		ReadPreference: readPreference,
 		FailFast:       i.FailFast,
 		Direct:         i.Direct,
+		KeepAlive:      i.KeepAlive,
 		MinPoolSize:    i.MinPoolSize,
 		MaxIdleTimeMS:  i.MaxIdleTimeMS,
+		LocalThreshold: i.LocalThreshold,
 		DialServer:     i.DialServer,
 		Dial:           i.Dial,
+
+		FailFastNoPrimary:    i.FailFastNoPrimary,
+		RetryBudgetRatio:     i.RetryBudgetRatio,
+		RetryBudgetBurst:     i.RetryBudgetBurst,
+		SyncFailureThreshold: i.SyncFailureThreshold,
+		MaxDiscoveryDepth:    i.MaxDiscoveryDepth,
+		StandbyPoolSize:      i.StandbyPoolSize,
+		ServerSelector:       i.ServerSelector,
 	}
 
 	info.Addrs = make([]string, len(i.Addrs))
 	copy(info.Addrs, i.Addrs)
 
+	if i.SeedGroups != nil {
+		info.SeedGroups = make([]SeedGroup, len(i.SeedGroups))
+		for j, group := range i.SeedGroups {
+			info.SeedGroups[j].Priority = group.Priority
+			info.SeedGroups[j].Addrs = make([]string, len(group.Addrs))
+			copy(info.SeedGroups[j].Addrs, group.Addrs)
+		}
+	}
+
 	return info
 }
 
+// defaultLocalThreshold is the LocalThreshold used when it's not set.
+const defaultLocalThreshold = 15 * time.Millisecond
+
+// localThreshold returns the configured local threshold, or
+// defaultLocalThreshold if it's not set.
+func (i *DialInfo) localThreshold() time.Duration {
+	if i.LocalThreshold == zeroDuration {
+		return defaultLocalThreshold
+	}
+	return i.LocalThreshold
+}
+
+// SeedsOnlyDiscovery may be used as the MaxDiscoveryDepth so that none of
+// the servers advertised by the seeds are discovered.
+const SeedsOnlyDiscovery = -1
+
+// discoverableDepth returns whether servers may be discovered at the given
+// depth, in hops away from the seeds, according to MaxDiscoveryDepth.
+func (i *DialInfo) discoverableDepth(depth int) bool {
+	switch {
+	case i.MaxDiscoveryDepth == 0:
+		return true
+	case i.MaxDiscoveryDepth < 0:
+		return depth == 0
+	}
+	return depth <= i.MaxDiscoveryDepth
+}
+
+// syncFailureThreshold returns the configured sync failure threshold,
+// or 1 if it's not set.
+func (i *DialInfo) syncFailureThreshold() int {
+	if i.SyncFailureThreshold < 1 {
+		return 1
+	}
+	return i.SyncFailureThreshold
+}
+
 // readTimeout returns the configured read timeout, or i.Timeout if it's not set
 func (i *DialInfo) readTimeout() time.Duration {
 	if i.ReadTimeout == zeroDuration {
@@ -706,14 +927,23 @@ func DialWithInfo(dialInfo *DialInfo) (*Session, error) {
 	info.ReadTimeout = info.readTimeout()
 	info.WriteTimeout = info.writeTimeout()
 
-	addrs := make([]string, len(info.Addrs))
-	for i, addr := range info.Addrs {
+	withPort := func(addr string) string {
 		p := strings.LastIndexAny(addr, "]:")
 		if p == -1 || addr[p] != ':' {
 			// XXX This is untested. The test suite doesn't use the standard port.
 			addr += ":27017"
 		}
-		addrs[i] = addr
+		return addr
+	}
+	addrs := make([]string, len(info.Addrs))
+	for i, addr := range info.Addrs {
+		addrs[i] = withPort(addr)
+	}
+	for _, group := range info.SeedGroups {
+		for i, addr := range group.Addrs {
+			group.Addrs[i] = withPort(addr)
+			addrs = append(addrs, group.Addrs[i])
+		}
 	}
 	cluster := newCluster(addrs, info)
 	session := newSession(Eventual, cluster, info)
@@ -871,8 +1101,18 @@ func copySession(session *Session, keepCreds bool) (s *Session) {
 		m:                sync.RWMutex{},
 		queryConfig:      session.queryConfig,
 		bypassValidation: session.bypassValidation,
+		writeInterceptor: session.writeInterceptor,
+		registry:         session.registry,
+		frozen:           session.frozen,
 		slaveOk:          session.slaveOk,
-		dialInfo:         session.dialInfo,
+		retryReads:       session.retryReads,
+		maxTimeMS:        session.maxTimeMS,
+		slowOps:          session.slowOps,
+		allowedDbs:       session.allowedDbs,
+		allowedNs:        session.allowedNs,
+		// Settings such as the pool limit and timeouts are kept in the
+		// dial info, so each copy needs its own.
+		dialInfo: session.dialInfo.Copy(),
 	}
 	s = &scopy
 	debugf("New session %p on cluster %p (copy from %p)", s, cluster, session)
@@ -888,6 +1128,236 @@ func (s *Session) LiveServers() (addrs []string) {
 	return addrs
 }
 
+// TopologySnapshot holds the servers known to a session at a given time.
+type TopologySnapshot struct {
+	Primary string       // Address of the primary, or empty if there's none
+	Servers []string     // Addresses of all servers, the primary included
+	Details []ServerInfo // Details of all servers, in the order of Servers
+}
+
+// TopologyType is the kind of deployment a session is connected to, as
+// found while discovering the servers.
+type TopologyType int
+
+const (
+	// TopologyUnknown is reported before any server was found, and
+	// while no server can be reached.
+	TopologyUnknown TopologyType = iota
+
+	// TopologySingle is a standalone server.
+	TopologySingle
+
+	// TopologyReplicaSet is a replica set, with or without a primary.
+	TopologyReplicaSet
+
+	// TopologySharded is a sharded cluster, with the servers known to
+	// the session being mongos routers.
+	TopologySharded
+)
+
+var topologyNames = []string{"unknown", "single", "replica set", "sharded"}
+
+func (t TopologyType) String() string {
+	if t < 0 || int(t) >= len(topologyNames) {
+		return fmt.Sprintf("TopologyType(%d)", int(t))
+	}
+	return topologyNames[t]
+}
+
+// ServerInfo holds the details of a server known to the cluster.
+type ServerInfo struct {
+	Addr           string
+	Master         bool // Whether the server is the primary or a mongos
+	Mongos         bool
+	Recovering     bool // Whether the server is in the RECOVERING state
+	SetName        string
+	Tags           bson.D
+	MaxWireVersion int
+	PingTime       time.Duration
+}
+
+// ServerSelector picks the server a new connection is acquired from among
+// the servers in snapshot, replacing the built-in selection based on the
+// session mode, the server tags and the ping times. The write parameter
+// tells whether the connection must be to the primary, for writes and for
+// reads in the Strong and Monotonic modes once they switched to it.
+//
+// The selector returns one of the servers in snapshot.Details, or nil if
+// none is suitable, in which case the cluster topology is checked again
+// and the selector called anew until the session sync timeout expires.
+// Selection only happens once the cluster has servers suitable for the
+// operation, but the selector must not rely on the chosen server being
+// the primary when write is true. The cluster still acquires the
+// connection, and a server not answering is removed from the topology
+// before the selector is called again.
+//
+// The selector is called synchronously whenever a session needs a new
+// connection, so it should return quickly, and it must not use sessions.
+// As with the built-in selection, sessions keep using the connections they
+// reserved according to their mode until refreshed.
+type ServerSelector func(snapshot *TopologySnapshot, write bool) *ServerInfo
+
+// errNoServerSelected is returned when the server selector picked no
+// known server before the sync timeout expired.
+var errNoServerSelected = errors.New("no server selected by the server selector")
+
+// TopologySnapshot returns the servers the session currently knows about.
+func (s *Session) TopologySnapshot() *TopologySnapshot {
+	s.m.RLock()
+	cluster := s.cluster()
+	s.m.RUnlock()
+
+	cluster.RLock()
+	defer cluster.RUnlock()
+	return cluster.snapshot()
+}
+
+// TopologyType returns the kind of deployment the session is connected to,
+// as found so far while discovering its servers. It's TopologyUnknown
+// until the first server is found, and while no server can be reached.
+//
+// For example, an application may only use transactions where they're
+// supported:
+//
+//     switch session.TopologyType() {
+//     case mgo.TopologyReplicaSet, mgo.TopologySharded:
+//         // Use transactions.
+//     }
+//
+func (s *Session) TopologyType() TopologyType {
+	s.m.RLock()
+	cluster := s.cluster()
+	s.m.RUnlock()
+	return cluster.TopologyType()
+}
+
+// FreezeTopology takes a snapshot of the servers known to the session, and
+// restricts the operations it performs to them until UnfreezeTopology is
+// called. Rather than being silently routed elsewhere, an operation fails
+// with ErrTopologyChanged if it must be sent to the primary and the primary
+// in the snapshot isn't the primary anymore, or if the server selected for
+// it isn't in the snapshot. Operations also fail as usual if a server in
+// the snapshot becomes unavailable.
+//
+// This suits jobs that favor predictability over availability, and that
+// must treat the topology as fixed for their whole duration. The snapshot
+// is taken once the session has found a primary, and is inherited by the
+// sessions created from this one with Copy, Clone or New afterwards.
+func (s *Session) FreezeTopology() (*TopologySnapshot, error) {
+	s.m.RLock()
+	cluster := s.cluster()
+	syncTimeout := s.syncTimeout
+	info := s.dialInfo
+	s.m.RUnlock()
+
+	// Wait for the primary to be known, without reserving a socket.
+	socket, err := cluster.AcquireSocketWithPoolTimeout(Primary, false, syncTimeout, nil, info)
+	if err != nil {
+		return nil, err
+	}
+	socket.Release()
+
+	snapshot := s.TopologySnapshot()
+	if snapshot.Primary == "" {
+		return nil, errors.New("no primary to freeze the topology with")
+	}
+	s.m.Lock()
+	s.frozen = snapshot
+	s.m.Unlock()
+	return snapshot, nil
+}
+
+// UnfreezeTopology lifts the restrictions set with FreezeTopology.
+func (s *Session) UnfreezeTopology() {
+	s.m.Lock()
+	s.frozen = nil
+	s.m.Unlock()
+}
+
+// checkFrozen returns ErrTopologyChanged if socket doesn't match the
+// topology frozen with FreezeTopology, if any.
+func (s *Session) checkFrozen(socket *mongoSocket, slaveOk bool) error {
+	s.m.RLock()
+	frozen := s.frozen
+	s.m.RUnlock()
+	if frozen == nil {
+		return nil
+	}
+	server := socket.Server()
+	if server == nil {
+		return ErrTopologyChanged
+	}
+	if !slaveOk {
+		if server.Addr != frozen.Primary || !server.Info().Master {
+			return ErrTopologyChanged
+		}
+		return nil
+	}
+	for _, addr := range frozen.Servers {
+		if server.Addr == addr {
+			return nil
+		}
+	}
+	return ErrTopologyChanged
+}
+
+// PinPrimary forces the operations that must be sent to the primary,
+// including all writes, to go to the server at addr until UnpinPrimary
+// is called. An error is returned unless the server is currently known
+// to be the primary. If the server later stops being the primary, the
+// pin is cleared and the primary is selected as usual once again.
+//
+// The pin is shared by all sessions created from the same original
+// session, and applies to sockets acquired after PinPrimary returns.
+// Call Refresh to release a socket the session may already be holding.
+//
+// This is an operational override meant for controlled maintenance and
+// failover testing, and shouldn't be needed otherwise.
+func (s *Session) PinPrimary(addr string) error {
+	s.m.RLock()
+	cluster := s.cluster()
+	s.m.RUnlock()
+	return cluster.PinPrimary(addr)
+}
+
+// UnpinPrimary clears the pin set with PinPrimary, if any, restoring the
+// normal selection of the primary.
+func (s *Session) UnpinPrimary() {
+	s.m.RLock()
+	cluster := s.cluster()
+	s.m.RUnlock()
+	cluster.UnpinPrimary()
+}
+
+// VotingMembers returns the number of data-bearing replica set members the
+// session currently sees alive, which bounds the number of members that
+// may acknowledge a write. For example, a write concern with W set to 2
+// can't be satisfied while fewer than 2 members are alive. Members with
+// no votes can't be told apart from the other members and are counted
+// as well, so see Session.ReplicaSetConfig for the exact votes of each
+// member. Zero is returned when not connected to a replica set.
+func (s *Session) VotingMembers() int {
+	s.m.RLock()
+	cluster := s.cluster()
+	s.m.RUnlock()
+	return cluster.VotingMembers()
+}
+
+// ProbeSeeds tests the connectivity to each of the seed servers provided
+// when dialing, as opposed to the servers discovered from them, reporting
+// for each one whether it's reachable and the role it plays. The seeds
+// are probed concurrently, each within the given timeout.
+//
+// This is meant as a diagnostic tool, and it neither depends on nor
+// changes the servers known to the session, so it may be used even when
+// the session has no reachable servers.
+func (s *Session) ProbeSeeds(timeout time.Duration) []SeedStatus {
+	s.m.RLock()
+	cluster := s.cluster()
+	s.m.RUnlock()
+	return cluster.Probe(timeout)
+}
+
 // DB returns a value representing the named database. If name
 // is empty, the database name provided in the dialed URL is
 // used instead. If that is also empty, "test" is used as a
@@ -989,7 +1459,10 @@ func (db *Database) GridFS(prefix string) *GridFS {
 //     http://www.mongodb.org/display/DOCS/List+of+Database+CommandSkips
 //
 func (db *Database) Run(cmd interface{}, result interface{}) error {
-	socket, err := db.Session.acquireSocket(true)
+	if err := db.Session.checkCommand(db.Name, cmd); err != nil {
+		return err
+	}
+	socket, err := db.Session.acquireSocket(!primaryCommands[commandName(cmd)])
 	if err != nil {
 		return err
 	}
@@ -999,6 +1472,72 @@ func (db *Database) Run(cmd interface{}, result interface{}) error {
 	return db.run(socket, cmd, result)
 }
 
+// RunOnPrimary works like Run, but always sends the command to the primary
+// server, regardless of the session consistency mode. As with writes, a
+// session in Monotonic mode switches over to the primary afterwards.
+//
+// Run already does this for commands which may only run on the primary,
+// such as write, index, user management and replSetStepDown commands,
+// when the command is provided as a string, a bson.D, or a single key
+// bson.M value.
+func (db *Database) RunOnPrimary(cmd interface{}, result interface{}) error {
+	if err := db.Session.checkCommand(db.Name, cmd); err != nil {
+		return err
+	}
+	socket, err := db.Session.acquireSocket(false)
+	if err != nil {
+		return err
+	}
+	defer socket.Release()
+	return db.run(socket, cmd, result)
+}
+
+// primaryCommands holds the names of commands that may only be run on
+// the primary server.
+var primaryCommands = map[string]bool{
+	"insert":                   true,
+	"update":                   true,
+	"delete":                   true,
+	"findAndModify":            true,
+	"findandmodify":            true,
+	"create":                   true,
+	"drop":                     true,
+	"dropDatabase":             true,
+	"createIndexes":            true,
+	"dropIndexes":              true,
+	"renameCollection":         true,
+	"collMod":                  true,
+	"convertToCapped":          true,
+	"createUser":               true,
+	"updateUser":               true,
+	"dropUser":                 true,
+	"dropAllUsersFromDatabase": true,
+	"grantRolesToUser":         true,
+	"revokeRolesFromUser":      true,
+	"createRole":               true,
+	"dropRole":                 true,
+	"replSetStepDown":          true,
+}
+
+// commandName returns the name of cmd, if easily known, or an empty string.
+func commandName(cmd interface{}) string {
+	switch cmd := cmd.(type) {
+	case string:
+		return cmd
+	case bson.D:
+		if len(cmd) > 0 {
+			return cmd[0].Name
+		}
+	case bson.M:
+		if len(cmd) == 1 {
+			for name := range cmd {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
 // runOnSocket does the same as Run, but guarantees that your command will be run
 // on the provided socket instance; if it's unhealthy, you will receive the error
 // from it.
@@ -1053,7 +1592,9 @@ func (db *Database) Login(user, pass string) error {
 // Login authenticates with MongoDB using the provided credential.  The
 // authentication is valid for the whole session and will stay valid until
 // Logout is explicitly called for the same database, or the session is
-// closed.
+// closed. The credential is replayed on every new connection established
+// for the session, including those replacing connections lost when the
+// servers become unreachable.
 func (s *Session) Login(cred *Credential) error {
 	socket, err := s.acquireSocket(true)
 	if err != nil {
@@ -1061,15 +1602,34 @@ func (s *Session) Login(cred *Credential) error {
 	}
 	defer socket.Release()
 
+	credCopy, err := s.resolveCredential(cred)
+	if err != nil {
+		return err
+	}
+	err = socket.Login(credCopy)
+	if err != nil {
+		return err
+	}
+
+	s.m.Lock()
+	s.creds = append(s.creds, credCopy)
+	s.m.Unlock()
+	return nil
+}
+
+// resolveCredential returns a copy of cred with the user name and mechanism
+// taken from its certificate, if any, and with its default source set.
+func (s *Session) resolveCredential(cred *Credential) (Credential, error) {
 	credCopy := *cred
 	if cred.Certificate != nil && cred.Username != "" {
-		return errors.New("failed to login, both certificate and credentials are given")
+		return credCopy, errors.New("failed to login, both certificate and credentials are given")
 	}
 
 	if cred.Certificate != nil {
+		var err error
 		credCopy.Username, err = getRFC2253NameStringFromCert(cred.Certificate)
 		if err != nil {
-			return err
+			return credCopy, err
 		}
 		credCopy.Mechanism = "MONGODB-X509"
 		credCopy.Source = "$external"
@@ -1082,20 +1642,60 @@ func (s *Session) Login(cred *Credential) error {
 			credCopy.Source = s.sourcedb
 		}
 	}
-	err = socket.Login(credCopy)
-	if err != nil {
-		return err
-	}
+	return credCopy, nil
+}
 
-	s.m.Lock()
-	s.creds = append(s.creds, credCopy)
-	s.m.Unlock()
+// Reconfiguration holds the connection settings replaced by
+// Session.Reconfigure. Settings left unset are kept as they are.
+type Reconfiguration struct {
+	// DialServer replaces the function used to establish connections,
+	// for example to use a new TLS configuration.
+	DialServer func(addr *ServerAddr) (net.Conn, error)
+
+	// Authenticator replaces DialInfo.Authenticator.
+	Authenticator Authenticator
+
+	// Credentials replace the ones used by sessions for the same user
+	// and database, whether provided in DialInfo or with Login, for
+	// example after their password was rotated.
+	Credentials []Credential
+}
+
+// Reconfigure replaces the connection settings of the pool shared by the
+// session and all sessions created from it with Copy, Clone or New, without
+// closing them. Operations in progress complete on the sockets they're
+// using, which are closed once released rather than returned to the pool,
+// and idle sockets are closed right away. New operations are run on fresh
+// connections established and authenticated with the new settings.
+//
+// The new settings aren't tried before being applied, so an error caused
+// by them is only reported by the following operations.
+func (s *Session) Reconfigure(config Reconfiguration) error {
+	creds := make([]Credential, len(config.Credentials))
+	for i := range config.Credentials {
+		cred, err := s.resolveCredential(&config.Credentials[i])
+		if err != nil {
+			return err
+		}
+		creds[i] = cred
+	}
+	s.cluster().Reconfigure(dialer{new: config.DialServer}, config.Authenticator, creds)
 	return nil
 }
 
 func (s *Session) socketLogin(socket *mongoSocket) error {
+	cluster := s.cluster()
+	authenticator := cluster.Authenticator()
+	if authenticator == nil && s.dialInfo != nil {
+		authenticator = s.dialInfo.Authenticator
+	}
+	if authenticator != nil {
+		if err := socket.authenticate(authenticator, s.sourcedb); err != nil {
+			return err
+		}
+	}
 	for _, cred := range s.creds {
-		if err := socket.Login(cred); err != nil {
+		if err := socket.Login(cluster.Credential(cred)); err != nil {
 			return err
 		}
 	}
@@ -1523,6 +2123,196 @@ type Collation struct {
 	Backwards bool `bson:"backwards,omitempty"`
 }
 
+// checkCollation returns an error if collation is set but the server behind
+// socket is too old to honor it.
+func checkCollation(socket *mongoSocket, collation *Collation) error {
+	if collation != nil && socket.ServerInfo().MaxWireVersion < 5 {
+		return errCollationNotSupported
+	}
+	return nil
+}
+
+// projectionOperators holds the operators that may be used to project
+// the value of a field, such as "tags": {"$slice": 5}.
+var projectionOperators = map[string]bool{
+	"$slice":     true,
+	"$elemMatch": true,
+	"$meta":      true,
+}
+
+// withTextSearch returns query with the given text search added to it.
+func withTextSearch(query interface{}, search string) interface{} {
+	text := bson.D{{Name: "$search", Value: search}}
+	switch query := query.(type) {
+	case nil:
+		return bson.D{{Name: "$text", Value: text}}
+	case bson.D:
+		return append(append(bson.D(nil), query...), bson.DocElem{Name: "$text", Value: text})
+	case bson.M:
+		m := make(bson.M, len(query)+1)
+		for name, value := range query {
+			m[name] = value
+		}
+		m["$text"] = text
+		return m
+	}
+	// Documents such as structs can't be extended, so both are required.
+	return bson.D{{Name: "$and", Value: []interface{}{query, bson.D{{Name: "$text", Value: text}}}}}
+}
+
+// checkTextSearch returns an error if op is a text search with options it
+// can't be combined with, and otherwise adds the projection of the text
+// score to its selector if one was requested.
+func checkTextSearch(op *queryOp) error {
+	if !op.textSearch {
+		if op.textScore != "" {
+			return errTextScoreWithoutText
+		}
+		return nil
+	}
+	if order, ok := op.options.OrderBy.(bson.D); ok {
+		for _, elem := range order {
+			if elem.Name == "$natural" {
+				return errTextSearchNatural
+			}
+		}
+	}
+	switch {
+	case op.options.Hint != nil:
+		return errTextSearchHint
+	case op.options.Snapshot:
+		return errTextSearchSnapshot
+	case op.flags&flagTailable != 0:
+		return errTextSearchTailable
+	case op.textScore == "":
+		return nil
+	}
+	var fields bson.D
+	if op.selector != nil {
+		data, err := bson.Marshal(op.selector)
+		if err != nil {
+			return err
+		}
+		if err = bson.Unmarshal(data, &fields); err != nil {
+			return err
+		}
+	}
+	projection := bson.D{}
+	for _, field := range fields {
+		if field.Name != op.textScore {
+			projection = append(projection, field)
+		}
+	}
+	op.selector = append(projection, bson.DocElem{Name: op.textScore, Value: bson.M{"$meta": "textScore"}})
+	return nil
+}
+
+// checkProjection returns an error if selector is an illegal projection,
+// either because it mixes included and excluded fields, aside from the _id
+// field which may be either, or because it uses an unknown
+// projection operator. Fields projected with operators are neither included
+// nor excluded.
+func checkProjection(selector interface{}) error {
+	if selector == nil {
+		return nil
+	}
+	data, err := bson.Marshal(selector)
+	if err != nil {
+		return err
+	}
+	var fields bson.RawD
+	if err = bson.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	var included, excluded string
+	for _, field := range fields {
+		var include bool
+		switch field.Value.Kind {
+		case 0x01: // Double
+			var f float64
+			field.Value.Unmarshal(&f)
+			include = f != 0
+		case 0x08: // Boolean
+			field.Value.Unmarshal(&include)
+		case 0x10, 0x12: // Int32 and int64
+			var n int64
+			field.Value.Unmarshal(&n)
+			include = n != 0
+		case 0x03: // Document
+			var ops bson.RawD
+			if err := field.Value.Unmarshal(&ops); err != nil {
+				return err
+			}
+			for _, op := range ops {
+				// Other fields are left for the server to judge, as
+				// recent ones take them as projections of subfields.
+				if strings.HasPrefix(op.Name, "$") && !projectionOperators[op.Name] {
+					return fmt.Errorf("invalid projection: unknown operator %s for field %q", op.Name, field.Name)
+				}
+			}
+			continue
+		default:
+			continue
+		}
+		switch {
+		case field.Name == "_id":
+		case include && included == "":
+			included = field.Name
+		case !include && excluded == "":
+			excluded = field.Name
+		}
+	}
+	if included != "" && excluded != "" {
+		return fmt.Errorf("invalid projection: cannot both include field %q and exclude field %q", included, excluded)
+	}
+	return nil
+}
+
+// readConcernWireVersions holds the minimum wire version of servers
+// supporting each read concern level.
+var readConcernWireVersions = map[string]int{
+	"local":        4,
+	"majority":     4,
+	"linearizable": 5,
+	"available":    6,
+	"snapshot":     7,
+}
+
+// checkReadConcern returns an error if the read concern level is set but
+// can't be honored by the server behind socket or in the given mode.
+func checkReadConcern(socket *mongoSocket, level string, mode Mode) error {
+	if level == "" {
+		return nil
+	}
+	wireVersion, ok := readConcernWireVersions[level]
+	if !ok {
+		return fmt.Errorf("unknown read concern level %q", level)
+	}
+	if level == "linearizable" && mode == Secondary {
+		return errLinearizableSecondary
+	}
+	if socket.ServerInfo().MaxWireVersion < wireVersion {
+		return fmt.Errorf("read concern level %q is not supported by the server", level)
+	}
+	return nil
+}
+
+// prepareReadConcern verifies that commands with the given read concern
+// level may be run on the session, switching it to Strong mode when the
+// level requires reading from the primary.
+func (s *Session) prepareReadConcern(level string) error {
+	mode := s.Mode()
+	if level == "linearizable" && mode != Secondary {
+		s.SetMode(Strong, false)
+	}
+	socket, err := s.acquireSocket(true)
+	if err != nil {
+		return err
+	}
+	defer socket.Release()
+	return checkReadConcern(socket, level, mode)
+}
+
 // mgo.v3: Drop Minf and Maxf and transform Min and Max to floats.
 // mgo.v3: Drop DropDups as it's unsupported past 2.8.
 
@@ -1669,6 +2459,8 @@ func (c *Collection) EnsureIndexKey(key ...string) error {
 //     err := collection.EnsureIndex(index)
 //
 // The example above requests the creation of a "2d" index for the "loc" field.
+// A "2dsphere" index, as needed for querying GeoJSON data with GeoNear,
+// GeoWithin and GeoIntersects, is requested with a key such as "$2dsphere:loc".
 //
 // The 2D index bounds may be changed using the Min and Max attributes of the
 // Index value.  The default bound setting of (-180, 180) is suitable for
@@ -1748,6 +2540,19 @@ NextField:
 	cloned.EnsureSafe(&Safe{})
 	db := c.Database.With(cloned)
 
+	if index.Collation != nil {
+		// The socket stays reserved by the Strong session for the command.
+		socket, err := cloned.acquireSocket(false)
+		if err != nil {
+			return err
+		}
+		err = checkCollation(socket, index.Collation)
+		socket.Release()
+		if err != nil {
+			return err
+		}
+	}
+
 	// Try with a command first.
 	err = db.Run(bson.D{{Name: "createIndexes", Value: c.Name}, {Name: "indexes", Value: []indexSpec{spec}}}, nil)
 	if isNoCmd(err) {
@@ -2032,6 +2837,19 @@ func (s *Session) New() *Session {
 
 // Copy works just like New, but preserves the exact authentication
 // information from the original session.
+//
+// Copy is the usual way of handing a session to a goroutine, such as one
+// handling a request in a server: the copy talks to the same cluster and
+// takes sockets from the same pools as the original session, so copying is
+// cheap, while its consistency mode, credentials, safety and other settings
+// may be changed without affecting the original session or other copies.
+// The copy must be closed when done, so that the cluster is closed once the
+// last session using it is.
+//
+// With servers supporting logical sessions, the copy doesn't share the
+// logical session of the original one. It takes one from the pool of those
+// returned by closed sessions, or else starts a new one when it first
+// acquires a connection, which takes an extra startSession round trip.
 func (s *Session) Copy() *Session {
 	s.m.Lock()
 	scopy := copySession(s, true)
@@ -2046,6 +2864,12 @@ func (s *Session) Copy() *Session {
 // are necessarily observed when using the new session, as long as it was a
 // strong or monotonic session.  That said, it also means that long operations
 // may cause other goroutines using the original session to wait.
+//
+// Settings may be changed in the clone without affecting the original
+// session, as with Copy. Prefer Copy when the new session doesn't need to
+// observe the writes performed in the original one, so that concurrent
+// goroutines don't contend for a single socket. The clone must be closed
+// when done, releasing its reference to the shared socket and cluster.
 func (s *Session) Clone() *Session {
 	s.m.Lock()
 	scopy := copySession(s, true)
@@ -2055,10 +2879,30 @@ func (s *Session) Clone() *Session {
 
 // Close terminates the session.  It's a runtime error to use a session
 // after it has been closed.
+//
+// With servers supporting logical sessions, every session obtains one with
+// the startSession command when it first acquires a connection, and its id
+// is attached to the commands it runs. Close returns the logical session to
+// a pool, so that sessions created later reuse it rather than starting new
+// ones, and the pooled logical sessions are ended with the endSessions
+// command once the last session sharing the cluster is closed.
+//
+// The server runs the operations of a logical session one at a time, so
+// the operations of a single session used concurrently by several
+// goroutines wait for each other on the server, even when they use
+// different connections. Use Copy to give each goroutine its own session.
 func (s *Session) Close() {
 	s.m.Lock()
 	if s.mgoCluster != nil {
 		debugf("Closing session %p", s)
+		if s.txn != nil {
+			s.txn.socket.Release()
+			s.txn = nil
+		}
+		if s.lsid != nil {
+			s.mgoCluster.releaseServerSession(s.lsid)
+			s.lsid = nil
+		}
 		s.unsetSocket()
 		s.mgoCluster.Release()
 		s.mgoCluster = nil
@@ -2209,7 +3053,51 @@ func (s *Session) SetPoolLimit(limit int) {
 	s.m.Unlock()
 }
 
-// SetPoolTimeout sets the maxinum time connection attempts will wait to reuse
+// SetServerSelector sets the function selecting the server new connections
+// are acquired from for the session, replacing the built-in selection.
+// Setting it to nil, the default, restores the built-in selection. See
+// ServerSelector for details.
+func (s *Session) SetServerSelector(selector ServerSelector) {
+	s.m.Lock()
+	s.dialInfo.ServerSelector = selector
+	s.m.Unlock()
+}
+
+// SetKeepAlive sets the period between TCP keepalive probes sent on idle
+// connections established for the session after the call, so that the
+// operating system detects connections silently dropped by load balancers
+// or NAT devices, rather than the next operation using them failing.
+// A negative period disables keepalive probes. The default period is
+// defined by DefaultKeepAlive.
+//
+// The default only applies to the TCP connections made by the driver.
+// Connections made with a DialInfo.DialServer function are left as that
+// function configured them, unless a non-zero period is set, in which case
+// it's configured on those having SetKeepAlive and SetKeepAlivePeriod
+// methods as *net.TCPConn does. Other kinds of connections, such as TLS
+// ones, should have it configured by that function.
+func (s *Session) SetKeepAlive(d time.Duration) {
+	s.m.Lock()
+	s.dialInfo.KeepAlive = d
+	s.m.Unlock()
+}
+
+// SetFailFastNoPrimary sets whether operations requiring the primary, such
+// as writes and reads in Primary mode, fail with ErrNoPrimary when the
+// cluster topology has been learned but no primary is currently known,
+// rather than blocking until one is elected or the sync timeout expires.
+// This leaves it up to the application to decide what to do while an
+// election is in progress, such as queueing the operation or retrying it
+// shortly after.
+//
+// The default is to wait for a primary.
+func (s *Session) SetFailFastNoPrimary(failFast bool) {
+	s.m.Lock()
+	s.dialInfo.FailFastNoPrimary = failFast
+	s.m.Unlock()
+}
+
+// SetPoolTimeout sets the maxinum time connection attempts will wait to reuse
 // an existing connection from the pool if the PoolLimit has been reached. If
 // the value is exceeded, the attempt to use a session will fail with an error.
 // The default value is zero, which means to wait forever with no timeout.
@@ -2225,7 +3113,10 @@ func (s *Session) SetPoolTimeout(timeout time.Duration) {
 // The default is to not bypass, and thus to perform the validation
 // expressions registered for modified collections.
 //
-// Document validation was introuced in MongoDB 3.2.
+// The setting affects inserts, updates and Query.Apply. Document validation
+// was introuced in MongoDB 3.2, and writes fail with an error rather than
+// silently performing the validation when bypassing it was requested with
+// older servers.
 //
 // Relevant documentation:
 //
@@ -2237,6 +3128,376 @@ func (s *Session) SetBypassValidation(bypass bool) {
 	s.m.Unlock()
 }
 
+// WriteInterceptor is called with each document about to be written into
+// the ns collection, in the "database.collection" form, and returns the
+// document to be written in its place. Returning an error aborts the write.
+// See Session.SetWriteInterceptor.
+type WriteInterceptor func(ns string, doc interface{}) (interface{}, error)
+
+// SetWriteInterceptor sets the function called with every document inserted,
+// and with every update or replacement document, before they are sent to the
+// server. The interceptor may return the document unchanged, a modified or
+// entirely different document to be written instead, or an error to abort
+// the write before any connection is used for it. Setting it to nil, the
+// default, disables interception.
+//
+// The interceptor is called once per document, including for the documents
+// of bulk operations, for the writes made by AsyncWriter, and for the update
+// documents of Query.Apply. Selectors and removals are not intercepted. With
+// several documents, the first error returned aborts the whole write.
+//
+// This offers a single place for enforcing client-side invariants, such as
+// requiring every document to carry a tenant field.
+func (s *Session) SetWriteInterceptor(interceptor WriteInterceptor) {
+	s.m.Lock()
+	s.writeInterceptor = interceptor
+	s.m.Unlock()
+}
+
+// SetAllowedDatabases restricts the session to operating on the named
+// databases and on the collections allowed with SetAllowedNamespaces.
+// Operations on anything else fail before a connection is acquired for
+// them. Setting it to nil, the default, lifts the restriction on databases,
+// leaving the session unrestricted unless SetAllowedNamespaces is in use.
+//
+// Queries, writes and commands are all checked, including the commands run
+// on behalf of methods such as Count, Pipe or EnsureIndex. A command is
+// checked against the collection named by its first element, if it holds
+// a string, and against its database otherwise. Commands that touch no
+// data, such as the ones run by Ping, are always allowed, and the ones
+// run by Collection.RenameTo are checked against both collections. Only
+// the namespace operations are addressed to is checked otherwise, and not
+// others they may refer to, such as the collections read by $lookup stages.
+//
+// The restriction is inherited by sessions created with Copy, Clone and
+// New. It's a client-side safety net, and not a replacement for the
+// authorization enforced by the server.
+func (s *Session) SetAllowedDatabases(names []string) {
+	s.m.Lock()
+	s.allowedDbs = allowedSet(names)
+	s.m.Unlock()
+}
+
+// SetAllowedNamespaces restricts the session to operating on the named
+// collections, in the "database.collection" form, and on the databases
+// allowed with SetAllowedDatabases. Commands not addressed to a collection
+// need their database to be allowed with SetAllowedDatabases. Setting it to
+// nil, the default, lifts the restriction on collections. See
+// SetAllowedDatabases for details.
+func (s *Session) SetAllowedNamespaces(namespaces []string) {
+	s.m.Lock()
+	s.allowedNs = allowedSet(namespaces)
+	s.m.Unlock()
+}
+
+func allowedSet(names []string) map[string]bool {
+	if names == nil {
+		return nil
+	}
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[name] = true
+	}
+	return set
+}
+
+// dataFreeCommands holds the names of commands that may be run regardless
+// of the databases and collections the session is allowed to operate on.
+var dataFreeCommands = map[string]bool{
+	"buildInfo": true,
+	"buildinfo": true,
+	"hello":     true,
+	"isMaster":  true,
+	"ismaster":  true,
+	"ping":      true,
+}
+
+// checkNamespace returns an error unless the session is allowed to operate
+// on the coll collection of the db database, or on the database itself if
+// coll is empty.
+func (s *Session) checkNamespace(db, coll string) error {
+	s.m.RLock()
+	allowedDbs, allowedNs := s.allowedDbs, s.allowedNs
+	s.m.RUnlock()
+	if allowedDbs == nil && allowedNs == nil || allowedDbs[db] {
+		return nil
+	}
+	if coll == "" {
+		return fmt.Errorf("database %q is not allowed for the session", db)
+	}
+	ns := db + "." + coll
+	if allowedNs[ns] {
+		return nil
+	}
+	return fmt.Errorf("namespace %q is not allowed for the session", ns)
+}
+
+// checkFullName works like checkNamespace for the ns collection, in the
+// "database.collection" form. Commands sent as queries on the $cmd
+// collection are checked against the database.
+func (s *Session) checkFullName(ns string) error {
+	db, coll := ns, ""
+	if i := strings.Index(ns, "."); i >= 0 {
+		db, coll = ns[:i], ns[i+1:]
+	}
+	if coll == "$cmd" || strings.HasPrefix(coll, "$cmd.") {
+		coll = ""
+	}
+	return s.checkNamespace(db, coll)
+}
+
+// checkCommand works like checkNamespace for cmd run on the db database.
+func (s *Session) checkCommand(db string, cmd interface{}) error {
+	s.m.RLock()
+	restricted := s.allowedDbs != nil || s.allowedNs != nil
+	s.m.RUnlock()
+	if !restricted {
+		return nil
+	}
+	name, coll := commandName(cmd), ""
+	var fields bson.RawD
+	if _, ok := cmd.(string); !ok {
+		if fields = docFields(cmd); len(fields) > 0 {
+			name = fields[0].Name
+			if fields[0].Value.Kind == 0x02 {
+				fields[0].Value.Unmarshal(&coll)
+			}
+		}
+	}
+	if dataFreeCommands[name] {
+		return nil
+	}
+	if name == "renameCollection" {
+		// Run on the admin database, with the namespaces in full.
+		if err := s.checkFullName(coll); err != nil {
+			return err
+		}
+		to, _ := fieldValue(fields, "to").(string)
+		return s.checkFullName(to)
+	}
+	return s.checkNamespace(db, coll)
+}
+
+// Registry marshals and unmarshals the documents exchanged with the server,
+// allowing custom Go types to be given specific BSON representations.
+// A *bson.Registry, holding the functions used for each registered type,
+// satisfies the interface. See Session.SetRegistry.
+type Registry interface {
+	Marshal(in interface{}) ([]byte, error)
+	Unmarshal(in []byte, out interface{}) error
+}
+
+// SetRegistry sets the registry used for marshalling the query and
+// projection documents of queries, the documents inserted, and the update
+// and replacement documents, and for unmarshalling the documents obtained
+// from One, Iter.Next, Iter.All and Apply. Setting it to nil, the default,
+// uses the bson package functions. For example:
+//
+//     registry := bson.NewRegistry()
+//     registry.Register(reflect.TypeOf(Amount{}), encodeAmount, decodeAmount)
+//     session.SetRegistry(registry)
+//
+// Documents are marshalled with the registry after they go through the
+// session write interceptor, if any. The selectors of updates and removals,
+// the queries of Count and Distinct, and the stages of aggregation
+// pipelines are marshalled with the registry too, while commands run with
+// Run are marshalled as usual.
+//
+// The registry is inherited by sessions created with Copy, Clone and New,
+// so different parts of an application may use different registries by
+// setting them on their own copies of a session.
+func (s *Session) SetRegistry(registry Registry) {
+	s.m.Lock()
+	s.registry = registry
+	s.m.Unlock()
+}
+
+// Registry returns the registry set with SetRegistry, or nil if none was.
+func (s *Session) Registry() Registry {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.registry
+}
+
+// interceptor returns the function called with every document about to be
+// written: the write interceptor followed by marshalling with the registry,
+// or nil if the session has neither.
+func (s *Session) interceptor() WriteInterceptor {
+	s.m.RLock()
+	interceptor := s.writeInterceptor
+	registry := s.registry
+	s.m.RUnlock()
+	if registry == nil {
+		return interceptor
+	}
+	return func(ns string, doc interface{}) (interface{}, error) {
+		if interceptor != nil {
+			var err error
+			if doc, err = interceptor(ns, doc); err != nil {
+				return nil, err
+			}
+		}
+		return marshalRaw(registry, doc)
+	}
+}
+
+// marshalRaw returns doc marshalled with registry as a raw document, or nil
+// if doc is nil.
+func marshalRaw(registry Registry, doc interface{}) (interface{}, error) {
+	if doc == nil {
+		return nil, nil
+	}
+	data, err := registry.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	return bson.Raw{Kind: 0x03, Data: data}, nil
+}
+
+// encodeQuery replaces the query and projection documents of op with their
+// marshalling with the session registry, if there's one.
+func (s *Session) encodeQuery(op *queryOp) (err error) {
+	registry := s.Registry()
+	if registry == nil {
+		return nil
+	}
+	if op.query, err = marshalRaw(registry, op.query); err != nil {
+		return err
+	}
+	op.selector, err = marshalRaw(registry, op.selector)
+	return err
+}
+
+// encodePipeline returns the stages of pipeline marshalled with the session
+// registry as a raw array, or pipeline itself if there's no registry.
+func (s *Session) encodePipeline(pipeline interface{}) (interface{}, error) {
+	registry := s.Registry()
+	if registry == nil || pipeline == nil {
+		return pipeline, nil
+	}
+	data, err := registry.Marshal(pipeline)
+	if err != nil {
+		return nil, err
+	}
+	return bson.Raw{Kind: 0x04, Data: data}, nil
+}
+
+// marshal marshals doc with the session registry, or with bson.Marshal if
+// there's none.
+func (s *Session) marshal(doc interface{}) ([]byte, error) {
+	if registry := s.Registry(); registry != nil {
+		return registry.Marshal(doc)
+	}
+	return bson.Marshal(doc)
+}
+
+// unmarshal unmarshals data into result with the session registry, or with
+// bson.Unmarshal if there's none.
+func (s *Session) unmarshal(data []byte, result interface{}) error {
+	if s != nil {
+		if registry := s.Registry(); registry != nil {
+			return registry.Unmarshal(data, result)
+		}
+	}
+	return bson.Unmarshal(data, result)
+}
+
+// SetRetryReads sets whether queries, aggregations and counts are retried
+// once on a freshly selected server when they fail due to a network error
+// or because the server they were sent to is no longer the master.
+//
+// Only the initial operation is retried. Failures while iterating over
+// further batches of a cursor are reported as usual, so that results are
+// never skipped or duplicated. Reads within a transaction are not retried.
+//
+// When the connection was closed cleanly by the server, as happens when it
+// restarts, the read is retried on the same server as soon as it answers
+// again, provided it does so shortly, rather than after checking the whole
+// cluster topology.
+//
+// Retries are limited by the retry budget of the cluster, so that they're
+// never more than a fraction of the operations performed. See
+// DialInfo.RetryBudgetRatio.
+//
+// The default is to not retry reads.
+func (s *Session) SetRetryReads(retry bool) {
+	s.m.Lock()
+	s.retryReads = retry
+	s.m.Unlock()
+}
+
+// SetSlowOperationThreshold arranges for callback to be called with the
+// details of every operation run by the session that takes longer than
+// threshold to be answered by the server, counting from the moment it's
+// sent. Setting a zero threshold or a nil callback, the default, disables
+// the notification.
+//
+// Operations are timed as commands, queries and cursor batch requests are
+// sent, so a write without acknowledgement, which has no reply, is never
+// reported. The callback is called synchronously from the goroutine
+// receiving replies on the connection, so it should return quickly.
+//
+// For example, to log all operations slower than 100ms:
+//
+//     session.SetSlowOperationThreshold(100*time.Millisecond, func(op *mgo.SlowOperation) {
+//         log.Printf("slow %s on %s: %v (server %s)", op.CommandName, op.Namespace, op.Duration, op.ServerAddress)
+//     })
+//
+func (s *Session) SetSlowOperationThreshold(threshold time.Duration, callback func(op *SlowOperation)) {
+	s.m.Lock()
+	if threshold > 0 && callback != nil {
+		s.slowOps = &slowOpWatch{threshold: threshold, callback: callback}
+	} else {
+		s.slowOps = nil
+	}
+	s.m.Unlock()
+}
+
+// retryRead runs op, and runs it once more on a newly acquired socket if the
+// first attempt fails with a transient error and the session retries reads.
+func (s *Session) retryRead(op func() error) error {
+	s.m.RLock()
+	retry := s.retryReads && s.txn == nil
+	s.m.RUnlock()
+	if !retry {
+		return op()
+	}
+	budget := s.cluster().retryBudget
+	budget.deposit()
+	err := op()
+	if err == nil || !isRetryableReadError(err) {
+		return err
+	}
+	s.m.Lock()
+	retry = s.retryReads && s.txn == nil
+	if retry && !budget.withdraw() {
+		debugf("Session %p not retrying read, as the retry budget is exhausted: %v", s, err)
+		retry = false
+	}
+	if retry {
+		s.unsetSocket()
+	}
+	s.m.Unlock()
+	if !retry {
+		return err
+	}
+	debugf("Session %p retrying read after error: %v", s, err)
+	if err != io.EOF || !s.cluster().awaitRestarts() {
+		// Not a server restart, or the server didn't come back in
+		// time; let the topology be checked before retrying.
+		s.cluster().syncServers()
+	}
+	return op()
+}
+
+func isRetryableReadError(err error) bool {
+	if err == io.EOF || isNotMasterError(err) {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
 // SetBatch sets the default batch size used when fetching documents from the
 // database. It's possible to change this setting on a per-query basis as
 // well, using the Query.Batch method.
@@ -2254,6 +3515,23 @@ func (s *Session) SetBatch(n int) {
 	s.m.Unlock()
 }
 
+// SetMaxTime sets the default maximum amount of time the server may spend
+// running queries, counts, distincts, find and modify operations and
+// pipelines created from the session after the call, as if Query.SetMaxTime
+// and Pipe.SetMaxTime were called on every one of them. When the limit is
+// reached the server aborts the operation, and IsMaxTimeExpired reports
+// the error returned. Setting it to zero, the default, disables the limit.
+// Commands ran with Database.Run are not affected.
+//
+// Unlike the socket timeout, which just abandons an operation on the client
+// side, the limit stops the work done on the server. The limit is not sent
+// to servers older than MongoDB 2.6, which don't support it.
+func (s *Session) SetMaxTime(d time.Duration) {
+	s.m.Lock()
+	s.maxTimeMS = int(d / time.Millisecond)
+	s.m.Unlock()
+}
+
 // SetPrefetch sets the default point at which the next batch of results will be
 // requested.  When there are p*batch_size remaining documents cached in an
 // Iter, the next batch will be requested in background. For instance, when
@@ -2325,7 +3603,10 @@ func (s *Session) Safe() (safe *Safe) {
 // returning. Custom modes may also be defined within the server to create
 // very detailed placement schemas. See the data awareness documentation in
 // the links below for more details (note that MongoDB internally reuses the
-// "w" field name for WMode).
+// "w" field name for WMode). With servers that predate the wire protocol
+// versioning of MongoDB 2.6, "majority" is sent as the number of members
+// making a majority of the replica set as listed by the server, and writes
+// fail rather than guessing if the server doesn't list them.
 //
 // If safe.J is true, servers will block until write operations have been
 // committed to the journal. Cannot be used in combination with FSync. Prior
@@ -2381,6 +3662,29 @@ func (s *Session) SetSafe(safe *Safe) {
 	s.m.Unlock()
 }
 
+// LastError returns the result of the most recent write made with the
+// session, as reported by the getLastError command or, with MongoDB 2.6 or
+// newer, by the write command itself. It's nil if no write was made yet, if
+// the most recent one was unacknowledged (see SetSafe), or if it failed
+// before the server could report on it.
+//
+// The server keeps the last error per connection, and connections are
+// shared between sessions, so the driver checks every acknowledged write
+// on the connection it was sent on, in the same round trip. For the same
+// reason, running the getLastError command by hand after an unacknowledged
+// write only reports on that write if the session holds on to its
+// connection, as it does in the Strong mode, and no other write was made
+// with the session in between.
+//
+// With concurrent writes on the same session, the result is the one of
+// whichever write completed last, so concurrent writers that need their
+// own results should use a copy of the session each.
+func (s *Session) LastError() *LastError {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.lastError
+}
+
 // EnsureSafe compares the provided safety parameters with the ones
 // currently in use by the session and picks the most conservative
 // choice for each setting.
@@ -2525,6 +3829,35 @@ func (s *Session) Ping() error {
 	return s.Run("ping", nil)
 }
 
+// LastRequestId returns the wire protocol request id of the last operation
+// sent to the server by the session that expected a reply, or zero if there
+// was none. That includes queries, commands, the retrieval of further
+// batches of results, and the getLastError command sent after writes to
+// servers older than MongoDB 2.6. Servers log the request id along with
+// slow operations, so it may be used to find a given operation in their
+// logs. Request ids are only unique per connection, so the address of the
+// server must be taken into account as well.
+//
+// When the session is used from multiple goroutines, the last operation is
+// whichever of them was sent last. The request ids of commands are also
+// delivered to the monitor set with SetCommandMonitor.
+func (s *Session) LastRequestId() uint32 {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.lastRequestId
+}
+
+// noteRequestId records requestId as the one of the last operation sent
+// by the session, unless it's zero because the operation wasn't sent.
+func (s *Session) noteRequestId(requestId uint32) {
+	if requestId == 0 {
+		return
+	}
+	s.m.Lock()
+	s.lastRequestId = requestId
+	s.m.Unlock()
+}
+
 // Fsync flushes in-memory writes to disk on the server the session
 // is established with. If async is true, the call returns immediately,
 // otherwise it returns after the flush has been made.
@@ -2596,9 +3929,14 @@ func (c *Collection) Find(query interface{}) *Query {
 	session := c.Database.Session
 	session.m.RLock()
 	q := &Query{session: session, query: session.queryConfig}
+	maxTimeMS := session.maxTimeMS
 	session.m.RUnlock()
 	q.op.query = query
 	q.op.collection = c.FullName
+	if maxTimeMS > 0 && c.Name != "$cmd" {
+		q.op.options.MaxTimeMS = maxTimeMS
+		q.op.hasOptions = true
+	}
 	return q
 }
 
@@ -2648,16 +3986,123 @@ func (c *Collection) FindId(id interface{}) *Query {
 	return c.Find(bson.D{{Name: "_id", Value: id}})
 }
 
+// FindByIds retrieves with a single $in query all documents with an _id
+// in the ids slice, and unmarshals them into the slice addressed by result.
+// The query is routed like any other query, according to the session mode.
+//
+// Results are in the order of ids rather than in the order the server
+// returns them, which is usually the order of the _id index. Ids without a
+// matching document are simply absent from result, and repeated ids yield
+// a single document. Documents whose _id is equal but of a different type
+// than the requested one, such as an int32 for a requested int64, are
+// appended at the end in the order they were returned.
+//
+// The ids are sent in a single query document, so they must not exceed
+// the maximum document size of 16MB in total.
+//
+// For instance:
+//
+//     var people []Person
+//     err := collection.FindByIds([]bson.ObjectId{id3, id1, id2}, &people)
+//     if err != nil {
+//         return err
+//     }
+//
+func (c *Collection) FindByIds(ids interface{}, result interface{}) error {
+	idsv := reflect.ValueOf(ids)
+	if idsv.Kind() != reflect.Slice && idsv.Kind() != reflect.Array {
+		panic("ids argument must be a slice")
+	}
+	resultv := reflect.ValueOf(result)
+	if resultv.Kind() != reflect.Ptr {
+		panic("result argument must be a slice address")
+	}
+	slicev := resultv.Elem()
+	if slicev.Kind() == reflect.Interface {
+		slicev = slicev.Elem()
+	}
+	if slicev.Kind() != reflect.Slice {
+		panic("result argument must be a slice address")
+	}
+	session := c.Database.Session
+
+	order := make(map[string]int, idsv.Len())
+	for i := 0; i < idsv.Len(); i++ {
+		data, err := session.marshal(bson.D{{Name: "_id", Value: idsv.Index(i).Interface()}})
+		if err != nil {
+			return err
+		}
+		key, err := idKey(data)
+		if err != nil {
+			return err
+		}
+		if _, ok := order[key]; !ok {
+			order[key] = i
+		}
+	}
+
+	var docs [][]byte
+	if len(order) > 0 {
+		docs = make([][]byte, idsv.Len())
+		iter := c.Find(bson.M{"_id": bson.M{"$in": ids}}).Iter()
+		for iter.Next(nil) {
+			data := append([]byte(nil), iter.Raw()...)
+			key, err := idKey(data)
+			if err != nil {
+				iter.Close()
+				return err
+			}
+			if i, ok := order[key]; ok && docs[i] == nil {
+				docs[i] = data
+			} else {
+				docs = append(docs, data)
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+	}
+
+	slicev = reflect.MakeSlice(slicev.Type(), 0, len(order))
+	elemt := slicev.Type().Elem()
+	for _, data := range docs {
+		if data == nil {
+			continue
+		}
+		elemp := reflect.New(elemt)
+		if err := session.unmarshal(data, elemp.Interface()); err != nil {
+			return err
+		}
+		slicev = reflect.Append(slicev, elemp.Elem())
+	}
+	resultv.Elem().Set(slicev)
+	return nil
+}
+
+// idKey returns a string identifying the type and value of the _id field
+// of the document data.
+func idKey(data []byte) (string, error) {
+	var doc struct {
+		Id bson.Raw `bson:"_id"`
+	}
+	if err := bson.Unmarshal(data, &doc); err != nil {
+		return "", err
+	}
+	return string(doc.Id.Kind) + string(doc.Id.Data), nil
+}
+
 // Pipe is used to run aggregation queries against a
 // collection.
 type Pipe struct {
-	session    *Session
-	collection *Collection
-	pipeline   interface{}
-	allowDisk  bool
-	batchSize  int
-	maxTimeMS  int64
-	collation  *Collation
+	session     *Session
+	collection  *Collection
+	pipeline    interface{}
+	allowDisk   bool
+	batchSize   int
+	maxTimeMS   int64
+	collation   *Collation
+	readConcern string
+	comment     string
 }
 
 type pipeCmd struct {
@@ -2668,6 +4113,9 @@ type pipeCmd struct {
 	AllowDisk bool           `bson:"allowDiskUse,omitempty"`
 	MaxTimeMS int64          `bson:"maxTimeMS,omitempty"`
 	Collation *Collation     `bson:"collation,omitempty"`
+	Comment   string         `bson:"comment,omitempty"`
+
+	ReadConcern *readLevel `bson:"readConcern,omitempty"`
 }
 
 type pipeCmdCursor struct {
@@ -2682,6 +4130,10 @@ type pipeCmdCursor struct {
 //     pipe := collection.Pipe([]bson.M{{"$match": bson.M{"name": "Otavio"}}})
 //     iter := pipe.Iter()
 //
+// A pipeline ending in an $out or $merge stage writes its results to a
+// collection, so it's always sent to the primary, whatever the session
+// mode, and it's not retried as reads are.
+//
 // Relevant documentation:
 //
 //     http://docs.mongodb.org/manual/reference/aggregation
@@ -2693,12 +4145,16 @@ func (c *Collection) Pipe(pipeline interface{}) *Pipe {
 	session := c.Database.Session
 	session.m.RLock()
 	batchSize := int(session.queryConfig.op.limit)
+	maxTimeMS := int64(session.maxTimeMS)
+	readConcern := session.queryConfig.op.readConcern
 	session.m.RUnlock()
 	return &Pipe{
-		session:    session,
-		collection: c,
-		pipeline:   pipeline,
-		batchSize:  batchSize,
+		session:     session,
+		collection:  c,
+		pipeline:    pipeline,
+		batchSize:   batchSize,
+		maxTimeMS:   maxTimeMS,
+		readConcern: readConcern,
 	}
 }
 
@@ -2717,21 +4173,39 @@ func (p *Pipe) Iter() *Iter {
 		Cursor cursorData // 2.6+, with cursors.
 	}
 
+	pipeline, err := cloned.encodePipeline(p.pipeline)
 	cmd := pipeCmd{
 		Aggregate: c.Name,
-		Pipeline:  p.pipeline,
+		Pipeline:  pipeline,
 		AllowDisk: p.allowDisk,
 		Cursor:    &pipeCmdCursor{p.batchSize},
 		Collation: p.collation,
+		Comment:   p.comment,
 	}
 	if p.maxTimeMS > 0 {
 		cmd.MaxTimeMS = p.maxTimeMS
 	}
-	err := c.Database.Run(cmd, &result)
+	if err == nil && p.readConcern != "" {
+		cmd.ReadConcern = &readLevel{Level: p.readConcern}
+		err = cloned.prepareReadConcern(p.readConcern)
+	}
+	// Pipelines ending in $out or $merge write their results, so they
+	// must run on the primary and are not retried.
+	run := c.Database.Run
+	if pipelineWrites(p.pipeline) {
+		run = c.Database.RunOnPrimary
+		if err == nil {
+			err = run(cmd, &result)
+		}
+	} else if err == nil {
+		err = cloned.retryRead(func() error {
+			return run(cmd, &result)
+		})
+	}
 	if e, ok := err.(*QueryError); ok && e.Message == `unrecognized field "cursor` {
 		cmd.Cursor = nil
 		cmd.AllowDisk = false
-		err = c.Database.Run(cmd, &result)
+		err = run(cmd, &result)
 	}
 	firstBatch := result.Result
 	if firstBatch == nil {
@@ -2741,9 +4215,25 @@ func (p *Pipe) Iter() *Iter {
 	if p.maxTimeMS > 0 {
 		it.maxTimeMS = p.maxTimeMS
 	}
+	it.comment = p.comment
 	return it
 }
 
+// pipelineWrites returns whether the last stage of pipeline is $out or
+// $merge, which write the pipeline results to a collection.
+func pipelineWrites(pipeline interface{}) bool {
+	fields := docFields(bson.D{{Name: "pipeline", Value: pipeline}})
+	if len(fields) == 0 {
+		return false
+	}
+	var stages []bson.RawD
+	if fields[0].Value.Unmarshal(&stages) != nil || len(stages) == 0 {
+		return false
+	}
+	last := stages[len(stages)-1]
+	return len(last) > 0 && (last[0].Name == "$out" || last[0].Name == "$merge")
+}
+
 // NewIter returns a newly created iterator with the provided parameters. Using
 // this method is not recommended unless the desired functionality is not yet
 // exposed via a more convenient interface (Find, Pipe, etc).
@@ -2800,6 +4290,7 @@ func (c *Collection) NewIter(session *Session, firstBatch []bson.Raw, cursorId i
 		server:  server,
 		timeout: -1,
 		err:     err,
+		lsid:    csession.sessionId(),
 	}
 
 	if socket.ServerInfo().MaxWireVersion >= 4 && c.FullName != "admin.$cmd" {
@@ -2879,9 +4370,13 @@ func (p *Pipe) One(result interface{}) error {
 //
 func (p *Pipe) Explain(result interface{}) error {
 	c := p.collection
+	pipeline, err := c.Database.Session.encodePipeline(p.pipeline)
+	if err != nil {
+		return err
+	}
 	cmd := pipeCmd{
 		Aggregate: c.Name,
-		Pipeline:  p.pipeline,
+		Pipeline:  pipeline,
 		AllowDisk: p.allowDisk,
 		Explain:   true,
 	}
@@ -2913,6 +4408,21 @@ func (p *Pipe) SetMaxTime(d time.Duration) *Pipe {
 }
 
 
+// Comment adds a comment to the aggregation to identify it in the database
+// profiler output and in the server logs. See Query.Comment for details.
+func (p *Pipe) Comment(comment string) *Pipe {
+	p.comment = comment
+	return p
+}
+
+// SetReadConcern sets the read concern level of the pipeline, overriding
+// the one defined for the session with the RMode field of Safe. See
+// Query.SetReadConcern for details.
+func (p *Pipe) SetReadConcern(level string) *Pipe {
+	p.readConcern = level
+	return p
+}
+
 // Collation allows to specify language-specific rules for string comparison,
 // such as rules for lettercase and accent marks.
 // When specifying collation, the locale field is mandatory; all other collation
@@ -2944,33 +4454,228 @@ type LastError struct {
 	UpdatedExisting bool        `bson:"updatedExisting"`
 	UpsertedId      interface{} `bson:"upserted"`
 
-	modified int
-	ecases   []BulkErrorCase
+	// WrittenTo holds the addresses of the members that acknowledged the
+	// write, as reported by servers older than MongoDB 2.6 when the write
+	// concern required acknowledgement by more than one member.
+	WrittenTo []string `bson:"writtenTo"`
+
+	// OpTime holds the optime of the write in the oplog of the primary,
+	// as reported by replica set members. It's zero when unknown, as
+	// with standalone servers. See Session.WaitForReplication.
+	OpTime bson.MongoTimestamp `bson:"lastOp"`
+
+	// ConcernError holds the write concern error reported by the server,
+	// if any. Unlike the errors of the individual writes, it informs that
+	// the writes were applied, but couldn't be confirmed to satisfy the
+	// write concern, so retrying them may apply them twice.
+	ConcernError *WriteConcernError `bson:"-"`
+
+	modified     int
+	ecases       []BulkErrorCase
+	acknowledged int
+	majority     bool
+	majorityErr  error
 }
 
 func (err *LastError) Error() string {
 	return err.Err
 }
 
+// WriteErrors returns the errors of the individual writes that failed, and
+// so weren't applied, with the position of each write in the operation.
+// The write concern error, if any, is reported in ConcernError instead.
+func (err *LastError) WriteErrors() []BulkErrorCase {
+	var ecases []BulkErrorCase
+	for _, ecase := range err.ecases {
+		if !IsWriteConcernError(ecase.Err) {
+			ecases = append(ecases, ecase)
+		}
+	}
+	return ecases
+}
+
+// noteOpTime keeps the most recent optime reported in oplerr for one of
+// the batches the write was split into.
+func (err *LastError) noteOpTime(oplerr *LastError) {
+	if oplerr.OpTime > err.OpTime {
+		err.OpTime = oplerr.OpTime
+	}
+}
+
+// noteConcernError keeps the write concern error reported in oplerr for
+// one of the batches the write was split into, if any.
+func (err *LastError) noteConcernError(oplerr *LastError) {
+	if oplerr.ConcernError != nil {
+		err.ConcernError = oplerr.ConcernError
+		if len(err.ecases) == 0 {
+			err.Code = oplerr.ConcernError.Code
+			err.Err = oplerr.ConcernError.Message
+			err.WTimeout = oplerr.ConcernError.WTimeout
+		}
+	}
+}
+
+// WriteConcernError holds the error reported by the server when writes were
+// applied, but couldn't be confirmed to satisfy the requested write concern,
+// as when the replication to enough members timed out.
+type WriteConcernError struct {
+	Code     int
+	Message  string
+	WTimeout bool // Whether the write concern timed out
+}
+
+func (err *WriteConcernError) Error() string {
+	return err.Message
+}
+
+// changeInfo returns a ChangeInfo holding the acknowledgement details of
+// the write that resulted in err.
+func (err *LastError) changeInfo() *ChangeInfo {
+	return &ChangeInfo{Acknowledged: err.acknowledged, majority: err.majority, majorityErr: err.majorityErr}
+}
+
+// upsertedId returns the _id of the document inserted by an upsert with the
+// given selector and update, as reported by the server in lerr. Servers
+// older than MongoDB 2.6 only report it when they generated the _id, so
+// otherwise it's taken from the update document or the selector, in the
+// same order the server looks for it.
+func upsertedId(lerr *LastError, selector, update interface{}) interface{} {
+	if lerr.UpsertedId != nil {
+		return lerr.UpsertedId
+	}
+	fields := docFields(update)
+	if len(fields) > 0 && strings.HasPrefix(fields[0].Name, "$") {
+		for _, op := range fields {
+			if op.Name == "$set" || op.Name == "$setOnInsert" {
+				if id := fieldValue(docFields(op.Value), "_id"); id != nil {
+					return id
+				}
+			}
+		}
+	} else if id := fieldValue(fields, "_id"); id != nil {
+		return id
+	}
+	id := fieldValue(docFields(selector), "_id")
+	if m, ok := id.(bson.M); ok {
+		for name := range m {
+			if strings.HasPrefix(name, "$") {
+				// Not an equality match, such as {"$in": [...]}.
+				return nil
+			}
+		}
+	}
+	return id
+}
+
+// docFields returns the fields of the document doc, or nil if it isn't one.
+func docFields(doc interface{}) bson.RawD {
+	if doc == nil {
+		return nil
+	}
+	if raw, ok := doc.(bson.Raw); ok {
+		doc = &raw
+	}
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return nil
+	}
+	var fields bson.RawD
+	if bson.Unmarshal(data, &fields) != nil {
+		return nil
+	}
+	return fields
+}
+
+// fieldValue returns the value of the named field, or nil if it's missing.
+func fieldValue(fields bson.RawD, name string) interface{} {
+	for _, field := range fields {
+		if field.Name == name {
+			var value interface{}
+			if field.Value.Unmarshal(&value) == nil {
+				return value
+			}
+		}
+	}
+	return nil
+}
+
+// acknowledgement returns how many members are known to have acknowledged
+// a write made with the w write concern that resulted in lerr and err, and
+// whether they make a majority of the voting members configured in the
+// replica set of the server described by info. Unless the majority write
+// concern was satisfied, errMajorityUnknown is returned when the server
+// didn't report the members of its replica set.
+func acknowledgement(lerr *LastError, err error, w interface{}, info *mongoServerInfo) (acknowledged int, majority bool, majorityErr error) {
+	voting := 0
+	if info.SetName != "" {
+		voting = info.Members
+	}
+	needed := voting/2 + 1
+	satisfied := err == nil && !lerr.WTimeout
+	switch {
+	case len(lerr.WrittenTo) > 0:
+		acknowledged = len(lerr.WrittenTo)
+	case !satisfied:
+		// Only the server that performed the write is known to have it.
+		acknowledged = 1
+	case w == "majority":
+		acknowledged = needed
+	default:
+		acknowledged = 1
+		if n, ok := w.(int); ok && n > 1 {
+			acknowledged = n
+		}
+	}
+	switch {
+	case satisfied && w == "majority":
+		majority = true
+	case info.Mongos:
+		majority = false
+	case info.SetName == "":
+		majority = true
+	case voting == 0:
+		majorityErr = errMajorityUnknown
+	default:
+		majority = acknowledged >= needed
+	}
+	return acknowledged, majority, majorityErr
+}
+
 type queryError struct {
 	Err           string `bson:"$err"`
 	ErrMsg        string
 	Assertion     string
 	Code          int
-	AssertionCode int `bson:"assertionCode"`
+	AssertionCode int      `bson:"assertionCode"`
+	ErrorLabels   []string `bson:"errorLabels"`
 }
 
 // QueryError is returned when a query fails
 type QueryError struct {
-	Code      int
-	Message   string
-	Assertion bool
+	Code        int
+	Message     string
+	Assertion   bool
+	ErrorLabels []string
 }
 
 func (err *QueryError) Error() string {
 	return err.Message
 }
 
+// CursorLostError is reported by an iterator when the server holding its
+// cursor became unavailable while further results were pending, as happens
+// when the server is restarted or removed from the replica set. The results
+// delivered so far are valid, but the remaining ones may only be obtained by
+// running the query again.
+type CursorLostError struct {
+	Server string // Address of the server holding the cursor.
+	Err    error  // Error that made the server unavailable.
+}
+
+func (err *CursorLostError) Error() string {
+	return fmt.Sprintf("cursor lost as server %s is no longer available: %v", err.Server, err.Err)
+}
+
 // IsDup returns whether err informs of a duplicate key error because
 // a primary key index or a secondary unique index already has an entry
 // with the given value.
@@ -2993,6 +4698,47 @@ func IsDup(err error) bool {
 	return false
 }
 
+// IsWriteConcernError returns whether err informs that the writes were all
+// applied, but couldn't be confirmed to satisfy the write concern, as when
+// the replication to enough members timed out. Unlike with the errors of
+// individual writes, retrying such writes blindly may apply them twice.
+func IsWriteConcernError(err error) bool {
+	switch e := err.(type) {
+	case *WriteConcernError:
+		return true
+	case *LastError:
+		if e.ConcernError == nil {
+			return false
+		}
+		for _, ecase := range e.ecases {
+			if ecase.Err != e && !IsWriteConcernError(ecase.Err) {
+				return false
+			}
+		}
+		return true
+	case *BulkError:
+		for _, ecase := range e.ecases {
+			if !IsWriteConcernError(ecase.Err) {
+				return false
+			}
+		}
+		return len(e.ecases) > 0
+	}
+	return false
+}
+
+// IsMaxTimeExpired returns whether err informs that the server aborted an
+// operation because it exceeded the time limit set with SetMaxTime.
+func IsMaxTimeExpired(err error) bool {
+	switch e := err.(type) {
+	case *QueryError:
+		return e.Code == 50
+	case *LastError:
+		return e.Code == 50
+	}
+	return false
+}
+
 // Insert inserts one or more documents in the respective collection.  In
 // case the session is in safe mode (see the SetSafe method) and an error
 // happens while inserting the provided documents, the returned error will
@@ -3038,6 +4784,112 @@ func (c *Collection) UpdateId(id interface{}, update interface{}) error {
 	return c.Update(bson.D{{Name: "_id", Value: id}}, update)
 }
 
+// UpdateWithArrayFilters modifies the documents matching the provided
+// selector document according to the update document, using arrayFilters
+// to determine which array elements are modified by update operators
+// making use of the filtered positional operator, $[<identifier>].
+// Each of the filters must be defined in terms of a single identifier.
+//
+// If multi is false only the first matching document is updated and,
+// if the session is in safe mode (see SetSafe), ErrNotFound is returned
+// when no document matches the selector. Otherwise, all matching
+// documents are updated, as done by UpdateAll.
+//
+// Array filters require MongoDB 3.6 or newer.
+//
+// Relevant documentation:
+//
+//     https://docs.mongodb.com/manual/reference/operator/update/positional-filtered/
+//
+func (c *Collection) UpdateWithArrayFilters(selector, update interface{}, arrayFilters []bson.M, multi bool) (info *ChangeInfo, err error) {
+	return c.updateMatching(&updateOp{
+		Collection:   c.FullName,
+		Selector:     selector,
+		Update:       update,
+		ArrayFilters: arrayFilters,
+		Multi:        multi,
+	})
+}
+
+// UpdateWithComment modifies the documents matching the provided selector
+// document according to the update document, as done by Update when multi
+// is false or by UpdateAll otherwise, sending comment along with the update
+// command to identify it in the database profiler output and in the server
+// logs. See Query.Comment for details.
+//
+// The comment is only sent to MongoDB 4.4 or newer, as older servers reject
+// it, so with them the update is performed without it.
+//
+// Relevant documentation:
+//
+//     https://docs.mongodb.com/manual/reference/command/update/
+//
+func (c *Collection) UpdateWithComment(selector, update interface{}, comment string, multi bool) (info *ChangeInfo, err error) {
+	return c.updateMatching(&updateOp{
+		Collection: c.FullName,
+		Selector:   selector,
+		Update:     update,
+		Comment:    comment,
+		Multi:      multi,
+	})
+}
+
+// UpdateOptions holds the options for updating documents with
+// Collection.UpdateWithOptions. Zero values pick the defaults.
+type UpdateOptions struct {
+	// ArrayFilters determine which array elements are modified by update
+	// operators making use of the filtered positional operator. See
+	// Collection.UpdateWithArrayFilters.
+	ArrayFilters []bson.M
+
+	// Comment is sent along with the update command to MongoDB 4.4 or
+	// newer. See Collection.UpdateWithComment.
+	Comment string
+
+	// Multi causes all matching documents to be updated, as done by
+	// UpdateAll, rather than the first one only.
+	Multi bool
+}
+
+// UpdateWithOptions modifies the documents matching the provided selector
+// document according to the update document and options, combining the
+// settings of UpdateWithArrayFilters and UpdateWithComment.
+//
+// If options.Multi is false only the first matching document is updated
+// and, if the session is in safe mode (see SetSafe), ErrNotFound is
+// returned when no document matches the selector.
+func (c *Collection) UpdateWithOptions(selector, update interface{}, options UpdateOptions) (info *ChangeInfo, err error) {
+	return c.updateMatching(&updateOp{
+		Collection:   c.FullName,
+		Selector:     selector,
+		Update:       update,
+		ArrayFilters: options.ArrayFilters,
+		Comment:      options.Comment,
+		Multi:        options.Multi,
+	})
+}
+
+// updateMatching runs the prepared op, updating the first document matching
+// its selector or all of them if op.Multi is set, and reports the outcome.
+func (c *Collection) updateMatching(op *updateOp) (info *ChangeInfo, err error) {
+	if op.Selector == nil {
+		op.Selector = bson.D{}
+	}
+	if op.Multi {
+		op.Flags = 2
+	}
+	lerr, err := c.writeOp(op, true)
+	if err == nil && lerr != nil {
+		if !op.Multi && !lerr.UpdatedExisting {
+			return nil, ErrNotFound
+		}
+		info = lerr.changeInfo()
+		info.Updated = lerr.modified
+		info.Matched = lerr.N
+	}
+	return info, err
+}
+
 // ChangeInfo holds details about the outcome of an update operation.
 type ChangeInfo struct {
 	// Updated reports the number of existing documents modified.
@@ -3046,7 +4898,30 @@ type ChangeInfo struct {
 	Updated    int
 	Removed    int         // Number of documents removed
 	Matched    int         // Number of documents matched but not necessarily changed
-	UpsertedId interface{} // Upserted _id field, when not explicitly provided
+	UpsertedId interface{} // Upserted _id field, when a document was inserted
+
+	// Acknowledged reports the number of replica set members known to have
+	// acknowledged the write, according to the write concern it satisfied
+	// (see Session.SetSafe) or to the members reported by the server.
+	// It's zero when unknown, as with writes made out of safe mode.
+	Acknowledged int
+
+	majority    bool
+	majorityErr error
+}
+
+// MajorityAcknowledged returns whether the write was acknowledged by a
+// majority of the voting members of the replica set, as configured when
+// the write was done, whether or not all of them were alive. With a replica
+// set, this requires a write concern asking for acknowledgement by more than
+// one member. Writes acknowledged by a standalone server are always
+// acknowledged by a majority, while writes made through mongos are only
+// known to be when the majority write concern was requested.
+//
+// An error is returned when the server didn't report the members of its
+// replica set, so that the size of the majority is unknown.
+func (info *ChangeInfo) MajorityAcknowledged() (bool, error) {
+	return info.majority, info.majorityErr
 }
 
 // UpdateAll finds all documents matching the provided selector document
@@ -3074,7 +4949,9 @@ func (c *Collection) UpdateAll(selector interface{}, update interface{}) (info *
 	}
 	lerr, err := c.writeOp(&op, true)
 	if err == nil && lerr != nil {
-		info = &ChangeInfo{Updated: lerr.modified, Matched: lerr.N}
+		info = lerr.changeInfo()
+		info.Updated = lerr.modified
+		info.Matched = lerr.N
 	}
 	return info, err
 }
@@ -3085,7 +4962,9 @@ func (c *Collection) UpdateAll(selector interface{}, update interface{}) (info *
 // document and the result is inserted in the collection.
 // If the session is in safe mode (see SetSafe) details of the executed
 // operation are returned in info, or an error of type *LastError when
-// some problem is detected.
+// some problem is detected. A document was inserted if info.UpsertedId
+// is set, and otherwise info.Matched and info.Updated report the existing
+// document, regardless of the server version.
 //
 // Relevant documentation:
 //
@@ -3103,9 +4982,13 @@ func (c *Collection) Upsert(selector interface{}, update interface{}) (info *Cha
 		Flags:      1,
 		Upsert:     true,
 	}
+	intercepted, err := c.interceptWrite(&op)
+	if err != nil {
+		return nil, err
+	}
 	var lerr *LastError
 	for i := 0; i < maxUpsertRetries; i++ {
-		lerr, err = c.writeOp(&op, true)
+		lerr, err = c.runWriteOp(intercepted, true)
 		// Retry duplicate key errors on upserts.
 		// https://docs.mongodb.com/v3.2/reference/method/db.collection.update/#use-unique-indexes
 		if !IsDup(err) {
@@ -3113,12 +4996,12 @@ func (c *Collection) Upsert(selector interface{}, update interface{}) (info *Cha
 		}
 	}
 	if err == nil && lerr != nil {
-		info = &ChangeInfo{}
+		info = lerr.changeInfo()
 		if lerr.UpdatedExisting {
 			info.Matched = lerr.N
 			info.Updated = lerr.modified
 		} else {
-			info.UpsertedId = lerr.UpsertedId
+			info.UpsertedId = upsertedId(lerr, selector, intercepted.(*updateOp).Update)
 		}
 	}
 	return info, err
@@ -3178,7 +5061,9 @@ func (c *Collection) RemoveAll(selector interface{}) (info *ChangeInfo, err erro
 	}
 	lerr, err := c.writeOp(&deleteOp{c.FullName, selector, 0, 0}, true)
 	if err == nil && lerr != nil {
-		info = &ChangeInfo{Removed: lerr.N, Matched: lerr.N}
+		info = lerr.changeInfo()
+		info.Removed = lerr.N
+		info.Matched = lerr.N
 	}
 	return info, err
 }
@@ -3188,11 +5073,106 @@ func (db *Database) DropDatabase() error {
 	return db.Run(bson.D{{Name: "dropDatabase", Value: 1}}, nil)
 }
 
+// ProfilingLevel holds the settings of the database profiler.
+type ProfilingLevel struct {
+	// Level is 0 when the profiler is off, 1 when it collects data for
+	// slow operations only, and 2 when it collects data for all operations.
+	Level int `bson:"was"`
+
+	// SlowMs is the threshold in milliseconds above which operations are
+	// considered slow.
+	SlowMs int `bson:"slowms"`
+}
+
+// GetProfilingLevel returns the settings of the profiler for the database
+// on the primary server.
+//
+// Relevant documentation:
+//
+//     https://docs.mongodb.com/manual/reference/command/profile/
+//
+func (db *Database) GetProfilingLevel() (*ProfilingLevel, error) {
+	var result ProfilingLevel
+	err := db.RunOnPrimary(bson.D{{Name: "profile", Value: -1}}, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// SetProfilingLevel sets the profiling level of the database on the primary
+// server, and the threshold in milliseconds above which operations are
+// considered slow, unless slowMs is zero. The provided level must be 0 to
+// turn the profiler off, 1 to profile slow operations, or 2 to profile all
+// operations. The settings in place before the change are returned, so that
+// they may be restored afterwards:
+//
+//     prior, err := db.SetProfilingLevel(2, 0)
+//     if err != nil {
+//         return err
+//     }
+//     defer db.SetProfilingLevel(prior.Level, prior.SlowMs)
+//
+// Profiler settings are kept by every server on its own, and aren't
+// replicated to other members of a replica set.
+//
+// Relevant documentation:
+//
+//     https://docs.mongodb.com/manual/reference/command/profile/
+//     https://docs.mongodb.com/manual/tutorial/manage-the-database-profiler/
+//
+func (db *Database) SetProfilingLevel(level int, slowMs int) (prior *ProfilingLevel, err error) {
+	if level < 0 || level > 2 {
+		return nil, fmt.Errorf("invalid profiling level: %d", level)
+	}
+	if slowMs < 0 {
+		return nil, fmt.Errorf("invalid slow operation threshold: %dms", slowMs)
+	}
+	cmd := bson.D{{Name: "profile", Value: level}}
+	if slowMs > 0 {
+		cmd = append(cmd, bson.DocElem{Name: "slowms", Value: slowMs})
+	}
+	var result ProfilingLevel
+	if err = db.RunOnPrimary(cmd, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
 // DropCollection removes the entire collection including all of its documents.
 func (c *Collection) DropCollection() error {
 	return c.Database.Run(bson.D{{Name: "drop", Value: c.Name}}, nil)
 }
 
+// Rename renames the collection to name, within the same database. See
+// RenameTo for details.
+func (c *Collection) Rename(name string, dropTarget bool) error {
+	return c.RenameTo(c.Database.C(name), dropTarget)
+}
+
+// RenameTo renames the collection to target, which may be in a different
+// database, as long as the server supports it: collections can't be moved
+// across databases in sharded clusters, for instance. The indexes of the
+// collection are kept. If the target exists, it's dropped beforehand when
+// dropTarget is true, and otherwise the server refuses to rename the
+// collection, reporting a *QueryError with code 48 (NamespaceExists).
+// The command is always run on the primary. For example:
+//
+//     err := session.DB("mydb").C("events").RenameTo(session.DB("archive").C("events2019"), false)
+//
+// Relevant documentation:
+//
+//     https://docs.mongodb.com/manual/reference/command/renameCollection/
+//
+func (c *Collection) RenameTo(target *Collection, dropTarget bool) error {
+	cmd := bson.D{
+		{Name: "renameCollection", Value: c.FullName},
+		{Name: "to", Value: target.FullName},
+		{Name: "dropTarget", Value: dropTarget},
+	}
+	return c.Database.Session.DB("admin").Run(cmd, nil)
+}
+
 // The CollectionInfo type holds metadata about a collection.
 //
 // Relevant documentation:
@@ -3220,7 +5200,10 @@ type CollectionInfo struct {
 	MaxDocs  int
 
 	// Validator contains a validation expression that defines which
-	// documents should be considered valid for this collection.
+	// documents should be considered valid for this collection. Besides
+	// query operators, it may use $jsonSchema to validate documents
+	// against a JSON schema, or $expr to use aggregation expressions,
+	// both requiring MongoDB 3.6 or newer.
 	Validator interface{}
 
 	// ValidationLevel may be set to "strict" (the default) to force
@@ -3291,7 +5274,110 @@ func (c *Collection) Create(info *CollectionInfo) error {
 		cmd = append(cmd, bson.DocElem{Name: "collation", Value: info.Collation})
 	}
 
-	return c.Database.Run(cmd, nil)
+	return c.runWithValidator(cmd, info.Validator)
+}
+
+// SetValidator changes the validation rules of the existing c collection,
+// as defined by the Validator, ValidationLevel and ValidationAction fields
+// of CollectionInfo. A nil validator, or an empty level or action, leaves
+// the respective setting unchanged. An empty validator document, such as
+// bson.M{}, removes the validation rules.
+//
+// For example:
+//
+//     err := collection.SetValidator(bson.M{
+//         "$jsonSchema": bson.M{
+//             "bsonType": "object",
+//             "required": []string{"name"},
+//             "properties": bson.M{
+//                 "name": bson.M{"bsonType": "string"},
+//             },
+//         },
+//     }, "moderate", "")
+//
+// Relevant documentation:
+//
+//     https://docs.mongodb.com/manual/reference/command/collMod/
+//     https://docs.mongodb.com/manual/core/schema-validation/
+//
+func (c *Collection) SetValidator(validator interface{}, level, action string) error {
+	cmd := bson.D{{Name: "collMod", Value: c.Name}}
+	if validator != nil {
+		cmd = append(cmd, bson.DocElem{Name: "validator", Value: validator})
+	}
+	if level != "" {
+		cmd = append(cmd, bson.DocElem{Name: "validationLevel", Value: level})
+	}
+	if action != "" {
+		cmd = append(cmd, bson.DocElem{Name: "validationAction", Value: action})
+	}
+	return c.runWithValidator(cmd, validator)
+}
+
+// runWithValidator runs the create or collMod cmd on the primary, once it's
+// checked that the server supports validator, if set.
+func (c *Collection) runWithValidator(cmd bson.D, validator interface{}) error {
+	if validator == nil {
+		return c.Database.Run(cmd, nil)
+	}
+	session := c.Database.Session.Clone()
+	defer session.Close()
+	session.SetMode(Strong, false)
+
+	// The socket stays reserved by the Strong session for the command.
+	socket, err := session.acquireSocket(false)
+	if err != nil {
+		return err
+	}
+	err = checkValidator(socket, validator)
+	socket.Release()
+	if err != nil {
+		return err
+	}
+	return session.DB(c.Database.Name).Run(cmd, nil)
+}
+
+// recentValidatorOperators holds the operators validators may only use with
+// MongoDB 3.6 or newer.
+var recentValidatorOperators = map[string]bool{
+	"$jsonSchema": true,
+	"$expr":       true,
+}
+
+// checkValidator returns an error if the server behind socket is too old to
+// honor validator.
+func checkValidator(socket *mongoSocket, validator interface{}) error {
+	wireVersion := socket.ServerInfo().MaxWireVersion
+	if wireVersion < 4 {
+		return errValidatorNotSupported
+	}
+	if wireVersion < 6 {
+		if op := validatorOperator(docFields(validator)); op != "" {
+			return fmt.Errorf("validator operator %s requires MongoDB 3.6 or newer", op)
+		}
+	}
+	return nil
+}
+
+// validatorOperator returns the first operator in recentValidatorOperators
+// used by the validator with the given fields, at any depth, or an empty
+// string if there's none.
+func validatorOperator(fields bson.RawD) string {
+	for _, field := range fields {
+		if recentValidatorOperators[field.Name] {
+			return field.Name
+		}
+		if field.Value.Kind == 0x03 || field.Value.Kind == 0x04 {
+			// Arrays are encoded as documents with the indexes as names.
+			var nested bson.RawD
+			if bson.Unmarshal(field.Value.Data, &nested) == nil {
+				if op := validatorOperator(nested); op != "" {
+					return op
+				}
+			}
+		}
+	}
+	return ""
 }
 
 // Batch sets the batch size used when fetching documents from the database.
@@ -3301,13 +5387,19 @@ func (c *Collection) Create(info *CollectionInfo) error {
 // The default batch size is defined by the database itself.  As of this
 // writing, MongoDB will use an initial size of min(100 docs, 4MB) on the
 // first batch, and 4MB on remaining ones.
+//
+// A batch size larger than the query limit (see the Limit method) is ignored,
+// so that the server never returns more documents than the limit allows.
 func (q *Query) Batch(n int) *Query {
 	if n == 1 {
 		// Server interprets 1 as -1 and closes the cursor (!?)
 		n = 2
 	}
 	q.m.Lock()
-	q.op.limit = int32(n)
+	// A negative batch size was set by Limit and requests a single batch.
+	if q.op.limit >= 0 && (q.limit == 0 || int32(n) < q.limit) {
+		q.op.limit = int32(n)
+	}
 	q.m.Unlock()
 	return q
 }
@@ -3341,8 +5433,8 @@ func (q *Query) Skip(n int) *Query {
 }
 
 // Limit restricts the maximum number of documents retrieved to n, and also
-// changes the batch size to the same value.  Once n documents have been
-// returned by Next, the following call will return ErrNotFound.
+// reduces the batch size to the same value if it was larger.  Once n documents
+// have been returned by Next, the following call will return ErrNotFound.
 func (q *Query) Limit(n int) *Query {
 	q.m.Lock()
 	switch {
@@ -3357,7 +5449,9 @@ func (q *Query) Limit(n int) *Query {
 		q.op.limit = int32(n)
 	default:
 		q.limit = int32(n)
-		q.op.limit = int32(n)
+		if q.op.limit <= 0 || q.op.limit > q.limit {
+			q.op.limit = q.limit
+		}
 	}
 	q.m.Unlock()
 	return q
@@ -3368,9 +5462,21 @@ func (q *Query) Limit(n int) *Query {
 //
 //     err := collection.Find(nil).Select(bson.M{"name": 1}).One(&result)
 //
+// Fields are either all included or all excluded, except for _id which may
+// be either regardless of the other fields, and the value of array fields may
+// be projected with the $slice and $elemMatch operators:
+//
+//     selector := bson.M{"_id": 0, "name": 1, "tags": bson.M{"$slice": 5}}
+//     err := collection.Find(nil).Select(selector).One(&result)
+//
+// Running a query with a selector mixing included and excluded fields, or
+// projecting a field with an unknown operator, fails with an error without
+// contacting the server.
+//
 // Relevant documentation:
 //
 //     http://www.mongodb.org/display/DOCS/Retrieving+a+Subset+of+Fields
+//     https://docs.mongodb.com/manual/reference/operator/projection/
 //
 func (q *Query) Select(selector interface{}) *Query {
 	q.m.Lock()
@@ -3379,6 +5485,31 @@ func (q *Query) Select(selector interface{}) *Query {
 	return q
 }
 
+// DecodeOnly restricts the decoding of the resulting documents into the
+// result values to the given top-level fields. Unlike Select, the server
+// still returns the other fields, but the driver skips over them without
+// decoding their values. This saves time and allocations with wide
+// documents when a projection isn't desirable, as when it would prevent
+// the query from being covered by an index. Calling DecodeOnly with no
+// fields decodes all of them again.
+//
+// The undecoded data returned by Iter.Raw still holds all fields.
+//
+// For example:
+//
+//     var result struct{ Name string }
+//     iter := collection.Find(query).DecodeOnly("name").Iter()
+//     for iter.Next(&result) {
+//         ...
+//     }
+//
+func (q *Query) DecodeOnly(fields ...string) *Query {
+	q.m.Lock()
+	q.decodeFields = decodeFieldSet(fields)
+	q.m.Unlock()
+	return q
+}
+
 // Sort asks the database to order returned documents according to the
 // provided field names. A field name may be prefixed by - (minus) for
 // it to be sorted in reverse order.
@@ -3390,6 +5521,11 @@ func (q *Query) Select(selector interface{}) *Query {
 //     query3 := collection.Find(nil).Sort("$natural")
 //     query4 := collection.Find(nil).Select(bson.M{"score": bson.M{"$meta": "textScore"}}).Sort("$textScore:score")
 //
+// The $natural pseudo-field sorts documents in the order they are stored
+// in, which for capped collections and the oplog is the insertion order.
+// Both "-$natural" and "$natural:-1" sort them in reverse natural order,
+// newest first, while "$natural" and "$natural:1" sort them oldest first.
+//
 // Relevant documentation:
 //
 //     http://www.mongodb.org/display/DOCS/Sorting+and+Natural+Order
@@ -3407,6 +5543,18 @@ func (q *Query) Sort(fields ...string) *Query {
 					field = field[c+1:]
 				}
 			}
+			if kind == "natural" {
+				// The order follows, as in "$natural:-1".
+				switch field {
+				case "1", "+1":
+				case "-1":
+					n = -1
+				default:
+					q.m.Unlock()
+					panic("Sort: invalid $natural order: " + field)
+				}
+				kind, field = "", "$natural"
+			}
 			switch field[0] {
 			case '+':
 				field = field[1:]
@@ -3416,6 +5564,7 @@ func (q *Query) Sort(fields ...string) *Query {
 			}
 		}
 		if field == "" {
+			q.m.Unlock()
 			panic("Sort: empty field name")
 		}
 		if kind == "textScore" {
@@ -3424,8 +5573,54 @@ func (q *Query) Sort(fields ...string) *Query {
 			order = append(order, bson.DocElem{Name: field, Value: n})
 		}
 	}
-	q.op.options.OrderBy = order
-	q.op.hasOptions = true
+	q.op.options.OrderBy = order
+	q.op.hasOptions = true
+	q.m.Unlock()
+	return q
+}
+
+// Text restricts the query to documents matching the given text search,
+// which requires the collection to have a text index. The search string
+// holds the terms to look for, and may also hold "quoted phrases" and
+// -negated terms, as documented for the $text operator.
+//
+// The text search is added to the query document provided to Find. A query
+// may have a single text search, which can't be combined with Hint,
+// Snapshot, Tail or sorting in natural order.
+//
+// For example:
+//
+//     query := collection.Find(bson.M{"lang": "en"}).Text("coffee -shop")
+//     query.TextScore("score").Sort("$textScore:score")
+//
+// Relevant documentation:
+//
+//     https://docs.mongodb.com/manual/reference/operator/query/text/
+//     https://docs.mongodb.com/manual/core/index-text/
+//
+func (q *Query) Text(search string) *Query {
+	q.m.Lock()
+	if q.op.textSearch {
+		q.m.Unlock()
+		panic("Text: query already has a text search")
+	}
+	q.op.query = withTextSearch(q.op.query, search)
+	q.op.textSearch = true
+	q.m.Unlock()
+	return q
+}
+
+// TextScore includes in the results the relevance score of the document
+// for the text search of the query (see Text), in the given field. The
+// fields to return otherwise are still defined by Select. To sort results
+// by relevance, sort them by the same field prefixed with $textScore, as
+// in "$textScore:score".
+func (q *Query) TextScore(field string) *Query {
+	if field == "" {
+		panic("TextScore: empty field name")
+	}
+	q.m.Lock()
+	q.op.textScore = field
 	q.m.Unlock()
 	return q
 }
@@ -3450,6 +5645,9 @@ func (q *Query) Sort(fields ...string) *Query {
 //     {"a": "A"}
 //     {"a": "â"}
 //
+// The collation is also honored by Count, Distinct and Apply. Querying a
+// server older than MongoDB 3.4 with a collation set returns an error.
+//
 // Relevant documentation:
 //
 //      https://docs.mongodb.com/manual/reference/collation/
@@ -3481,13 +5679,27 @@ func (q *Query) Collation(collation *Collation) *Query {
 //     http://www.mongodb.org/display/DOCS/Query+Optimizer
 //
 func (q *Query) Explain(result interface{}) error {
+	return q.ExplainWithVerbosity("", result)
+}
+
+// ExplainWithVerbosity works like Explain, but also defines the amount of
+// detail reported by MongoDB 3.2+ servers. The verbosity may be one of
+// "queryPlanner", "executionStats" or "allPlansExecution", or empty for the
+// server default. Older servers ignore the verbosity.
+//
+// Relevant documentation:
+//
+//     https://docs.mongodb.com/manual/reference/command/explain/
+//
+func (q *Query) ExplainWithVerbosity(verbosity string, result interface{}) error {
 	q.m.Lock()
 	clone := &Query{session: q.session, query: q.query}
 	q.m.Unlock()
 	clone.op.options.Explain = true
 	clone.op.hasOptions = true
+	clone.op.explainVerbosity = verbosity
 	if clone.op.limit > 0 {
-		clone.op.limit = -q.op.limit
+		clone.op.limit = -clone.op.limit
 	}
 	iter := clone.Iter()
 	if iter.Next(result) {
@@ -3526,6 +5738,25 @@ func (q *Query) Hint(indexKey ...string) *Query {
 	return q
 }
 
+// HintIndex will include an explicit "hint" in the query to force the
+// server to use the index with the provided name, as an alternative to
+// Hint for when the index name is known rather than its key.
+//
+// For example:
+//
+//     query := collection.Find(bson.M{"firstname": "Joe", "lastname": "Winter"})
+//     query.HintIndex("lastname_1_firstname_1")
+//
+// If no index with the given name exists, the server rejects the query
+// and the error is reported when the query is run.
+func (q *Query) HintIndex(name string) *Query {
+	q.m.Lock()
+	q.op.options.Hint = name
+	q.op.hasOptions = true
+	q.m.Unlock()
+	return q
+}
+
 // SetMaxScan constrains the query to stop after scanning the specified
 // number of documents.
 //
@@ -3608,8 +5839,99 @@ func (q *Query) Snapshot() *Query {
 	return q
 }
 
+// SetMode sets the read preference mode used to select the server the
+// query is sent to, overriding the mode of the session for this query
+// only. The socket used isn't reserved by the session, so its consistency
+// guarantees are unaffected. Iterating over the results, including the
+// retrieval of further batches, happens on the server that received the
+// query for the lifetime of the cursor. This allows, for example, a large
+// scan to be offloaded to a secondary from an otherwise Strong session:
+//
+//     iter := collection.Find(nil).SetMode(mgo.SecondaryPreferred).Iter()
+//
+// Queries with a linearizable read concern are always sent to the primary,
+// as are queries run within a transaction.
+func (q *Query) SetMode(mode Mode) *Query {
+	q.m.Lock()
+	q.mode = mode
+	q.hasMode = true
+	q.m.Unlock()
+	return q
+}
+
+// SetReadTags restricts the servers the query may be sent to to those
+// configured with the given tags, overriding the tags selected for the
+// session with Session.SelectServers for this query only. As with
+// SelectServers, the used server must match all tags within any one of
+// the tag sets. For example, the following query is sent to a secondary
+// in the "west" data center:
+//
+//     query := collection.Find(nil).SetMode(mgo.Secondary)
+//     query.SetReadTags([]bson.D{{{Name: "dc", Value: "west"}}}, false)
+//
+// If fallback is true and no known server matches the given tags, the
+// query is sent to a server matching the session tags instead. Otherwise
+// the query waits for a matching server to show up, as sessions do when
+// no server matches their tags.
+//
+// Tags only select among secondaries, so they have no effect when the
+// query is sent to the primary, as happens in the Primary and Strong
+// modes, after a write in the Monotonic mode, within a transaction, or
+// with a linearizable read concern. The mode set with Query.SetMode takes
+// precedence over the session one, and the socket used for the query isn't
+// reserved by the session, as described in Query.SetMode.
+func (q *Query) SetReadTags(tags []bson.D, fallback bool) *Query {
+	q.m.Lock()
+	q.tags = &queryTags{tags: tags, fallback: fallback}
+	q.m.Unlock()
+	return q
+}
+
+// SetReadConcern sets the read concern level of the query, overriding the
+// one defined for the session with the RMode field of Safe. The supported
+// levels are "local", "available", "majority", "linearizable" and
+// "snapshot", each depending on a minimum server version: MongoDB 3.2
+// for the first ones, and 3.4, 3.6 and 4.0 for the others, respectively.
+// An error is returned when the query runs if the level is unknown or
+// unsupported by the server.
+//
+// Linearizable reads are always sent to the primary, and may not be used
+// in Secondary mode.
+//
+// Relevant documentation:
+//
+//     https://docs.mongodb.com/manual/reference/read-concern/
+//
+func (q *Query) SetReadConcern(level string) *Query {
+	q.m.Lock()
+	q.op.readConcern = level
+	q.m.Unlock()
+	return q
+}
+
+// SetNoTimeout disables the timeout the server enforces on the cursor
+// created by the query, which otherwise closes it after 10 minutes of
+// inactivity. This is useful for iterating slowly over large result sets.
+//
+// As the server never closes such a cursor by itself, the caller is
+// responsible for calling Close on the resulting iterator, which kills
+// the cursor if results weren't exhausted. See also Session.SetCursorTimeout.
+func (q *Query) SetNoTimeout() *Query {
+	q.m.Lock()
+	q.op.flags |= flagNoCursorTimeout
+	q.m.Unlock()
+	return q
+}
+
 // Comment adds a comment to the query to identify it in the database profiler output.
 //
+// With MongoDB 4.4 or newer, the comment is also sent along with the query
+// when running Count, when running Apply for changing the matching document,
+// and along with the getMore commands retrieving further results from the
+// query cursor. Older servers don't accept it there, so it's left out, but
+// they still attribute getMore commands to the original query in the
+// profiler output. See Collection.UpdateWithComment for updates.
+//
 // Relevant documentation:
 //
 //     http://docs.mongodb.org/manual/reference/operator/meta/comment
@@ -3663,9 +5985,9 @@ Error:
 		return &QueryError{Code: result.AssertionCode, Message: result.Assertion, Assertion: true}
 	}
 	if result.Err != "" {
-		return &QueryError{Code: result.Code, Message: result.Err}
+		return &QueryError{Code: result.Code, Message: result.Err, ErrorLabels: result.ErrorLabels}
 	}
-	return &QueryError{Code: result.Code, Message: result.ErrMsg}
+	return &QueryError{Code: result.Code, Message: result.ErrMsg, ErrorLabels: result.ErrorLabels}
 }
 
 // One executes the query and unmarshals the first obtained document into the
@@ -3683,24 +6005,57 @@ Error:
 // desired.
 //
 func (q *Query) One(result interface{}) (err error) {
+	q.m.Lock()
+	session := q.session
+	q.m.Unlock()
+	return session.retryRead(func() error { return q.one(result) })
+}
+
+func (q *Query) one(result interface{}) (err error) {
 	q.m.Lock()
 	session := q.session
 	op := q.op // Copy.
+	mode, hasMode := q.mode, q.hasMode
+	tags := q.tags
+	decodeFields := q.decodeFields
 	q.m.Unlock()
 
-	socket, err := session.acquireSocket(true)
+	if err = checkTextSearch(&op); err != nil {
+		return err
+	}
+	if err = session.encodeQuery(&op); err != nil {
+		return err
+	}
+	if err = checkProjection(op.selector); err != nil {
+		return err
+	}
+	socket, err := session.acquireQuerySocket(&op, mode, hasMode, tags)
 	if err != nil {
 		return err
 	}
 	defer socket.Release()
 
+	if !hasMode {
+		mode = session.Mode()
+	}
+	if err = checkCollation(socket, op.options.Collation); err != nil {
+		return err
+	}
+	if err = checkReadConcern(socket, op.readConcern, mode); err != nil {
+		return err
+	}
+
 	op.limit = -1
 
 	session.prepareQuery(&op)
+	if hasMode {
+		op.setMode(mode)
+	}
 
 	expectFindReply := prepareFindOp(socket, &op, 1)
 
 	data, err := socket.SimpleQuery(&op)
+	session.noteRequestId(op.requestId)
 	if err != nil {
 		return err
 	}
@@ -3727,7 +6082,7 @@ func (q *Query) One(result interface{}) (err error) {
 		data = findReply.Cursor.FirstBatch[0].Data
 	}
 	if result != nil {
-		err = bson.Unmarshal(data, result)
+		err = session.unmarshal(onlyFields(data, decodeFields), result)
 		if err == nil {
 			debugf("Query %p document unmarshaled: %#v", q, result)
 		} else {
@@ -3769,7 +6124,7 @@ func prepareFindOp(socket *mongoSocket, op *queryOp, limit int32) bool {
 		AwaitData:       op.flags&flagAwaitData != 0,
 		OplogReplay:     op.flags&flagLogReplay != 0,
 		NoCursorTimeout: op.flags&flagNoCursorTimeout != 0,
-		ReadConcern:     readLevel{level: op.readConcern},
+		ReadConcern:     readLevel{Level: op.readConcern},
 	}
 
 	if op.limit < 0 {
@@ -3789,7 +6144,11 @@ func prepareFindOp(socket *mongoSocket, op *queryOp, limit int32) bool {
 	op.hasOptions = false
 
 	if explain {
-		op.query = bson.D{{Name: "explain", Value: op.query}}
+		cmd := bson.D{{Name: "explain", Value: op.query}}
+		if op.explainVerbosity != "" {
+			cmd = append(cmd, bson.DocElem{Name: "verbosity", Value: op.explainVerbosity})
+		}
+		op.query = cmd
 		return false
 	}
 	return true
@@ -3838,7 +6197,7 @@ type findCmd struct {
 // readLevel provides the nested "level: majority" serialisation needed for the
 // query read concern.
 type readLevel struct {
-	level string `bson:"level,omitempty"`
+	Level string `bson:"level,omitempty"`
 }
 
 // getMoreCmd holds the command used for requesting more query results on MongoDB 3.2+.
@@ -3852,6 +6211,7 @@ type getMoreCmd struct {
 	Collection string `bson:"collection"`
 	BatchSize  int32  `bson:"batchSize,omitempty"`
 	MaxTimeMS  int64  `bson:"maxTimeMS,omitempty"`
+	Comment    string `bson:"comment,omitempty"`
 }
 
 // run duplicates the behavior of collection.Find(query).One(&result)
@@ -3876,6 +6236,7 @@ func (db *Database) run(socket *mongoSocket, cmd, result interface{}) (err error
 	op.limit = -1
 
 	data, err := socket.SimpleQuery(&op)
+	session.noteRequestId(op.requestId)
 	if err != nil {
 		return err
 	}
@@ -4013,6 +6374,109 @@ func (db *Database) CollectionNames() (names []string, err error) {
 	return names, nil
 }
 
+// CollectionStats holds the statistics of a collection, as reported by
+// the collStats command. Sizes are in bytes.
+type CollectionStats struct {
+	Count          int              `bson:"count"`
+	Size           int64            `bson:"size"`
+	AvgObjSize     int64            `bson:"avgObjSize"`
+	StorageSize    int64            `bson:"storageSize"`
+	Capped         bool             `bson:"capped"`
+	NIndexes       int              `bson:"nindexes"`
+	TotalIndexSize int64            `bson:"totalIndexSize"`
+	IndexSizes     map[string]int64 `bson:"indexSizes"`
+
+	// Err holds the error reported for this collection in particular,
+	// if any, in which case the other fields are unset.
+	Err error `bson:"-"`
+}
+
+// CollectionStats returns the statistics of each of the named collections
+// in the db database, keyed by collection name.
+//
+// The collStats commands are all sent at once over a single connection to
+// the primary server, and their replies are then awaited together, rather
+// than doing a round-trip per collection. Errors affecting a collection in
+// particular are reported in the Err field of its statistics, rather than
+// failing the whole call. Depending on the server version, a collection
+// that doesn't exist is reported either that way or as an empty one.
+// Without any names, an empty map is returned without reaching the server.
+//
+// Relevant documentation:
+//
+//     https://docs.mongodb.com/manual/reference/command/collStats/
+//
+func (db *Database) CollectionStats(names ...string) (map[string]*CollectionStats, error) {
+	for _, name := range names {
+		if err := db.Session.checkNamespace(db.Name, name); err != nil {
+			return nil, err
+		}
+	}
+	if len(names) == 0 {
+		return map[string]*CollectionStats{}, nil
+	}
+	socket, err := db.Session.acquireSocket(false)
+	if err != nil {
+		return nil, err
+	}
+	defer socket.Release()
+
+	session := db.Session
+	session.m.RLock()
+	base := session.queryConfig.op // Copy.
+	session.m.RUnlock()
+
+	var wg sync.WaitGroup
+	replies := make([][]byte, len(names))
+	errs := make([]error, len(names))
+	ops := make([]interface{}, len(names))
+	for i, name := range names {
+		i := i
+		op := new(queryOp)
+		*op = base
+		op.query = bson.D{{Name: "collStats", Value: name}}
+		op.collection = db.Name + ".$cmd"
+		session.prepareQuery(op)
+		op.limit = -1
+		var once sync.Once
+		op.replyFunc = func(err error, reply *replyOp, docNum int, docData []byte) {
+			once.Do(func() {
+				errs[i] = err
+				replies[i] = docData
+				wg.Done()
+			})
+		}
+		ops[i] = op
+		wg.Add(1)
+	}
+	err = socket.Query(ops...)
+	session.noteRequestId(ops[len(ops)-1].(*queryOp).requestId)
+	if err != nil {
+		return nil, err
+	}
+	wg.Wait()
+
+	stats := make(map[string]*CollectionStats, len(names))
+	for i, name := range names {
+		result := &CollectionStats{}
+		err := errs[i]
+		if err == nil && replies[i] == nil {
+			err = ErrNotFound
+		}
+		if err == nil {
+			err = checkQueryError(db.Name+".$cmd", replies[i])
+		}
+		if err == nil {
+			err = bson.Unmarshal(replies[i], result)
+		}
+		if err != nil {
+			result = &CollectionStats{Err: err}
+		}
+		stats[name] = result
+	}
+	return stats, nil
+}
+
 type dbNames struct {
 	Databases []struct {
 		Name  string
@@ -4041,18 +6505,44 @@ func (s *Session) DatabaseNames() (names []string, err error) {
 // size (see the Batch method) and more documents will be requested when a
 // configurable number of documents is iterated over (see the Prefetch method).
 func (q *Query) Iter() *Iter {
+	q.m.Lock()
+	session := q.session
+	q.m.Unlock()
+
+	session.m.RLock()
+	retry := session.retryReads
+	session.m.RUnlock()
+	if !retry {
+		return q.iter()
+	}
+
+	// Wait for the initial reply, so that a failure there may still be
+	// retried before the iterator is handed out.
+	var iter *Iter
+	session.retryRead(func() error {
+		iter = q.iter()
+		return iter.initialErr()
+	})
+	return iter
+}
+
+func (q *Query) iter() *Iter {
 	q.m.Lock()
 	session := q.session
 	op := q.op
 	prefetch := q.prefetch
 	limit := q.limit
+	mode, hasMode := q.mode, q.hasMode
+	tags := q.tags
+	decodeFields := q.decodeFields
 	q.m.Unlock()
 
 	iter := &Iter{
-		session:  session,
-		prefetch: prefetch,
-		limit:    limit,
-		timeout:  -1,
+		session:      session,
+		prefetch:     prefetch,
+		limit:        limit,
+		timeout:      -1,
+		decodeFields: decodeFields,
 	}
 	iter.gotReply.L = &iter.m
 	iter.op.collection = op.collection
@@ -4060,22 +6550,50 @@ func (q *Query) Iter() *Iter {
 	iter.op.replyFunc = iter.replyFunc()
 	iter.docsToReceive++
 
-	socket, err := session.acquireSocket(true)
+	err := checkTextSearch(&op)
+	if err == nil {
+		err = session.encodeQuery(&op)
+	}
+	if err == nil {
+		err = checkProjection(op.selector)
+	}
+	if err != nil {
+		iter.err = err
+		return iter
+	}
+	socket, err := session.acquireQuerySocket(&op, mode, hasMode, tags)
 	if err != nil {
 		iter.err = err
 		return iter
 	}
 	defer socket.Release()
 
+	if !hasMode {
+		mode = session.Mode()
+	}
+	if err = checkCollation(socket, op.options.Collation); err == nil {
+		err = checkReadConcern(socket, op.readConcern, mode)
+	}
+	if err != nil {
+		iter.err = err
+		return iter
+	}
+
 	session.prepareQuery(&op)
+	if hasMode {
+		op.setMode(mode)
+	}
 	op.replyFunc = iter.op.replyFunc
+	iter.lsid = op.lsid
 
 	if prepareFindOp(socket, &op, limit) {
 		iter.isFindCmd = true
 	}
 
 	iter.server = socket.Server()
+	iter.comment = op.options.Comment
 	err = socket.Query(&op)
+	session.noteRequestId(op.requestId)
 	if err != nil {
 		// Must lock as the query is already out and it may call replyFunc.
 		iter.m.Lock()
@@ -4138,9 +6656,10 @@ func (q *Query) Tail(timeout time.Duration) *Iter {
 	session := q.session
 	op := q.op
 	prefetch := q.prefetch
+	decodeFields := q.decodeFields
 	q.m.Unlock()
 
-	iter := &Iter{session: session, prefetch: prefetch}
+	iter := &Iter{session: session, prefetch: prefetch, decodeFields: decodeFields}
 	iter.gotReply.L = &iter.m
 	iter.timeout = timeout
 	iter.op.collection = op.collection
@@ -4150,13 +6669,28 @@ func (q *Query) Tail(timeout time.Duration) *Iter {
 	session.prepareQuery(&op)
 	op.replyFunc = iter.op.replyFunc
 	op.flags |= flagTailable | flagAwaitData
+	iter.lsid = op.lsid
 
-	socket, err := session.acquireSocket(true)
+	var socket *mongoSocket
+	err := checkTextSearch(&op)
+	if err == nil {
+		err = session.encodeQuery(&op)
+	}
+	if err == nil {
+		err = checkProjection(op.selector)
+	}
+	if err == nil {
+		err = session.checkFullName(op.collection)
+	}
+	if err == nil {
+		socket, err = session.acquireSocket(true)
+	}
 	if err != nil {
 		iter.err = err
 	} else {
 		iter.server = socket.Server()
 		err = socket.Query(&op)
+		session.noteRequestId(op.requestId)
 		if err != nil {
 			// Must lock as the query is already out and it may call replyFunc.
 			iter.m.Lock()
@@ -4168,22 +6702,147 @@ func (q *Query) Tail(timeout time.Duration) *Iter {
 	return iter
 }
 
+// acquireQuerySocket acquires the socket the query op must be sent to.
+// When the query has its own read preference mode or server tags, the
+// server is selected according to them without reserving the socket in
+// the session, so that the consistency guarantees of the session are
+// preserved. The server tags of op are updated to the ones used.
+func (s *Session) acquireQuerySocket(op *queryOp, mode Mode, hasMode bool, tags *queryTags) (*mongoSocket, error) {
+	if err := s.checkFullName(op.collection); err != nil {
+		return nil, err
+	}
+	s.m.RLock()
+	inTxn := s.txn != nil
+	s.m.RUnlock()
+	if inTxn {
+		// Reads within a transaction must go to its primary.
+		if hasMode && mode != Primary || tags != nil {
+			return nil, errTransactionReadPreference
+		}
+		return s.acquireSocket(true)
+	}
+	// Linearizable reads must go to the primary.
+	if op.readConcern == "linearizable" {
+		return s.acquireSocket(false)
+	}
+	if !hasMode && tags == nil {
+		return s.acquireSocket(true)
+	}
+
+	s.m.RLock()
+	cluster := s.cluster()
+	syncTimeout := s.syncTimeout
+	serverTags := s.queryConfig.op.serverTags
+	info := s.dialInfo
+	slaveOk := mode != Primary
+	if !hasMode {
+		mode = s.consistency
+		slaveOk = s.slaveOk
+	}
+	s.m.RUnlock()
+
+	if tags != nil && (!tags.fallback || cluster.HasTaggedServer(mode, tags.tags)) {
+		serverTags = tags.tags
+	}
+	op.serverTags = serverTags
+
+	socket, err := cluster.AcquireSocketWithPoolTimeout(mode, slaveOk, syncTimeout, serverTags, info)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.checkFrozen(socket, slaveOk); err == nil {
+		err = s.socketLogin(socket)
+	}
+	if err != nil {
+		socket.Release()
+		return nil, err
+	}
+	s.prepareServerSession(socket)
+	return socket, nil
+}
+
 func (s *Session) prepareQuery(op *queryOp) {
 	s.m.RLock()
 	op.mode = s.consistency
 	if s.slaveOk {
 		op.flags |= flagSlaveOk
 	}
+	if s.lsid != nil {
+		op.lsid = &s.lsid.id
+	}
+	op.slowOps = s.slowOps
 	s.m.RUnlock()
+	op.txn, op.txnFields = s.txnFields()
 	return
 }
 
+// setMode overrides the read preference mode set by prepareQuery with
+// the one defined for the query.
+func (op *queryOp) setMode(mode Mode) {
+	op.mode = mode
+	if mode == Primary {
+		op.flags &^= flagSlaveOk
+	} else {
+		op.flags |= flagSlaveOk
+	}
+}
+
+// initialErr waits for the reply to the query that created the iterator
+// and returns the error it carried, if any.
+func (iter *Iter) initialErr() error {
+	iter.m.Lock()
+	defer iter.m.Unlock()
+	for iter.err == nil && iter.docsToReceive > 0 && iter.docData.Len() == 0 {
+		iter.gotReply.Wait()
+	}
+	if iter.err == ErrNotFound {
+		return nil
+	}
+	return iter.err
+}
+
+// Raw returns the undecoded data of the last document retrieved by Next,
+// or nil if none was. The data isn't copied, and remains valid after
+// further calls to Next.
+//
+// Next may be called with a nil result to skip decoding documents
+// altogether, so that callers holding very large documents may decode
+// them lazily. For instance, unmarshalling the data into a bson.RawD
+// leaves the values of all fields undecoded, referencing the same data:
+//
+//    for iter.Next(nil) {
+//        var fields bson.RawD
+//        err := bson.Unmarshal(iter.Raw(), &fields)
+//        ...
+//    }
+//
+func (iter *Iter) Raw() []byte {
+	iter.m.Lock()
+	defer iter.m.Unlock()
+	return iter.raw
+}
+
+// DecodeOnly restricts the decoding of the documents retrieved by further
+// calls to Next into the result values to the given top-level fields, as
+// Query.DecodeOnly does. Calling it with no fields decodes all of them
+// again.
+func (iter *Iter) DecodeOnly(fields ...string) *Iter {
+	set := decodeFieldSet(fields)
+	iter.m.Lock()
+	iter.decodeFields = set
+	iter.m.Unlock()
+	return iter
+}
+
 // Err returns nil if no errors happened during iteration, or the actual
 // error otherwise.
 //
 // In case a resulting document included a field named $err or errmsg, which are
 // standard ways for MongoDB to report an improper query, the returned value has
-// a *QueryError type, and includes the Err message and the Code.
+// a *QueryError type, and includes the Err message and the Code. If the server
+// holding the cursor became unavailable before all results were delivered, the
+// returned value has a *CursorLostError type, and the query must be run again
+// to obtain the remaining results.
 func (iter *Iter) Err() error {
 	iter.m.Lock()
 	err := iter.err
@@ -4202,6 +6861,8 @@ func (iter *Iter) Err() error {
 // the server finished sending results to the driver. If Close is not called
 // in such a situation, the cursor will remain available at the server until
 // the default cursor timeout period is reached. No further problems arise.
+// If the server holding the cursor was meanwhile removed from the cluster,
+// the cursor is simply dropped.
 //
 // Close is idempotent. That means it can be called repeatedly and will
 // return the same result every time.
@@ -4222,7 +6883,10 @@ func (iter *Iter) Close() error {
 		return err
 	}
 	socket, err := iter.acquireSocket()
-	if err == nil {
+	if err == errServerClosed {
+		// The cursor went away along with its server.
+		err = nil
+	} else if err == nil {
 		// TODO Batch kills.
 		err = socket.Query(&killCursorsOp{[]int64{cursorId}})
 		socket.Release()
@@ -4283,7 +6947,11 @@ func (iter *Iter) Timeout() bool {
 // methods).
 //
 // Next returns true if a document was successfully unmarshalled onto result,
-// and false at the end of the result set or if an error happened.
+// and false at the end of the result set or if an error happened. If result
+// is nil, the document is retrieved without being unmarshalled (see Raw).
+// The same result value may be provided on every call to avoid allocating
+// one per document. A struct result is fully overwritten each time, so
+// fields missing from a document are left with their zero value.
 // When Next returns false, either the Err method or the Close method should be
 // called to verify if there was an error during iteration. While both will
 // return the error (or nil), Close will also release the cursor on the server.
@@ -4345,6 +7013,8 @@ func (iter *Iter) Next(result interface{}) bool {
 	// We have data from the getMore.
 	// Exhaust available data before reporting any errors.
 	if docData, ok := iter.docData.Pop().([]byte); ok {
+		iter.raw = docData
+		decodeFields := iter.decodeFields
 		close := false
 		if iter.limit > 0 {
 			iter.limit--
@@ -4369,19 +7039,21 @@ func (iter *Iter) Next(result interface{}) bool {
 		if close {
 			iter.Close()
 		}
-		err := bson.Unmarshal(docData, result)
-		if err != nil {
-			debugf("Iter %p document unmarshaling failed: %#v", iter, err)
-			iter.m.Lock()
-			if iter.err == nil {
-				iter.err = err
+		if result != nil {
+			err := iter.session.unmarshal(onlyFields(docData, decodeFields), result)
+			if err != nil {
+				debugf("Iter %p document unmarshaling failed: %#v", iter, err)
+				iter.m.Lock()
+				if iter.err == nil {
+					iter.err = err
+				}
+				iter.m.Unlock()
+				return false
 			}
-			iter.m.Unlock()
-			return false
+			debugf("Iter %p document unmarshaled: %#v", iter, result)
 		}
-		debugf("Iter %p document unmarshaled: %#v", iter, result)
 		// XXX Only have to check first document for a query error?
-		err = checkQueryError(iter.op.collection, docData)
+		err := checkQueryError(iter.op.collection, docData)
 		if err != nil {
 			iter.m.Lock()
 			if iter.err == nil {
@@ -4502,6 +7174,76 @@ func (iter *Iter) For(result interface{}, f func() error) (err error) {
 	return iter.Err()
 }
 
+// Channel iterates over the results in a new goroutine, sending each
+// document on ch, which must be a channel of the type results should be
+// unmarshalled into. Channel returns immediately, and ch is closed once
+// the results are exhausted, an error happens, or done is closed. The
+// outcome of iter.Close, called before ch is closed, is then delivered
+// on the returned channel, which is closed right after that.
+//
+// The goroutine blocks while ch is full, so the rate at which results
+// are fetched from the server is bounded by the rate at which they are
+// consumed. Closing done makes the goroutine stop early, and the server
+// cursor is then killed. The done channel may be nil if the results are
+// always going to be consumed until the end.
+//
+// The iterator must not be used after the call to Channel.
+//
+// For instance:
+//
+//    done := make(chan struct{})
+//    defer close(done)
+//    ch := make(chan Person, 100)
+//    errc := collection.Find(nil).Iter().Channel(ch, done)
+//    for person := range ch {
+//        fmt.Printf("Person: %v\n", person)
+//    }
+//    if err := <-errc; err != nil {
+//        return err
+//    }
+//
+func (iter *Iter) Channel(ch interface{}, done <-chan struct{}) <-chan error {
+	chv := sendChannel(ch)
+	errc := make(chan error, 1)
+	go func() {
+		iter.send(chv, done)
+		errc <- iter.Close()
+		close(errc)
+		chv.Close()
+	}()
+	return errc
+}
+
+// sendChannel returns the value of ch, which must be a channel results
+// may be sent on.
+func sendChannel(ch interface{}) reflect.Value {
+	chv := reflect.ValueOf(ch)
+	if chv.Kind() != reflect.Chan || chv.Type().ChanDir()&reflect.SendDir == 0 {
+		panic("ch argument must be a channel results may be sent on")
+	}
+	return chv
+}
+
+// send sends the results of the iterator on chv, until they are exhausted,
+// an error happens, or done is closed.
+func (iter *Iter) send(chv reflect.Value, done <-chan struct{}) {
+	elemt := chv.Type().Elem()
+	cases := []reflect.SelectCase{
+		{Dir: reflect.SelectSend, Chan: chv},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(done)},
+	}
+	for {
+		elemp := reflect.New(elemt)
+		if !iter.Next(elemp.Interface()) {
+			return
+		}
+		cases[0].Send = elemp.Elem()
+		if chosen, _, _ := reflect.Select(cases); chosen == 1 {
+			return
+		}
+	}
+}
+
 // acquireSocket acquires a socket from the same server that the iterator
 // cursor was obtained from.
 //
@@ -4545,7 +7287,7 @@ func (iter *Iter) getMore() {
 	socket, err := iter.acquireSocket()
 	iter.m.Lock()
 	if err != nil {
-		iter.err = err
+		iter.err = iter.cursorLost(err)
 		return
 	}
 	defer socket.Release()
@@ -4559,18 +7301,39 @@ func (iter *Iter) getMore() {
 		}
 	}
 	var op interface{}
+	requestId := &iter.op.requestId
 	if iter.isFindCmd || iter.isChangeStream {
-		op = iter.getMoreCmd()
+		cmd := iter.getMoreCmd(socket)
+		op = cmd
+		requestId = &cmd.requestId
 	} else {
 		op = &iter.op
 	}
-	if err := socket.Query(op); err != nil {
+	err = socket.Query(op)
+	iter.session.noteRequestId(*requestId)
+	if err != nil {
 		iter.docsToReceive--
-		iter.err = err
+		iter.err = iter.cursorLost(err)
+	}
+}
+
+// cursorLost returns a CursorLostError for err if it tells that the server
+// holding the cursor of iter is unavailable, or err itself otherwise.
+func (iter *Iter) cursorLost(err error) error {
+	if iter.op.cursorId == 0 || iter.server == nil {
+		return err
+	}
+	switch err.(type) {
+	case *QueryError, *CursorLostError:
+		return err
+	}
+	if err == errPoolLimit || err == errPoolTimeout {
+		return err
 	}
+	return &CursorLostError{Server: iter.server.Addr, Err: err}
 }
 
-func (iter *Iter) getMoreCmd() *queryOp {
+func (iter *Iter) getMoreCmd(socket *mongoSocket) *queryOp {
 	// TODO: Define the query statically in the Iter type, next to getMoreOp.
 	nameDot := strings.Index(iter.op.collection, ".")
 	if nameDot < 0 {
@@ -4585,23 +7348,33 @@ func (iter *Iter) getMoreCmd() *queryOp {
 	if iter.maxTimeMS > 0 {
 		getMore.MaxTimeMS = iter.maxTimeMS
 	}
+	if socket.ServerInfo().MaxWireVersion >= 9 {
+		// Rejected as an unknown field before 4.4.
+		getMore.Comment = iter.comment
+	}
 
 	var op queryOp
 	op.collection = iter.op.collection[:nameDot] + ".$cmd"
 	op.query = &getMore
 	op.limit = -1
 	op.replyFunc = iter.op.replyFunc
+	op.txn, op.txnFields = iter.session.txnFields()
+	op.lsid = iter.lsid
+	iter.session.m.RLock()
+	op.slowOps = iter.session.slowOps
+	iter.session.m.RUnlock()
 	return &op
 }
 
 type countCmd struct {
 	Count     string
 	Query     interface{}
-	Limit     int32      `bson:",omitempty"`
-	Skip      int32      `bson:",omitempty"`
-	Hint      bson.D     `bson:"hint,omitempty"`
-	MaxTimeMS int        `bson:"maxTimeMS,omitempty"`
-	Collation *Collation `bson:"collation,omitempty"`
+	Limit     int32       `bson:",omitempty"`
+	Skip      int32       `bson:",omitempty"`
+	Hint      interface{} `bson:"hint,omitempty"`
+	MaxTimeMS int         `bson:"maxTimeMS,omitempty"`
+	Collation *Collation  `bson:"collation,omitempty"`
+	Comment   string      `bson:"comment,omitempty"`
 }
 
 // Count returns the total number of documents in the result set.
@@ -4623,11 +7396,31 @@ func (q *Query) Count() (n int, err error) {
 	if query == nil {
 		query = bson.D{}
 	}
-	// not checking the error because if type assertion fails, we
-	// simply want a Zero bson.D
-	hint, _ := q.op.options.Hint.(bson.D)
+	op.query = query
+	if err = session.encodeQuery(&op); err != nil {
+		return 0, err
+	}
 	result := struct{ N int }{}
-	err = session.DB(dbname).Run(countCmd{cname, query, limit, op.skip, hint, op.options.MaxTimeMS, op.options.Collation}, &result)
+	cmd := countCmd{cname, op.query, limit, op.skip, op.options.Hint, op.options.MaxTimeMS, op.options.Collation, op.options.Comment}
+	if err = session.checkCommand(dbname, cmd); err != nil {
+		return 0, err
+	}
+	err = session.retryRead(func() error {
+		socket, err := session.acquireSocket(true)
+		if err != nil {
+			return err
+		}
+		defer socket.Release()
+		if err := checkCollation(socket, cmd.Collation); err != nil {
+			return err
+		}
+		cmd := cmd
+		if socket.ServerInfo().MaxWireVersion < 9 {
+			// Rejected as an unknown field before 4.4.
+			cmd.Comment = ""
+		}
+		return session.DB(dbname).run(socket, cmd, &result)
+	})
 
 	return result.N, err
 }
@@ -4637,10 +7430,43 @@ func (c *Collection) Count() (n int, err error) {
 	return c.Find(nil).Count()
 }
 
+type estimatedCountCmd struct {
+	Count     string
+	MaxTimeMS int `bson:"maxTimeMS,omitempty"`
+}
+
+// EstimatedCount returns an approximation of the number of documents in the
+// collection, taken from the collection metadata rather than by going over
+// the documents, so it's cheap regardless of the collection size. Depending
+// on the session mode, it may be served by a secondary, as other reads are.
+//
+// The estimate may be off by some documents, for instance after an unclean
+// shutdown of the server, or in sharded clusters while chunks are migrated,
+// so it should only be relied on for the order of magnitude. Use Query.Count
+// when the exact number matters.
+//
+// Relevant documentation:
+//
+//     https://docs.mongodb.com/manual/reference/method/db.collection.estimatedDocumentCount/
+//
+func (c *Collection) EstimatedCount() (n int, err error) {
+	session := c.Database.Session
+	session.m.RLock()
+	cmd := estimatedCountCmd{c.Name, session.maxTimeMS}
+	session.m.RUnlock()
+	result := struct{ N int }{}
+	err = session.retryRead(func() error {
+		return c.Database.Run(cmd, &result)
+	})
+	return result.N, err
+}
+
 type distinctCmd struct {
 	Collection string `bson:"distinct"`
 	Key        string
 	Query      interface{} `bson:",omitempty"`
+	Collation  *Collation  `bson:"collation,omitempty"`
+	MaxTimeMS  int         `bson:"maxTimeMS,omitempty"`
 }
 
 // Distinct unmarshals into result the list of distinct values for the given key.
@@ -4668,11 +7494,25 @@ func (q *Query) Distinct(key string, result interface{}) error {
 	dbname := op.collection[:c]
 	cname := op.collection[c+1:]
 
-	var doc struct{ Values bson.Raw }
-	err := session.DB(dbname).Run(distinctCmd{cname, key, op.query}, &doc)
+	if err := session.encodeQuery(&op); err != nil {
+		return err
+	}
+	cmd := distinctCmd{cname, key, op.query, op.options.Collation, op.options.MaxTimeMS}
+	if err := session.checkCommand(dbname, cmd); err != nil {
+		return err
+	}
+	socket, err := session.acquireSocket(true)
 	if err != nil {
 		return err
 	}
+	defer socket.Release()
+	if err = checkCollation(socket, cmd.Collation); err != nil {
+		return err
+	}
+	var doc struct{ Values bson.Raw }
+	if err = session.DB(dbname).run(socket, cmd, &doc); err != nil {
+		return err
+	}
 	return doc.Values.Unmarshal(result)
 }
 
@@ -4902,6 +7742,10 @@ type Change struct {
 	Upsert    bool        // Whether to insert in case the document isn't found
 	Remove    bool        // Whether to remove the document found rather than updating
 	ReturnNew bool        // Should the modified document be returned rather than the old one
+
+	// ArrayFilters determines which array elements are modified by the
+	// update. See UpdateWithArrayFilters for details.
+	ArrayFilters []bson.M
 }
 
 type findModifyCmd struct {
@@ -4909,6 +7753,12 @@ type findModifyCmd struct {
 	Query, Update, Sort, Fields interface{} `bson:",omitempty"`
 	Upsert, Remove, New         bool        `bson:",omitempty"`
 	WriteConcern                interface{} `bson:"writeConcern"`
+	Collation                   *Collation  `bson:"collation,omitempty"`
+	MaxTimeMS                   int         `bson:"maxTimeMS,omitempty"`
+	ArrayFilters                []bson.M    `bson:"arrayFilters,omitempty"`
+	Comment                     string      `bson:"comment,omitempty"`
+
+	BypassDocumentValidation bool `bson:"bypassDocumentValidation,omitempty"`
 }
 
 type valueResult struct {
@@ -4959,10 +7809,14 @@ func (q *Query) Apply(change Change, result interface{}) (info *ChangeInfo, err
 
 	dbname := op.collection[:c]
 	cname := op.collection[c+1:]
+	if err := session.checkNamespace(dbname, cname); err != nil {
+		return nil, err
+	}
 
 	// https://docs.mongodb.com/manual/reference/command/findAndModify/#dbcmd.findAndModify
 	session.m.RLock()
 	safeOp := session.safeOp
+	bypassValidation := session.bypassValidation
 	session.m.RUnlock()
 	var writeConcern interface{}
 	if safeOp == nil {
@@ -4971,9 +7825,25 @@ func (q *Query) Apply(change Change, result interface{}) (info *ChangeInfo, err
 		writeConcern = safeOp.query.(*getLastError)
 	}
 
+	if err = checkTextSearch(&op); err != nil {
+		return nil, err
+	}
+	if err = session.encodeQuery(&op); err != nil {
+		return nil, err
+	}
+	update := change.Update
+	if update != nil {
+		if interceptor := session.interceptor(); interceptor != nil {
+			update, err = interceptor(op.collection, update)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
 	cmd := findModifyCmd{
 		Collection:   cname,
-		Update:       change.Update,
+		Update:       update,
 		Upsert:       change.Upsert,
 		Remove:       change.Remove,
 		New:          change.ReturnNew,
@@ -4981,12 +7851,40 @@ func (q *Query) Apply(change Change, result interface{}) (info *ChangeInfo, err
 		Sort:         op.options.OrderBy,
 		Fields:       op.selector,
 		WriteConcern: writeConcern,
+		Collation:    op.options.Collation,
+		MaxTimeMS:    op.options.MaxTimeMS,
+		ArrayFilters: change.ArrayFilters,
+		Comment:      op.options.Comment,
+
+		BypassDocumentValidation: bypassValidation,
 	}
 
 	session = session.Clone()
 	defer session.Close()
 	session.SetMode(Strong, false)
 
+	// The socket stays reserved by the Strong session for the command.
+	socket, err := session.acquireSocket(false)
+	if err != nil {
+		return nil, err
+	}
+	serverInfo := socket.ServerInfo()
+	socket.Release()
+	wireVersion := serverInfo.MaxWireVersion
+	if bypassValidation && wireVersion < 4 {
+		return nil, errBypassValidationNotSupported
+	}
+	if len(change.ArrayFilters) > 0 && wireVersion < 6 {
+		return nil, errArrayFiltersNotSupported
+	}
+	if cmd.Collation != nil && wireVersion < 5 {
+		return nil, errCollationNotSupported
+	}
+	if wireVersion < 9 {
+		// Rejected as an unknown field before 4.4.
+		cmd.Comment = ""
+	}
+
 	var doc valueResult
 	for i := 0; i < maxUpsertRetries; i++ {
 		err = session.DB(dbname).Run(&cmd, &doc)
@@ -5007,7 +7905,11 @@ func (q *Query) Apply(change Change, result interface{}) (info *ChangeInfo, err
 		return nil, ErrNotFound
 	}
 	if doc.Value.Kind != 0x0A && result != nil {
-		err = doc.Value.Unmarshal(result)
+		if registry := session.Registry(); registry != nil && doc.Value.Kind == 0x03 {
+			err = registry.Unmarshal(doc.Value.Data, result)
+		} else {
+			err = doc.Value.Unmarshal(result)
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -5021,17 +7923,24 @@ func (q *Query) Apply(change Change, result interface{}) (info *ChangeInfo, err
 		info.Removed = lerr.N
 		info.Matched = lerr.N
 	} else if change.Upsert {
-		info.UpsertedId = lerr.UpsertedId
+		info.UpsertedId = upsertedId(lerr, cmd.Query, cmd.Update)
+	}
+	e := doc.ConcernError
+	if e.Code != 0 {
+		err = &LastError{
+			Code:         e.Code,
+			Err:          e.ErrMsg,
+			WTimeout:     e.ErrInfo.WTimeout,
+			WrittenTo:    e.ErrInfo.WrittenTo,
+			ConcernError: &WriteConcernError{Code: e.Code, Message: e.ErrMsg, WTimeout: e.ErrInfo.WTimeout},
+		}
 	}
-	if doc.ConcernError.Code != 0 {
-		var lerr LastError
-		e := doc.ConcernError
-		lerr.Code = e.Code
-		lerr.Err = e.ErrMsg
-		err = &lerr
-		return info, err
+	if safeOp != nil {
+		acknowledged := &LastError{WTimeout: e.ErrInfo.WTimeout, WrittenTo: e.ErrInfo.WrittenTo}
+		w := safeOp.query.(*getLastError).W
+		info.Acknowledged, info.majority, info.majorityErr = acknowledgement(acknowledged, err, w, serverInfo)
 	}
-	return info, nil
+	return info, err
 }
 
 // The BuildInfo type encapsulates details about the running MongoDB server.
@@ -5047,7 +7956,23 @@ type BuildInfo struct {
 	SysInfo        string `bson:"sysInfo"` // Deprecated and empty on MongoDB 3.2+.
 	Bits           int
 	Debug          bool
-	MaxObjectSize  int `bson:"maxBsonObjectSize"`
+	MaxObjectSize  int      `bson:"maxBsonObjectSize"`
+	StorageEngines []string `bson:"storageEngines"` // On MongoDB 3.2+.
+}
+
+// Major returns the major number of the BuildInfo version.
+func (bi *BuildInfo) Major() int {
+	return bi.VersionArray[0]
+}
+
+// Minor returns the minor number of the BuildInfo version.
+func (bi *BuildInfo) Minor() int {
+	return bi.VersionArray[1]
+}
+
+// Patch returns the patch number of the BuildInfo version.
+func (bi *BuildInfo) Patch() int {
+	return bi.VersionArray[2]
 }
 
 // VersionAtLeast returns whether the BuildInfo version is greater than or
@@ -5066,9 +7991,22 @@ func (bi *BuildInfo) VersionAtLeast(version ...int) bool {
 }
 
 // BuildInfo retrieves the version and other details about the
-// running MongoDB server.
+// running MongoDB server. The command is sent to any server the session
+// may read from, according to its consistency mode, and the details are
+// cached for that server until it is seen restarting, so that they may be
+// obtained whenever a version-gated decision must be made.
 func (s *Session) BuildInfo() (info BuildInfo, err error) {
-	err = s.Run(bson.D{{Name: "buildInfo", Value: "1"}}, &info)
+	socket, err := s.acquireSocket(true)
+	if err != nil {
+		return info, err
+	}
+	defer socket.Release()
+	server := socket.Server()
+	if cached := server.BuildInfo(); cached != nil {
+		return cached.copy(), nil
+	}
+
+	err = s.DB("admin").run(socket, bson.D{{Name: "buildInfo", Value: "1"}}, &info)
 	if len(info.VersionArray) == 0 {
 		for _, a := range strings.Split(info.Version, ".") {
 			i, err := strconv.Atoi(a)
@@ -5089,25 +8027,298 @@ func (s *Session) BuildInfo() (info BuildInfo, err error) {
 	if info.SysInfo == "deprecated" {
 		info.SysInfo = ""
 	}
+	if err == nil {
+		cached := info.copy()
+		server.SetBuildInfo(&cached)
+	}
 	return
 }
 
+// copy returns a copy of bi which shares no slices with it.
+func (bi *BuildInfo) copy() BuildInfo {
+	info := *bi
+	info.VersionArray = append([]int(nil), bi.VersionArray...)
+	if bi.StorageEngines != nil {
+		info.StorageEngines = append([]string(nil), bi.StorageEngines...)
+	}
+	return info
+}
+
+// ReplicaSetConfig holds the configuration of a replica set, as reported
+// by the replSetGetConfig command.
+type ReplicaSetConfig struct {
+	Name    string             `bson:"_id"`
+	Version int                `bson:"version"`
+	Members []ReplicaSetMember `bson:"members"`
+}
+
+// ReplicaSetMember holds the configuration of a single replica set member.
+type ReplicaSetMember struct {
+	Id          int     `bson:"_id"`
+	Host        string  `bson:"host"`
+	Priority    float64 `bson:"priority"`
+	Votes       int     `bson:"votes"`
+	Hidden      bool    `bson:"hidden"`
+	ArbiterOnly bool    `bson:"arbiterOnly"`
+	Tags        bson.D  `bson:"tags,omitempty"`
+}
+
+// ReplicaSetConfig retrieves the configuration of the replica set from its
+// primary. Unlike the topology the driver discovers by itself, it includes
+// every configured member, whatever its current state.
+//
+// The replSetGetConfig command was introduced in MongoDB 3.0.
+//
+// Relevant documentation:
+//
+//     https://docs.mongodb.com/manual/reference/command/replSetGetConfig/
+//
+func (s *Session) ReplicaSetConfig() (config *ReplicaSetConfig, err error) {
+	var result struct {
+		Config ReplicaSetConfig `bson:"config"`
+	}
+	err = s.DB("admin").RunOnPrimary(bson.D{{Name: "replSetGetConfig", Value: 1}}, &result)
+	if err != nil {
+		return nil, err
+	}
+	return &result.Config, nil
+}
+
+// replicationPollDelay is how long WaitForReplication waits between
+// checks of the replica set status.
+const replicationPollDelay = 100 * time.Millisecond
+
+var errNoOpTime = errors.New("no optime to wait for replication of")
+
+// replSetStatus holds the parts of the replSetGetStatus reply needed to
+// tell how far members got in replicating the primary oplog.
+type replSetStatus struct {
+	Members []struct {
+		Name       string    `bson:"name"`
+		State      int       `bson:"state"`
+		OpTime     bson.Raw  `bson:"optime"`
+		OpTimeDate time.Time `bson:"optimeDate"`
+	} `bson:"members"`
+}
+
+// member returns the optime of the last operation applied by the named
+// member, and how far behind the primary it is, if both are found.
+func (status *replSetStatus) member(name string) (applied bson.MongoTimestamp, lag time.Duration, ok bool) {
+	var primary, member time.Time
+	for _, m := range status.Members {
+		if m.State == 1 {
+			primary = m.OpTimeDate
+		}
+		if m.Name == name {
+			applied = opTimestamp(m.OpTime)
+			member = m.OpTimeDate
+			ok = true
+		}
+	}
+	if ok && !primary.IsZero() && primary.After(member) {
+		lag = primary.Sub(member)
+	}
+	return applied, lag, ok
+}
+
+// opTimestamp returns the timestamp of the optime in raw, which is either
+// a timestamp itself, or a document holding it in the ts field along with
+// the election term, as in replica sets using protocol version 1.
+func opTimestamp(raw bson.Raw) bson.MongoTimestamp {
+	var ts bson.MongoTimestamp
+	switch raw.Kind {
+	case 0x11:
+		raw.Unmarshal(&ts)
+	case 0x03:
+		var opTime struct {
+			Ts bson.MongoTimestamp `bson:"ts"`
+		}
+		if raw.Unmarshal(&opTime) == nil {
+			ts = opTime.Ts
+		}
+	}
+	return ts
+}
+
+// WaitForReplication waits until the replica set member with the given
+// address, as named in the replica set configuration, has applied the
+// operation with the given optime, such as the OpTime of the LastError of
+// a write, or until the timeout expires. It returns whether the member
+// caught up in time, and its replication lag behind the primary as last
+// observed.
+//
+// Unlike write concerns, which count acknowledgements from any members,
+// this confirms that a write reached a specific member before, for
+// example, reading it back from there:
+//
+//     err := collection.Insert(doc)
+//     if err != nil {
+//         return err
+//     }
+//     opTime := session.LastError().OpTime
+//     caughtUp, lag, err := session.WaitForReplication("analytics.example.com:27017", opTime, 10*time.Second)
+//     if err != nil {
+//         return err
+//     }
+//     if !caughtUp {
+//         return fmt.Errorf("analytics member is lagging behind by %v", lag)
+//     }
+//
+// The status of the member is checked with the replSetGetStatus command
+// on the primary, repeatedly until it caught up.
+//
+// Relevant documentation:
+//
+//     https://docs.mongodb.com/manual/reference/command/replSetGetStatus/
+//
+func (s *Session) WaitForReplication(member string, opTime bson.MongoTimestamp, timeout time.Duration) (caughtUp bool, lag time.Duration, err error) {
+	if opTime == 0 {
+		return false, 0, errNoOpTime
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		var status replSetStatus
+		err := s.DB("admin").RunOnPrimary(bson.D{{Name: "replSetGetStatus", Value: 1}}, &status)
+		if err != nil {
+			return false, 0, err
+		}
+		applied, lag, ok := status.member(member)
+		if !ok {
+			return false, 0, fmt.Errorf("replica set member %s not found", member)
+		}
+		if applied >= opTime {
+			return true, lag, nil
+		}
+		delay := time.Until(deadline)
+		if delay <= 0 {
+			return false, lag, nil
+		}
+		if delay > replicationPollDelay {
+			delay = replicationPollDelay
+		}
+		time.Sleep(delay)
+	}
+}
+
+// CurrentOperation holds details about an operation in progress on the
+// server, as reported by the currentOp command.
+type CurrentOperation struct {
+	// OpId identifies the operation, and may be provided to KillOp.
+	// It's an integer when reported by a mongod server, and a string
+	// prefixed with the shard name when reported by a mongos.
+	OpId interface{} `bson:"opid"`
+
+	Active           bool
+	Op               string `bson:"op"`
+	Namespace        string `bson:"ns"`
+	Client           string `bson:"client"`
+	Desc             string `bson:"desc"`
+	SecsRunning      int    `bson:"secs_running"`
+	MicrosecsRunning int64  `bson:"microsecs_running"`
+	Command          bson.M `bson:"command,omitempty"`
+	WaitingForLock   bool   `bson:"waitingForLock"`
+}
+
+// CurrentOp returns the operations currently in progress on the primary
+// server, which may be inspected to find long running operations.
+// Idle connections and system operations are left out.
+//
+// Relevant documentation:
+//
+//     https://docs.mongodb.com/manual/reference/command/currentOp/
+//
+func (s *Session) CurrentOp() (ops []CurrentOperation, err error) {
+	return s.currentOp(bson.D{{Name: "currentOp", Value: 1}})
+}
+
+func (s *Session) currentOp(cmd bson.D) (ops []CurrentOperation, err error) {
+	var result struct {
+		InProg []CurrentOperation `bson:"inprog"`
+	}
+	err = s.DB("admin").RunOnPrimary(cmd, &result)
+	if err != nil {
+		return nil, err
+	}
+	return result.InProg, nil
+}
+
+// KillOp terminates the operation in progress on the primary server with
+// the given opid, as reported by CurrentOp, and returns whether such an
+// operation was found. The server terminates the operation at its next
+// interruption point, so it may take effect after KillOp returns.
+//
+// Relevant documentation:
+//
+//     https://docs.mongodb.com/manual/reference/command/killOp/
+//
+func (s *Session) KillOp(opid interface{}) (killed bool, err error) {
+	// Integer opids are 32-bit wide on mongod, and must be sent as such.
+	switch id := opid.(type) {
+	case int:
+		if id >= math.MinInt32 && id <= math.MaxInt32 {
+			opid = int32(id)
+		}
+	case int64:
+		if id >= math.MinInt32 && id <= math.MaxInt32 {
+			opid = int32(id)
+		}
+	case float64:
+		if id >= math.MinInt32 && id <= math.MaxInt32 && id == math.Trunc(id) {
+			opid = int32(id)
+		}
+	}
+	ops, err := s.currentOp(bson.D{
+		{Name: "currentOp", Value: 1},
+		{Name: "$all", Value: true},
+		{Name: "opid", Value: opid},
+	})
+	if err != nil || len(ops) == 0 {
+		return false, err
+	}
+	err = s.DB("admin").RunOnPrimary(bson.D{{Name: "killOp", Value: 1}, {Name: "op", Value: opid}}, nil)
+	return err == nil, err
+}
+
 // ---------------------------------------------------------------------------
 // Internal session handling helpers.
 
 func (s *Session) acquireSocket(slaveOk bool) (*mongoSocket, error) {
+	s.m.RLock()
+	anyServer := slaveOk && s.slaveOk
+	s.m.RUnlock()
+	socket, err := s.acquireAnySocket(slaveOk)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.checkFrozen(socket, anyServer); err != nil {
+		socket.Release()
+		return nil, err
+	}
+	s.prepareServerSession(socket)
+	return socket, nil
+}
+
+// acquireAnySocket works like acquireSocket, regardless of the topology
+// frozen with FreezeTopology.
+func (s *Session) acquireAnySocket(slaveOk bool) (*mongoSocket, error) {
 
 	// Read-only lock to check for previously reserved socket.
 	s.m.RLock()
+	// Operations within a transaction must all go through the same socket.
+	if s.txn != nil {
+		txn := s.txn
+		s.m.RUnlock()
+		return txn.acquireSocket()
+	}
 	// If there is a slave socket reserved and its use is acceptable, take it as long
 	// as there isn't a master socket which would be preferred by the read preference mode.
-	if s.slaveSocket != nil && s.slaveSocket.dead == nil && s.slaveOk && slaveOk && (s.masterSocket == nil || s.consistency != PrimaryPreferred && s.consistency != Monotonic) {
+	if s.slaveSocket != nil && s.slaveSocket.reservable() && s.slaveOk && slaveOk && (s.masterSocket == nil || s.consistency != PrimaryPreferred && s.consistency != Monotonic) {
 		socket := s.slaveSocket
 		socket.Acquire()
 		s.m.RUnlock()
 		return socket, nil
 	}
-	if s.masterSocket != nil && s.masterSocket.dead == nil {
+	if s.masterSocket != nil && s.masterSocket.reservable() {
 		socket := s.masterSocket
 		socket.Acquire()
 		s.m.RUnlock()
@@ -5121,23 +8332,28 @@ func (s *Session) acquireSocket(slaveOk bool) (*mongoSocket, error) {
 	defer s.m.Unlock()
 
 	if s.slaveSocket != nil && s.slaveOk && slaveOk && (s.masterSocket == nil || s.consistency != PrimaryPreferred && s.consistency != Monotonic) {
-		if s.slaveSocket.dead == nil {
+		if s.slaveSocket.reservable() {
 			s.slaveSocket.Acquire()
 			return s.slaveSocket, nil
 		} else {
+			debugf("Session %p: reserved slave socket to %s is no longer usable", s, s.slaveSocket.addr)
 			s.unsetSocket()
 		}
 	}
 	if s.masterSocket != nil {
-		if s.masterSocket.dead == nil {
+		if s.masterSocket.reservable() {
 			s.masterSocket.Acquire()
 			return s.masterSocket, nil
 		} else {
+			debugf("Session %p: reserved master socket to %s is no longer usable", s, s.masterSocket.addr)
 			s.unsetSocket()
 		}
 	}
 
-	// Still not good.  We need a new socket.
+	// Still not good.  We need a new socket. The session credentials are
+	// replayed on it and the consistency mode is preserved, so that the
+	// session resumes transparently after the cluster recovers from an
+	// outage that killed its reserved sockets.
 	sock, err := s.cluster().AcquireSocketWithPoolTimeout(
 		s.consistency,
 		slaveOk && s.slaveOk,
@@ -5188,6 +8404,54 @@ func (s *Session) setSocket(socket *mongoSocket) {
 	}
 }
 
+// ServerLimits holds the limits advertised by a server.
+type ServerLimits struct {
+	MaxBsonObjectSize   int // Maximum size of a document, in bytes
+	MaxMessageSizeBytes int // Maximum size of a wire protocol message
+	MaxWriteBatchSize   int // Maximum number of operations in a write command
+}
+
+// ServerLimits returns the limits advertised by the server that writes
+// in the session are sent to. Write operations involving more documents
+// than the server accepts at once are automatically split in several
+// write commands, and their results are aggregated.
+func (s *Session) ServerLimits() (limits ServerLimits, err error) {
+	// Don't let a Monotonic session switch over to the master.
+	clone := s.Clone()
+	defer clone.Close()
+	socket, err := clone.acquireSocket(false)
+	if err != nil {
+		return limits, err
+	}
+	info := socket.ServerInfo()
+	socket.Release()
+	limits.MaxBsonObjectSize = info.MaxBsonObjectSize
+	limits.MaxMessageSizeBytes = info.MaxMessageSizeBytes
+	limits.MaxWriteBatchSize = info.maxWriteBatchSize()
+	return limits, nil
+}
+
+// PinnedServer returns the address of the server the session is pinned to,
+// and whether it is pinned at all. A session is pinned once it reserves a
+// socket as defined by its consistency mode, and keeps sending operations
+// to the same server while it's healthy and part of the cluster, or until
+// the session is refreshed. See the Session.SetMode method for details.
+//
+// When the session holds both a primary and a secondary socket, the server
+// reported is the one reads are sent to.
+func (s *Session) PinnedServer() (addr string, pinned bool) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	socket := s.masterSocket
+	if s.slaveSocket != nil && s.slaveOk && (s.masterSocket == nil || s.consistency != PrimaryPreferred && s.consistency != Monotonic) {
+		socket = s.slaveSocket
+	}
+	if socket == nil || !socket.reservable() {
+		return "", false
+	}
+	return socket.addr, true
+}
+
 // unsetSocket releases any slave and/or master sockets reserved.
 func (s *Session) unsetSocket() {
 	if s.masterSocket != nil {
@@ -5207,7 +8471,7 @@ func (iter *Iter) replyFunc() replyFunc {
 		iter.m.Lock()
 		iter.docsToReceive--
 		if err != nil {
-			iter.err = err
+			iter.err = iter.cursorLost(err)
 			debugf("Iter %p received an error: %s", iter, err.Error())
 		} else if docNum == -1 {
 			debugf("Iter %p received no documents (cursor=%d).", iter, op.cursorId)
@@ -5282,11 +8546,18 @@ type writeCmdResult struct {
 	}
 	ConcernError writeConcernError `bson:"writeConcernError"`
 	Errors       []writeCmdError   `bson:"writeErrors"`
+
+	OpTime        bson.Raw            `bson:"opTime"`
+	OperationTime bson.MongoTimestamp `bson:"operationTime"`
 }
 
 type writeConcernError struct {
-	Code   int
-	ErrMsg string
+	Code    int
+	ErrMsg  string
+	ErrInfo struct {
+		WTimeout  bool     `bson:"wtimeout"`
+		WrittenTo []string `bson:"writtenTo"`
+	} `bson:"errInfo"`
 }
 
 type writeCmdError struct {
@@ -5308,7 +8579,103 @@ func (r *writeCmdResult) BulkErrorCases() []BulkErrorCase {
 // LastError result is made available in lerr, and if lerr.Err is set it
 // will also be returned as err.
 func (c *Collection) writeOp(op interface{}, ordered bool) (lerr *LastError, err error) {
+	op, err = c.interceptWrite(op)
+	if err != nil {
+		return nil, err
+	}
+	return c.runWriteOp(op, ordered)
+}
+
+// interceptWrite returns op with its documents replaced by the ones returned
+// by the session write interceptor and marshalled with the session registry,
+// or op itself if there's neither. The selectors of updates and removals
+// aren't intercepted, but are marshalled with the registry as well.
+// The provided op and its documents are left untouched.
+func (c *Collection) interceptWrite(op interface{}) (interface{}, error) {
+	interceptor := c.Database.Session.interceptor()
+	if interceptor == nil {
+		return op, nil
+	}
+	registry := c.Database.Session.Registry()
+	encodeSelector := func(selector interface{}) (interface{}, error) {
+		if registry == nil {
+			return selector, nil
+		}
+		return marshalRaw(registry, selector)
+	}
+	interceptUpdate := func(op *updateOp) (*updateOp, error) {
+		selector, err := encodeSelector(op.Selector)
+		if err != nil {
+			return nil, err
+		}
+		update, err := interceptor(c.FullName, op.Update)
+		if err != nil {
+			return nil, err
+		}
+		intercepted := *op
+		intercepted.Selector = selector
+		intercepted.Update = update
+		return &intercepted, nil
+	}
+	interceptDelete := func(op *deleteOp) (*deleteOp, error) {
+		selector, err := encodeSelector(op.Selector)
+		if err != nil {
+			return nil, err
+		}
+		intercepted := *op
+		intercepted.Selector = selector
+		return &intercepted, nil
+	}
+	switch op := op.(type) {
+	case *insertOp:
+		docs := make([]interface{}, len(op.documents))
+		for i, doc := range op.documents {
+			doc, err := interceptor(c.FullName, doc)
+			if err != nil {
+				return nil, err
+			}
+			docs[i] = doc
+		}
+		return &insertOp{op.collection, docs, op.flags}, nil
+	case *updateOp:
+		return interceptUpdate(op)
+	case bulkUpdateOp:
+		ops := make(bulkUpdateOp, len(op))
+		for i, doc := range op {
+			doc, err := interceptUpdate(doc.(*updateOp))
+			if err != nil {
+				return nil, err
+			}
+			ops[i] = doc
+		}
+		return ops, nil
+	case *deleteOp:
+		return interceptDelete(op)
+	case bulkDeleteOp:
+		ops := make(bulkDeleteOp, len(op))
+		for i, doc := range op {
+			doc, err := interceptDelete(doc.(*deleteOp))
+			if err != nil {
+				return nil, err
+			}
+			ops[i] = doc
+		}
+		return ops, nil
+	}
+	return op, nil
+}
+
+// runWriteOp sends op to the server as writeOp does, without intercepting it.
+func (c *Collection) runWriteOp(op interface{}, ordered bool) (lerr *LastError, err error) {
 	s := c.Database.Session
+	defer func() {
+		s.m.Lock()
+		s.lastError = lerr
+		s.m.Unlock()
+	}()
+	if err := s.checkNamespace(c.Database.Name, c.Name); err != nil {
+		return nil, err
+	}
 	socket, err := s.acquireSocket(c.Database.Name == "local")
 	if err != nil {
 		return nil, err
@@ -5320,28 +8687,54 @@ func (c *Collection) writeOp(op interface{}, ordered bool) (lerr *LastError, err
 	bypassValidation := s.bypassValidation
 	s.m.RUnlock()
 
+	defer func() {
+		if lerr != nil && safeOp != nil {
+			w := safeOp.query.(*getLastError).W
+			lerr.acknowledged, lerr.majority, lerr.majorityErr = acknowledgement(lerr, err, w, socket.ServerInfo())
+		}
+	}()
+
+	if bypassValidation && socket.ServerInfo().MaxWireVersion < 4 {
+		return nil, errBypassValidationNotSupported
+	}
+	if op, ok := op.(*updateOp); ok && len(op.ArrayFilters) > 0 && socket.ServerInfo().MaxWireVersion < 6 {
+		return nil, errArrayFiltersNotSupported
+	}
+	if safeOp != nil && socket.ServerInfo().MaxWireVersion == 0 {
+		safeOp, err = translateMajority(socket.ServerInfo(), safeOp)
+		if err != nil {
+			return nil, err
+		}
+	}
 	if socket.ServerInfo().MaxWireVersion >= 2 {
 		// Servers with a more recent write protocol benefit from write commands.
-		if op, ok := op.(*insertOp); ok && len(op.documents) > 1000 {
+		batchSize := socket.ServerInfo().maxWriteBatchSize()
+		if op, ok := op.(*insertOp); ok && len(op.documents) > batchSize {
 			var lerr LastError
 
-			// Maximum batch size is 1000. Must split out in separate operations for compatibility.
+			// Must split out in separate operations to fit the maximum batch size.
 			all := op.documents
-			for i := 0; i < len(all); i += 1000 {
-				l := i + 1000
+			for i := 0; i < len(all); i += batchSize {
+				l := i + batchSize
 				if l > len(all) {
 					l = len(all)
 				}
 				op.documents = all[i:l]
 				oplerr, err := c.writeOpCommand(socket, safeOp, op, ordered, bypassValidation)
+				if oplerr == nil {
+					// Unacknowledged writes.
+					continue
+				}
 				lerr.N += oplerr.N
 				lerr.modified += oplerr.modified
+				lerr.noteOpTime(oplerr)
 				if err != nil {
 					for ei := range oplerr.ecases {
 						oplerr.ecases[ei].Index += i
 					}
 					lerr.ecases = append(lerr.ecases, oplerr.ecases...)
-					if op.flags&1 == 0 {
+					lerr.noteConcernError(oplerr)
+					if op.flags&1 == 0 && len(oplerr.ecases) > 0 {
 						return &lerr, err
 					}
 				}
@@ -5349,24 +8742,33 @@ func (c *Collection) writeOp(op interface{}, ordered bool) (lerr *LastError, err
 			if len(lerr.ecases) != 0 {
 				return &lerr, lerr.ecases[0].Err
 			}
+			if lerr.ConcernError != nil {
+				return &lerr, &lerr
+			}
 			return &lerr, nil
 		}
-		if updateOp, ok := op.(bulkUpdateOp); ok && len(updateOp) > 1000 {
+		if updateOp, ok := op.(bulkUpdateOp); ok && len(updateOp) > batchSize {
 			var lerr LastError
 
-			// Maximum batch size is 1000. Must split out in separate operations for compatibility.
-			for i := 0; i < len(updateOp); i += 1000 {
-				l := i + 1000
+			// Must split out in separate operations to fit the maximum batch size.
+			for i := 0; i < len(updateOp); i += batchSize {
+				l := i + batchSize
 				if l > len(updateOp) {
 					l = len(updateOp)
 				}
 
 				oplerr, err := c.writeOpCommand(socket, safeOp, updateOp[i:l], ordered, bypassValidation)
+				if oplerr == nil {
+					// Unacknowledged writes.
+					continue
+				}
 
 				lerr.N += oplerr.N
 				lerr.modified += oplerr.modified
+				lerr.noteOpTime(oplerr)
 				if err != nil {
 					lerr.ecases = append(lerr.ecases, BulkErrorCase{i, err})
+					lerr.noteConcernError(oplerr)
 					if ordered {
 						break
 					}
@@ -5377,22 +8779,28 @@ func (c *Collection) writeOp(op interface{}, ordered bool) (lerr *LastError, err
 			}
 			return &lerr, nil
 		}
-		if deleteOps, ok := op.(bulkDeleteOp); ok && len(deleteOps) > 1000 {
+		if deleteOps, ok := op.(bulkDeleteOp); ok && len(deleteOps) > batchSize {
 			var lerr LastError
 
-			// Maximum batch size is 1000. Must split out in separate operations for compatibility.
-			for i := 0; i < len(deleteOps); i += 1000 {
-				l := i + 1000
+			// Must split out in separate operations to fit the maximum batch size.
+			for i := 0; i < len(deleteOps); i += batchSize {
+				l := i + batchSize
 				if l > len(deleteOps) {
 					l = len(deleteOps)
 				}
 
 				oplerr, err := c.writeOpCommand(socket, safeOp, deleteOps[i:l], ordered, bypassValidation)
+				if oplerr == nil {
+					// Unacknowledged writes.
+					continue
+				}
 
 				lerr.N += oplerr.N
 				lerr.modified += oplerr.modified
+				lerr.noteOpTime(oplerr)
 				if err != nil {
 					lerr.ecases = append(lerr.ecases, BulkErrorCase{i, err})
+					lerr.noteConcernError(oplerr)
 					if ordered {
 						break
 					}
@@ -5410,8 +8818,10 @@ func (c *Collection) writeOp(op interface{}, ordered bool) (lerr *LastError, err
 			oplerr, err := c.writeOpQuery(socket, safeOp, updateOp, ordered)
 			lerr.N += oplerr.N
 			lerr.modified += oplerr.modified
+			lerr.noteOpTime(oplerr)
 			if err != nil {
 				lerr.ecases = append(lerr.ecases, BulkErrorCase{i, err})
+				lerr.noteConcernError(oplerr)
 				if ordered {
 					break
 				}
@@ -5427,8 +8837,10 @@ func (c *Collection) writeOp(op interface{}, ordered bool) (lerr *LastError, err
 			oplerr, err := c.writeOpQuery(socket, safeOp, deleteOp, ordered)
 			lerr.N += oplerr.N
 			lerr.modified += oplerr.modified
+			lerr.noteOpTime(oplerr)
 			if err != nil {
 				lerr.ecases = append(lerr.ecases, BulkErrorCase{i, err})
+				lerr.noteConcernError(oplerr)
 				if ordered {
 					break
 				}
@@ -5442,6 +8854,30 @@ func (c *Collection) writeOp(op interface{}, ordered bool) (lerr *LastError, err
 	return c.writeOpQuery(socket, safeOp, op, ordered)
 }
 
+// translateMajority returns safeOp with a "majority" write concern replaced
+// by the number of members making a majority of the replica set, according
+// to the server described by info. This is done with servers that predate
+// the wire protocol versioning, as the oldest of them choke on "majority".
+// Other write concerns and those sent to mongos are left untouched.
+func translateMajority(info *mongoServerInfo, safeOp *queryOp) (*queryOp, error) {
+	lastError := safeOp.query.(*getLastError)
+	if lastError.W != "majority" || info.Mongos {
+		return safeOp, nil
+	}
+	w := 1
+	if info.SetName != "" {
+		if info.Members == 0 {
+			return nil, errMajorityUnknown
+		}
+		w = info.Members/2 + 1
+	}
+	translated := *lastError
+	translated.W = w
+	op := *safeOp
+	op.query = &translated
+	return &op, nil
+}
+
 func (c *Collection) writeOpQuery(socket *mongoSocket, safeOp *queryOp, op interface{}, ordered bool) (lerr *LastError, err error) {
 	if safeOp == nil {
 		return nil, socket.Query(op)
@@ -5459,6 +8895,7 @@ func (c *Collection) writeOpQuery(socket *mongoSocket, safeOp *queryOp, op inter
 		mutex.Unlock()
 	}
 	err = socket.Query(op, &query)
+	c.Database.Session.noteRequestId(query.requestId)
 	if err != nil {
 		return nil, err
 	}
@@ -5476,6 +8913,9 @@ func (c *Collection) writeOpQuery(socket *mongoSocket, safeOp *queryOp, op inter
 	result := &LastError{}
 	bson.Unmarshal(replyData, &result)
 	debugf("Result from writing query: %#v", result)
+	if result.WTimeout {
+		result.ConcernError = &WriteConcernError{Code: result.Code, Message: result.Err, WTimeout: true}
+	}
 	if result.Err != "" {
 		result.ecases = []BulkErrorCase{{Index: 0, Err: result}}
 		if insert, ok := op.(*insertOp); ok && len(insert.documents) > 1 {
@@ -5514,6 +8954,10 @@ func (c *Collection) writeOpCommand(socket *mongoSocket, safeOp *queryOp, op int
 			{Name: "writeConcern", Value: writeConcern},
 			{Name: "ordered", Value: ordered},
 		}
+		if op.Comment != "" && socket.ServerInfo().MaxWireVersion >= 9 {
+			// Rejected as an unknown field before 4.4.
+			cmd = append(cmd, bson.DocElem{Name: "comment", Value: op.Comment})
+		}
 	case bulkUpdateOp:
 		// http://docs.mongodb.org/manual/reference/command/update
 		cmd = bson.D{
@@ -5557,15 +9001,22 @@ func (c *Collection) writeOpCommand(socket *mongoSocket, safeOp *queryOp, op int
 	if len(result.Upserted) > 0 {
 		lerr.UpsertedId = result.Upserted[0].Id
 	}
+	if lerr.OpTime = opTimestamp(result.OpTime); lerr.OpTime == 0 {
+		lerr.OpTime = result.OperationTime
+	}
+	if e := result.ConcernError; e.Code != 0 {
+		lerr.ConcernError = &WriteConcernError{Code: e.Code, Message: e.ErrMsg, WTimeout: e.ErrInfo.WTimeout}
+	}
 	if len(result.Errors) > 0 {
 		e := result.Errors[0]
 		lerr.Code = e.Code
 		lerr.Err = e.ErrMsg
 		err = lerr
-	} else if result.ConcernError.Code != 0 {
-		e := result.ConcernError
+	} else if lerr.ConcernError != nil {
+		e := lerr.ConcernError
 		lerr.Code = e.Code
-		lerr.Err = e.ErrMsg
+		lerr.Err = e.Message
+		lerr.WTimeout = e.WTimeout
 		err = lerr
 	}
 
@@ -1,8 +1,21 @@
 package mgo
 
 import (
+	"bytes"
 	"crypto/x509/pkix"
 	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -83,3 +96,2842 @@ func (s *S) TestDialTimeouts(c *C) {
 	info.WriteTimeout = time.Second
 	c.Assert(info.writeTimeout(), Equals, time.Second)
 }
+
+func (s *S) TestNearestStableWithNoisyPings(c *C) {
+	near := &mongoServer{Addr: "near", info: &mongoServerInfo{}}
+	far := &mongoServer{Addr: "far", info: &mongoServerInfo{}}
+	servers := &mongoServers{}
+	servers.Add(near)
+	servers.Add(far)
+
+	// Ties within the threshold are broken randomly in the Nearest mode,
+	// so fix the source for the selection to be reproducible.
+	SetSelectionRand(rand.NewSource(42))
+	defer SetSelectionRand(nil)
+
+	nearPings := []time.Duration{10, 12, 9, 80, 11, 10, 60, 9, 10, 12}
+	farPings := []time.Duration{40, 38, 41, 39, 42, 40, 39, 41, 40, 38}
+	for i := range nearPings {
+		near.recordPing(nearPings[i] * time.Millisecond)
+		far.recordPing(farPings[i] * time.Millisecond)
+		best := servers.BestFit(Nearest, nil, 15*time.Millisecond)
+		c.Assert(best, Equals, near, Commentf("sample %d", i))
+	}
+
+	// A lasting change must move the selection eventually.
+	for i := 0; i < 10; i++ {
+		near.recordPing(80 * time.Millisecond)
+		far.recordPing(40 * time.Millisecond)
+	}
+	c.Assert(servers.BestFit(Nearest, nil, 15*time.Millisecond), Equals, far)
+}
+
+func (s *S) TestRecoveringServerBackoff(c *C) {
+	server := &mongoServer{Addr: "recovering", info: &mongoServerInfo{}}
+	other := &mongoServer{Addr: "other", info: &mongoServerInfo{}}
+	servers := &mongoServers{}
+	servers.Add(server)
+	servers.Add(other)
+
+	var delays []time.Duration
+	for i := 0; i < 8; i++ {
+		delays = append(delays, server.setRecovering(true))
+	}
+	c.Assert(delays, DeepEquals, []time.Duration{
+		1 * time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second,
+		16 * time.Second, 30 * time.Second, 30 * time.Second, 30 * time.Second,
+	})
+
+	recovering, retry := server.Recovering()
+	c.Assert(recovering, Equals, true)
+	c.Assert(retry.After(time.Now()), Equals, true)
+	c.Assert(servers.RecoveringLen(), Equals, 1)
+	for _, mode := range []Mode{Secondary, SecondaryPreferred, Nearest} {
+		c.Assert(servers.BestFit(mode, nil, 15*time.Millisecond), Equals, other)
+	}
+
+	c.Assert(server.setRecovering(false), Equals, time.Duration(0))
+	recovering, _ = server.Recovering()
+	c.Assert(recovering, Equals, false)
+	c.Assert(servers.RecoveringLen(), Equals, 0)
+	c.Assert(server.setRecovering(true), Equals, time.Second)
+}
+
+func (s *S) TestBestFitSeedGroups(c *C) {
+	master := &mongoServer{Addr: "master", info: &mongoServerInfo{Master: true}, groupPriority: 1, pingValue: 50 * time.Millisecond}
+	local := &mongoServer{Addr: "local", info: &mongoServerInfo{}, groupPriority: 1, pingValue: 50 * time.Millisecond}
+	remote := &mongoServer{Addr: "remote", info: &mongoServerInfo{}}
+	servers := &mongoServers{}
+	servers.Add(remote)
+	servers.Add(master)
+	servers.Add(local)
+
+	// The local group is preferred even though the remote server is nearer.
+	for _, mode := range []Mode{Secondary, SecondaryPreferred} {
+		c.Assert(servers.BestFit(mode, nil, 15*time.Millisecond), Equals, local, Commentf("mode %d", mode))
+	}
+	c.Assert(servers.BestFit(PrimaryPreferred, nil, 15*time.Millisecond), Equals, master)
+	c.Assert(servers.BestFit(Nearest, nil, 15*time.Millisecond).groupPriority, Equals, 1)
+
+	// With no usable secondary left in the local group, Secondary reads
+	// fall back to the remote group, while SecondaryPreferred ones stay
+	// on the local master.
+	local.setRecovering(true)
+	c.Assert(servers.BestFit(Secondary, nil, 15*time.Millisecond), Equals, remote)
+	c.Assert(servers.BestFit(SecondaryPreferred, nil, 15*time.Millisecond), Equals, master)
+}
+
+func (s *S) TestHelloResultParsing(c *C) {
+	reply := bson.M{
+		"isWritablePrimary": true,
+		"secondary":         false,
+		"setName":           "rs1",
+		"primary":           "localhost:40011",
+		"hosts":             []string{"localhost:40011", "localhost:40012"},
+		"maxWireVersion":    13,
+		"maxBsonObjectSize": 16777216,
+		"ok":                1,
+	}
+	data, err := bson.Marshal(reply)
+	c.Assert(err, IsNil)
+
+	var result isMasterResult
+	c.Assert(bson.Unmarshal(data, &result), IsNil)
+	result.normalize()
+	c.Assert(result.IsMaster, Equals, true)
+	c.Assert(result.Secondary, Equals, false)
+	c.Assert(result.SetName, Equals, "rs1")
+	c.Assert(result.Primary, Equals, "localhost:40011")
+	c.Assert(result.Hosts, DeepEquals, []string{"localhost:40011", "localhost:40012"})
+	c.Assert(result.MaxWireVersion, Equals, 13)
+	c.Assert(result.MaxBsonObjectSize, Equals, 16777216)
+
+	// Replies to isMaster are unaffected.
+	data, err = bson.Marshal(bson.M{"ismaster": false, "secondary": true, "ok": 1})
+	c.Assert(err, IsNil)
+	result = isMasterResult{}
+	c.Assert(bson.Unmarshal(data, &result), IsNil)
+	result.normalize()
+	c.Assert(result.IsMaster, Equals, false)
+	c.Assert(result.Secondary, Equals, true)
+}
+
+func (s *S) TestSyncFailureThreshold(c *C) {
+	info := &DialInfo{SyncFailureThreshold: 3}
+	threshold := info.syncFailureThreshold()
+	server := &mongoServer{Addr: "flaky", info: &mongoServerInfo{}}
+
+	// Alternating failures and successes never reach the threshold.
+	for i := 0; i < 10; i++ {
+		c.Assert(server.syncFailed(threshold), Equals, false)
+		server.syncSucceeded()
+	}
+
+	c.Assert(server.syncFailed(threshold), Equals, false)
+	c.Assert(server.syncFailed(threshold), Equals, false)
+	c.Assert(server.syncFailed(threshold), Equals, true)
+
+	// The default matches the original behavior of demoting on the
+	// first failure.
+	server.syncSucceeded()
+	c.Assert(server.syncFailed((&DialInfo{}).syncFailureThreshold()), Equals, true)
+}
+
+func (s *S) TestUpdateDynaSeedsDropsRemovedMembers(c *C) {
+	a := &mongoServer{Addr: "a:27017", ResolvedAddr: "10.0.0.1:27017", info: &mongoServerInfo{}}
+	b := &mongoServer{Addr: "b:27017", ResolvedAddr: "10.0.0.2:27017", info: &mongoServerInfo{}}
+	removed := &mongoServer{Addr: "c:27017", ResolvedAddr: "10.0.0.3:27017", info: &mongoServerInfo{}}
+	flaky := &mongoServer{Addr: "d:27017", ResolvedAddr: "10.0.0.4:27017", info: &mongoServerInfo{}}
+
+	cluster := &mongoCluster{}
+	for _, server := range []*mongoServer{a, b, removed, flaky} {
+		cluster.servers.Add(server)
+	}
+	cluster.updateDynaSeeds()
+	c.Assert(cluster.dynaSeeds, DeepEquals, []string{"a:27017", "b:27017", "c:27017", "d:27017"})
+
+	// The member leaves the set, and another one fails its check.
+	cluster.servers.Remove(removed)
+	flaky.syncFailed(2)
+	cluster.updateDynaSeeds()
+	c.Assert(cluster.dynaSeeds, DeepEquals, []string{"a:27017", "b:27017"})
+
+	flaky.syncSucceeded()
+	cluster.updateDynaSeeds()
+	c.Assert(cluster.dynaSeeds, DeepEquals, []string{"a:27017", "b:27017", "d:27017"})
+}
+
+func (s *S) TestDeterministicServerSelection(c *C) {
+	a := &mongoServer{Addr: "a", ResolvedAddr: "10.0.0.1:27017", info: &mongoServerInfo{}}
+	b := &mongoServer{Addr: "b", ResolvedAddr: "10.0.0.2:27017", info: &mongoServerInfo{}}
+	d := &mongoServer{Addr: "c", ResolvedAddr: "10.0.0.3:27017", info: &mongoServerInfo{}}
+
+	// The order servers are kept in doesn't depend on discovery order.
+	servers1 := &mongoServers{}
+	servers2 := &mongoServers{}
+	for _, server := range []*mongoServer{d, a, b} {
+		servers1.Add(server)
+	}
+	for _, server := range []*mongoServer{b, d, a} {
+		servers2.Add(server)
+	}
+	c.Assert(servers1.Slice(), DeepEquals, []*mongoServer{a, b, d})
+	c.Assert(servers2.Slice(), DeepEquals, servers1.Slice())
+
+	defer SetSelectionRand(nil)
+	pick := func(servers *mongoServers) (addrs []string) {
+		SetSelectionRand(rand.NewSource(42))
+		for i := 0; i < 30; i++ {
+			addrs = append(addrs, servers.BestFit(Nearest, nil, 15*time.Millisecond).Addr)
+		}
+		return addrs
+	}
+	picks := pick(servers1)
+	c.Assert(pick(servers2), DeepEquals, picks)
+
+	// Equally suitable servers all get picked.
+	seen := make(map[string]bool)
+	for _, addr := range picks {
+		seen[addr] = true
+	}
+	c.Assert(seen, HasLen, 3)
+}
+
+// fakeServer answers every message received on conn with doc, as a
+// server replying to the hello and isMaster commands would. The doc
+// must carry a nonce, as one is requested on every new connection.
+func fakeServer(conn net.Conn, doc bson.M) {
+	fakeServerFunc(conn, func(body []byte) bson.M { return doc })
+}
+
+// fakeServerFunc works like fakeServer, but answers every message with
+// the doc returned by answer for the message body, or closes conn if the
+// returned doc is nil.
+func fakeServerFunc(conn net.Conn, answer func(body []byte) bson.M) {
+	defer conn.Close()
+	header := make([]byte, 16)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		body := make([]byte, binary.LittleEndian.Uint32(header)-16)
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+		doc := answer(body)
+		if doc == nil {
+			return
+		}
+		if fakeReply(conn, header, doc) != nil {
+			return
+		}
+	}
+}
+
+// fakeAddr is the address of the fake server dialed by dialFake.
+const fakeAddr = "127.0.0.1:40300"
+
+// fakeHello returns the reply of a standalone server supporting up to
+// maxWireVersion to the hello and isMaster commands.
+func fakeHello(maxWireVersion int) bson.M {
+	return bson.M{"ok": 1, "nonce": "2375531c32080ae8", "ismaster": true, "maxWireVersion": maxWireVersion}
+}
+
+// fakeMember returns the reply of the member at addr of the "rs" replica
+// set of hosts to the hello and isMaster commands.
+func fakeMember(addr, primary string, hosts []string, maxWireVersion int) bson.M {
+	return bson.M{
+		"ok":             1,
+		"nonce":          "2375531c32080ae8",
+		"ismaster":       addr == primary,
+		"secondary":      addr != primary,
+		"setName":        "rs",
+		"hosts":          hosts,
+		"maxWireVersion": maxWireVersion,
+	}
+}
+
+// fakeClusterInfo returns the DialInfo of fake servers at addrs, with
+// every connection going over a pipe to a fakeServerFunc answering
+// messages as answer does for the address dialed.
+func fakeClusterInfo(addrs []string, answer func(addr string, body []byte) bson.M) *DialInfo {
+	return &DialInfo{
+		Addrs:    addrs,
+		Timeout:  5 * time.Second,
+		FailFast: true,
+		DialServer: func(server *ServerAddr) (net.Conn, error) {
+			addr := server.String()
+			client, conn := net.Pipe()
+			go fakeServerFunc(conn, func(body []byte) bson.M { return answer(addr, body) })
+			return client, nil
+		},
+	}
+}
+
+// fakeDialInfo returns the DialInfo of a single fake server at fakeAddr
+// answering messages as answer does.
+func fakeDialInfo(answer func(body []byte) bson.M) *DialInfo {
+	return fakeClusterInfo([]string{fakeAddr}, func(addr string, body []byte) bson.M { return answer(body) })
+}
+
+// dialFake returns a session to the fake server of fakeDialInfo.
+func dialFake(c *C, answer func(body []byte) bson.M) *Session {
+	session, err := DialWithInfo(fakeDialInfo(answer))
+	c.Assert(err, IsNil)
+	return session
+}
+
+// fakeAnswer returns an answer replying doc to every message.
+func fakeAnswer(doc bson.M) func(body []byte) bson.M {
+	return func(body []byte) bson.M { return doc }
+}
+
+// fakeCommand unmarshals into cmd the command document of a query
+// message body, which follows the flags, the collection name, and the
+// skip and limit fields.
+func fakeCommand(c *C, body []byte, cmd interface{}) {
+	start := 4 + bytes.IndexByte(body[4:], 0) + 1 + 8
+	c.Check(bson.Unmarshal(body[start:], cmd), IsNil)
+}
+
+// fakeReply writes doc to conn as the reply to the message with header.
+func fakeReply(conn net.Conn, header []byte, doc bson.M) error {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		panic(err)
+	}
+	reply := make([]byte, 36, 36+len(data))
+	binary.LittleEndian.PutUint32(reply[0:], uint32(36+len(data)))
+	copy(reply[8:12], header[4:8])               // responseTo
+	binary.LittleEndian.PutUint32(reply[12:], 1) // OP_REPLY
+	binary.LittleEndian.PutUint32(reply[32:], 1) // numberReturned
+	_, err = conn.Write(append(reply, data...))
+	return err
+}
+
+func (s *S) TestMaxDiscoveryDepth(c *C) {
+	// Each server in the chain advertises the next one only, so
+	// every one of them is a hop farther from the seed.
+	const chainLen = 6
+	addr := func(i int) string {
+		return fmt.Sprintf("127.0.0.1:%d", 40200+i)
+	}
+	discover := func(maxDepth int) int {
+		var m sync.Mutex
+		dialed := make(map[string]bool)
+		info := fakeClusterInfo(nil, func(server string, body []byte) bson.M {
+			var i int
+			fmt.Sscanf(server, "127.0.0.1:%d", &i)
+			i -= 40200
+			hosts := []string{addr(i)}
+			if i+1 < chainLen {
+				hosts = append(hosts, addr(i+1))
+			}
+			return fakeMember(server, addr(0), hosts, 0)
+		})
+		info.MaxDiscoveryDepth = maxDepth
+		dial := info.DialServer
+		info.DialServer = func(server *ServerAddr) (net.Conn, error) {
+			m.Lock()
+			dialed[server.String()] = true
+			m.Unlock()
+			return dial(server)
+		}
+		cluster := newCluster([]string{addr(0)}, info)
+		defer cluster.Release()
+
+		// Let the sync loop go over the chain twice, so that servers
+		// discovered in the first pass are seeds in the second one.
+		for {
+			cluster.RLock()
+			synced := cluster.syncCount >= 2
+			cluster.RUnlock()
+			if synced {
+				break
+			}
+			cluster.syncServers()
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		m.Lock()
+		defer m.Unlock()
+		return len(dialed)
+	}
+
+	c.Assert(discover(0), Equals, chainLen)
+	c.Assert(discover(SeedsOnlyDiscovery), Equals, 1)
+	c.Assert(discover(1), Equals, 2)
+	c.Assert(discover(3), Equals, 4)
+
+	info := &DialInfo{MaxDiscoveryDepth: 2}
+	c.Assert(info.Copy().MaxDiscoveryDepth, Equals, 2)
+}
+
+func (s *S) TestConflictingPrimaries(c *C) {
+	cluster := &mongoCluster{}
+	cluster.serverSynced.L = cluster.RWMutex.RLocker()
+	newServer := func(addr, resolved string) *mongoServer {
+		return &mongoServer{Addr: addr, ResolvedAddr: resolved, info: &mongoServerInfo{}}
+	}
+	a := newServer("a", "10.0.0.1:27017")
+	b := newServer("b", "10.0.0.2:27017")
+	primary := func(setVersion int, electionId string) *mongoServerInfo {
+		return &mongoServerInfo{
+			Master:     true,
+			SetName:    "rs",
+			SetVersion: setVersion,
+			ElectionId: bson.ObjectIdHex(electionId),
+		}
+	}
+	masters := func() (addrs []string) {
+		for _, server := range cluster.masters.Slice() {
+			addrs = append(addrs, server.Addr)
+		}
+		return addrs
+	}
+
+	cluster.addServer(a, primary(1, "7fffffff0000000000000001"), completeSync)
+	c.Assert(masters(), DeepEquals, []string{"a"})
+
+	// A newer election demotes the previous primary.
+	cluster.addServer(b, primary(1, "7fffffff0000000000000002"), completeSync)
+	c.Assert(masters(), DeepEquals, []string{"b"})
+	c.Assert(a.Info().Master, Equals, false)
+
+	// The stepped down primary still claims to be the primary.
+	cluster.addServer(a, primary(1, "7fffffff0000000000000001"), completeSync)
+	c.Assert(masters(), DeepEquals, []string{"b"})
+	c.Assert(cluster.servers.Len(), Equals, 2)
+
+	// The set version takes precedence over the election id.
+	cluster.addServer(a, primary(2, "7fffffff0000000000000001"), completeSync)
+	c.Assert(masters(), DeepEquals, []string{"a"})
+	c.Assert(b.Info().Master, Equals, false)
+}
+
+func (s *S) TestTranslateMajority(c *C) {
+	safeOp := func(w interface{}) *queryOp {
+		return &queryOp{query: &getLastError{CmdName: 1, W: w, WTimeout: 100}, collection: "admin.$cmd", limit: -1}
+	}
+	translate := func(info *mongoServerInfo, w interface{}) (interface{}, error) {
+		op := safeOp(w)
+		translated, err := translateMajority(info, op)
+		if err != nil {
+			return nil, err
+		}
+		c.Assert(op.query.(*getLastError).W, Equals, w)
+		c.Assert(translated.query.(*getLastError).WTimeout, Equals, 100)
+		return translated.query.(*getLastError).W, nil
+	}
+
+	for _, test := range []struct {
+		info   mongoServerInfo
+		w      interface{}
+		result interface{}
+	}{
+		{mongoServerInfo{SetName: "rs", Members: 3}, "majority", 2},
+		{mongoServerInfo{SetName: "rs", Members: 4}, "majority", 3},
+		{mongoServerInfo{SetName: "rs", Members: 5}, "majority", 3},
+		{mongoServerInfo{}, "majority", 1},
+		{mongoServerInfo{Mongos: true}, "majority", "majority"},
+		{mongoServerInfo{SetName: "rs", Members: 3}, 2, 2},
+		{mongoServerInfo{SetName: "rs", Members: 3}, "custom", "custom"},
+	} {
+		w, err := translate(&test.info, test.w)
+		c.Assert(err, IsNil)
+		c.Assert(w, Equals, test.result)
+	}
+
+	_, err := translate(&mongoServerInfo{SetName: "rs"}, "majority")
+	c.Assert(err, Equals, errMajorityUnknown)
+}
+
+func (s *S) TestRetryReadAfterRestart(c *C) {
+	var m sync.Mutex
+	var down, restarted bool
+	var refused int
+	doc := fakeHello(0)
+	info := fakeDialInfo(func(body []byte) bson.M {
+		m.Lock()
+		defer m.Unlock()
+		if restarted || !bytes.Contains(body, []byte("mydb.restart")) {
+			return doc
+		}
+		// Close the connection and refuse new ones for a moment, as a
+		// restarting server does.
+		restarted = true
+		down = true
+		time.AfterFunc(200*time.Millisecond, func() {
+			m.Lock()
+			down = false
+			m.Unlock()
+		})
+		return nil
+	})
+	dial := info.DialServer
+	info.DialServer = func(server *ServerAddr) (net.Conn, error) {
+		m.Lock()
+		defer m.Unlock()
+		if down {
+			refused++
+			return nil, errors.New("connection refused")
+		}
+		return dial(server)
+	}
+	session, err := DialWithInfo(info)
+	c.Assert(err, IsNil)
+	defer session.Close()
+	session.SetRetryReads(true)
+
+	var result struct{ Ok int }
+	err = session.DB("mydb").C("restart").Find(nil).One(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result.Ok, Equals, 1)
+
+	m.Lock()
+	c.Assert(restarted, Equals, true)
+	c.Assert(refused > 0, Equals, true)
+	m.Unlock()
+
+	cluster := session.cluster()
+	cluster.RLock()
+	servers := cluster.servers.Slice()
+	cluster.RUnlock()
+	c.Assert(servers, HasLen, 1)
+	c.Assert(servers[0].Restarting(), Equals, false)
+}
+
+func (s *S) TestCopyAndCloneReferences(c *C) {
+	session := dialFake(c, fakeAnswer(fakeHello(0)))
+	defer session.Close()
+	c.Assert(session.Ping(), IsNil)
+
+	cluster := session.cluster()
+	refs := func() int {
+		cluster.RLock()
+		defer cluster.RUnlock()
+		return cluster.references
+	}
+	base := refs()
+
+	copied := session.Copy()
+	cloned := session.Clone()
+	c.Assert(refs(), Equals, base+2)
+	c.Assert(copied.masterSocket == nil, Equals, true)
+	c.Assert(cloned.masterSocket, Equals, session.masterSocket)
+
+	// Settings changed in copies don't leak into the original.
+	limit := session.dialInfo.PoolLimit
+	copied.SetPoolLimit(limit + 1)
+	copied.SetMode(Eventual, true)
+	cloned.SetSocketTimeout(time.Second)
+	c.Assert(session.dialInfo.PoolLimit, Equals, limit)
+	c.Assert(session.dialInfo.Timeout, Equals, 5*time.Second)
+	c.Assert(session.Mode(), Equals, Strong)
+
+	// The shared socket stays usable by the original session.
+	cloned.Close()
+	c.Assert(session.masterSocket.reservable(), Equals, true)
+	c.Assert(session.Ping(), IsNil)
+
+	copied.Close()
+	c.Assert(refs(), Equals, base)
+}
+
+func (s *S) TestWriteAcknowledgement(c *C) {
+	wtimeout := &LastError{WTimeout: true}
+	rs3 := &mongoServerInfo{SetName: "rs", Members: 3}
+	rs5 := &mongoServerInfo{SetName: "rs", Members: 5}
+	unknown := &mongoServerInfo{SetName: "rs"}
+	mongos := &mongoServerInfo{Mongos: true}
+	standalone := &mongoServerInfo{}
+	for _, test := range []struct {
+		lerr         *LastError
+		err          error
+		w            interface{}
+		info         *mongoServerInfo
+		acknowledged int
+		majority     bool
+		majorityErr  error
+	}{
+		{&LastError{}, nil, nil, rs3, 1, false, nil},
+		{&LastError{}, nil, 2, rs3, 2, true, nil},
+		{&LastError{}, nil, 2, rs5, 2, false, nil},
+		{&LastError{}, nil, "majority", rs5, 3, true, nil},
+		{&LastError{}, nil, "majority", mongos, 1, true, nil},
+		{&LastError{}, nil, 2, mongos, 2, false, nil},
+		{&LastError{}, nil, nil, standalone, 1, true, nil},
+		{&LastError{}, nil, "tagged", rs3, 1, false, nil},
+		{&LastError{WrittenTo: []string{"a", "b"}}, nil, 2, rs3, 2, true, nil},
+		{wtimeout, wtimeout, 3, rs3, 1, false, nil},
+		{wtimeout, wtimeout, "majority", rs3, 1, false, nil},
+		{&LastError{}, nil, 2, unknown, 2, false, errMajorityUnknown},
+		{&LastError{}, nil, "majority", unknown, 1, true, nil},
+	} {
+		acknowledged, majority, majorityErr := acknowledgement(test.lerr, test.err, test.w, test.info)
+		c.Assert(acknowledged, Equals, test.acknowledged)
+		c.Assert(majority, Equals, test.majority)
+		c.Assert(majorityErr, Equals, test.majorityErr)
+	}
+}
+
+func (s *S) TestWriteProtocolByWireVersion(c *C) {
+	write := func(maxWireVersion int) (getLastErrors, insertCmds int) {
+		var m sync.Mutex
+		doc := fakeHello(maxWireVersion)
+		session := dialFake(c, func(body []byte) bson.M {
+			m.Lock()
+			defer m.Unlock()
+			// Write commands carry the write concern as getLastError
+			// does, so look for them first.
+			switch {
+			case bytes.Contains(body, []byte("\x02insert\x00")):
+				insertCmds++
+			case bytes.Contains(body, []byte("getLastError\x00")):
+				getLastErrors++
+			}
+			return doc
+		})
+		defer session.Close()
+
+		err := session.DB("mydb").C("mycoll").Insert(bson.M{"n": 1})
+		c.Assert(err, IsNil)
+
+		m.Lock()
+		defer m.Unlock()
+		return getLastErrors, insertCmds
+	}
+
+	// Old servers get the document followed by getLastError.
+	getLastErrors, insertCmds := write(0)
+	c.Assert(getLastErrors, Equals, 1)
+	c.Assert(insertCmds, Equals, 0)
+
+	// Servers supporting write commands get the result in one round trip.
+	getLastErrors, insertCmds = write(6)
+	c.Assert(getLastErrors, Equals, 0)
+	c.Assert(insertCmds, Equals, 1)
+}
+
+func (s *S) TestPoolWaitPercentile(c *C) {
+	stats := &Stats{}
+	c.Assert(stats.PoolWaitPercentile(50), Equals, time.Duration(0))
+
+	for _, wait := range []time.Duration{
+		500 * time.Microsecond,
+		3 * time.Millisecond,
+		3 * time.Millisecond,
+		4 * time.Millisecond,
+		150 * time.Millisecond,
+		10 * time.Second,
+	} {
+		stats.noticePoolWait(wait)
+	}
+	c.Assert(stats.PoolWaitHistogram[0], Equals, 1)
+	c.Assert(stats.PoolWaitHistogram[2], Equals, 3)
+	c.Assert(stats.PoolWaitHistogram[7], Equals, 1)
+	c.Assert(stats.PoolWaitHistogram[len(poolWaitBounds)], Equals, 1)
+	c.Assert(stats.MaxPoolWaitTime, Equals, 10*time.Second)
+
+	c.Assert(stats.PoolWaitPercentile(0), Equals, time.Millisecond)
+	c.Assert(stats.PoolWaitPercentile(50), Equals, 5*time.Millisecond)
+	c.Assert(stats.PoolWaitPercentile(80), Equals, 200*time.Millisecond)
+	c.Assert(stats.PoolWaitPercentile(99), Equals, 10*time.Second)
+	c.Assert(stats.PoolWaitPercentile(100), Equals, 10*time.Second)
+}
+
+func (s *S) TestCheckProjection(c *C) {
+	for _, selector := range []interface{}{
+		nil,
+		bson.M{"name": 1},
+		bson.M{"name": 1, "age": true, "score": 1.0},
+		bson.M{"name": 0, "age": false},
+		bson.M{"_id": 0, "name": 1},
+		bson.M{"_id": 1, "name": 0},
+		bson.M{"name": 1, "tags": bson.M{"$slice": 5}},
+		bson.M{"name": 0, "tags": bson.M{"$slice": []int{10, 5}}},
+		bson.M{"tags": bson.M{"$elemMatch": bson.M{"n": 1}}},
+		bson.M{"score": bson.M{"$meta": "textScore"}, "name": 1},
+		bson.M{"a": bson.M{"b": 1}},
+		bson.D{{Name: "name", Value: int64(1)}},
+		struct {
+			Name int `bson:"name"`
+		}{1},
+	} {
+		c.Assert(checkProjection(selector), IsNil, Commentf("selector: %v", selector))
+	}
+
+	err := checkProjection(bson.D{{Name: "name", Value: 1}, {Name: "age", Value: 0}})
+	c.Assert(err, ErrorMatches, `invalid projection: cannot both include field "name" and exclude field "age"`)
+	err = checkProjection(bson.D{{Name: "_id", Value: 0}, {Name: "age", Value: 0}, {Name: "name", Value: 1.0}})
+	c.Assert(err, ErrorMatches, `invalid projection: cannot both include field "name" and exclude field "age"`)
+	err = checkProjection(bson.M{"tags": bson.M{"$size": 1}})
+	c.Assert(err, ErrorMatches, `invalid projection: unknown operator \$size for field "tags"`)
+}
+
+func (s *S) TestFailFastNoPrimary(c *C) {
+	var m sync.Mutex
+	primary := true
+	info := fakeDialInfo(func(body []byte) bson.M {
+		m.Lock()
+		defer m.Unlock()
+		doc := fakeHello(0)
+		doc["ismaster"] = primary
+		doc["secondary"] = !primary
+		return doc
+	})
+	info.FailFast = false
+	session, err := DialWithInfo(info)
+	c.Assert(err, IsNil)
+	defer session.Close()
+	session.SetSyncTimeout(300 * time.Millisecond)
+
+	// Step the primary down, as happens when an election starts.
+	m.Lock()
+	primary = false
+	m.Unlock()
+	cluster := session.cluster()
+	for i := 0; ; i++ {
+		cluster.RLock()
+		masters := cluster.masters.Len()
+		cluster.RUnlock()
+		if masters == 0 {
+			break
+		}
+		cluster.syncServers()
+		c.Assert(i < 50, Equals, true)
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	coll := session.DB("mydb").C("mycoll")
+	err = coll.Insert(bson.M{"n": 1})
+	c.Assert(err == ErrNoPrimary, Equals, false)
+
+	session.SetFailFastNoPrimary(true)
+	started := time.Now()
+	err = coll.Insert(bson.M{"n": 1})
+	c.Assert(err, Equals, ErrNoPrimary)
+	c.Assert(time.Since(started) < 100*time.Millisecond, Equals, true)
+
+	// Reads which may go to secondaries are unaffected.
+	session.SetMode(Monotonic, true)
+	c.Assert(session.Ping(), IsNil)
+}
+
+func (s *S) TestRetryBudget(c *C) {
+	SetStats(true)
+	before := GetStats()
+
+	budget := newRetryBudget(&DialInfo{RetryBudgetRatio: 0.5, RetryBudgetBurst: 2})
+
+	// The budget starts full.
+	c.Assert(budget.withdraw(), Equals, true)
+	c.Assert(budget.withdraw(), Equals, true)
+	c.Assert(budget.withdraw(), Equals, false)
+
+	// Every two operations refill one retry.
+	budget.deposit()
+	c.Assert(budget.withdraw(), Equals, false)
+	budget.deposit()
+	c.Assert(budget.withdraw(), Equals, true)
+
+	// Refills never exceed the burst.
+	for i := 0; i < 10; i++ {
+		budget.deposit()
+	}
+	c.Assert(budget.withdraw(), Equals, true)
+	c.Assert(budget.withdraw(), Equals, true)
+	c.Assert(budget.withdraw(), Equals, false)
+
+	after := GetStats()
+	c.Assert(after.Retries-before.Retries, Equals, 5)
+	c.Assert(after.RetriesDenied-before.RetriesDenied, Equals, 3)
+
+	budget = newRetryBudget(&DialInfo{})
+	c.Assert(budget.ratio, Equals, defaultRetryBudgetRatio)
+	c.Assert(budget.burst, Equals, float64(defaultRetryBudgetBurst))
+	c.Assert(budget.tokens, Equals, budget.burst)
+
+	// A ratio of 1 never denies a retry after an operation.
+	budget = newRetryBudget(&DialInfo{RetryBudgetRatio: 1, RetryBudgetBurst: 1})
+	for i := 0; i < 3; i++ {
+		budget.deposit()
+		c.Assert(budget.withdraw(), Equals, true)
+	}
+}
+
+func (s *S) TestBuildInfoCache(c *C) {
+	var m sync.Mutex
+	var commands int
+	session := dialFake(c, func(body []byte) bson.M {
+		doc := fakeHello(0)
+		if bytes.Contains(body, []byte("buildInfo")) {
+			m.Lock()
+			commands++
+			m.Unlock()
+			doc["version"] = "4.0.3"
+			doc["gitVersion"] = "7ea530946fa7880364d88c8d8b6026bbc9ffa48c modules: enterprise"
+			doc["storageEngines"] = []string{"mmapv1", "wiredTiger"}
+		}
+		return doc
+	})
+	defer session.Close()
+
+	buildInfo, err := session.BuildInfo()
+	c.Assert(err, IsNil)
+	c.Assert(buildInfo.VersionArray, DeepEquals, []int{4, 0, 3, 0})
+	c.Assert(buildInfo.Major(), Equals, 4)
+	c.Assert(buildInfo.Minor(), Equals, 0)
+	c.Assert(buildInfo.Patch(), Equals, 3)
+	c.Assert(buildInfo.GitVersion, Equals, "7ea530946fa7880364d88c8d8b6026bbc9ffa48c")
+	c.Assert(buildInfo.StorageEngines, DeepEquals, []string{"mmapv1", "wiredTiger"})
+	c.Assert(buildInfo.VersionAtLeast(3, 4), Equals, true)
+	c.Assert(buildInfo.VersionAtLeast(4, 2), Equals, false)
+
+	// Changing the returned details doesn't affect the cached ones.
+	buildInfo.VersionArray[0] = 1
+	buildInfo, err = session.BuildInfo()
+	c.Assert(err, IsNil)
+	c.Assert(buildInfo.Major(), Equals, 4)
+	m.Lock()
+	c.Assert(commands, Equals, 1)
+	m.Unlock()
+
+	// A restarting server may have been upgraded.
+	cluster := session.cluster()
+	cluster.RLock()
+	servers := cluster.servers.Slice()
+	cluster.RUnlock()
+	c.Assert(servers, HasLen, 1)
+	servers[0].NoteRestart()
+	servers[0].Restarted()
+	_, err = session.BuildInfo()
+	c.Assert(err, IsNil)
+	m.Lock()
+	c.Assert(commands, Equals, 2)
+	m.Unlock()
+}
+
+func (s *S) TestGlobalSyncConcurrency(c *C) {
+	SetGlobalSyncConcurrency(2)
+	defer SetGlobalSyncConcurrency(0)
+
+	var m sync.Mutex
+	var checking, maxChecking int
+	answer := func(body []byte) bson.M {
+		doc := fakeHello(0)
+		doc["msg"] = "isdbgrid"
+		if !bytes.Contains(body, []byte("hello")) && !bytes.Contains(body, []byte("ismaster")) {
+			return doc
+		}
+		m.Lock()
+		checking++
+		if checking > maxChecking {
+			maxChecking = checking
+		}
+		m.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		m.Lock()
+		checking--
+		m.Unlock()
+		return doc
+	}
+
+	// Several clusters of several servers each sync at the same time.
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		var addrs []string
+		for j := 0; j < 3; j++ {
+			addrs = append(addrs, fmt.Sprintf("127.0.0.1:%d", 40300+i*10+j))
+		}
+		info := fakeClusterInfo(addrs, func(addr string, body []byte) bson.M { return answer(body) })
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			session, err := DialWithInfo(info)
+			if err == nil {
+				session.Close()
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		c.Assert(err, IsNil)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	c.Assert(maxChecking, Equals, 2)
+}
+
+func (s *S) TestIterNextOverwritesResult(c *C) {
+	iter := &Iter{timeout: -1}
+	iter.gotReply.L = &iter.m
+	for _, doc := range []interface{}{
+		bson.M{"name": "first", "count": 1, "tags": []string{"a", "b"}},
+		bson.M{"name": "second", "tags": []interface{}{"c", 1, "d"}},
+		bson.M{},
+	} {
+		data, err := bson.Marshal(doc)
+		c.Assert(err, IsNil)
+		iter.docData.Push(data)
+	}
+
+	var result benchIterDoc
+	c.Assert(iter.Next(&result), Equals, true)
+	first := result
+	c.Assert(first, DeepEquals, benchIterDoc{Name: "first", Count: 1, Tags: []string{"a", "b"}})
+
+	// Fields missing from later documents are reset, and the values
+	// retained from earlier ones are left alone.
+	c.Assert(iter.Next(&result), Equals, true)
+	c.Assert(result, DeepEquals, benchIterDoc{Name: "second", Tags: []string{"c", "d"}})
+	c.Assert(iter.Next(&result), Equals, true)
+	c.Assert(result, DeepEquals, benchIterDoc{})
+	c.Assert(first, DeepEquals, benchIterDoc{Name: "first", Count: 1, Tags: []string{"a", "b"}})
+}
+
+type benchIterDoc struct {
+	Id    bson.ObjectId `bson:"_id"`
+	Name  string        `bson:"name"`
+	Count int           `bson:"count"`
+	Score float64       `bson:"score"`
+	Tags  []string      `bson:"tags"`
+}
+
+func BenchmarkIterNext(b *testing.B) {
+	data, err := bson.Marshal(benchIterDoc{
+		Id:    bson.NewObjectId(),
+		Name:  "name",
+		Count: 42,
+		Score: 1.5,
+		Tags:  []string{"a", "b", "c"},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	iter := &Iter{timeout: -1}
+	iter.gotReply.L = &iter.m
+	var result benchIterDoc
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		iter.docData.Push(data)
+		if !iter.Next(&result) {
+			b.Fatal(iter.Err())
+		}
+	}
+}
+
+// wideDoc returns a document with many fields of assorted kinds.
+func wideDoc() bson.D {
+	var doc bson.D
+	for i := 0; i < 20; i++ {
+		doc = append(doc,
+			bson.DocElem{Name: fmt.Sprintf("s%d", i), Value: "some string value"},
+			bson.DocElem{Name: fmt.Sprintf("n%d", i), Value: i},
+			bson.DocElem{Name: fmt.Sprintf("f%d", i), Value: float64(i)},
+			bson.DocElem{Name: fmt.Sprintf("a%d", i), Value: []string{"a", "b", "c"}},
+			bson.DocElem{Name: fmt.Sprintf("d%d", i), Value: bson.M{"x": i, "y": "z"}},
+		)
+	}
+	return append(doc, bson.DocElem{Name: "name", Value: "name"})
+}
+
+func benchmarkIterNextWide(b *testing.B, fields ...string) {
+	data, err := bson.Marshal(wideDoc())
+	if err != nil {
+		b.Fatal(err)
+	}
+	iter := &Iter{timeout: -1}
+	iter.gotReply.L = &iter.m
+	iter.DecodeOnly(fields...)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		iter.docData.Push(data)
+		var result bson.M
+		if !iter.Next(&result) {
+			b.Fatal(iter.Err())
+		}
+	}
+}
+
+func BenchmarkIterNextWide(b *testing.B) {
+	benchmarkIterNextWide(b)
+}
+
+func BenchmarkIterNextWideDecodeOnly(b *testing.B) {
+	benchmarkIterNextWide(b, "name", "n3")
+}
+
+func (s *S) TestUpsertChangeInfoByWireVersion(c *C) {
+	upsert := func(maxWireVersion int, result bson.M, selector, update interface{}) *ChangeInfo {
+		doc := fakeHello(maxWireVersion)
+		session := dialFake(c, func(body []byte) bson.M {
+			if bytes.Contains(body, []byte("\x02update\x00")) || bytes.Contains(body, []byte("getLastError\x00")) {
+				return result
+			}
+			return doc
+		})
+		defer session.Close()
+
+		change, err := session.DB("mydb").C("mycoll").Upsert(selector, update)
+		c.Assert(err, IsNil)
+		return &ChangeInfo{Updated: change.Updated, Matched: change.Matched, UpsertedId: change.UpsertedId}
+	}
+
+	// Old servers report the result through getLastError, and leave
+	// out the _id of inserted documents unless they generated it.
+	inserted := &ChangeInfo{UpsertedId: 48}
+	change := upsert(0, bson.M{"ok": 1, "n": 1, "updatedExisting": false}, bson.M{"k": 48}, bson.M{"_id": 48, "n": 1})
+	c.Assert(change, DeepEquals, inserted)
+	change = upsert(0, bson.M{"ok": 1, "n": 1, "updatedExisting": false}, bson.M{"_id": 48}, bson.M{"$set": bson.M{"n": 1}})
+	c.Assert(change, DeepEquals, inserted)
+	change = upsert(0, bson.M{"ok": 1, "n": 1, "updatedExisting": false}, bson.M{"k": 48}, bson.D{{Name: "$setOnInsert", Value: bson.M{"_id": 48}}})
+	c.Assert(change, DeepEquals, inserted)
+	change = upsert(0, bson.M{"ok": 1, "n": 1, "updatedExisting": false, "upserted": 48}, bson.M{"k": 48}, bson.M{"n": 1})
+	c.Assert(change, DeepEquals, inserted)
+	change = upsert(0, bson.M{"ok": 1, "n": 1, "updatedExisting": false}, bson.M{"_id": bson.M{"$gt": 47}}, bson.M{"$set": bson.M{"n": 1}})
+	c.Assert(change, DeepEquals, &ChangeInfo{})
+
+	// New servers report it in the write command result.
+	change = upsert(6, bson.M{"ok": 1, "n": 1, "nModified": 0, "upserted": []bson.M{{"index": 0, "_id": 48}}}, bson.M{"k": 48}, bson.M{"n": 1})
+	c.Assert(change, DeepEquals, inserted)
+
+	// Updates look the same either way.
+	updated := &ChangeInfo{Updated: 1, Matched: 1}
+	change = upsert(0, bson.M{"ok": 1, "n": 1, "updatedExisting": true}, bson.M{"_id": 48}, bson.M{"_id": 48, "n": 1})
+	c.Assert(change, DeepEquals, updated)
+	change = upsert(6, bson.M{"ok": 1, "n": 1, "nModified": 1}, bson.M{"_id": 48}, bson.M{"_id": 48, "n": 1})
+	c.Assert(change, DeepEquals, updated)
+}
+
+func (s *S) TestLastRequestId(c *C) {
+	session := dialFake(c, fakeAnswer(fakeHello(0)))
+	defer session.Close()
+
+	var m sync.Mutex
+	var pings []uint32
+	SetCommandMonitor(&CommandMonitor{
+		Started: func(event *CommandStartedEvent) {
+			m.Lock()
+			defer m.Unlock()
+			if event.CommandName == "ping" {
+				pings = append(pings, event.RequestId)
+			}
+		},
+	})
+	defer SetCommandMonitor(nil)
+
+	c.Assert(session.Ping(), IsNil)
+	m.Lock()
+	c.Assert(pings, HasLen, 1)
+	c.Assert(session.LastRequestId(), Equals, pings[0])
+	m.Unlock()
+
+	// Queries sent to old servers aren't commands, but are tracked too.
+	var result bson.M
+	err := session.DB("mydb").C("mycoll").Find(nil).One(&result)
+	c.Assert(err, IsNil)
+	c.Assert(session.LastRequestId() > pings[0], Equals, true)
+
+	other := session.Copy()
+	defer other.Close()
+	c.Assert(other.LastRequestId(), Equals, uint32(0))
+}
+
+func (s *S) TestCheckTextSearch(c *C) {
+	type filter struct {
+		Lang string `bson:"lang"`
+	}
+	text := bson.D{{Name: "$search", Value: "coffee"}}
+	c.Assert(withTextSearch(nil, "coffee"), DeepEquals, bson.D{{Name: "$text", Value: text}})
+	c.Assert(withTextSearch(bson.D{{Name: "lang", Value: "en"}}, "coffee"), DeepEquals,
+		bson.D{{Name: "lang", Value: "en"}, {Name: "$text", Value: text}})
+	c.Assert(withTextSearch(bson.M{"lang": "en"}, "coffee"), DeepEquals, bson.M{"lang": "en", "$text": text})
+	c.Assert(withTextSearch(filter{"en"}, "coffee"), DeepEquals,
+		bson.D{{Name: "$and", Value: []interface{}{filter{"en"}, bson.D{{Name: "$text", Value: text}}}}})
+
+	// The query document provided isn't modified.
+	query := bson.M{"lang": "en"}
+	withTextSearch(query, "coffee")
+	c.Assert(query, DeepEquals, bson.M{"lang": "en"})
+
+	op := &queryOp{textSearch: true, textScore: "score", selector: bson.M{"score": 1, "title": 1}}
+	c.Assert(checkTextSearch(op), IsNil)
+	c.Assert(op.selector, DeepEquals, bson.D{{Name: "title", Value: 1}, {Name: "score", Value: bson.M{"$meta": "textScore"}}})
+
+	op = &queryOp{textSearch: true, textScore: "score"}
+	c.Assert(checkTextSearch(op), IsNil)
+	c.Assert(op.selector, DeepEquals, bson.D{{Name: "score", Value: bson.M{"$meta": "textScore"}}})
+
+	op = &queryOp{textScore: "score"}
+	c.Assert(checkTextSearch(op), Equals, errTextScoreWithoutText)
+	op = &queryOp{textSearch: true}
+	op.options.Hint = bson.D{{Name: "lang", Value: 1}}
+	c.Assert(checkTextSearch(op), Equals, errTextSearchHint)
+	op = &queryOp{textSearch: true}
+	op.options.OrderBy = bson.D{{Name: "$natural", Value: -1}}
+	c.Assert(checkTextSearch(op), Equals, errTextSearchNatural)
+	op = &queryOp{textSearch: true}
+	op.options.Snapshot = true
+	c.Assert(checkTextSearch(op), Equals, errTextSearchSnapshot)
+	op = &queryOp{textSearch: true, flags: flagTailable}
+	c.Assert(checkTextSearch(op), Equals, errTextSearchTailable)
+}
+
+type testAuthenticator func(conn AuthConn, db string) error
+
+func (auth testAuthenticator) Auth(conn AuthConn, db string) error {
+	return auth(conn, db)
+}
+
+func (s *S) TestReconfigure(c *C) {
+	doc := fakeHello(6)
+	var m sync.Mutex
+	dials := make(map[string]int)
+	open := make(map[string]int)
+	dialer := func(name string) func(server *ServerAddr) (net.Conn, error) {
+		return func(server *ServerAddr) (net.Conn, error) {
+			client, conn := net.Pipe()
+			m.Lock()
+			dials[name]++
+			open[name]++
+			m.Unlock()
+			go func() {
+				fakeServer(conn, doc)
+				m.Lock()
+				open[name]--
+				m.Unlock()
+			}()
+			return client, nil
+		}
+	}
+	count := func(counts map[string]int, name string) int {
+		m.Lock()
+		defer m.Unlock()
+		return counts[name]
+	}
+
+	info := fakeDialInfo(fakeAnswer(doc))
+	info.DialServer = dialer("old")
+	session, err := DialWithInfo(info)
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	// Both sessions keep a socket reserved, and thus in use.
+	other := session.Copy()
+	defer other.Close()
+	c.Assert(session.Ping(), IsNil)
+	c.Assert(other.Ping(), IsNil)
+
+	var authenticated int
+	err = session.Reconfigure(Reconfiguration{
+		DialServer: dialer("new"),
+		Authenticator: testAuthenticator(func(conn AuthConn, db string) error {
+			m.Lock()
+			authenticated++
+			m.Unlock()
+			return nil
+		}),
+		Credentials: []Credential{{Username: "user", Password: "new"}},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(count(open, "old") > 0, Equals, true)
+
+	// Reserved sockets are replaced on the next use.
+	c.Assert(session.Ping(), IsNil)
+	c.Assert(other.Ping(), IsNil)
+	c.Assert(count(dials, "new") > 0, Equals, true)
+	m.Lock()
+	c.Assert(authenticated > 0, Equals, true)
+	m.Unlock()
+
+	// Once released, old sockets are closed rather than recycled.
+	for i := 0; count(open, "old") > 0 && i < 500; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(count(open, "old"), Equals, 0)
+	c.Assert(count(open, "new") > 0, Equals, true)
+
+	cred := Credential{Username: "user", Password: "old", Source: session.sourcedb}
+	c.Assert(session.cluster().Credential(cred).Password, Equals, "new")
+	cred.Username = "other"
+	c.Assert(session.cluster().Credential(cred).Password, Equals, "old")
+}
+
+func (s *S) TestAllowedNamespaces(c *C) {
+	doc := fakeHello(0)
+	doc["n"] = 1
+	doc["updatedExisting"] = true
+	session := dialFake(c, fakeAnswer(doc))
+	defer session.Close()
+
+	session.SetAllowedDatabases([]string{"tenant1"})
+	session.SetAllowedNamespaces([]string{"shared.config"})
+
+	var result bson.M
+	c.Assert(session.DB("tenant1").C("any").Find(nil).One(&result), IsNil)
+	c.Assert(session.DB("tenant1").C("any").Insert(bson.M{"n": 1}), IsNil)
+	c.Assert(session.DB("tenant1").Run("listCollections", nil), IsNil)
+	c.Assert(session.DB("shared").C("config").Find(nil).One(&result), IsNil)
+	c.Assert(session.DB("shared").C("config").Update(nil, bson.M{"n": 1}), IsNil)
+	c.Assert(session.Ping(), IsNil)
+
+	other := session.DB("tenant2").C("any")
+	c.Assert(other.Find(nil).One(&result), ErrorMatches, `namespace "tenant2.any" is not allowed for the session`)
+	c.Assert(other.Find(nil).Iter().Close(), ErrorMatches, `namespace "tenant2.any" is not allowed for the session`)
+	c.Assert(other.Insert(bson.M{"n": 1}), ErrorMatches, `namespace "tenant2.any" is not allowed for the session`)
+	c.Assert(other.Update(nil, bson.M{"n": 1}), ErrorMatches, `namespace "tenant2.any" is not allowed for the session`)
+	c.Assert(other.Remove(nil), ErrorMatches, `namespace "tenant2.any" is not allowed for the session`)
+	_, err := other.Count()
+	c.Assert(err, ErrorMatches, `namespace "tenant2.any" is not allowed for the session`)
+	c.Assert(other.DropCollection(), ErrorMatches, `namespace "tenant2.any" is not allowed for the session`)
+	c.Assert(session.DB("shared").C("data").Find(nil).One(&result), ErrorMatches, `namespace "shared.data" is not allowed for the session`)
+	c.Assert(session.DB("shared").DropDatabase(), ErrorMatches, `database "shared" is not allowed for the session`)
+	c.Assert(session.Run("listDatabases", nil), ErrorMatches, `database "admin" is not allowed for the session`)
+	c.Assert(session.DB("tenant1").C("a").Rename("b", false), IsNil)
+	c.Assert(session.DB("tenant1").C("a").RenameTo(other, false), ErrorMatches, `namespace "tenant2.any" is not allowed for the session`)
+	c.Assert(other.RenameTo(session.DB("tenant1").C("a"), false), ErrorMatches, `namespace "tenant2.any" is not allowed for the session`)
+
+	// Copies are restricted too, until the restriction is lifted.
+	copied := session.Copy()
+	defer copied.Close()
+	c.Assert(copied.DB("tenant2").C("any").Insert(bson.M{"n": 1}), ErrorMatches, `namespace "tenant2.any" is not allowed for the session`)
+	copied.SetAllowedDatabases(nil)
+	copied.SetAllowedNamespaces(nil)
+	c.Assert(copied.DB("tenant2").C("any").Insert(bson.M{"n": 1}), IsNil)
+	c.Assert(session.DB("tenant2").C("any").Insert(bson.M{"n": 1}), NotNil)
+}
+
+func (s *S) TestStandbyPool(c *C) {
+	const a, b = "127.0.0.1:40311", "127.0.0.1:40312"
+	var m sync.Mutex
+	primary := a
+	dials := make(map[string]int)
+	var conns []net.Conn
+	info := fakeClusterInfo([]string{a, b}, func(addr string, body []byte) bson.M {
+		m.Lock()
+		defer m.Unlock()
+		doc := fakeMember(addr, primary, []string{a, b}, 6)
+		doc["n"] = 1
+		return doc
+	})
+	info.StandbyPoolSize = 4
+	dial := info.DialServer
+	info.DialServer = func(server *ServerAddr) (net.Conn, error) {
+		addr := server.String()
+		m.Lock()
+		defer m.Unlock()
+		if addr == a && primary != a {
+			return nil, errors.New("unreachable")
+		}
+		dials[addr]++
+		conn, err := dial(server)
+		if addr == a {
+			conns = append(conns, conn)
+		}
+		return conn, err
+	}
+	session, err := DialWithInfo(info)
+	c.Assert(err, IsNil)
+	defer session.Close()
+	c.Assert(session.DB("mydb").C("mycoll").Insert(bson.M{"n": 1}), IsNil)
+
+	cluster := session.cluster()
+	idle := func(addr string) int {
+		cluster.RLock()
+		server := cluster.servers.Search(addr)
+		cluster.RUnlock()
+		if server == nil {
+			return 0
+		}
+		server.RLock()
+		defer server.RUnlock()
+		return len(server.unusedSockets)
+	}
+	for i := 0; idle(b) < 4; i++ {
+		c.Assert(i < 100, Equals, true)
+		cluster.syncServers()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The primary goes away, and the secondary is elected.
+	m.Lock()
+	primary = b
+	for _, conn := range conns {
+		conn.Close()
+	}
+	dialed := dials[b]
+	m.Unlock()
+	for i := 0; ; i++ {
+		cluster.RLock()
+		elected := cluster.masters.Len() == 1 && cluster.masters.Search(b) != nil
+		cluster.RUnlock()
+		if elected {
+			break
+		}
+		c.Assert(i < 100, Equals, true)
+		cluster.syncServers()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Writes go over the standby connections.
+	session.Refresh()
+	c.Assert(session.DB("mydb").C("mycoll").Insert(bson.M{"n": 2}), IsNil)
+	m.Lock()
+	c.Assert(dials[b], Equals, dialed)
+	m.Unlock()
+
+	c.Assert(info.Copy().StandbyPoolSize, Equals, 4)
+}
+
+func (s *S) TestPoolMonitor(c *C) {
+	const addr = "127.0.0.1:40320"
+	var m sync.Mutex
+	var events []string
+	reasons := make(map[string]int)
+	open := make(map[uint64]bool)
+	note := func(kind string) func(event *PoolEvent) {
+		return func(event *PoolEvent) {
+			if event.ServerAddress != addr {
+				return
+			}
+			m.Lock()
+			defer m.Unlock()
+			events = append(events, kind)
+			switch kind {
+			case "created":
+				open[event.ConnectionId] = true
+			case "closed":
+				delete(open, event.ConnectionId)
+				reasons[event.Reason]++
+			case "failed":
+				reasons[event.Reason]++
+			}
+		}
+	}
+	SetPoolMonitor(&PoolMonitor{
+		PoolCreated:              note("pool"),
+		ConnectionCreated:        note("created"),
+		ConnectionCheckedOut:     note("out"),
+		ConnectionCheckOutFailed: note("failed"),
+		ConnectionCheckedIn:      note("in"),
+		ConnectionClosed:         note("closed"),
+	})
+	defer SetPoolMonitor(nil)
+	count := func(kind string) int {
+		m.Lock()
+		defer m.Unlock()
+		n := 0
+		for _, event := range events {
+			if event == kind {
+				n++
+			}
+		}
+		return n
+	}
+
+	info := fakeDialInfo(fakeAnswer(fakeHello(0)))
+	info.Addrs = []string{addr}
+	session, err := DialWithInfo(info)
+	c.Assert(err, IsNil)
+	c.Assert(session.Ping(), IsNil)
+	c.Assert(count("pool") > 0, Equals, true)
+	c.Assert(count("created") > 0, Equals, true)
+	c.Assert(count("out") > 0, Equals, true)
+
+	// The session keeps its socket checked out, so none may be checked
+	// out by a session limited to a single connection.
+	limited := session.Copy()
+	limited.SetPoolLimit(1)
+	limited.SetPoolTimeout(50 * time.Millisecond)
+	c.Assert(limited.Ping(), ErrorMatches, "could not acquire connection within pool timeout")
+	limited.Close()
+	m.Lock()
+	c.Assert(reasons[PoolReasonTimeout], Equals, 1)
+	m.Unlock()
+
+	c.Assert(session.Reconfigure(Reconfiguration{}), IsNil)
+	c.Assert(session.Ping(), IsNil)
+	session.Close()
+
+	// All connections are closed once the cluster goes away.
+	for i := 0; ; i++ {
+		m.Lock()
+		closed := len(open) == 0
+		m.Unlock()
+		if closed {
+			break
+		}
+		c.Assert(i < 500, Equals, true)
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(count("in"), Equals, count("out"))
+	c.Assert(count("closed"), Equals, count("created"))
+	m.Lock()
+	c.Assert(reasons[PoolReasonStale] > 0, Equals, true)
+	c.Assert(reasons[PoolReasonPoolClosed] > 0, Equals, true)
+	m.Unlock()
+}
+
+func (s *S) TestTransactionRouting(c *C) {
+	doc := fakeHello(7)
+	doc["id"] = bson.M{"id": 1}
+	session := dialFake(c, func(body []byte) bson.M {
+		if bytes.Contains(body, []byte("\x02find\x00")) {
+			return bson.M{"ok": 1, "cursor": bson.M{"id": int64(0), "ns": "mydb.mycoll", "firstBatch": []bson.M{{"n": 1}}}}
+		}
+		return doc
+	})
+	defer session.Close()
+	session.SetMode(Eventual, true)
+	coll := session.DB("mydb").C("mycoll")
+
+	c.Assert(session.StartTransaction(), IsNil)
+	var result bson.M
+	c.Assert(coll.Find(nil).One(&result), IsNil)
+	c.Assert(coll.Find(nil).SetMode(Primary).One(&result), IsNil)
+	err := coll.Find(nil).SetMode(Secondary).One(&result)
+	c.Assert(err, Equals, errTransactionReadPreference)
+	err = coll.Find(nil).SetMode(Nearest).Iter().Close()
+	c.Assert(err, Equals, errTransactionReadPreference)
+
+	// Once the connection is lost, the transaction can't go on elsewhere.
+	session.m.RLock()
+	socket := session.txn.socket
+	session.m.RUnlock()
+	socket.Close()
+	c.Assert(coll.Find(nil).One(&result), Equals, errTransactionServerLost)
+	c.Assert(coll.Insert(bson.M{"n": 1}), Equals, errTransactionServerLost)
+	c.Assert(session.AbortTransaction(), NotNil)
+
+	// Aborting releases the pin.
+	session.m.RLock()
+	c.Assert(session.txn, IsNil)
+	session.m.RUnlock()
+	c.Assert(coll.Find(nil).One(&result), IsNil)
+	c.Assert(session.Ping(), IsNil)
+}
+
+func (s *S) TestFindByIds(c *C) {
+	doc := fakeHello(7)
+	var queries int32
+	session := dialFake(c, func(body []byte) bson.M {
+		if bytes.Contains(body, []byte("\x02find\x00")) {
+			atomic.AddInt32(&queries, 1)
+			// Documents come in _id index order, one of them with an _id
+			// of another type than requested.
+			batch := []bson.D{
+				{{Name: "_id", Value: int32(40)}, {Name: "n", Value: 40}},
+				{{Name: "_id", Value: int64(42)}, {Name: "n", Value: 42}},
+				{{Name: "_id", Value: int64(43)}, {Name: "n", Value: 43}},
+			}
+			return bson.M{"ok": 1, "cursor": bson.M{"id": int64(0), "ns": "mydb.mycoll", "firstBatch": batch}}
+		}
+		return doc
+	})
+	defer session.Close()
+	coll := session.DB("mydb").C("mycoll")
+
+	var result []struct{ N int }
+	err := coll.FindByIds([]int64{43, 99, 40, 42, 43}, &result)
+	c.Assert(err, IsNil)
+	c.Assert(atomic.LoadInt32(&queries), Equals, int32(1))
+	c.Assert(result, HasLen, 3)
+	c.Assert(result[0].N, Equals, 43)
+	c.Assert(result[1].N, Equals, 42)
+	c.Assert(result[2].N, Equals, 40)
+
+	// No query is needed without ids.
+	err = coll.FindByIds([]int64{}, &result)
+	c.Assert(err, IsNil)
+	c.Assert(result, HasLen, 0)
+	c.Assert(atomic.LoadInt32(&queries), Equals, int32(1))
+
+	c.Assert(func() { coll.FindByIds(nil, &result) }, PanicMatches, "ids argument must be a slice")
+	c.Assert(func() { coll.FindByIds([]int64{1}, result) }, PanicMatches, "result argument must be a slice address")
+}
+
+func (s *S) TestPipeWriteRouting(c *C) {
+	const a, b = "127.0.0.1:40341", "127.0.0.1:40342"
+	var m sync.Mutex
+	aggregates := make(map[string]int)
+	info := fakeClusterInfo([]string{a, b}, func(addr string, body []byte) bson.M {
+		if bytes.Contains(body, []byte("\x02aggregate\x00")) {
+			m.Lock()
+			aggregates[addr]++
+			m.Unlock()
+			return bson.M{"ok": 1, "cursor": bson.M{"id": int64(0), "ns": "mydb.mycoll", "firstBatch": []bson.M{}}}
+		}
+		return fakeMember(addr, a, []string{a, b}, 7)
+	})
+	session, err := DialWithInfo(info)
+	c.Assert(err, IsNil)
+	defer session.Close()
+	session.SetMode(Secondary, true)
+	coll := session.DB("mydb").C("mycoll")
+
+	match := bson.M{"$match": bson.M{"n": 1}}
+	c.Assert(coll.Pipe([]bson.M{match}).Iter().Close(), IsNil)
+	c.Assert(coll.Pipe([]bson.M{match, {"$out": "other"}}).Iter().Close(), IsNil)
+	c.Assert(coll.Pipe([]bson.D{{{Name: "$merge", Value: bson.M{"into": "other"}}}}).Iter().Close(), IsNil)
+	c.Assert(coll.Pipe([]bson.M{{"$out": "other"}, match}).Iter().Close(), IsNil)
+
+	m.Lock()
+	c.Assert(aggregates[a], Equals, 2)
+	c.Assert(aggregates[b], Equals, 2)
+	m.Unlock()
+
+	c.Assert(pipelineWrites(nil), Equals, false)
+	c.Assert(pipelineWrites([]interface{}{}), Equals, false)
+	c.Assert(pipelineWrites([]interface{}{bson.M{"$out": "other"}}), Equals, true)
+}
+
+func (s *S) TestServerSessionPool(c *C) {
+	doc := fakeHello(7)
+	doc["n"] = 1
+	doc["logicalSessionTimeoutMinutes"] = 30
+	var m sync.Mutex
+	var started, dials int
+	withLsid := make(map[string]int)
+	ended := make(chan []byte, 1)
+	commands := []string{"hello", "isMaster", "find", "getMore", "insert", "count"}
+	info := fakeDialInfo(func(body []byte) bson.M {
+		m.Lock()
+		defer m.Unlock()
+		if bytes.Contains(body, []byte("\x10startSession\x00")) {
+			started++
+			return bson.M{"ok": 1, "id": bson.M{"id": started}}
+		}
+		if bytes.Contains(body, []byte("\x04endSessions\x00")) {
+			ended <- body
+			return doc
+		}
+		for _, name := range commands {
+			if bytes.Contains(body, []byte(name+"\x00")) && bytes.Contains(body, []byte("\x03lsid\x00")) {
+				withLsid[name]++
+			}
+		}
+		if bytes.Contains(body, []byte("\x02find\x00")) {
+			return bson.M{"ok": 1, "cursor": bson.M{"id": int64(42), "ns": "mydb.mycoll", "firstBatch": []bson.M{{"n": 1}}}}
+		}
+		if bytes.Contains(body, []byte("\x12getMore\x00")) {
+			return bson.M{"ok": 1, "cursor": bson.M{"id": int64(0), "ns": "mydb.mycoll", "nextBatch": []bson.M{{"n": 2}}}}
+		}
+		return doc
+	})
+	dial := info.DialServer
+	info.DialServer = func(server *ServerAddr) (net.Conn, error) {
+		m.Lock()
+		dials++
+		m.Unlock()
+		return dial(server)
+	}
+	session, err := DialWithInfo(info)
+	c.Assert(err, IsNil)
+	coll := session.DB("mydb").C("mycoll")
+
+	c.Assert(coll.Insert(bson.M{"n": 1}), IsNil)
+	var result []bson.M
+	c.Assert(coll.Find(nil).All(&result), IsNil)
+	c.Assert(result, HasLen, 2)
+	session.SetSafe(nil)
+	c.Assert(coll.Insert(bson.M{"n": 2}), IsNil)
+
+	m.Lock()
+	c.Assert(started, Equals, 1)
+	c.Assert(withLsid["insert"], Equals, 1)
+	c.Assert(withLsid["find"], Equals, 1)
+	c.Assert(withLsid["getMore"], Equals, 1)
+	c.Assert(withLsid["hello"]+withLsid["isMaster"], Equals, 0)
+	m.Unlock()
+
+	// A closed session's id is reused by the next one.
+	other := session.Copy()
+	_, err = other.DB("mydb").C("mycoll").Count()
+	c.Assert(err, IsNil)
+	other.Close()
+	another := session.Copy()
+	_, err = another.DB("mydb").C("mycoll").Count()
+	c.Assert(err, IsNil)
+	m.Lock()
+	c.Assert(started, Equals, 2)
+	c.Assert(withLsid["count"], Equals, 2)
+	m.Unlock()
+	another.Close()
+
+	// Pooled ids are ended once the cluster is closed, over one of the
+	// idle connections rather than a new one.
+	m.Lock()
+	before := dials
+	m.Unlock()
+	session.Close()
+	select {
+	case body := <-ended:
+		c.Assert(bytes.Count(body, []byte("\x10id\x00")), Equals, 2)
+	case <-time.After(5 * time.Second):
+		c.Fatalf("pooled sessions weren't ended")
+	}
+	m.Lock()
+	c.Assert(dials, Equals, before)
+	m.Unlock()
+}
+
+func (s *S) TestEndServerSessionsWithoutIdleSocket(c *C) {
+	var dials int
+	server := &mongoServer{
+		Addr: "127.0.0.1:40470",
+		info: &mongoServerInfo{Master: true, MaxWireVersion: 7, LogicalSessionTimeout: 30 * time.Minute},
+		dial: dialer{new: func(addr *ServerAddr) (net.Conn, error) {
+			dials++
+			return nil, errors.New("no dialing")
+		}},
+	}
+
+	// With no idle connection the sessions are left to time out on the
+	// server, rather than waiting for a connection to be established.
+	endServerSessions(server, &DialInfo{Timeout: time.Second}, []bson.Raw{{Kind: 0x03}})
+	c.Assert(dials, Equals, 0)
+}
+
+func (s *S) TestSlowOperationThreshold(c *C) {
+	doc := fakeHello(7)
+	doc["n"] = 1
+	session := dialFake(c, func(body []byte) bson.M {
+		if bytes.Contains(body, []byte("\x02find\x00")) {
+			time.Sleep(50 * time.Millisecond)
+			return bson.M{"ok": 1, "cursor": bson.M{"id": int64(0), "ns": "mydb.mycoll", "firstBatch": []bson.M{{"n": 1}}}}
+		}
+		return doc
+	})
+	defer session.Close()
+
+	var m sync.Mutex
+	var slow []SlowOperation
+	session.SetSlowOperationThreshold(20*time.Millisecond, func(op *SlowOperation) {
+		m.Lock()
+		slow = append(slow, *op)
+		m.Unlock()
+	})
+	coll := session.DB("mydb").C("mycoll")
+	c.Assert(coll.Insert(bson.M{"n": 1}), IsNil)
+	c.Assert(session.Ping(), IsNil)
+	var result bson.M
+	c.Assert(coll.Find(nil).One(&result), IsNil)
+
+	// Copies keep the setting until it's disabled.
+	copied := session.Copy()
+	defer copied.Close()
+	c.Assert(copied.DB("mydb").C("mycoll").Find(nil).One(&result), IsNil)
+	copied.SetSlowOperationThreshold(0, nil)
+	c.Assert(copied.DB("mydb").C("mycoll").Find(nil).One(&result), IsNil)
+
+	m.Lock()
+	defer m.Unlock()
+	c.Assert(slow, HasLen, 2)
+	for _, op := range slow {
+		c.Assert(op.CommandName, Equals, "find")
+		c.Assert(op.Namespace, Equals, "mydb.mycoll")
+		c.Assert(op.ServerAddress, Equals, fakeAddr)
+		c.Assert(op.Duration >= 50*time.Millisecond, Equals, true)
+		c.Assert(op.Err, IsNil)
+	}
+
+	kind, name, value := firstElement([]byte("\x05\x00\x00\x00\x00"))
+	c.Assert(kind, Equals, byte(0))
+	c.Assert(name, Equals, "")
+	c.Assert(value, IsNil)
+	name, ns := commandSummary("mydb.mycoll", nil)
+	c.Assert(name, Equals, "query")
+	c.Assert(ns, Equals, "mydb.mycoll")
+}
+
+func (s *S) TestCursorLost(c *C) {
+	doc := fakeHello(7)
+	var m sync.Mutex
+	gone := false
+	info := fakeDialInfo(func(body []byte) bson.M {
+		switch {
+		case bytes.Contains(body, []byte("\x02find\x00")):
+			return bson.M{"ok": 1, "cursor": bson.M{"id": int64(42), "ns": "mydb.mycoll", "firstBatch": []bson.M{{"n": 1}}}}
+		case bytes.Contains(body, []byte("\x12getMore\x00")) && bytes.Contains(body, []byte("\x02collection\x00\x07\x00\x00\x00failed\x00")):
+			return bson.M{"ok": 0, "code": 43, "errmsg": "cursor id 42 not found"}
+		case bytes.Contains(body, []byte("\x12getMore\x00")):
+			// The server goes away mid-cursor.
+			m.Lock()
+			gone = true
+			m.Unlock()
+			return nil
+		}
+		return doc
+	})
+	dial := info.DialServer
+	info.DialServer = func(server *ServerAddr) (net.Conn, error) {
+		m.Lock()
+		defer m.Unlock()
+		if gone {
+			return nil, errors.New("unreachable")
+		}
+		return dial(server)
+	}
+	session, err := DialWithInfo(info)
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	// Errors reported by the server are kept as they are.
+	iter := session.DB("mydb").C("failed").Find(nil).Iter()
+	var result bson.M
+	c.Assert(iter.Next(&result), Equals, true)
+	c.Assert(iter.Next(&result), Equals, false)
+	qerr, ok := iter.Err().(*QueryError)
+	c.Assert(ok, Equals, true)
+	c.Assert(qerr.Code, Equals, 43)
+
+	iter = session.DB("mydb").C("mycoll").Find(nil).Iter()
+	c.Assert(iter.Next(&result), Equals, true)
+	c.Assert(result["n"], Equals, 1)
+	c.Assert(iter.Next(&result), Equals, false)
+	lerr, ok := iter.Err().(*CursorLostError)
+	c.Assert(ok, Equals, true)
+	c.Assert(lerr.Server, Equals, fakeAddr)
+	c.Assert(lerr.Err, NotNil)
+	c.Assert(lerr, ErrorMatches, "cursor lost as server "+fakeAddr+" is no longer available: .*")
+
+	// Asking for more once the connection is gone is reported alike.
+	c.Assert(iter.Next(&result), Equals, false)
+	_, ok = iter.Err().(*CursorLostError)
+	c.Assert(ok, Equals, true)
+}
+
+func (s *S) TestServerSelector(c *C) {
+	const a, b = "127.0.0.1:40381", "127.0.0.1:40382"
+	var m sync.Mutex
+	finds := make(map[string]int)
+	info := fakeClusterInfo([]string{a, b}, func(addr string, body []byte) bson.M {
+		if bytes.Contains(body, []byte("\x02find\x00")) {
+			m.Lock()
+			finds[addr]++
+			m.Unlock()
+			return bson.M{"ok": 1, "cursor": bson.M{"id": int64(0), "ns": "mydb.mycoll", "firstBatch": []bson.M{{"n": 1}}}}
+		}
+		doc := fakeMember(addr, a, []string{a, b}, 7)
+		doc["n"] = 1
+		return doc
+	})
+	session, err := DialWithInfo(info)
+	c.Assert(err, IsNil)
+	defer session.Close()
+	for i := 0; len(session.TopologySnapshot().Servers) < 2; i++ {
+		c.Assert(i < 100, Equals, true)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var writes []bool
+	var snapshots []*TopologySnapshot
+	pick := func(addr string) ServerSelector {
+		return func(snapshot *TopologySnapshot, write bool) *ServerInfo {
+			m.Lock()
+			defer m.Unlock()
+			writes = append(writes, write)
+			snapshots = append(snapshots, snapshot)
+			for i := range snapshot.Details {
+				if snapshot.Details[i].Addr == addr {
+					return &snapshot.Details[i]
+				}
+			}
+			return nil
+		}
+	}
+
+	// Reads go wherever the selector says, despite the session mode.
+	selected := session.Copy()
+	defer selected.Close()
+	selected.SetMode(Secondary, true)
+	selected.SetServerSelector(pick(a))
+	var result bson.M
+	c.Assert(selected.DB("mydb").C("mycoll").Find(nil).One(&result), IsNil)
+	writer := session.Copy()
+	defer writer.Close()
+	writer.SetServerSelector(pick(a))
+	c.Assert(writer.DB("mydb").C("mycoll").Insert(bson.M{"n": 1}), IsNil)
+
+	m.Lock()
+	c.Assert(finds[a], Equals, 1)
+	c.Assert(finds[b], Equals, 0)
+	c.Assert(writes, DeepEquals, []bool{false, true})
+	snapshot := snapshots[0]
+	m.Unlock()
+	c.Assert(snapshot.Primary, Equals, a)
+	c.Assert(snapshot.Servers, HasLen, 2)
+	c.Assert(snapshot.Details, HasLen, 2)
+	for _, info := range snapshot.Details {
+		c.Assert(info.Master, Equals, info.Addr == a)
+		c.Assert(info.SetName, Equals, "rs")
+		c.Assert(info.MaxWireVersion, Equals, 7)
+	}
+
+	// Selecting no server fails once the sync timeout expires.
+	none := session.Copy()
+	defer none.Close()
+	none.SetSyncTimeout(300 * time.Millisecond)
+	none.SetServerSelector(pick("127.0.0.1:1"))
+	c.Assert(none.Ping(), Equals, errNoServerSelected)
+
+	// The built-in selection is restored without a selector.
+	builtin := session.Copy()
+	defer builtin.Close()
+	builtin.SetMode(Secondary, true)
+	builtin.SetServerSelector(pick(a))
+	builtin.SetServerSelector(nil)
+	c.Assert(builtin.DB("mydb").C("mycoll").Find(nil).One(&result), IsNil)
+	m.Lock()
+	c.Assert(finds[b], Equals, 1)
+	m.Unlock()
+}
+
+func (s *S) TestProfilingLevelCommand(c *C) {
+	doc := fakeHello(7)
+	var m sync.Mutex
+	var profiles []bson.M
+	session := dialFake(c, func(body []byte) bson.M {
+		if bytes.Contains(body, []byte("\x10profile\x00")) {
+			var cmd bson.M
+			fakeCommand(c, body, &cmd)
+			m.Lock()
+			profiles = append(profiles, cmd)
+			m.Unlock()
+			return bson.M{"ok": 1, "was": 1, "slowms": 100, "sampleRate": 1.0}
+		}
+		return doc
+	})
+	defer session.Close()
+	db := session.DB("mydb")
+
+	level, err := db.GetProfilingLevel()
+	c.Assert(err, IsNil)
+	c.Assert(*level, Equals, ProfilingLevel{Level: 1, SlowMs: 100})
+	prior, err := db.SetProfilingLevel(2, 0)
+	c.Assert(err, IsNil)
+	c.Assert(*prior, Equals, ProfilingLevel{Level: 1, SlowMs: 100})
+	_, err = db.SetProfilingLevel(0, 20)
+	c.Assert(err, IsNil)
+	_, err = db.SetProfilingLevel(1, -1)
+	c.Assert(err, ErrorMatches, "invalid slow operation threshold: -1ms")
+
+	m.Lock()
+	defer m.Unlock()
+	c.Assert(profiles, HasLen, 3)
+	c.Assert(profiles[0]["profile"], Equals, -1)
+	c.Assert(profiles[1]["profile"], Equals, 2)
+	c.Assert(profiles[1]["slowms"], IsNil)
+	c.Assert(profiles[2]["profile"], Equals, 0)
+	c.Assert(profiles[2]["slowms"], Equals, 20)
+}
+
+func (s *S) TestSplitIds(c *C) {
+	// Numbers are split into distinct ranges, the last one including max.
+	c.Assert(splitIds(0, 100, 4), DeepEquals, []interface{}{int64(0), int64(25), int64(50), int64(75), int64(100)})
+	c.Assert(splitIds(int64(-10), 10, 2), DeepEquals, []interface{}{int64(-10), int64(0), int64(10)})
+	c.Assert(splitIds(0, 2, 8), DeepEquals, []interface{}{int64(0), int64(1), int64(2)})
+	c.Assert(splitIds(5, 5, 4), DeepEquals, []interface{}{int64(5), int64(5)})
+	c.Assert(splitIds(int64(math.MinInt64), int64(math.MaxInt64), 2), DeepEquals, []interface{}{int64(math.MinInt64), int64(-1), int64(math.MaxInt64)})
+	c.Assert(splitIds(0, 1.0, 4), DeepEquals, []interface{}{0.0, 0.25, 0.5, 0.75, 1.0})
+	c.Assert(splitIds(0.5, 0.5, 4), DeepEquals, []interface{}{0.5, 0.5})
+
+	min := bson.ObjectIdHex("5a0000000000000000000000")
+	max := bson.ObjectIdHex("5c0000000000000000000000")
+	c.Assert(splitIds(min, max, 2), DeepEquals, []interface{}{min, bson.ObjectIdHex("5b0000000000000000000000"), max})
+
+	// Anything else isn't split.
+	c.Assert(splitIds("a", "z", 4), IsNil)
+	c.Assert(splitIds(min, 10, 4), IsNil)
+	c.Assert(splitIds(1, "z", 4), IsNil)
+	c.Assert(splitIds(math.NaN(), 1.0, 4), IsNil)
+	c.Assert(splitIds(bson.M{"a": 1}, bson.M{"a": 2}, 4), IsNil)
+
+	c.Assert(idRanges("a", "z", 4), DeepEquals, []interface{}{nil})
+	c.Assert(idRanges(0, 10, 2), DeepEquals, []interface{}{
+		bson.D{{Name: "_id", Value: bson.D{{Name: "$gte", Value: int64(0)}, {Name: "$lt", Value: int64(5)}}}},
+		bson.D{{Name: "_id", Value: bson.D{{Name: "$gte", Value: int64(5)}, {Name: "$lte", Value: int64(10)}}}},
+	})
+}
+
+func (s *S) TestBulkDuplicates(c *C) {
+	doc := fakeHello(7)
+	var m sync.Mutex
+	var stored map[int]bool
+	var inserts int
+	var updates []bson.M
+	command := func(body []byte) (cmd struct {
+		Ordered   bool
+		Documents []bson.M
+		Updates   []bson.M
+	}) {
+		fakeCommand(c, body, &cmd)
+		return cmd
+	}
+	session := dialFake(c, func(body []byte) bson.M {
+		m.Lock()
+		defer m.Unlock()
+		switch {
+		case bytes.Contains(body, []byte("\x02insert\x00")):
+			cmd := command(body)
+			inserts++
+			n := 0
+			var errs []bson.M
+			for i, d := range cmd.Documents {
+				id := d["_id"].(int)
+				if stored[id] {
+					errs = append(errs, bson.M{"index": i, "code": 11000, "errmsg": "E11000 duplicate key error"})
+					if cmd.Ordered {
+						break
+					}
+					continue
+				}
+				stored[id] = true
+				n++
+			}
+			return bson.M{"ok": 1, "n": n, "writeErrors": errs}
+		case bytes.Contains(body, []byte("\x02update\x00")):
+			cmd := command(body)
+			updates = append(updates, cmd.Updates...)
+			return bson.M{"ok": 1, "n": len(cmd.Updates), "nModified": len(cmd.Updates)}
+		}
+		return doc
+	})
+	defer session.Close()
+	coll := session.DB("mydb").C("mycoll")
+
+	run := func(mode DuplicateMode, ordered bool) (*BulkResult, error) {
+		m.Lock()
+		stored = map[int]bool{2: true, 4: true}
+		inserts = 0
+		updates = nil
+		m.Unlock()
+		bulk := coll.Bulk()
+		if !ordered {
+			bulk.Unordered()
+		}
+		bulk.SetDuplicates(mode)
+		bulk.Insert(bson.M{"_id": 1}, bson.M{"_id": 2}, bson.M{"_id": 3}, bson.M{"_id": 4}, bson.M{"_id": 5})
+		return bulk.Run()
+	}
+
+	// Duplicates fail the bulk operation by default.
+	_, err := run(DuplicatesFail, true)
+	c.Assert(IsDup(err), Equals, true)
+	m.Lock()
+	c.Assert(stored, DeepEquals, map[int]bool{1: true, 2: true, 4: true})
+	m.Unlock()
+
+	// Ordered inserts go on after every duplicate.
+	result, err := run(DuplicatesSkip, true)
+	c.Assert(err, IsNil)
+	c.Assert(result.Duplicates, DeepEquals, []int{1, 3})
+	m.Lock()
+	c.Assert(stored, DeepEquals, map[int]bool{1: true, 2: true, 3: true, 4: true, 5: true})
+	c.Assert(inserts, Equals, 3)
+	c.Assert(updates, HasLen, 0)
+	m.Unlock()
+
+	// Duplicates replace the existing documents by _id.
+	result, err = run(DuplicatesUpsert, false)
+	c.Assert(err, IsNil)
+	c.Assert(result.Duplicates, DeepEquals, []int{1, 3})
+	c.Assert(result.Matched, Equals, 2)
+	m.Lock()
+	c.Assert(inserts, Equals, 1)
+	c.Assert(updates, HasLen, 2)
+	for i, id := range []int{2, 4} {
+		c.Assert(updates[i]["q"], DeepEquals, bson.M{"_id": id})
+		c.Assert(updates[i]["u"], DeepEquals, bson.M{"_id": id})
+		c.Assert(updates[i]["upsert"], Equals, true)
+	}
+	m.Unlock()
+}
+
+func (s *S) TestTopologyType(c *C) {
+	topology := func(fields bson.M) TopologyType {
+		reply := fakeHello(0)
+		for name, value := range fields {
+			reply[name] = value
+		}
+		info := fakeDialInfo(fakeAnswer(reply))
+		info.Direct = true
+		session, err := DialWithInfo(info)
+		c.Assert(err, IsNil)
+		defer session.Close()
+		return session.TopologyType()
+	}
+
+	c.Assert((&mongoCluster{}).TopologyType(), Equals, TopologyUnknown)
+	c.Assert(topology(nil), Equals, TopologySingle)
+	c.Assert(topology(bson.M{"setName": "rs"}), Equals, TopologyReplicaSet)
+	c.Assert(topology(bson.M{"msg": "isdbgrid"}), Equals, TopologySharded)
+	c.Assert(TopologyReplicaSet.String(), Equals, "replica set")
+}
+
+func (s *S) TestHandshakeClientMetadata(c *C) {
+	doc := fakeHello(7)
+	var m sync.Mutex
+	var handshakes [][]bson.M // Per connection.
+	info := fakeDialInfo(fakeAnswer(doc))
+	info.AppName = "checkout-service"
+	info.DialServer = func(server *ServerAddr) (net.Conn, error) {
+		client, conn := net.Pipe()
+		m.Lock()
+		n := len(handshakes)
+		handshakes = append(handshakes, nil)
+		m.Unlock()
+		go fakeServerFunc(conn, func(body []byte) bson.M {
+			if bytes.Contains(body, []byte("\x10isMaster\x00")) || bytes.Contains(body, []byte("\x10hello\x00")) {
+				var cmd bson.M
+				fakeCommand(c, body, &cmd)
+				m.Lock()
+				handshakes[n] = append(handshakes[n], cmd)
+				m.Unlock()
+			}
+			return doc
+		})
+		return client, nil
+	}
+	session, err := DialWithInfo(info)
+	c.Assert(err, IsNil)
+	defer session.Close()
+	c.Assert(session.Ping(), IsNil)
+	session.Refresh()
+	c.Assert(session.Ping(), IsNil)
+
+	m.Lock()
+	defer m.Unlock()
+	c.Assert(len(handshakes) > 0, Equals, true)
+	for _, cmds := range handshakes {
+		c.Assert(len(cmds) > 0, Equals, true)
+		client, ok := cmds[0]["client"].(bson.M)
+		c.Assert(ok, Equals, true)
+		c.Assert(client["application"], DeepEquals, bson.M{"name": "checkout-service"})
+		c.Assert(client["driver"], DeepEquals, bson.M{"name": "mgo", "version": "globalsign"})
+		c.Assert(client["os"], DeepEquals, bson.M{"type": runtime.GOOS, "architecture": runtime.GOARCH})
+
+		// Later handshakes on the same connection carry no metadata.
+		for _, cmd := range cmds[1:] {
+			c.Assert(cmd["client"], IsNil)
+		}
+	}
+}
+
+func (s *S) TestWriteConcernError(c *C) {
+	doc := fakeHello(7)
+	var m sync.Mutex
+	var reply bson.M
+	session := dialFake(c, func(body []byte) bson.M {
+		if bytes.Contains(body, []byte("\x02insert\x00")) {
+			m.Lock()
+			defer m.Unlock()
+			return reply
+		}
+		return doc
+	})
+	defer session.Close()
+	coll := session.DB("mydb").C("mycoll")
+	insert := func(r bson.M) error {
+		m.Lock()
+		reply = r
+		m.Unlock()
+		return coll.Insert(bson.M{"_id": 1}, bson.M{"_id": 2})
+	}
+	concernError := bson.M{"code": 64, "errmsg": "waiting for replication timed out", "errInfo": bson.M{"wtimeout": true}}
+	writeErrors := []bson.M{{"index": 1, "code": 11000, "errmsg": "E11000 duplicate key error"}}
+
+	// The writes were applied, but not confirmed.
+	err := insert(bson.M{"ok": 1, "n": 2, "writeConcernError": concernError})
+	c.Assert(err, ErrorMatches, "waiting for replication timed out")
+	c.Assert(IsWriteConcernError(err), Equals, true)
+	lerr := err.(*LastError)
+	c.Assert(lerr.ConcernError, DeepEquals, &WriteConcernError{Code: 64, Message: "waiting for replication timed out", WTimeout: true})
+	c.Assert(lerr.WTimeout, Equals, true)
+	c.Assert(lerr.WriteErrors(), HasLen, 0)
+
+	// A write failed.
+	err = insert(bson.M{"ok": 1, "n": 1, "writeErrors": writeErrors})
+	c.Assert(IsDup(err), Equals, true)
+	c.Assert(IsWriteConcernError(err), Equals, false)
+	lerr = err.(*LastError)
+	c.Assert(lerr.ConcernError, IsNil)
+	c.Assert(lerr.WriteErrors(), HasLen, 1)
+	c.Assert(lerr.WriteErrors()[0].Index, Equals, 1)
+
+	// A write failed, and the others weren't confirmed.
+	err = insert(bson.M{"ok": 1, "n": 1, "writeErrors": writeErrors, "writeConcernError": concernError})
+	c.Assert(IsWriteConcernError(err), Equals, false)
+	lerr = err.(*LastError)
+	c.Assert(lerr.ConcernError, NotNil)
+	c.Assert(lerr.WriteErrors(), HasLen, 1)
+
+	// Bulk operations tell them apart as well.
+	m.Lock()
+	reply = bson.M{"ok": 1, "n": 2, "writeConcernError": concernError}
+	m.Unlock()
+	bulk := coll.Bulk()
+	bulk.Insert(bson.M{"_id": 1}, bson.M{"_id": 2})
+	_, err = bulk.Run()
+	c.Assert(IsWriteConcernError(err), Equals, true)
+	c.Assert(err.(*BulkError).Cases(), HasLen, 2)
+}
+
+func (s *S) TestOnlyFields(c *C) {
+	doc := bson.D{
+		{Name: "double", Value: 1.5},
+		{Name: "string", Value: "s"},
+		{Name: "doc", Value: bson.M{"a": 1}},
+		{Name: "array", Value: []int{1, 2}},
+		{Name: "binary", Value: []byte("bin")},
+		{Name: "undefined", Value: bson.Undefined},
+		{Name: "objectid", Value: bson.ObjectIdHex("5a934e000102030405000000")},
+		{Name: "bool", Value: true},
+		{Name: "datetime", Value: time.Unix(1, 0)},
+		{Name: "null", Value: nil},
+		{Name: "regex", Value: bson.RegEx{Pattern: "^a", Options: "i"}},
+		{Name: "dbpointer", Value: bson.DBPointer{Namespace: "db.c", Id: bson.ObjectIdHex("5a934e000102030405000000")}},
+		{Name: "code", Value: bson.JavaScript{Code: "f()"}},
+		{Name: "symbol", Value: bson.Symbol("sym")},
+		{Name: "scope", Value: bson.JavaScript{Code: "f()", Scope: bson.M{"x": 1}}},
+		{Name: "int32", Value: 1},
+		{Name: "timestamp", Value: bson.MongoTimestamp(1)},
+		{Name: "int64", Value: int64(1) << 40},
+		{Name: "decimal", Value: bson.Decimal128{}},
+		{Name: "min", Value: bson.MinKey},
+		{Name: "max", Value: bson.MaxKey},
+	}
+	data, err := bson.Marshal(doc)
+	c.Assert(err, IsNil)
+
+	// Every element is skipped over by its size.
+	for i, elem := range doc {
+		only, err := bson.Marshal(doc[i : i+1])
+		c.Assert(err, IsNil)
+		c.Assert(onlyFields(data, map[string]bool{elem.Name: true}), DeepEquals, only, Commentf("field %s", elem.Name))
+	}
+	only, err := bson.Marshal(bson.D{doc[1], doc[20]})
+	c.Assert(err, IsNil)
+	c.Assert(onlyFields(data, decodeFieldSet([]string{"max", "string", "missing"})), DeepEquals, only)
+	c.Assert(onlyFields(data, map[string]bool{}), DeepEquals, []byte{5, 0, 0, 0, 0})
+	c.Assert(onlyFields(data, nil), DeepEquals, data)
+
+	// Malformed documents are left for the decoder to report.
+	truncated := append([]byte(nil), data[:len(data)-20]...)
+	binary.LittleEndian.PutUint32(truncated, uint32(len(truncated)))
+	c.Assert(onlyFields(truncated, map[string]bool{"max": true}), DeepEquals, truncated)
+	c.Assert(onlyFields(data[:3], map[string]bool{"max": true}), DeepEquals, data[:3])
+
+	// Iterators decode the selected fields only, keeping the raw data whole.
+	iter := &Iter{timeout: -1}
+	iter.gotReply.L = &iter.m
+	iter.DecodeOnly("string", "int32")
+	iter.docData.Push(data)
+	var result bson.M
+	c.Assert(iter.Next(&result), Equals, true)
+	c.Assert(result, DeepEquals, bson.M{"string": "s", "int32": 1})
+	c.Assert(iter.Raw(), DeepEquals, data)
+	iter.DecodeOnly()
+	iter.docData.Push(data)
+	result = nil
+	c.Assert(iter.Next(&result), Equals, true)
+	c.Assert(result, HasLen, len(doc))
+}
+
+func (s *S) TestValidatorCommands(c *C) {
+	var sessions []*Session
+	defer func() {
+		for _, session := range sessions {
+			session.Close()
+		}
+	}()
+	validator := func(maxWireVersion int) (*Collection, func() []bson.M) {
+		doc := fakeHello(maxWireVersion)
+		var m sync.Mutex
+		var cmds []bson.M
+		session := dialFake(c, func(body []byte) bson.M {
+			if bytes.Contains(body, []byte("\x02create\x00")) || bytes.Contains(body, []byte("\x02collMod\x00")) {
+				var cmd bson.M
+				fakeCommand(c, body, &cmd)
+				m.Lock()
+				cmds = append(cmds, cmd)
+				m.Unlock()
+				return bson.M{"ok": 1}
+			}
+			return doc
+		})
+		sessions = append(sessions, session)
+		return session.DB("mydb").C("mycoll"), func() []bson.M {
+			m.Lock()
+			defer m.Unlock()
+			return cmds
+		}
+	}
+	schema := bson.M{"$jsonSchema": bson.M{"required": []string{"name"}}}
+	expr := bson.M{"$and": []bson.M{{"a": 1}, {"$expr": bson.M{"$gt": []string{"$a", "$b"}}}}}
+
+	coll, cmds := validator(7)
+	c.Assert(coll.Create(&CollectionInfo{Validator: schema, ValidationAction: "warn"}), IsNil)
+	c.Assert(coll.SetValidator(expr, "moderate", ""), IsNil)
+	c.Assert(coll.SetValidator(nil, "", "error"), IsNil)
+	c.Assert(cmds(), HasLen, 3)
+	c.Assert(cmds()[0]["validator"], DeepEquals, bson.M{"$jsonSchema": bson.M{"required": []interface{}{"name"}}})
+	c.Assert(cmds()[0]["validationAction"], Equals, "warn")
+	c.Assert(cmds()[1]["collMod"], Equals, "mycoll")
+	c.Assert(cmds()[1]["validationLevel"], Equals, "moderate")
+	c.Assert(cmds()[1]["validationAction"], IsNil)
+	c.Assert(cmds()[2], DeepEquals, bson.M{"collMod": "mycoll", "validationAction": "error"})
+
+	// Schemas and expressions need MongoDB 3.6, even when nested.
+	coll, cmds = validator(5)
+	c.Assert(coll.Create(&CollectionInfo{Validator: schema}), ErrorMatches, `validator operator \$jsonSchema requires MongoDB 3.6 or newer`)
+	c.Assert(coll.SetValidator(expr, "", ""), ErrorMatches, `validator operator \$expr requires MongoDB 3.6 or newer`)
+	c.Assert(coll.SetValidator(bson.M{"a": bson.M{"$exists": true}}, "", ""), IsNil)
+	c.Assert(cmds(), HasLen, 1)
+
+	// Validation itself needs MongoDB 3.2.
+	coll, cmds = validator(3)
+	c.Assert(coll.SetValidator(bson.M{}, "", ""), Equals, errValidatorNotSupported)
+	c.Assert(coll.Create(&CollectionInfo{Capped: true, MaxBytes: 1024}), IsNil)
+	c.Assert(cmds(), HasLen, 1)
+}
+
+func (s *S) TestLastErrorSameSocket(c *C) {
+	// The fake server predates write commands, and as real ones it keeps
+	// the last error per connection, reporting the n field of the last
+	// inserted document.
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		header := make([]byte, 16)
+		var last int
+		for {
+			if _, err := io.ReadFull(conn, header); err != nil {
+				return
+			}
+			body := make([]byte, binary.LittleEndian.Uint32(header)-16)
+			if _, err := io.ReadFull(conn, body); err != nil {
+				return
+			}
+			// Both OP_INSERT and OP_QUERY start with the flags and the
+			// collection name, and queries have the skip and limit next.
+			start := 4 + bytes.IndexByte(body[4:], 0) + 1
+			var doc bson.M
+			switch binary.LittleEndian.Uint32(header[12:]) {
+			case 2002: // OP_INSERT
+				c.Check(bson.Unmarshal(body[start:], &doc), IsNil)
+				last = doc["n"].(int)
+				continue
+			case 2004: // OP_QUERY
+				c.Check(bson.Unmarshal(body[start+8:], &doc), IsNil)
+			}
+			reply := fakeHello(0)
+			if _, ok := doc["getLastError"]; ok {
+				reply = bson.M{"ok": 1, "err": nil, "n": last}
+			}
+			if fakeReply(conn, header, reply) != nil {
+				return
+			}
+		}
+	}
+	var dials int32
+	info := fakeDialInfo(nil)
+	info.DialServer = func(server *ServerAddr) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		client, conn := net.Pipe()
+		go serve(conn)
+		return client, nil
+	}
+	session, err := DialWithInfo(info)
+	c.Assert(err, IsNil)
+	defer session.Close()
+	session.SetMode(Eventual, true)
+	c.Assert(session.LastError(), IsNil)
+
+	// Writers share the connections in the pool, without ever getting
+	// the last error of another writer.
+	const writers, writes = 10, 50
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			writer := session.Copy()
+			defer writer.Close()
+			coll := writer.DB("mydb").C("mycoll")
+			for j := 0; j < writes; j++ {
+				n := i*writes + j
+				if !c.Check(coll.Insert(bson.M{"n": n}), IsNil) {
+					return
+				}
+				lerr := writer.LastError()
+				if !c.Check(lerr, NotNil) || !c.Check(lerr.N, Equals, n) {
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	c.Assert(atomic.LoadInt32(&dials) > 2, Equals, true)
+
+	// Unacknowledged writes leave nothing to report.
+	session.SetSafe(nil)
+	c.Assert(session.DB("mydb").C("mycoll").Insert(bson.M{"n": -1}), IsNil)
+	c.Assert(session.LastError(), IsNil)
+}
+
+func (s *S) TestWaitForReplication(c *C) {
+	const member = "analytics:27017"
+	opTime, err := bson.NewMongoTimestamp(time.Unix(1500000000, 0), 3)
+	c.Assert(err, IsNil)
+	primaryDate := time.Unix(1500000010, 0)
+
+	var m sync.Mutex
+	var insertReply bson.M
+	var memberOpTimes []bson.MongoTimestamp // Reported by successive polls.
+	var polls int
+	session := dialFake(c, func(body []byte) bson.M {
+		m.Lock()
+		defer m.Unlock()
+		switch {
+		case bytes.Contains(body, []byte("\x02insert\x00")):
+			return insertReply
+		case bytes.Contains(body, []byte("\x10replSetGetStatus\x00")):
+			applied := memberOpTimes[0]
+			if len(memberOpTimes) > 1 {
+				memberOpTimes = memberOpTimes[1:]
+			}
+			polls++
+			lag := 2 * time.Second
+			if applied >= opTime {
+				lag = 0
+			}
+			return bson.M{"ok": 1, "members": []bson.M{
+				{"name": "primary:27017", "state": 1, "optime": bson.M{"ts": opTime, "t": int64(1)}, "optimeDate": primaryDate},
+				{"name": member, "state": 2, "optime": bson.M{"ts": applied, "t": int64(1)}, "optimeDate": primaryDate.Add(-lag)},
+			}}
+		}
+		return fakeHello(7)
+	})
+	defer session.Close()
+	script := func(reply bson.M, opTimes ...bson.MongoTimestamp) {
+		m.Lock()
+		insertReply = reply
+		memberOpTimes = opTimes
+		polls = 0
+		m.Unlock()
+	}
+
+	// The optime of writes is reported by replica set members.
+	script(bson.M{"ok": 1, "n": 1, "opTime": bson.M{"ts": opTime, "t": int64(1)}})
+	c.Assert(session.DB("mydb").C("mycoll").Insert(bson.M{"n": 1}), IsNil)
+	c.Assert(session.LastError().OpTime, Equals, opTime)
+	script(bson.M{"ok": 1, "n": 1, "operationTime": opTime - 1})
+	c.Assert(session.DB("mydb").C("mycoll").Insert(bson.M{"n": 1}), IsNil)
+	c.Assert(session.LastError().OpTime, Equals, opTime-1)
+
+	// The member catches up within the timeout.
+	script(nil, opTime-1, opTime-1, opTime)
+	caughtUp, lag, err := session.WaitForReplication(member, opTime, 5*time.Second)
+	c.Assert(err, IsNil)
+	c.Assert(caughtUp, Equals, true)
+	c.Assert(lag, Equals, time.Duration(0))
+	m.Lock()
+	c.Assert(polls, Equals, 3)
+	m.Unlock()
+
+	// The member lags behind for longer than the timeout.
+	script(nil, opTime-1)
+	caughtUp, lag, err = session.WaitForReplication(member, opTime, 2*replicationPollDelay)
+	c.Assert(err, IsNil)
+	c.Assert(caughtUp, Equals, false)
+	c.Assert(lag, Equals, 2*time.Second)
+
+	script(nil, opTime)
+	_, _, err = session.WaitForReplication("unknown:27017", opTime, time.Second)
+	c.Assert(err, ErrorMatches, "replica set member unknown:27017 not found")
+	_, _, err = session.WaitForReplication(member, 0, time.Second)
+	c.Assert(err, Equals, errNoOpTime)
+}
+
+func (s *S) TestInterceptWriteSelectors(c *C) {
+	type price struct{ cents int64 }
+	registry := bson.NewRegistry()
+	registry.Register(reflect.TypeOf(price{}), func(v interface{}) (interface{}, error) {
+		return v.(price).cents, nil
+	}, nil)
+	session := &Session{registry: registry}
+	coll := &Collection{Database: &Database{Session: session, Name: "mydb"}, Name: "mycoll", FullName: "mydb.mycoll"}
+
+	selector := func(doc interface{}) bson.M {
+		raw, ok := doc.(bson.Raw)
+		c.Assert(ok, Equals, true, Commentf("%#v", doc))
+		var m bson.M
+		c.Assert(raw.Unmarshal(&m), IsNil)
+		return m
+	}
+	want := bson.M{"price": int64(99)}
+
+	update := &updateOp{Selector: bson.M{"price": price{99}}, Update: bson.M{"$set": bson.M{"n": 1}}}
+	op, err := coll.interceptWrite(update)
+	c.Assert(err, IsNil)
+	c.Assert(selector(op.(*updateOp).Selector), DeepEquals, want)
+	c.Assert(update.Selector, DeepEquals, bson.M{"price": price{99}})
+
+	op, err = coll.interceptWrite(&deleteOp{Selector: bson.M{"price": price{99}}})
+	c.Assert(err, IsNil)
+	c.Assert(selector(op.(*deleteOp).Selector), DeepEquals, want)
+
+	op, err = coll.interceptWrite(bulkDeleteOp{&deleteOp{Selector: bson.M{"price": price{99}}}})
+	c.Assert(err, IsNil)
+	c.Assert(selector(op.(bulkDeleteOp)[0].(*deleteOp).Selector), DeepEquals, want)
+
+	query := queryOp{query: bson.M{"price": price{99}}}
+	c.Assert(session.encodeQuery(&query), IsNil)
+	c.Assert(selector(query.query), DeepEquals, want)
+
+	pipeline, err := session.encodePipeline([]bson.M{{"$match": bson.M{"price": price{99}}}})
+	c.Assert(err, IsNil)
+	data, err := bson.Marshal(bson.M{"pipeline": pipeline})
+	c.Assert(err, IsNil)
+	var cmd struct{ Pipeline []bson.M }
+	c.Assert(bson.Unmarshal(data, &cmd), IsNil)
+	c.Assert(cmd.Pipeline, DeepEquals, []bson.M{{"$match": want}})
+}
+
+func (s *S) TestTransactionFields(c *C) {
+	doc := fakeHello(7)
+	doc["n"] = 1
+	doc["logicalSessionTimeoutMinutes"] = 30
+	doc["maxBsonObjectSize"] = 1024
+	var m sync.Mutex
+	var sent []string
+	session := dialFake(c, func(body []byte) bson.M {
+		var cmd bson.D
+		fakeCommand(c, body, &cmd)
+		switch cmd[0].Name {
+		case "ismaster", "isMaster", "hello", "getnonce":
+			return doc
+		case "startSession":
+			return bson.M{"ok": 1, "id": bson.M{"id": 1}}
+		}
+		name := cmd[0].Name
+		for _, elem := range cmd {
+			switch elem.Name {
+			case "txnNumber", "startTransaction":
+				name += " " + elem.Name
+			}
+		}
+		m.Lock()
+		sent = append(sent, name)
+		m.Unlock()
+		if cmd[0].Name == "find" {
+			return bson.M{"ok": 1, "cursor": bson.M{"id": int64(0), "ns": "mydb.mycoll", "firstBatch": []bson.M{{"n": 1}}}}
+		}
+		return doc
+	})
+	defer session.Close()
+	coll := session.DB("mydb").C("mycoll")
+	m.Lock()
+	sent = nil
+	m.Unlock()
+
+	c.Assert(session.StartTransaction(), IsNil)
+
+	// A command that never got to the server doesn't start the
+	// transaction, so the next one still does.
+	pad := strings.Repeat("x", 20*1024)
+	err := session.DB("mydb").Run(bson.D{{Name: "ping", Value: 1}, {Name: "pad", Value: pad}}, nil)
+	c.Assert(err, ErrorMatches, "document exceeds maxBsonObjectSize.*")
+
+	// Commands run against the admin database stay out of the transaction.
+	c.Assert(session.Run("ping", nil), IsNil)
+
+	c.Assert(coll.Insert(bson.M{"n": 1}), IsNil)
+	var result bson.M
+	c.Assert(coll.Find(nil).One(&result), IsNil)
+	c.Assert(session.CommitTransaction(), IsNil)
+
+	m.Lock()
+	defer m.Unlock()
+	c.Assert(sent, DeepEquals, []string{
+		"ping",
+		"insert txnNumber startTransaction",
+		"find txnNumber",
+		"commitTransaction txnNumber",
+	})
+}
+
+func (s *S) TestCommentByWireVersion(c *C) {
+	run := func(maxWireVersion int) map[string]interface{} {
+		var m sync.Mutex
+		comments := make(map[string]interface{})
+		doc := fakeHello(maxWireVersion)
+		doc["n"] = 1
+		session := dialFake(c, func(body []byte) bson.M {
+			var cmd bson.D
+			fakeCommand(c, body, &cmd)
+			name := cmd[0].Name
+			switch name {
+			case "count", "findAndModify", "update":
+				m.Lock()
+				comments[name] = cmd.Map()["comment"]
+				m.Unlock()
+			}
+			if name == "findAndModify" {
+				return bson.M{"ok": 1, "value": bson.M{"n": 1}, "lastErrorObject": bson.M{"n": 1, "updatedExisting": true}}
+			}
+			return doc
+		})
+		defer session.Close()
+		coll := session.DB("mydb").C("mycoll")
+
+		_, err := coll.Find(nil).Comment("counting").Count()
+		c.Assert(err, IsNil)
+		var result bson.M
+		_, err = coll.Find(nil).Comment("applying").Apply(Change{Update: bson.M{"$inc": bson.M{"n": 1}}}, &result)
+		c.Assert(err, IsNil)
+		_, err = coll.UpdateWithComment(nil, bson.M{"$inc": bson.M{"n": 1}}, "updating", true)
+		c.Assert(err, IsNil)
+
+		m.Lock()
+		defer m.Unlock()
+		return comments
+	}
+
+	c.Assert(run(8), DeepEquals, map[string]interface{}{"count": nil, "findAndModify": nil, "update": nil})
+	c.Assert(run(9), DeepEquals, map[string]interface{}{"count": "counting", "findAndModify": "applying", "update": "updating"})
+}
+
+func (s *S) TestCollationNotSupported(c *C) {
+	var m sync.Mutex
+	var sent []string
+	doc := fakeHello(4)
+	doc["n"] = 1
+	session := dialFake(c, func(body []byte) bson.M {
+		var cmd bson.D
+		fakeCommand(c, body, &cmd)
+		switch cmd[0].Name {
+		case "count", "distinct", "findAndModify", "createIndexes":
+			m.Lock()
+			sent = append(sent, cmd[0].Name)
+			m.Unlock()
+		}
+		return doc
+	})
+	defer session.Close()
+	coll := session.DB("mydb").C("mycoll")
+	collation := &Collation{Locale: "en", Strength: 2}
+
+	_, err := coll.Find(nil).Collation(collation).Count()
+	c.Assert(err, Equals, errCollationNotSupported)
+	var values []int
+	err = coll.Find(nil).Collation(collation).Distinct("n", &values)
+	c.Assert(err, Equals, errCollationNotSupported)
+	_, err = coll.Find(nil).Collation(collation).Apply(Change{Remove: true}, nil)
+	c.Assert(err, Equals, errCollationNotSupported)
+	err = coll.EnsureIndex(Index{Key: []string{"n"}, Collation: collation})
+	c.Assert(err, Equals, errCollationNotSupported)
+
+	m.Lock()
+	c.Assert(sent, HasLen, 0)
+	m.Unlock()
+}
+
+func (s *S) TestApplyAcknowledgement(c *C) {
+	const primary = "127.0.0.1:40474"
+	passives := []string{"127.0.0.1:40475", "127.0.0.1:40476"}
+	var m sync.Mutex
+	var concernError bson.M
+	info := fakeClusterInfo([]string{primary}, func(addr string, body []byte) bson.M {
+		if bytes.Contains(body, []byte("findAndModify\x00")) {
+			reply := bson.M{"ok": 1, "value": bson.M{"n": 1}, "lastErrorObject": bson.M{"n": 1, "updatedExisting": true}}
+			m.Lock()
+			if concernError != nil {
+				reply["writeConcernError"] = concernError
+			}
+			m.Unlock()
+			return reply
+		}
+		doc := fakeMember(addr, primary, []string{primary}, 7)
+		doc["passives"] = passives
+		return doc
+	})
+	session, err := DialWithInfo(info)
+	c.Assert(err, IsNil)
+	defer session.Close()
+	coll := session.DB("mydb").C("mycoll")
+	change := Change{Update: bson.M{"$inc": bson.M{"n": 1}}}
+
+	session.SetSafe(&Safe{W: 2})
+	changed, err := coll.Find(nil).Apply(change, nil)
+	c.Assert(err, IsNil)
+	c.Assert(changed.Acknowledged, Equals, 2)
+	majority, err := changed.MajorityAcknowledged()
+	c.Assert(err, IsNil)
+	c.Assert(majority, Equals, true)
+
+	// Timing out, only the members the server reports have the write.
+	m.Lock()
+	concernError = bson.M{"code": 64, "errmsg": "waiting for replication timed out", "errInfo": bson.M{"wtimeout": true, "writtenTo": []string{primary}}}
+	m.Unlock()
+	session.SetSafe(&Safe{W: 3, WTimeout: 100})
+	changed, err = coll.Find(nil).Apply(change, nil)
+	c.Assert(IsWriteConcernError(err), Equals, true)
+	c.Assert(err.(*LastError).WTimeout, Equals, true)
+	c.Assert(changed.Acknowledged, Equals, 1)
+	majority, err = changed.MajorityAcknowledged()
+	c.Assert(err, IsNil)
+	c.Assert(majority, Equals, false)
+
+	// Writes out of safe mode aren't known to be acknowledged at all.
+	m.Lock()
+	concernError = nil
+	m.Unlock()
+	session.SetSafe(nil)
+	changed, err = coll.Find(nil).Apply(change, nil)
+	c.Assert(err, IsNil)
+	c.Assert(changed.Acknowledged, Equals, 0)
+}
+
+func (s *S) TestSyncAtGlobalConnLimit(c *C) {
+	info := fakeDialInfo(fakeAnswer(fakeHello(6)))
+	session, err := DialWithInfo(info)
+	c.Assert(err, IsNil)
+	defer session.Close()
+	c.Assert(session.Ping(), IsNil)
+	c.Assert(session.LiveServers(), HasLen, 1)
+
+	// Hold the idle connections, so that checking the server requires
+	// a new one.
+	cluster := session.cluster()
+	server := cluster.servers.Slice()[0]
+	var held []*mongoSocket
+	for socket := server.idleSocket(info); socket != nil; socket = server.idleSocket(info) {
+		held = append(held, socket)
+	}
+	defer func() {
+		for _, socket := range held {
+			socket.Release()
+		}
+	}()
+
+	SetGlobalConnLimit(GlobalConnCount())
+	defer SetGlobalConnLimit(0)
+	cluster.syncServersIteration(false)
+	c.Assert(session.LiveServers(), HasLen, 1)
+}
+
+// keepAlivePipe is a pipe connection recording how keepalive probes were
+// configured on it, as done on TCP connections.
+type keepAlivePipe struct {
+	net.Conn
+	m       *sync.Mutex
+	enabled bool
+	period  time.Duration
+}
+
+func (conn *keepAlivePipe) SetKeepAlive(keepalive bool) error {
+	conn.m.Lock()
+	conn.enabled = keepalive
+	conn.m.Unlock()
+	return nil
+}
+
+func (conn *keepAlivePipe) SetKeepAlivePeriod(d time.Duration) error {
+	conn.m.Lock()
+	conn.period = d
+	conn.m.Unlock()
+	return nil
+}
+
+func (s *S) TestKeepAliveOnDialedConns(c *C) {
+	dialed := func(keepAlive time.Duration) []*keepAlivePipe {
+		var m sync.Mutex
+		var conns []*keepAlivePipe
+		info := fakeDialInfo(fakeAnswer(fakeHello(6)))
+		info.KeepAlive = keepAlive
+		dial := info.DialServer
+		info.DialServer = func(server *ServerAddr) (net.Conn, error) {
+			conn, err := dial(server)
+			pipe := &keepAlivePipe{Conn: conn, m: &m}
+			m.Lock()
+			conns = append(conns, pipe)
+			m.Unlock()
+			return pipe, err
+		}
+		session, err := DialWithInfo(info)
+		c.Assert(err, IsNil)
+		defer session.Close()
+		c.Assert(session.Ping(), IsNil)
+
+		m.Lock()
+		defer m.Unlock()
+		c.Assert(conns, Not(HasLen), 0)
+		return conns
+	}
+
+	for _, conn := range dialed(time.Second) {
+		c.Assert(conn.enabled, Equals, true)
+		c.Assert(conn.period, Equals, time.Second)
+	}
+
+	// Without a period set, the dialer's configuration is left alone.
+	for _, conn := range dialed(0) {
+		c.Assert(conn.enabled, Equals, false)
+		c.Assert(conn.period, Equals, time.Duration(0))
+	}
+}
+
+func (s *S) TestCollectionStatsWithoutNames(c *C) {
+	var collStats int32
+	session := dialFake(c, func(body []byte) bson.M {
+		if bytes.Contains(body, []byte("\x02collStats\x00")) {
+			atomic.AddInt32(&collStats, 1)
+		}
+		return fakeHello(6)
+	})
+	defer session.Close()
+
+	stats, err := session.DB("mydb").CollectionStats()
+	c.Assert(err, IsNil)
+	c.Assert(stats, HasLen, 0)
+	c.Assert(atomic.LoadInt32(&collStats), Equals, int32(0))
+}
+
+func (s *S) TestRetryBudgetDeposits(c *C) {
+	session := dialFake(c, func(body []byte) bson.M {
+		if bytes.Contains(body, []byte("\x02find\x00")) {
+			return bson.M{"ok": 1, "cursor": bson.M{"id": int64(0), "ns": "mydb.mycoll", "firstBatch": []bson.M{{"n": 1}}}}
+		}
+		doc := fakeHello(7)
+		doc["n"] = 1
+		return doc
+	})
+	defer session.Close()
+	coll := session.DB("mydb").C("mycoll")
+	budget := session.cluster().retryBudget
+	tokens := func() float64 {
+		budget.m.Lock()
+		defer budget.m.Unlock()
+		return budget.tokens
+	}
+	budget.m.Lock()
+	budget.tokens = 0
+	budget.m.Unlock()
+	reads := func() {
+		var result bson.M
+		c.Assert(coll.Find(nil).One(&result), IsNil)
+		c.Assert(coll.Find(nil).Iter().Close(), IsNil)
+		_, err := coll.Find(nil).Count()
+		c.Assert(err, IsNil)
+	}
+
+	// Reads that are never retried leave the budget alone.
+	reads()
+	c.Assert(tokens(), Equals, 0.0)
+
+	// Otherwise every read API refills it alike.
+	session.SetRetryReads(true)
+	reads()
+	c.Assert(tokens(), Equals, 3*budget.ratio)
+}
+
+func (s *S) TestUpdateWithOptions(c *C) {
+	var m sync.Mutex
+	var updates []bson.M
+	doc := fakeHello(9)
+	doc["n"] = 1
+	doc["nModified"] = 1
+	session := dialFake(c, func(body []byte) bson.M {
+		if bytes.Contains(body, []byte("\x02update\x00")) {
+			var cmd bson.M
+			fakeCommand(c, body, &cmd)
+			m.Lock()
+			updates = append(updates, cmd)
+			m.Unlock()
+		}
+		return doc
+	})
+	defer session.Close()
+	coll := session.DB("mydb").C("mycoll")
+
+	filters := []bson.M{{"g": bson.M{"$gte": 100}}}
+	info, err := coll.UpdateWithOptions(nil, bson.M{"$set": bson.M{"grades.$[g]": 100}}, UpdateOptions{
+		ArrayFilters: filters,
+		Comment:      "grading",
+		Multi:        true,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(info.Updated, Equals, 1)
+	c.Assert(info.Matched, Equals, 1)
+	_, err = coll.UpdateWithArrayFilters(bson.M{"_id": 1}, bson.M{"$set": bson.M{"grades.$[g]": 100}}, filters, false)
+	c.Assert(err, IsNil)
+
+	m.Lock()
+	defer m.Unlock()
+	c.Assert(updates, HasLen, 2)
+	c.Assert(updates[0]["comment"], Equals, "grading")
+	statement := updates[0]["updates"].([]interface{})[0].(bson.M)
+	c.Assert(statement["q"], DeepEquals, bson.M{})
+	c.Assert(statement["multi"], Equals, true)
+	c.Assert(statement["arrayFilters"], DeepEquals, []interface{}{bson.M{"g": bson.M{"$gte": 100}}})
+	c.Assert(updates[1]["comment"], IsNil)
+	statement = updates[1]["updates"].([]interface{})[0].(bson.M)
+	c.Assert(statement["multi"], IsNil)
+	c.Assert(statement["arrayFilters"], NotNil)
+}
+
+func (s *S) TestIterCloseOnRemovedServer(c *C) {
+	const a, b = "127.0.0.1:40301", "127.0.0.1:40302"
+	var kills int32
+	info := fakeClusterInfo([]string{a, b}, func(addr string, body []byte) bson.M {
+		if len(body) == 16 && binary.LittleEndian.Uint64(body[8:]) == 42 {
+			// An OP_KILL_CURSORS message for the cursor.
+			atomic.AddInt32(&kills, 1)
+			return bson.M{"ok": 1}
+		}
+		if bytes.Contains(body, []byte("\x02find\x00")) {
+			return bson.M{"ok": 1, "cursor": bson.M{"id": int64(42), "ns": "mydb.mycoll", "firstBatch": []bson.M{{"n": 1}, {"n": 2}}}}
+		}
+		return fakeMember(addr, a, []string{a, b}, 7)
+	})
+	session, err := DialWithInfo(info)
+	c.Assert(err, IsNil)
+	defer session.Close()
+	for i := 0; len(session.LiveServers()) < 2; i++ {
+		c.Assert(i < 100, Equals, true)
+		time.Sleep(10 * time.Millisecond)
+	}
+	session.SetMode(Monotonic, true)
+	open := func() *Iter {
+		iter := session.DB("mydb").C("mycoll").Find(nil).Iter()
+		c.Assert(iter.Done(), Equals, false)
+		c.Assert(iter.server.Addr, Equals, b)
+		return iter
+	}
+
+	// The cursor is killed while its server is around.
+	c.Assert(open().Close(), IsNil)
+	for i := 0; atomic.LoadInt32(&kills) == 0; i++ {
+		c.Assert(i < 100, Equals, true)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Once the server is removed, the cursor is gone along with it.
+	iter := open()
+	session.cluster().removeServer(iter.server)
+	session.Refresh()
+	c.Assert(iter.Close(), IsNil)
+	c.Assert(iter.Err(), IsNil)
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(atomic.LoadInt32(&kills), Equals, int32(1))
+}
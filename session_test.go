@@ -27,11 +27,13 @@
 package mgo_test
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"math"
 	"math/rand"
 	"os"
+	"reflect"
 	"runtime"
 	"sort"
 	"strconv"
@@ -277,6 +279,29 @@ func (s *S) TestMaxIdleTimeMS(c *C) {
 	}
 }
 
+func (s *S) TestLocalThresholdMS(c *C) {
+	tests := []struct {
+		url       string
+		threshold time.Duration
+		fail      bool
+	}{
+		{"localhost:40001", 0, false},
+		{"localhost:40001?localThresholdMS=0", 0, false},
+		{"localhost:40001?localThresholdMS=30", 30 * time.Millisecond, false},
+		{"localhost:40001?localThresholdMS=-1", 0, true},
+		{"localhost:40001?localThresholdMS=-.", 0, true},
+	}
+	for _, test := range tests {
+		info, err := mgo.ParseURL(test.url)
+		if test.fail {
+			c.Assert(err, NotNil)
+		} else {
+			c.Assert(err, IsNil)
+			c.Assert(info.LocalThreshold, Equals, test.threshold)
+		}
+	}
+}
+
 func (s *S) TestPoolShrink(c *C) {
 	if *fast {
 		c.Skip("-fast")
@@ -583,6 +608,45 @@ func (s *S) TestDatabaseAndCollectionNames(c *C) {
 	c.Assert(filterDBs(names), DeepEquals, []string{"col3"})
 }
 
+func (s *S) TestDatabaseCollectionStats(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := session.DB("mydb")
+	for i := 0; i < 3; i++ {
+		err = db.C("col1").Insert(M{"n": i})
+		c.Assert(err, IsNil)
+	}
+	err = db.C("col2").Insert(M{"n": 42})
+	c.Assert(err, IsNil)
+	err = db.C("col2").EnsureIndexKey("n")
+	c.Assert(err, IsNil)
+
+	stats, err := db.CollectionStats("col1", "col2", "missing")
+	c.Assert(err, IsNil)
+	c.Assert(stats, HasLen, 3)
+
+	c.Assert(stats["col1"].Err, IsNil)
+	c.Assert(stats["col1"].Count, Equals, 3)
+	c.Assert(stats["col1"].Size > 0, Equals, true)
+	c.Assert(stats["col1"].NIndexes, Equals, 1)
+
+	c.Assert(stats["col2"].Err, IsNil)
+	c.Assert(stats["col2"].Count, Equals, 1)
+	c.Assert(stats["col2"].NIndexes, Equals, 2)
+	c.Assert(stats["col2"].IndexSizes, HasLen, 2)
+	c.Assert(stats["col2"].TotalIndexSize > 0, Equals, true)
+
+	// Older servers fail, newer ones report an empty collection.
+	missing := stats["missing"]
+	if missing.Err != nil {
+		c.Assert(missing.Err, ErrorMatches, ".*not found.*")
+	} else {
+		c.Assert(missing.Count, Equals, 0)
+	}
+}
+
 func (s *S) TestSelect(c *C) {
 	session, err := mgo.Dial("localhost:40001")
 	c.Assert(err, IsNil)
@@ -599,6 +663,57 @@ func (s *S) TestSelect(c *C) {
 	c.Assert(result.B, Equals, 2)
 }
 
+func (s *S) TestSelectProjection(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	err = coll.Insert(M{"_id": 1, "a": 1, "b": 2, "tags": []int{1, 2, 3, 4}})
+	c.Assert(err, IsNil)
+
+	var result M
+	err = coll.Find(nil).Select(M{"_id": 0, "a": 1, "tags": M{"$slice": 2}}).One(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result, DeepEquals, M{"a": 1, "tags": []interface{}{1, 2}})
+
+	result = nil
+	err = coll.Find(nil).Select(M{"b": 0, "tags": M{"$elemMatch": M{"$gt": 2}}}).One(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result, DeepEquals, M{"_id": 1, "a": 1, "tags": []interface{}{3}})
+
+	err = coll.Find(nil).Select(M{"a": 1, "b": 0}).One(&result)
+	c.Assert(err, ErrorMatches, "invalid projection: cannot both include field .* and exclude field .*")
+
+	iter := coll.Find(nil).Select(M{"tags": M{"$size": 1}}).Iter()
+	c.Assert(iter.Next(&result), Equals, false)
+	c.Assert(iter.Close(), ErrorMatches, `invalid projection: unknown operator \$size for field "tags"`)
+}
+
+func (s *S) TestDecodeOnly(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	err = coll.Insert(M{"_id": 1, "a": 1, "b": 2, "c": M{"d": 3}})
+	c.Assert(err, IsNil)
+
+	var result M
+	err = coll.Find(nil).DecodeOnly("a", "c").One(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result, DeepEquals, M{"a": 1, "c": M{"d": 3}})
+
+	iter := coll.Find(nil).DecodeOnly("b").Iter()
+	result = nil
+	c.Assert(iter.Next(&result), Equals, true)
+	c.Assert(result, DeepEquals, M{"b": 2})
+	var raw M
+	c.Assert(bson.Unmarshal(iter.Raw(), &raw), IsNil)
+	c.Assert(raw, HasLen, 4)
+	c.Assert(iter.Close(), IsNil)
+}
+
 func (s *S) TestInlineMap(c *C) {
 	session, err := mgo.Dial("localhost:40001")
 	c.Assert(err, IsNil)
@@ -772,11 +887,7 @@ func (s *S) TestUpsert(c *C) {
 	c.Assert(err, IsNil)
 	c.Assert(info.Updated, Equals, 0)
 	c.Assert(info.Matched, Equals, 0)
-	if s.versionAtLeast(2, 6) {
-		c.Assert(info.UpsertedId, Equals, 48)
-	} else {
-		c.Assert(info.UpsertedId, IsNil) // Unfortunate, but that's what Mongo gave us.
-	}
+	c.Assert(info.UpsertedId, Equals, 48)
 
 	err = coll.Find(M{"k": 48}).One(result)
 	c.Assert(err, IsNil)
@@ -809,17 +920,48 @@ func (s *S) TestUpsertId(c *C) {
 	info, err = coll.UpsertId(47, M{"_id": 47, "n": 47})
 	c.Assert(err, IsNil)
 	c.Assert(info.Updated, Equals, 0)
-	if s.versionAtLeast(2, 6) {
-		c.Assert(info.UpsertedId, Equals, 47)
-	} else {
-		c.Assert(info.UpsertedId, IsNil)
-	}
+	c.Assert(info.UpsertedId, Equals, 47)
 
 	err = coll.FindId(47).One(result)
 	c.Assert(err, IsNil)
 	c.Assert(result["n"], Equals, 47)
 }
 
+func (s *S) TestUpdateWithArrayFilters(c *C) {
+	if !s.versionAtLeast(3, 6) {
+		c.Skip("array filters depend on 3.6+")
+	}
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	err = coll.Insert(M{"_id": 1, "grades": []int{95, 102, 90, 150}})
+	c.Assert(err, IsNil)
+
+	info, err := coll.UpdateWithArrayFilters(M{"_id": 1}, M{"$set": M{"grades.$[g]": 100}}, []bson.M{{"g": M{"$gte": 100}}}, false)
+	c.Assert(err, IsNil)
+	c.Assert(info.Matched, Equals, 1)
+	c.Assert(info.Updated, Equals, 1)
+
+	var result struct{ Grades []int }
+	err = coll.FindId(1).One(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result.Grades, DeepEquals, []int{95, 100, 90, 100})
+
+	_, err = coll.UpdateWithArrayFilters(M{"_id": 2}, M{"$set": M{"grades.$[g]": 100}}, []bson.M{{"g": M{"$gte": 100}}}, false)
+	c.Assert(err, Equals, mgo.ErrNotFound)
+
+	change := mgo.Change{
+		Update:       M{"$inc": M{"grades.$[g]": 1}},
+		ReturnNew:    true,
+		ArrayFilters: []bson.M{{"g": M{"$lt": 95}}},
+	}
+	_, err = coll.FindId(1).Apply(change, &result)
+	c.Assert(err, IsNil)
+	c.Assert(result.Grades, DeepEquals, []int{95, 100, 91, 100})
+}
+
 func (s *S) TestUpdateAll(c *C) {
 	session, err := mgo.Dial("localhost:40001")
 	c.Assert(err, IsNil)
@@ -1005,6 +1147,33 @@ func (s *S) TestDropDatabase(c *C) {
 	c.Assert(filterDBs(names), DeepEquals, []string{})
 }
 
+func (s *S) TestProfilingLevel(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := session.DB("mydb")
+	initial, err := db.GetProfilingLevel()
+	c.Assert(err, IsNil)
+
+	prior, err := db.SetProfilingLevel(1, 250)
+	c.Assert(err, IsNil)
+	c.Assert(*prior, Equals, *initial)
+
+	level, err := db.GetProfilingLevel()
+	c.Assert(err, IsNil)
+	c.Assert(level.Level, Equals, 1)
+	c.Assert(level.SlowMs, Equals, 250)
+
+	prior, err = db.SetProfilingLevel(initial.Level, initial.SlowMs)
+	c.Assert(err, IsNil)
+	c.Assert(prior.Level, Equals, 1)
+	c.Assert(prior.SlowMs, Equals, 250)
+
+	_, err = db.SetProfilingLevel(3, 0)
+	c.Assert(err, ErrorMatches, "invalid profiling level: 3")
+}
+
 func filterDBs(dbs []string) []string {
 	var i int
 	for _, name := range dbs {
@@ -1045,6 +1214,46 @@ func (s *S) TestDropCollection(c *C) {
 	c.Assert(len(filterDBs(names)), Equals, 0)
 }
 
+func (s *S) TestRenameCollection(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := session.DB("db1")
+	err = db.C("col1").Insert(M{"_id": 1})
+	c.Assert(err, IsNil)
+	err = db.C("col2").Insert(M{"_id": 2})
+	c.Assert(err, IsNil)
+
+	err = db.C("col1").Rename("col3", false)
+	c.Assert(err, IsNil)
+	names, err := db.CollectionNames()
+	c.Assert(err, IsNil)
+	c.Assert(filterDBs(names), DeepEquals, []string{"col2", "col3"})
+
+	// The target is only replaced when asked to.
+	err = db.C("col3").Rename("col2", false)
+	c.Assert(err, ErrorMatches, ".*target namespace exists.*")
+	c.Assert(err.(*mgo.QueryError).Code, Equals, 48)
+	err = db.C("col3").Rename("col2", true)
+	c.Assert(err, IsNil)
+	var result M
+	err = db.C("col2").Find(nil).One(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result["_id"], Equals, 1)
+
+	// Collections may be moved across databases.
+	target := session.DB("db2").C("moved")
+	err = db.C("col2").RenameTo(target, false)
+	c.Assert(err, IsNil)
+	n, err := target.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+	names, err = db.CollectionNames()
+	c.Assert(err, IsNil)
+	c.Assert(len(filterDBs(names)), Equals, 0)
+}
+
 func (s *S) TestCreateCollectionCapped(c *C) {
 	session, err := mgo.Dial("localhost:40001")
 	c.Assert(err, IsNil)
@@ -1166,6 +1375,40 @@ func (s *S) TestCreateCollectionValidator(c *C) {
 	c.Assert(err, IsNil)
 }
 
+func (s *S) TestSetValidator(c *C) {
+	if !s.versionAtLeast(3, 6) {
+		c.Skip("$jsonSchema validators depend on MongoDB 3.6+")
+	}
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	err = coll.Create(&mgo.CollectionInfo{
+		Validator: M{"$jsonSchema": M{"required": []string{"a"}}},
+	})
+	c.Assert(err, IsNil)
+	err = coll.Insert(M{"b": 1})
+	c.Assert(err, ErrorMatches, "Document failed validation")
+
+	err = coll.SetValidator(M{"$expr": M{"$gt": []string{"$a", "$b"}}}, "", "")
+	c.Assert(err, IsNil)
+	err = coll.Insert(M{"a": 1, "b": 2})
+	c.Assert(err, ErrorMatches, "Document failed validation")
+	err = coll.Insert(M{"a": 2, "b": 1})
+	c.Assert(err, IsNil)
+
+	err = coll.SetValidator(nil, "", "warn")
+	c.Assert(err, IsNil)
+	err = coll.Insert(M{"a": 1, "b": 2})
+	c.Assert(err, IsNil)
+
+	err = coll.SetValidator(M{}, "", "error")
+	c.Assert(err, IsNil)
+	err = coll.Insert(M{"b": 1})
+	c.Assert(err, IsNil)
+}
+
 func (s *S) TestCreateCollectionStorageEngine(c *C) {
 	if !s.versionAtLeast(3, 0) {
 		c.Skip("storageEngine option depends on MongoDB 3.0+")
@@ -1483,6 +1726,31 @@ func (s *S) TestCountCollection(c *C) {
 	c.Assert(n, Equals, 3)
 }
 
+func (s *S) TestEstimatedCount(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+
+	n, err := coll.EstimatedCount()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 0)
+
+	for i := 0; i < 10; i++ {
+		err := coll.Insert(M{"n": i})
+		c.Assert(err, IsNil)
+	}
+
+	exact, err := coll.Find(M{"n": M{"$gte": 0}}).Count()
+	c.Assert(err, IsNil)
+	c.Assert(exact, Equals, 10)
+
+	n, err = coll.EstimatedCount()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, exact)
+}
+
 func (s *S) TestView(c *C) {
 	if !s.versionAtLeast(3, 4) {
 		c.Skip("depends on mongodb 3.4+")
@@ -1781,6 +2049,34 @@ func (s *S) TestQueryExplain(c *C) {
 	c.Assert(n, Equals, 2)
 }
 
+func (s *S) TestQueryExplainWithVerbosity(c *C) {
+	if !s.versionAtLeast(3, 2) {
+		c.Skip("explain verbosity requires 3.2+")
+	}
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+
+	ns := []int{40, 41, 42}
+	for _, n := range ns {
+		err := coll.Insert(M{"n": n})
+		c.Assert(err, IsNil)
+	}
+
+	m := M{}
+	err = coll.Find(nil).ExplainWithVerbosity("queryPlanner", m)
+	c.Assert(err, IsNil)
+	c.Assert(m["queryPlanner"], NotNil)
+	c.Assert(m["executionStats"], IsNil)
+
+	m = M{}
+	err = coll.Find(nil).ExplainWithVerbosity("executionStats", m)
+	c.Assert(err, IsNil)
+	c.Assert(m["executionStats"].(M)["totalDocsExamined"], Equals, 3)
+}
+
 func (s *S) TestQuerySetMaxScan(c *C) {
 	session, err := mgo.Dial("localhost:40001")
 	c.Assert(err, IsNil)
@@ -1823,6 +2119,45 @@ func (s *S) TestQuerySetMaxTime(c *C) {
 	c.Assert(err, ErrorMatches, "operation exceeded time limit")
 }
 
+func (s *S) TestSessionSetMaxTime(c *C) {
+	if !s.versionAtLeast(2, 6) {
+		c.Skip("SetMaxTime only supported in 2.6+")
+	}
+
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+	coll := session.DB("mydb").C("mycoll")
+
+	for i := 0; i < 1000; i++ {
+		err := coll.Insert(M{"n": i})
+		c.Assert(err, IsNil)
+	}
+
+	session.SetMaxTime(1 * time.Millisecond)
+
+	// Commands are not affected.
+	err = session.Ping()
+	c.Assert(err, IsNil)
+
+	var result []M
+	err = coll.Find(nil).Batch(2).All(&result)
+	c.Assert(err, ErrorMatches, "operation exceeded time limit")
+	c.Assert(mgo.IsMaxTimeExpired(err), Equals, true)
+
+	// Copies inherit the limit.
+	copied := session.Copy()
+	defer copied.Close()
+	err = copied.DB("mydb").C("mycoll").Find(nil).Batch(2).All(&result)
+	c.Assert(mgo.IsMaxTimeExpired(err), Equals, true)
+
+	session.SetMaxTime(0)
+	err = coll.Find(nil).Batch(2).All(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result, HasLen, 1000)
+	c.Assert(mgo.IsMaxTimeExpired(err), Equals, false)
+}
+
 func (s *S) TestQueryHint(c *C) {
 	session, err := mgo.Dial("localhost:40001")
 	c.Assert(err, IsNil)
@@ -1846,6 +2181,44 @@ func (s *S) TestQueryHint(c *C) {
 	}
 }
 
+func (s *S) TestQueryHintIndex(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	err = coll.EnsureIndexKey("a")
+	c.Assert(err, IsNil)
+	err = coll.Insert(M{"a": 1})
+	c.Assert(err, IsNil)
+
+	m := M{}
+	err = coll.Find(nil).HintIndex("a_1").Explain(m)
+	c.Assert(err, IsNil)
+
+	if m["queryPlanner"] != nil {
+		m = m["queryPlanner"].(M)
+		m = m["winningPlan"].(M)
+		m = m["inputStage"].(M)
+		c.Assert(m["indexName"], Equals, "a_1")
+	} else {
+		c.Assert(m["indexBounds"], NotNil)
+		c.Assert(m["indexBounds"].(M)["a"], NotNil)
+	}
+
+	n, err := coll.Find(M{"a": 1}).HintIndex("a_1").Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+
+	// An unknown index is reported by the server rather than ignored.
+	var result M
+	err = coll.Find(nil).HintIndex("does_not_exist").One(&result)
+	c.Assert(err, NotNil)
+	c.Assert(err, ErrorMatches, "(?i).*hint.*")
+	_, err = coll.Find(nil).HintIndex("does_not_exist").Count()
+	c.Assert(err, ErrorMatches, "(?i).*hint.*")
+}
+
 func (s *S) TestQueryComment(c *C) {
 	session, err := mgo.Dial("localhost:40001")
 	c.Assert(err, IsNil)
@@ -1892,20 +2265,97 @@ func (s *S) TestQueryComment(c *C) {
 	c.Assert(err, IsNil)
 }
 
-func (s *S) TestFindOneNotFound(c *C) {
+func (s *S) TestCommentOnCommands(c *C) {
+	if !s.versionAtLeast(3, 6) {
+		c.Skip("comments on commands are supported on 3.6+")
+	}
 	session, err := mgo.Dial("localhost:40001")
 	c.Assert(err, IsNil)
 	defer session.Close()
 
 	coll := session.DB("mydb").C("mycoll")
+	for i := 0; i < 10; i++ {
+		err = coll.Insert(M{"n": i})
+		c.Assert(err, IsNil)
+	}
+
+	var m sync.Mutex
+	comments := make(map[string][]string)
+	mgo.SetCommandMonitor(&mgo.CommandMonitor{
+		Started: func(event *mgo.CommandStartedEvent) {
+			if event.DatabaseName != "mydb" {
+				return
+			}
+			var cmd struct{ Comment string }
+			event.Command.Unmarshal(&cmd)
+			m.Lock()
+			comments[event.CommandName] = append(comments[event.CommandName], cmd.Comment)
+			m.Unlock()
+		},
+	})
+	defer mgo.SetCommandMonitor(nil)
+
+	// Older servers don't accept comments on getMore.
+	getMoreComment := func(comment string) string {
+		if s.versionAtLeast(4, 4) {
+			return comment
+		}
+		return ""
+	}
+	checkComments := func(name, comment string) {
+		m.Lock()
+		defer m.Unlock()
+		c.Assert(comments[name], DeepEquals, []string{comment})
+		c.Assert(comments["getMore"], Not(HasLen), 0)
+		for _, getMore := range comments["getMore"] {
+			c.Assert(getMore, Equals, getMoreComment(comment))
+		}
+		delete(comments, "getMore")
+	}
+
+	var result []M
+	err = coll.Find(nil).Batch(2).Comment("find").All(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result, HasLen, 10)
+	checkComments("find", "find")
+
+	err = coll.Pipe([]M{{"$match": M{}}}).Batch(2).Comment("aggregate").All(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result, HasLen, 10)
+	checkComments("aggregate", "aggregate")
+
+	n, err := coll.Find(M{"n": 1}).Comment("count").Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+
+	m.Lock()
+	c.Assert(comments["count"], DeepEquals, []string{"count"})
+	m.Unlock()
+
+	if s.versionAtLeast(4, 4) {
+		_, err = coll.Find(M{"n": 1}).Comment("update").Apply(mgo.Change{Update: M{"$set": M{"n": 1}}}, nil)
+		c.Assert(err, IsNil)
+
+		m.Lock()
+		c.Assert(comments["findAndModify"], DeepEquals, []string{"update"})
+		m.Unlock()
+	}
+}
+
+func (s *S) TestFindOneNotFound(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+
+	result := struct{ A, B int }{}
+	err = coll.Find(M{"a": 1}).One(&result)
+	c.Assert(err, Equals, mgo.ErrNotFound)
+	c.Assert(err, ErrorMatches, "not found")
+	c.Assert(err == mgo.ErrNotFound, Equals, true)
+}
 
-	result := struct{ A, B int }{}
-	err = coll.Find(M{"a": 1}).One(&result)
-	c.Assert(err, Equals, mgo.ErrNotFound)
-	c.Assert(err, ErrorMatches, "not found")
-	c.Assert(err == mgo.ErrNotFound, Equals, true)
-}
-
 func (s *S) TestFindIterNotFound(c *C) {
 	session, err := mgo.Dial("localhost:40001")
 	c.Assert(err, IsNil)
@@ -1954,6 +2404,82 @@ func (s *S) TestFindId(c *C) {
 	c.Assert(result.N, Equals, 42)
 }
 
+func (s *S) TestFindByIds(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	for _, n := range []int{40, 41, 42, 43} {
+		err = coll.Insert(M{"_id": n, "n": n})
+		c.Assert(err, IsNil)
+	}
+
+	var result []struct{ N int }
+	err = coll.FindByIds([]int{43, 99, 40, 42, 40}, &result)
+	c.Assert(err, IsNil)
+	c.Assert(result, HasLen, 3)
+	c.Assert(result[0].N, Equals, 43)
+	c.Assert(result[1].N, Equals, 40)
+	c.Assert(result[2].N, Equals, 42)
+
+	err = coll.FindByIds([]int{}, &result)
+	c.Assert(err, IsNil)
+	c.Assert(result, HasLen, 0)
+
+	c.Assert(func() { coll.FindByIds(42, &result) }, PanicMatches, "ids argument must be a slice")
+}
+
+func (s *S) TestParallelExport(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	for i := 0; i < 100; i++ {
+		err = coll.Insert(M{"_id": i * 7})
+		c.Assert(err, IsNil)
+	}
+	// Collections with ObjectId _ids are split as well.
+	objects := session.DB("mydb").C("objects")
+	for i := 0; i < 10; i++ {
+		err = objects.Insert(M{"_id": bson.NewObjectId()})
+		c.Assert(err, IsNil)
+	}
+
+	for _, coll := range []*mgo.Collection{coll, objects} {
+		seen := make(map[interface{}]bool)
+		err = coll.ParallelExport(4, func(doc bson.Raw) error {
+			var result struct {
+				Id interface{} `bson:"_id"`
+			}
+			c.Check(doc.Unmarshal(&result), IsNil)
+			c.Check(seen[result.Id], Equals, false)
+			seen[result.Id] = true
+			return nil
+		})
+		c.Assert(err, IsNil)
+		n, err := coll.Count()
+		c.Assert(err, IsNil)
+		c.Assert(seen, HasLen, n)
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err = coll.ParallelExport(4, func(doc bson.Raw) error {
+		calls++
+		return stop
+	})
+	c.Assert(err, Equals, stop)
+	c.Assert(calls, Equals, 1)
+
+	err = session.DB("mydb").C("empty").ParallelExport(4, func(doc bson.Raw) error {
+		c.Errorf("unexpected document")
+		return nil
+	})
+	c.Assert(err, IsNil)
+}
+
 func (s *S) TestFindIterAll(c *C) {
 	session, err := mgo.Dial("localhost:40001")
 	c.Assert(err, IsNil)
@@ -2454,6 +2980,55 @@ func (s *S) TestFindIterLimitWithBatch(c *C) {
 	c.Assert(stats.SocketsInUse, Equals, 0)
 }
 
+func (s *S) TestFindIterLimitAndBatchSizes(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+
+	for i := 0; i < 20; i++ {
+		err := coll.Insert(M{"n": i})
+		c.Assert(err, IsNil)
+	}
+
+	tests := []struct {
+		limit, batch int
+		batchFirst   bool
+	}{
+		{limit: 3, batch: 5},
+		{limit: 3, batch: 5, batchFirst: true},
+		{limit: 7, batch: 3},
+		{limit: 7, batch: 3, batchFirst: true},
+		{limit: 4, batch: 4},
+		{limit: 4, batch: 4, batchFirst: true},
+	}
+	for _, test := range tests {
+		query := coll.Find(nil).Sort("n")
+		if test.batchFirst {
+			query.Batch(test.batch).Limit(test.limit)
+		} else {
+			query.Limit(test.limit).Batch(test.batch)
+		}
+
+		var result struct{ N int }
+		var ns []int
+		iter := query.Iter()
+		for iter.Next(&result) {
+			ns = append(ns, result.N)
+		}
+		c.Assert(iter.Close(), IsNil)
+		c.Assert(ns, HasLen, test.limit, Commentf("limit=%d batch=%d", test.limit, test.batch))
+		for i, n := range ns {
+			c.Assert(n, Equals, i)
+		}
+	}
+
+	session.Refresh()
+	stats := mgo.GetStats()
+	c.Assert(stats.SocketsInUse, Equals, 0)
+}
+
 func (s *S) TestFindIterSortWithBatch(c *C) {
 	session, err := mgo.Dial("localhost:40001")
 	c.Assert(err, IsNil)
@@ -3152,6 +3727,58 @@ func (s *S) TestSortWithBadArgs(c *C) {
 	}
 }
 
+func (s *S) TestSortNatural(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	db := session.DB("mydb")
+	err = db.Run(bson.D{{Name: "create", Value: "mycoll"}, {Name: "capped", Value: true}, {Name: "size", Value: 1024}}, nil)
+	c.Assert(err, IsNil)
+	coll := db.C("mycoll")
+
+	// Insert in an order that differs from the one of the values.
+	ns := []int{42, 40, 44, 41, 43}
+	for _, n := range ns {
+		err = coll.Insert(M{"n": n})
+		c.Assert(err, IsNil)
+	}
+	reversed := []int{43, 41, 44, 40, 42}
+
+	find := func(sort string) []int {
+		var result []struct{ N int }
+		err := coll.Find(nil).Sort(sort).All(&result)
+		c.Assert(err, IsNil)
+		var got []int
+		for _, r := range result {
+			got = append(got, r.N)
+		}
+		return got
+	}
+	c.Assert(find("$natural"), DeepEquals, ns)
+	c.Assert(find("+$natural"), DeepEquals, ns)
+	c.Assert(find("$natural:1"), DeepEquals, ns)
+	c.Assert(find("-$natural"), DeepEquals, reversed)
+	c.Assert(find("$natural:-1"), DeepEquals, reversed)
+
+	// Tailing follows the insertion order.
+	iter := coll.Find(nil).Sort("$natural:1").Batch(2).Tail(-1)
+	var got []int
+	var result struct{ N int }
+	for len(got) < len(ns) && iter.Next(&result) {
+		got = append(got, result.N)
+	}
+	err = coll.Insert(M{"n": 39})
+	c.Assert(err, IsNil)
+	c.Assert(iter.Next(&result), Equals, true)
+	got = append(got, result.N)
+	c.Assert(iter.Close(), IsNil)
+	c.Assert(got, DeepEquals, append(ns, 39))
+
+	f := func() { coll.Find(nil).Sort("$natural:2") }
+	c.Assert(f, PanicMatches, "Sort: invalid \\$natural order: 2")
+}
+
 func (s *S) TestSortScoreText(c *C) {
 	session, err := mgo.Dial("localhost:40001")
 	c.Assert(err, IsNil)
@@ -3212,6 +3839,52 @@ func (s *S) TestSortScoreText(c *C) {
 	})
 }
 
+func (s *S) TestTextSearch(c *C) {
+	if !s.versionAtLeast(2, 6) {
+		c.Skip("The $text operator depends on 2.6+")
+	}
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	err = coll.EnsureIndexKey("$text:title")
+	c.Assert(err, IsNil)
+
+	for i, title := range []string{"coffee", "coffee coffee shop", "tea", "coffee coffee coffee"} {
+		err := coll.Insert(M{"_id": i, "title": title, "n": i % 2})
+		c.Assert(err, IsNil)
+	}
+
+	var result []struct {
+		Id    int `bson:"_id"`
+		Title string
+		Score float64
+	}
+	err = coll.Find(nil).Text("coffee").TextScore("score").Sort("$textScore:score").Select(M{"title": 0}).All(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result, HasLen, 3)
+	c.Assert(result[0].Id, Equals, 3)
+	c.Assert(result[1].Id, Equals, 1)
+	c.Assert(result[2].Id, Equals, 0)
+	c.Assert(result[0].Title, Equals, "")
+	c.Assert(result[0].Score > result[1].Score && result[1].Score > result[2].Score, Equals, true)
+
+	// The text search is combined with the query document.
+	n, err := coll.Find(M{"n": 1}).Text("coffee -shop").Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+
+	// Incompatible options are rejected before anything is sent.
+	err = coll.Find(nil).Text("coffee").Hint("title").All(&result)
+	c.Assert(err, ErrorMatches, "text search can't be used with a hint")
+	err = coll.Find(nil).Text("coffee").Sort("$natural").All(&result)
+	c.Assert(err, ErrorMatches, "text search can't be sorted in natural order")
+	err = coll.Find(nil).TextScore("score").One(&result)
+	c.Assert(err, ErrorMatches, `text score requires a text search \(see Query.Text\)`)
+	c.Assert(func() { coll.Find(nil).Text("coffee").Text("tea") }, PanicMatches, "Text: query already has a text search")
+}
+
 func (s *S) TestPrefetching(c *C) {
 	session, err := mgo.Dial("localhost:40001")
 	c.Assert(err, IsNil)
@@ -3470,6 +4143,27 @@ func (s *S) TestSafeParameters(c *C) {
 	}
 }
 
+func (s *S) TestSafeWTimeoutError(c *C) {
+	session, err := mgo.Dial("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	err = coll.Insert(M{"_id": 1})
+	c.Assert(err, IsNil)
+
+	// With one member frozen, w=3 may only time out.
+	s.Freeze("localhost:40013")
+	defer s.Thaw("localhost:40013")
+
+	session.SetSafe(&mgo.Safe{W: 3, WTimeout: 500})
+	err = coll.Insert(M{"_id": 2})
+	c.Assert(err, ErrorMatches, "timeout|timed out waiting for slaves|waiting for replication timed out")
+	lerr, ok := err.(*mgo.LastError)
+	c.Assert(ok, Equals, true)
+	c.Assert(lerr.WTimeout, Equals, true)
+}
+
 func (s *S) TestQueryErrorOne(c *C) {
 	session, err := mgo.Dial("localhost:40001")
 	c.Assert(err, IsNil)
@@ -4540,6 +5234,98 @@ func (s *S) TestBuildInfo(c *C) {
 	if info.MaxObjectSize < 8192 {
 		c.Fatalf("info.MaxObjectSize seems too small: %d", info.MaxObjectSize)
 	}
+	c.Assert(info.Major(), Equals, v[0])
+	c.Assert(info.Minor(), Equals, v[1])
+	c.Assert(info.Patch(), Equals, v[2])
+	if s.versionAtLeast(3, 2) {
+		c.Assert(len(info.StorageEngines) > 0, Equals, true)
+	}
+}
+
+func (s *S) TestCurrentOp(c *C) {
+	if !s.versionAtLeast(3, 2) {
+		c.Skip("the currentOp command depends on 3.2+")
+	}
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	err = coll.Insert(M{"n": 1})
+	c.Assert(err, IsNil)
+
+	done := make(chan error)
+	go func() {
+		slow := session.Copy()
+		defer slow.Close()
+		var result M
+		done <- slow.DB("mydb").C("mycoll").Find(M{"$where": "sleep(2000) || true"}).One(&result)
+	}()
+
+	var found *mgo.CurrentOperation
+	for i := 0; i < 50 && found == nil; i++ {
+		time.Sleep(50 * time.Millisecond)
+		ops, err := session.CurrentOp()
+		c.Assert(err, IsNil)
+		for i := range ops {
+			if ops[i].Namespace == "mydb.mycoll" {
+				found = &ops[i]
+			}
+		}
+	}
+	c.Assert(found, NotNil)
+	c.Assert(found.OpId, NotNil)
+	c.Assert(found.Active, Equals, true)
+	c.Assert(found.Client, Not(Equals), "")
+	c.Assert(<-done, IsNil)
+}
+
+func (s *S) TestKillOp(c *C) {
+	if !s.versionAtLeast(3, 2) {
+		c.Skip("the currentOp command depends on 3.2+")
+	}
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	for i := 0; i < 100; i++ {
+		err = coll.Insert(M{"n": i})
+		c.Assert(err, IsNil)
+	}
+
+	// Takes 10 seconds unless killed.
+	started := time.Now()
+	done := make(chan error)
+	go func() {
+		slow := session.Copy()
+		defer slow.Close()
+		done <- slow.DB("mydb").C("mycoll").Find(M{"$where": "sleep(100) || true"}).Batch(1000).All(&[]M{})
+	}()
+
+	var opid interface{}
+	for i := 0; i < 50 && opid == nil; i++ {
+		time.Sleep(50 * time.Millisecond)
+		ops, err := session.CurrentOp()
+		c.Assert(err, IsNil)
+		for _, op := range ops {
+			if op.Namespace == "mydb.mycoll" {
+				opid = op.OpId
+			}
+		}
+	}
+	c.Assert(opid, NotNil)
+
+	killed, err := session.KillOp(opid)
+	c.Assert(err, IsNil)
+	c.Assert(killed, Equals, true)
+
+	c.Assert(<-done, ErrorMatches, ".*(interrupted|killed).*")
+	c.Assert(time.Since(started) < 5*time.Second, Equals, true)
+
+	killed, err = session.KillOp(opid)
+	c.Assert(err, IsNil)
+	c.Assert(killed, Equals, false)
 }
 
 func (s *S) TestZeroTimeRoundtrip(c *C) {
@@ -4854,60 +5640,169 @@ func (s *S) TestFindIterCloseKillsCursor(c *C) {
 	c.Assert(serverCursorsOpen(session), Equals, cursors)
 }
 
-func (s *S) TestFindIterDoneWithBatches(c *C) {
+func (s *S) TestFindIterChannel(c *C) {
 	session, err := mgo.Dial("localhost:40001")
 	c.Assert(err, IsNil)
 	defer session.Close()
 
 	coll := session.DB("mydb").C("mycoll")
-
 	ns := []int{40, 41, 42, 43, 44, 45, 46}
 	for _, n := range ns {
-		coll.Insert(M{"n": n})
+		err = coll.Insert(M{"n": n})
+		c.Assert(err, IsNil)
 	}
 
-	iter := coll.Find(M{"n": M{"$gte": 42}}).Sort("$natural").Prefetch(0).Batch(2).Iter()
-	result := struct{ N int }{}
-	for i := 2; i < 7; i++ {
-		// first check will be with pending local record;
-		// second will be with open cursor Id but no local
-		// records
-		c.Assert(iter.Done(), Equals, false)
-		ok := iter.Next(&result)
-		c.Assert(ok, Equals, true, Commentf("err=%v", err))
+	ch := make(chan struct{ N int })
+	errc := coll.Find(nil).Sort("n").Batch(2).Iter().Channel(ch, nil)
+	var got []int
+	for result := range ch {
+		got = append(got, result.N)
 	}
+	c.Assert(<-errc, IsNil)
+	c.Assert(got, DeepEquals, ns)
 
-	c.Assert(iter.Done(), Equals, true)
-	ok := iter.Next(&result)
+	_, ok := <-errc
 	c.Assert(ok, Equals, false)
-	c.Assert(iter.Close(), IsNil)
 }
 
-func (s *S) TestFindIterDoneErr(c *C) {
-	session, err := mgo.Dial("localhost:40002")
+func (s *S) TestFindIterRaw(c *C) {
+	session, err := mgo.Dial("localhost:40001")
 	c.Assert(err, IsNil)
 	defer session.Close()
 
 	coll := session.DB("mydb").C("mycoll")
-	iter := coll.Find(nil).Iter()
+	ns := []int{40, 41, 42, 43, 44}
+	for _, n := range ns {
+		err = coll.Insert(M{"n": n, "blob": make([]byte, 1024)})
+		c.Assert(err, IsNil)
+	}
 
-	result := struct{}{}
-	ok := iter.Next(&result)
-	c.Assert(iter.Done(), Equals, true)
-	c.Assert(ok, Equals, false)
-	c.Assert(iter.Err(), ErrorMatches, "unauthorized.*|not authorized.*")
+	iter := coll.Find(nil).Sort("n").Batch(2).Iter()
+	c.Assert(iter.Raw(), IsNil)
+	var got []int
+	for iter.Next(nil) {
+		var fields bson.RawD
+		err := bson.Unmarshal(iter.Raw(), &fields)
+		c.Assert(err, IsNil)
+		for _, field := range fields {
+			switch field.Name {
+			case "n":
+				var n int
+				c.Assert(field.Value.Unmarshal(&n), IsNil)
+				got = append(got, n)
+			case "blob":
+				c.Assert(field.Value.Kind, Equals, byte(0x05))
+			}
+		}
+	}
+	c.Assert(iter.Close(), IsNil)
+	c.Assert(got, DeepEquals, ns)
+
+	// The data matches what Next decodes.
+	iter = coll.Find(M{"n": 42}).Iter()
+	var result struct{ N int }
+	c.Assert(iter.Next(&result), Equals, true)
+	var raw struct{ N int }
+	c.Assert(bson.Unmarshal(iter.Raw(), &raw), IsNil)
+	c.Assert(raw, Equals, result)
+	c.Assert(iter.Close(), IsNil)
 }
 
-func (s *S) TestFindIterDoneNotFound(c *C) {
+func (s *S) TestFindIterChannelDone(c *C) {
 	session, err := mgo.Dial("localhost:40001")
 	c.Assert(err, IsNil)
 	defer session.Close()
 
+	cursors := serverCursorsOpen(session)
+
 	coll := session.DB("mydb").C("mycoll")
+	ns := []int{40, 41, 42, 43, 44, 45, 46}
+	for _, n := range ns {
+		err = coll.Insert(M{"n": n})
+		c.Assert(err, IsNil)
+	}
 
-	result := struct{ A, B int }{}
-	iter := coll.Find(M{"a": 1}).Iter()
-	ok := iter.Next(&result)
+	done := make(chan struct{})
+	ch := make(chan *bson.M)
+	errc := coll.Find(nil).Batch(2).Iter().Channel(ch, done)
+	result := <-ch
+	c.Assert((*result)["n"], NotNil)
+	close(done)
+
+	c.Assert(<-errc, IsNil)
+	for range ch {
+	}
+	c.Assert(serverCursorsOpen(session), Equals, cursors)
+}
+
+func (s *S) TestFindIterChannelErr(c *C) {
+	session, err := mgo.Dial("localhost:40002")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	ch := make(chan bson.M)
+	errc := coll.Find(nil).Iter().Channel(ch, nil)
+	for range ch {
+		c.Fatalf("unexpected result")
+	}
+	c.Assert(<-errc, ErrorMatches, "unauthorized.*|not authorized.*")
+}
+
+func (s *S) TestFindIterDoneWithBatches(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+
+	ns := []int{40, 41, 42, 43, 44, 45, 46}
+	for _, n := range ns {
+		coll.Insert(M{"n": n})
+	}
+
+	iter := coll.Find(M{"n": M{"$gte": 42}}).Sort("$natural").Prefetch(0).Batch(2).Iter()
+	result := struct{ N int }{}
+	for i := 2; i < 7; i++ {
+		// first check will be with pending local record;
+		// second will be with open cursor Id but no local
+		// records
+		c.Assert(iter.Done(), Equals, false)
+		ok := iter.Next(&result)
+		c.Assert(ok, Equals, true, Commentf("err=%v", err))
+	}
+
+	c.Assert(iter.Done(), Equals, true)
+	ok := iter.Next(&result)
+	c.Assert(ok, Equals, false)
+	c.Assert(iter.Close(), IsNil)
+}
+
+func (s *S) TestFindIterDoneErr(c *C) {
+	session, err := mgo.Dial("localhost:40002")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	iter := coll.Find(nil).Iter()
+
+	result := struct{}{}
+	ok := iter.Next(&result)
+	c.Assert(iter.Done(), Equals, true)
+	c.Assert(ok, Equals, false)
+	c.Assert(iter.Err(), ErrorMatches, "unauthorized.*|not authorized.*")
+}
+
+func (s *S) TestFindIterDoneNotFound(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+
+	result := struct{ A, B int }{}
+	iter := coll.Find(M{"a": 1}).Iter()
+	ok := iter.Next(&result)
 	c.Assert(ok, Equals, false)
 	c.Assert(iter.Done(), Equals, true)
 }
@@ -4953,6 +5848,104 @@ func (s *S) TestSetCursorTimeout(c *C) {
 	c.Assert(iter.Next(&result), Equals, false)
 }
 
+func (s *S) TestQuerySetNoTimeout(c *C) {
+	if !s.versionAtLeast(3, 2) {
+		c.Skip("the find command is used on 3.2+")
+	}
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	for i := 0; i < 10; i++ {
+		err = coll.Insert(M{"n": i})
+		c.Assert(err, IsNil)
+	}
+
+	var m sync.Mutex
+	var finds []bson.Raw
+	mgo.SetCommandMonitor(&mgo.CommandMonitor{
+		Started: func(event *mgo.CommandStartedEvent) {
+			if event.CommandName == "find" && event.DatabaseName == "mydb" {
+				m.Lock()
+				finds = append(finds, event.Command)
+				m.Unlock()
+			}
+		},
+	})
+	defer mgo.SetCommandMonitor(nil)
+
+	cursors := serverCursorsOpen(session)
+
+	var result struct{ N int }
+	iter := coll.Find(nil).Batch(2).SetNoTimeout().Iter()
+	c.Assert(iter.Next(&result), Equals, true)
+
+	m.Lock()
+	c.Assert(finds, HasLen, 1)
+	var cmd struct {
+		NoCursorTimeout bool `bson:"noCursorTimeout"`
+	}
+	c.Assert(finds[0].Unmarshal(&cmd), IsNil)
+	m.Unlock()
+	c.Assert(cmd.NoCursorTimeout, Equals, true)
+
+	c.Assert(serverCursorsOpen(session), Equals, cursors+1)
+	c.Assert(iter.Close(), IsNil)
+	c.Assert(serverCursorsOpen(session), Equals, cursors)
+}
+
+func (s *S) TestQuerySetReadConcern(c *C) {
+	if !s.versionAtLeast(3, 2) {
+		c.Skip("read concern is supported on 3.2+")
+	}
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	err = coll.Insert(M{"n": 1})
+	c.Assert(err, IsNil)
+
+	var m sync.Mutex
+	var cmds []bson.Raw
+	mgo.SetCommandMonitor(&mgo.CommandMonitor{
+		Started: func(event *mgo.CommandStartedEvent) {
+			if (event.CommandName == "find" || event.CommandName == "aggregate") && event.DatabaseName == "mydb" {
+				m.Lock()
+				cmds = append(cmds, event.Command)
+				m.Unlock()
+			}
+		},
+	})
+	defer mgo.SetCommandMonitor(nil)
+
+	var result struct{ N int }
+	err = coll.Find(nil).SetReadConcern("local").One(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result.N, Equals, 1)
+
+	err = coll.Pipe([]M{{"$match": M{"n": 1}}}).SetReadConcern("local").One(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result.N, Equals, 1)
+
+	m.Lock()
+	c.Assert(cmds, HasLen, 2)
+	for _, raw := range cmds {
+		var cmd struct {
+			ReadConcern struct{ Level string } `bson:"readConcern"`
+		}
+		c.Assert(raw.Unmarshal(&cmd), IsNil)
+		c.Assert(cmd.ReadConcern.Level, Equals, "local")
+	}
+	m.Unlock()
+
+	err = coll.Find(nil).SetReadConcern("bogus").One(&result)
+	c.Assert(err, ErrorMatches, `unknown read concern level "bogus"`)
+	err = coll.Pipe([]M{{"$match": M{"n": 1}}}).SetReadConcern("bogus").One(&result)
+	c.Assert(err, ErrorMatches, `unknown read concern level "bogus"`)
+}
+
 func (s *S) TestNewIterNoServer(c *C) {
 	session, err := mgo.Dial("localhost:40001")
 	c.Assert(err, IsNil)
@@ -5044,6 +6037,210 @@ func (s *S) TestBypassValidation(c *C) {
 	c.Assert(ns, DeepEquals, []int{4})
 }
 
+func (s *S) TestBypassValidationApply(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	err = coll.Insert(M{"n": 1})
+	c.Assert(err, IsNil)
+
+	if !s.versionAtLeast(3, 2) {
+		session.SetBypassValidation(true)
+		err = coll.Insert(M{"n": 2})
+		c.Assert(err, ErrorMatches, "bypassing document validation requires MongoDB 3.2 or newer")
+		_, err = coll.Find(M{"n": 1}).Apply(mgo.Change{Update: M{"n": 2}}, nil)
+		c.Assert(err, ErrorMatches, "bypassing document validation requires MongoDB 3.2 or newer")
+		return
+	}
+
+	err = coll.Database.Run(bson.D{
+		{Name: "collMod", Value: "mycoll"},
+		{Name: "validator", Value: M{"s": M{"$type": "string"}}},
+	}, nil)
+	c.Assert(err, IsNil)
+
+	change := mgo.Change{Update: M{"$set": M{"n": 2}}, ReturnNew: true}
+	_, err = coll.Find(M{"n": 1}).Apply(change, nil)
+	c.Assert(err, ErrorMatches, "Document failed validation")
+
+	session.SetBypassValidation(true)
+
+	var result struct{ N int }
+	_, err = coll.Find(M{"n": 1}).Apply(change, &result)
+	c.Assert(err, IsNil)
+	c.Assert(result.N, Equals, 2)
+}
+
+func (s *S) TestWriteInterceptor(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	var namespaces []string
+	session.SetWriteInterceptor(func(ns string, doc interface{}) (interface{}, error) {
+		namespaces = append(namespaces, ns)
+		m, ok := doc.(M)
+		if !ok {
+			return nil, errors.New("unexpected document")
+		}
+		if m["reject"] == true {
+			return nil, errors.New("rejected")
+		}
+		if _, ok := m["$set"]; ok {
+			return M{"$set": m["$set"], "$inc": M{"updates": 1}}, nil
+		}
+		tagged := M{"tenant": "t1"}
+		for k, v := range m {
+			tagged[k] = v
+		}
+		return tagged, nil
+	})
+
+	coll := session.DB("mydb").C("mycoll")
+	err = coll.Insert(M{"_id": 1}, M{"_id": 2})
+	c.Assert(err, IsNil)
+	c.Assert(namespaces, DeepEquals, []string{"mydb.mycoll", "mydb.mycoll"})
+
+	err = coll.Insert(M{"_id": 3}, M{"_id": 4, "reject": true})
+	c.Assert(err, ErrorMatches, "rejected")
+	n, err := coll.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+
+	_, err = coll.Upsert(M{"_id": 5}, M{"n": 5})
+	c.Assert(err, IsNil)
+	err = coll.UpdateId(1, M{"$set": M{"n": 1}})
+	c.Assert(err, IsNil)
+
+	bulk := coll.Bulk()
+	bulk.Insert(M{"_id": 6})
+	bulk.Update(M{"_id": 2}, M{"$set": M{"n": 2}})
+	_, err = bulk.Run()
+	c.Assert(err, IsNil)
+
+	_, err = coll.Find(M{"_id": 6}).Apply(mgo.Change{Update: M{"$set": M{"n": 6}}}, nil)
+	c.Assert(err, IsNil)
+
+	// Each document was intercepted exactly once, including the
+	// document that was rejected and the one before it.
+	c.Assert(namespaces, HasLen, 9)
+
+	var result []M
+	err = coll.Find(nil).Sort("_id").All(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result, DeepEquals, []M{
+		{"_id": 1, "tenant": "t1", "n": 1, "updates": 1},
+		{"_id": 2, "tenant": "t1", "n": 2, "updates": 1},
+		{"_id": 5, "tenant": "t1", "n": 5},
+		{"_id": 6, "tenant": "t1", "n": 6, "updates": 1},
+	})
+
+	// Sessions copied afterwards inherit the interceptor.
+	copied := session.Copy()
+	defer copied.Close()
+	err = copied.DB("mydb").C("mycoll").Insert(M{"reject": true})
+	c.Assert(err, ErrorMatches, "rejected")
+
+	session.SetWriteInterceptor(nil)
+	err = coll.Insert(M{"_id": 7, "reject": true})
+	c.Assert(err, IsNil)
+}
+
+type money struct {
+	cents int64
+}
+
+func (s *S) TestRegistry(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	registry := bson.NewRegistry()
+	registry.Register(reflect.TypeOf(money{}),
+		func(v interface{}) (interface{}, error) {
+			return v.(money).cents, nil
+		},
+		func(raw bson.Raw) (interface{}, error) {
+			var cents int64
+			err := raw.Unmarshal(&cents)
+			return money{cents}, err
+		})
+	session.SetRegistry(registry)
+	c.Assert(session.Registry(), Equals, registry)
+
+	type item struct {
+		Id    int   `bson:"_id"`
+		Price money `bson:"price"`
+	}
+
+	coll := session.DB("mydb").C("mycoll")
+	err = coll.Insert(item{1, money{150}}, item{2, money{99}})
+	c.Assert(err, IsNil)
+	err = coll.Update(M{"price": money{99}}, M{"$set": M{"price": money{250}}})
+	c.Assert(err, IsNil)
+
+	// The selector matched the second item rather than going out as an
+	// empty document matching the first one.
+	var first item
+	err = coll.FindId(1).One(&first)
+	c.Assert(err, IsNil)
+	c.Assert(first, Equals, item{1, money{150}})
+
+	var one item
+	err = coll.Find(M{"price": money{250}}).One(&one)
+	c.Assert(err, IsNil)
+	c.Assert(one, Equals, item{2, money{250}})
+
+	var all []item
+	err = coll.Find(M{"price": M{"$gt": money{100}}}).Sort("_id").All(&all)
+	c.Assert(err, IsNil)
+	c.Assert(all, DeepEquals, []item{{1, money{150}}, {2, money{250}}})
+
+	var applied item
+	_, err = coll.Find(M{"_id": 1}).Apply(mgo.Change{Update: M{"$set": M{"price": money{175}}}, ReturnNew: true}, &applied)
+	c.Assert(err, IsNil)
+	c.Assert(applied, Equals, item{1, money{175}})
+
+	n, err := coll.Find(M{"price": money{175}}).Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+
+	var ids []int
+	err = coll.Find(M{"price": money{250}}).Distinct("_id", &ids)
+	c.Assert(err, IsNil)
+	c.Assert(ids, DeepEquals, []int{2})
+
+	var piped []item
+	err = coll.Pipe([]M{{"$match": M{"price": money{250}}}}).All(&piped)
+	c.Assert(err, IsNil)
+	c.Assert(piped, DeepEquals, []item{{2, money{250}}})
+
+	// Without the registry the values are stored as plain numbers.
+	plain, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer plain.Close()
+	var m M
+	err = plain.DB("mydb").C("mycoll").FindId(1).One(&m)
+	c.Assert(err, IsNil)
+	c.Assert(m["price"], Equals, int64(175))
+
+	err = coll.Remove(M{"price": money{250}})
+	c.Assert(err, IsNil)
+	n, err = plain.DB("mydb").C("mycoll").Find(nil).Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+	n, err = plain.DB("mydb").C("mycoll").FindId(1).Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+
+	// Sessions copied afterwards inherit the registry.
+	copied := session.Copy()
+	defer copied.Close()
+	c.Assert(copied.Registry(), Equals, registry)
+}
+
 func (s *S) TestVersionAtLeast(c *C) {
 	tests := [][][]int{
 		{{3, 2, 1}, {3, 2, 0}},
@@ -5109,6 +6306,363 @@ func (s *S) TestCollationQueries(c *C) {
 	}
 }
 
+func (s *S) TestTransactionCommit(c *C) {
+	if !s.versionAtLeast(4, 0) {
+		c.Skip("transactions being released with 4.0")
+	}
+	session, err := mgo.Dial("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	err = coll.Insert(M{"_id": 0})
+	c.Assert(err, IsNil)
+
+	err = session.StartTransaction()
+	c.Assert(err, IsNil)
+	err = session.StartTransaction()
+	c.Assert(err, ErrorMatches, "transaction already in progress")
+
+	err = coll.Insert(M{"_id": 1}, M{"_id": 2})
+	c.Assert(err, IsNil)
+	err = coll.UpdateId(0, M{"$set": M{"n": 1}})
+	c.Assert(err, IsNil)
+
+	// Changes are only visible within the transaction until it's committed.
+	other := session.Copy()
+	defer other.Close()
+	n, err := other.DB("mydb").C("mycoll").Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+	var result []M
+	err = coll.Find(nil).All(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result, HasLen, 3)
+
+	err = session.CommitTransaction()
+	c.Assert(err, IsNil)
+	err = session.CommitTransaction()
+	c.Assert(err, ErrorMatches, "no transaction in progress")
+
+	n, err = other.DB("mydb").C("mycoll").Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 3)
+}
+
+func (s *S) TestTransactionAbort(c *C) {
+	if !s.versionAtLeast(4, 0) {
+		c.Skip("transactions being released with 4.0")
+	}
+	session, err := mgo.Dial("localhost:40011")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	err = coll.Insert(M{"_id": 0})
+	c.Assert(err, IsNil)
+
+	err = session.RunTransaction(func() error {
+		err := coll.Insert(M{"_id": 1})
+		c.Assert(err, IsNil)
+		return coll.Insert(M{"_id": 0})
+	})
+	c.Assert(mgo.IsDup(err), Equals, true)
+
+	var result []M
+	err = coll.Find(nil).All(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result, DeepEquals, []M{{"_id": 0}})
+
+	// The session is usable for further transactions.
+	err = session.RunTransaction(func() error {
+		return coll.Insert(M{"_id": 1})
+	})
+	c.Assert(err, IsNil)
+	n, err := coll.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+}
+
+func (s *S) TestCollationDistinctAndApply(c *C) {
+	if !s.versionAtLeast(3, 3, 12) {
+		c.Skip("collations being released with 3.4")
+	}
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	for _, name := range []string{"a", "A", "b"} {
+		err = coll.Insert(M{"name": name, "n": 0})
+		c.Assert(err, IsNil)
+	}
+
+	collation := &mgo.Collation{Locale: "en", Strength: 1}
+
+	var names []string
+	err = coll.Find(nil).Collation(collation).Distinct("name", &names)
+	c.Assert(err, IsNil)
+	c.Assert(names, HasLen, 2)
+
+	change := mgo.Change{Update: M{"$inc": M{"n": 1}}}
+	info, err := coll.Find(M{"name": "B"}).Collation(collation).Apply(change, nil)
+	c.Assert(err, IsNil)
+	c.Assert(info.Updated, Equals, 1)
+
+	n, err := coll.Find(M{"name": "b", "n": 1}).Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+}
+
+func (s *S) TestInsertLargerThanMaxBsonObjectSize(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	doc := M{"data": make([]byte, 17*1024*1024)}
+
+	err = coll.Insert(doc)
+	c.Assert(err, ErrorMatches, `document exceeds maxBsonObjectSize \(\d+ > \d+ bytes\)`)
+
+	err = coll.Insert(M{"_id": 1})
+	c.Assert(err, IsNil)
+	err = coll.UpdateId(1, doc)
+	c.Assert(err, ErrorMatches, `document exceeds maxBsonObjectSize \(\d+ > \d+ bytes\)`)
+}
+
+func (s *S) TestInsertMoreThanMaxWriteBatchSize(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	limits, err := session.ServerLimits()
+	c.Assert(err, IsNil)
+	c.Assert(limits.MaxBsonObjectSize > 0, Equals, true)
+	c.Assert(limits.MaxWriteBatchSize > 0, Equals, true)
+
+	var m sync.Mutex
+	var inserts int
+	mgo.SetCommandMonitor(&mgo.CommandMonitor{
+		Started: func(event *mgo.CommandStartedEvent) {
+			if event.CommandName == "insert" {
+				m.Lock()
+				inserts++
+				m.Unlock()
+			}
+		},
+	})
+	defer mgo.SetCommandMonitor(nil)
+
+	total := limits.MaxWriteBatchSize + 10
+	docs := make([]interface{}, total)
+	for i := range docs {
+		docs[i] = M{"n": i}
+	}
+	coll := session.DB("mydb").C("mycoll")
+	err = coll.Insert(docs...)
+	c.Assert(err, IsNil)
+
+	n, err := coll.Count()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, total)
+
+	m.Lock()
+	defer m.Unlock()
+	if s.versionAtLeast(2, 6) {
+		c.Assert(inserts, Equals, 2)
+	}
+}
+
+func (s *S) TestCommandMonitor(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	// Ensure the connection is established before monitoring.
+	c.Assert(session.Ping(), IsNil)
+
+	var m sync.Mutex
+	var started []*mgo.CommandStartedEvent
+	var succeeded []*mgo.CommandSucceededEvent
+	var failed []*mgo.CommandFailedEvent
+	mgo.SetCommandMonitor(&mgo.CommandMonitor{
+		Started: func(event *mgo.CommandStartedEvent) {
+			m.Lock()
+			started = append(started, event)
+			m.Unlock()
+		},
+		Succeeded: func(event *mgo.CommandSucceededEvent) {
+			m.Lock()
+			succeeded = append(succeeded, event)
+			m.Unlock()
+		},
+		Failed: func(event *mgo.CommandFailedEvent) {
+			m.Lock()
+			failed = append(failed, event)
+			m.Unlock()
+		},
+	})
+	defer mgo.SetCommandMonitor(nil)
+
+	err = session.DB("mydb").Run(bson.D{{Name: "ping", Value: 1}}, nil)
+	c.Assert(err, IsNil)
+	err = session.DB("mydb").Run(bson.D{{Name: "unknownCommand", Value: 1}}, nil)
+	c.Assert(err, NotNil)
+
+	m.Lock()
+	defer m.Unlock()
+
+	// Other commands, such as the ones run by the cluster synchronization,
+	// may be seen as well, so events are matched by database and name.
+	var names []string
+	requestIds := make(map[string]uint32)
+	for _, event := range started {
+		if event.DatabaseName == "mydb" {
+			names = append(names, event.CommandName)
+			requestIds[event.CommandName] = event.RequestId
+			c.Assert(event.ServerAddress, Equals, "localhost:40001")
+		}
+	}
+	c.Assert(names, DeepEquals, []string{"ping", "unknownCommand"})
+
+	var ok, fail int
+	for _, event := range succeeded {
+		if event.DatabaseName == "mydb" {
+			c.Assert(event.CommandName, Equals, "ping")
+			c.Assert(event.RequestId, Equals, requestIds["ping"])
+			ok++
+		}
+	}
+	for _, event := range failed {
+		if event.DatabaseName == "mydb" {
+			c.Assert(event.CommandName, Equals, "unknownCommand")
+			c.Assert(event.RequestId, Equals, requestIds["unknownCommand"])
+			c.Assert(event.Err, ErrorMatches, ".*no such.*command.*")
+			fail++
+		}
+	}
+	c.Assert(ok, Equals, 1)
+	c.Assert(fail, Equals, 1)
+}
+
+func (s *S) TestSafeWritesUseWriteCommands(c *C) {
+	if !s.versionAtLeast(2, 6) {
+		c.Skip("write commands introduced in 2.6")
+	}
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+	c.Assert(session.Ping(), IsNil)
+
+	var m sync.Mutex
+	var names []string
+	mgo.SetCommandMonitor(&mgo.CommandMonitor{
+		Started: func(event *mgo.CommandStartedEvent) {
+			if event.DatabaseName != "mydb" {
+				return
+			}
+			m.Lock()
+			names = append(names, event.CommandName)
+			m.Unlock()
+		},
+	})
+	defer mgo.SetCommandMonitor(nil)
+
+	coll := session.DB("mydb").C("mycoll")
+	c.Assert(coll.Insert(M{"_id": 1}), IsNil)
+	c.Assert(coll.Update(M{"_id": 1}, M{"$set": M{"n": 1}}), IsNil)
+	c.Assert(coll.Remove(M{"_id": 1}), IsNil)
+
+	m.Lock()
+	defer m.Unlock()
+	c.Assert(names, DeepEquals, []string{"insert", "update", "delete"})
+}
+
+func (s *S) TestGeoQueries(c *C) {
+	if !s.versionAtLeast(2, 4) {
+		c.Skip("2dsphere indexes and GeoJSON queries need MongoDB 2.4+")
+	}
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	err = coll.EnsureIndexKey("$2dsphere:loc")
+	c.Assert(err, IsNil)
+
+	for i, point := range []mgo.Point{{0, 0}, {0, 0.001}, {0, 0.01}, {10, 10}} {
+		err := coll.Insert(M{"n": i, "loc": M{"type": "Point", "coordinates": point}})
+		c.Assert(err, IsNil)
+	}
+	ns := func(cond bson.D) []int {
+		var result []struct{ N int }
+		err := coll.Find(M{"loc": cond}).All(&result)
+		c.Assert(err, IsNil)
+		var ns []int
+		for _, doc := range result {
+			ns = append(ns, doc.N)
+		}
+		return ns
+	}
+
+	// Roughly 111 meters per thousandth of a degree of latitude.
+	near, err := mgo.GeoNear(mgo.Point{0, 0.002}, 500)
+	c.Assert(err, IsNil)
+	c.Assert(ns(near), DeepEquals, []int{1, 0})
+
+	near, err = mgo.GeoNear(mgo.Point{0, 0.02}, 0)
+	c.Assert(err, IsNil)
+	c.Assert(ns(near), DeepEquals, []int{2, 1, 0, 3})
+
+	within, err := mgo.GeoWithin(mgo.Polygon{{{-1, -1}, {1, -1}, {1, 1}, {-1, 1}, {-1, -1}}})
+	c.Assert(err, IsNil)
+	c.Assert(ns(within), HasLen, 3)
+
+	intersects, err := mgo.GeoIntersects(mgo.Point{10, 10})
+	c.Assert(err, IsNil)
+	c.Assert(ns(intersects), DeepEquals, []int{3})
+
+	// Malformed geometry is rejected before anything is sent.
+	_, err = mgo.GeoWithin(mgo.Polygon{{{-1, -1}, {1, -1}, {1, 1}, {-1, 1}}})
+	c.Assert(err, ErrorMatches, `invalid polygon: ring 0 is not closed, .*`)
+	_, err = mgo.GeoWithin(mgo.Polygon{{{-1, -1}, {1, 1}, {-1, -1}}})
+	c.Assert(err, ErrorMatches, `invalid polygon: ring 0 must have at least 4 points, got 3`)
+	_, err = mgo.GeoIntersects(mgo.LineString{{0, 0}})
+	c.Assert(err, ErrorMatches, `invalid line string: must have at least 2 points, got 1`)
+	_, err = mgo.GeoNear(mgo.Point{0, 91}, 0)
+	c.Assert(err, ErrorMatches, `invalid point \[0 91\]: latitude must be between -90 and 90`)
+	_, err = mgo.GeoNear(mgo.Point{0, 0}, -1)
+	c.Assert(err, ErrorMatches, `invalid maximum distance: -1`)
+}
+
+func (s *S) TestGeoWithinBox(c *C) {
+	session, err := mgo.Dial("localhost:40001")
+	c.Assert(err, IsNil)
+	defer session.Close()
+
+	coll := session.DB("mydb").C("mycoll")
+	err = coll.EnsureIndexKey("$2d:loc")
+	c.Assert(err, IsNil)
+
+	for i, point := range []mgo.Point{{1, 1}, {5, 5}, {20, 20}} {
+		err := coll.Insert(M{"n": i, "loc": point})
+		c.Assert(err, IsNil)
+	}
+
+	box, err := mgo.GeoWithinBox(mgo.Point{0, 0}, mgo.Point{10, 10})
+	c.Assert(err, IsNil)
+	var result []struct{ N int }
+	err = coll.Find(M{"loc": box}).Sort("n").All(&result)
+	c.Assert(err, IsNil)
+	c.Assert(result, HasLen, 2)
+	c.Assert(result[0].N, Equals, 0)
+	c.Assert(result[1].N, Equals, 1)
+
+	_, err = mgo.GeoWithinBox(mgo.Point{10, 10}, mgo.Point{0, 0})
+	c.Assert(err, ErrorMatches, `invalid box: .*`)
+}
+
 // --------------------------------------------------------------------------
 // Some benchmarks that require a running database.
 
@@ -0,0 +1,160 @@
+package mgo
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+var errNotMongos = errors.New("not connected to a mongos router")
+
+// Shard describes a shard of a sharded cluster.
+type Shard struct {
+	Id string `bson:"_id"`
+
+	// Host holds the address of the shard server, in the "host:port"
+	// form, or the addresses of the replica set members backing the
+	// shard, in the "setname/host1:port,host2:port" form.
+	Host string `bson:"host"`
+}
+
+// Shards returns the shards of the sharded cluster the session talks to
+// through mongos routers. An error is returned if the session isn't
+// connected to mongos routers.
+//
+// Relevant documentation:
+//
+//     https://docs.mongodb.com/manual/reference/command/listShards/
+//
+func (s *Session) Shards() ([]Shard, error) {
+	socket, err := s.acquireSocket(true)
+	if err != nil {
+		return nil, err
+	}
+	mongos := socket.ServerInfo().Mongos
+	socket.Release()
+	if !mongos {
+		return nil, errNotMongos
+	}
+	var result struct{ Shards []Shard }
+	if err := s.Run("listShards", &result); err != nil {
+		return nil, err
+	}
+	return result.Shards, nil
+}
+
+// DialShard establishes a new session talking to the given shard directly,
+// bypassing the mongos routers. The new session is dialed with the same
+// settings as s, and is put in the same consistency mode.
+//
+// Documents queried from a shard directly may include orphaned documents,
+// left behind or not yet owned by the shard while chunks are migrated.
+func (s *Session) DialShard(shard Shard) (*Session, error) {
+	s.m.RLock()
+	info := s.dialInfo.Copy()
+	mode := s.consistency
+	s.m.RUnlock()
+
+	addrs := shard.Host
+	info.ReplicaSetName = ""
+	if i := strings.Index(addrs, "/"); i >= 0 {
+		info.ReplicaSetName = addrs[:i]
+		addrs = addrs[i+1:]
+	}
+	info.Addrs = strings.Split(addrs, ",")
+	info.SeedGroups = nil
+	info.Direct = false
+
+	session, err := DialWithInfo(info)
+	if err != nil {
+		return nil, err
+	}
+	session.SetMode(mode, true)
+	return session, nil
+}
+
+// ForEachShard runs the query against every shard of the sharded cluster
+// directly, concurrently, rather than through the mongos routers. The
+// function fn is called once per shard from its own goroutine, with an
+// iterator over the results found in that shard. The iterators are closed
+// and the sessions to the shards are released when fn returns. The first
+// error returned by fn, or happening while talking to a shard, is returned
+// once all calls to fn are done.
+//
+// This speeds up heavy scans of sharded collections, such as the ones done
+// for analytics, by spreading the load of merging the results over the
+// client. Sorting, limits and skips apply per shard, and documents that
+// are being migrated between shards may show up in more than one of them,
+// as documented in DialShard.
+//
+// For instance:
+//
+//    err := collection.Find(nil).ForEachShard(func(shard mgo.Shard, iter *mgo.Iter) error {
+//        var result bson.M
+//        for iter.Next(&result) {
+//            fmt.Printf("Shard %s has %v\n", shard.Id, result)
+//        }
+//        return iter.Err()
+//    })
+//
+func (q *Query) ForEachShard(fn func(shard Shard, iter *Iter) error) error {
+	q.m.Lock()
+	session := q.session
+	query := q.query
+	mode, hasMode := q.mode, q.hasMode
+	q.m.Unlock()
+
+	shards, err := session.Shards()
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(shards))
+	for i, shard := range shards {
+		wg.Add(1)
+		go func(i int, shard Shard) {
+			defer wg.Done()
+			shardSession, err := session.DialShard(shard)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer shardSession.Close()
+
+			q := &Query{session: shardSession, query: query, mode: mode, hasMode: hasMode}
+			iter := q.Iter()
+			err = fn(shard, iter)
+			if closeErr := iter.Close(); err == nil {
+				err = closeErr
+			}
+			errs[i] = err
+		}(i, shard)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ShardChannel works like Iter.Channel, but runs the query against every
+// shard concurrently as ForEachShard does, merging the results from all
+// of them into ch in no particular order. The goroutine reading from each
+// shard blocks while ch is full.
+func (q *Query) ShardChannel(ch interface{}, done <-chan struct{}) <-chan error {
+	chv := sendChannel(ch)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- q.ForEachShard(func(shard Shard, iter *Iter) error {
+			iter.send(chv, done)
+			return iter.Err()
+		})
+		close(errc)
+		chv.Close()
+	}()
+	return errc
+}
@@ -29,8 +29,10 @@ package mgo
 import (
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/globalsign/mgo/bson"
@@ -48,6 +50,7 @@ type mongoSocket struct {
 	references     int
 	creds          []Credential
 	logout         []Credential
+	authenticated  bool // By DialInfo.Authenticator.
 	cachedNonce    string
 	gotNonce       sync.Cond
 	dead           error
@@ -55,6 +58,9 @@ type mongoSocket struct {
 	closeAfterIdle bool
 	lastTimeUsed   time.Time // for time based idle socket release
 	sendMeta       sync.Once
+	generation     int    // Of the server pool when established; immutable.
+	id             uint64 // For pool monitoring; immutable.
+	closeReason    string // Reported to the pool monitor once closed.
 
 	dialInfo *DialInfo
 }
@@ -83,6 +89,15 @@ type queryOp struct {
 	hasOptions  bool
 	flags       queryOpFlags
 	readConcern string
+	txn         *transaction
+	txnFields   bson.D
+	lsid        *bson.Raw
+	slowOps     *slowOpWatch
+	requestId   uint32 // Set by mongoSocket.Query once sent
+	textSearch  bool   // Query made with Query.Text
+	textScore   string // Field set with Query.TextScore
+
+	explainVerbosity string
 }
 
 type queryWrapper struct {
@@ -99,6 +114,16 @@ type queryWrapper struct {
 }
 
 func (op *queryOp) finalQuery(socket *mongoSocket) interface{} {
+	if op.txnFields != nil && op.txnCommand() {
+		op.query = appendTxnFields(op.query, op.txnFields)
+	} else {
+		op.txn = nil
+		if op.lsid != nil {
+			op.query = op.appendSessionId(socket)
+		}
+	}
+	op.txnFields = nil
+	op.lsid = nil
 	if op.flags&flagSlaveOk != 0 && socket.ServerInfo().Mongos {
 		var modeName string
 		switch op.mode {
@@ -124,6 +149,10 @@ func (op *queryOp) finalQuery(socket *mongoSocket) interface{} {
 			op.options.ReadPreference = append(op.options.ReadPreference, bson.DocElem{Name: "tags", Value: op.serverTags})
 		}
 	}
+	if op.options.MaxTimeMS > 0 && socket.ServerInfo().MaxWireVersion < 2 {
+		// Not supported before MongoDB 2.6.
+		op.options.MaxTimeMS = 0
+	}
 	if op.hasOptions {
 		if op.query == nil {
 			var empty bson.D
@@ -142,6 +171,7 @@ type getMoreOp struct {
 	limit      int32
 	cursorId   int64
 	replyFunc  replyFunc
+	requestId  uint32 // Set by mongoSocket.Query once sent
 }
 
 type replyOp struct {
@@ -164,6 +194,9 @@ type updateOp struct {
 	Flags      uint32      `bson:"-"`
 	Multi      bool        `bson:"multi,omitempty"`
 	Upsert     bool        `bson:"upsert,omitempty"`
+	Comment    string      `bson:"-"` // Sent along with the update command
+
+	ArrayFilters []bson.M `bson:"arrayFilters,omitempty"`
 }
 
 type deleteOp struct {
@@ -180,8 +213,13 @@ type killCursorsOp struct {
 type requestInfo struct {
 	bufferPos int
 	replyFunc replyFunc
+	monitored *monitoredCommand
+	requestId *uint32
 }
 
+// lastSocketId is the id of the most recently created socket.
+var lastSocketId uint64
+
 func newSocket(server *mongoServer, conn net.Conn, info *DialInfo) *mongoSocket {
 	socket := &mongoSocket{
 		conn:       conn,
@@ -189,8 +227,12 @@ func newSocket(server *mongoServer, conn net.Conn, info *DialInfo) *mongoSocket
 		server:     server,
 		replyFuncs: make(map[uint32]replyFunc),
 		dialInfo:   info,
+		id:         atomic.AddUint64(&lastSocketId, 1),
 	}
 	socket.gotNonce.L = &socket.Mutex
+	if monitor := poolMonitor(); monitor != nil && monitor.ConnectionCreated != nil {
+		monitor.ConnectionCreated(&PoolEvent{ServerAddress: socket.addr, ConnectionId: socket.id})
+	}
 	if err := socket.InitialAcquire(server.Info(), info); err != nil {
 		panic("newSocket: InitialAcquire returned error: " + err.Error())
 	}
@@ -210,6 +252,26 @@ func (socket *mongoSocket) Server() *mongoServer {
 	return server
 }
 
+// reservable returns whether the socket may remain reserved by a session,
+// which is the case while it's alive, its server wasn't removed from
+// the cluster, and the server wasn't reconfigured since it was established.
+func (socket *mongoSocket) reservable() bool {
+	socket.Lock()
+	dead := socket.dead
+	server := socket.server
+	socket.Unlock()
+	if dead != nil {
+		return false
+	}
+	if server == nil {
+		return true
+	}
+	server.RLock()
+	usable := !server.closed && socket.generation == server.generation
+	server.RUnlock()
+	return usable
+}
+
 // ServerInfo returns details for the server at the time the socket
 // was initially acquired.
 func (socket *mongoSocket) ServerInfo() *mongoServerInfo {
@@ -222,6 +284,19 @@ func (socket *mongoSocket) ServerInfo() *mongoServerInfo {
 	return serverInfo
 }
 
+// maxCommandOverhead is the room the server allows for command fields
+// besides documents of up to maxBsonObjectSize bytes.
+const maxCommandOverhead = 16 * 1024
+
+// checkDocSize returns an error if a document of the given size exceeds the
+// limit advertised by the server, increased by overhead.
+func (info *mongoServerInfo) checkDocSize(size, overhead int) error {
+	if info.MaxBsonObjectSize > 0 && size > info.MaxBsonObjectSize+overhead {
+		return fmt.Errorf("document exceeds maxBsonObjectSize (%d > %d bytes)", size, info.MaxBsonObjectSize+overhead)
+	}
+	return nil
+}
+
 // InitialAcquire obtains the first reference to the socket, either
 // right after the connection is made or once a recycled socket is
 // being put back in use.
@@ -241,6 +316,9 @@ func (socket *mongoSocket) InitialAcquire(serverInfo *mongoServerInfo, dialInfo
 	stats.socketsInUse(+1)
 	stats.socketRefs(+1)
 	socket.Unlock()
+	if monitor := poolMonitor(); monitor != nil && monitor.ConnectionCheckedOut != nil {
+		monitor.ConnectionCheckedOut(&PoolEvent{ServerAddress: socket.addr, ConnectionId: socket.id})
+	}
 	return nil
 }
 
@@ -275,6 +353,9 @@ func (socket *mongoSocket) Release() {
 		server := socket.server
 		closeAfterIdle := socket.closeAfterIdle
 		socket.Unlock()
+		if monitor := poolMonitor(); monitor != nil && monitor.ConnectionCheckedIn != nil {
+			monitor.ConnectionCheckedIn(&PoolEvent{ServerAddress: socket.addr, ConnectionId: socket.id})
+		}
 		socket.LogoutAll()
 		if closeAfterIdle {
 			socket.Close()
@@ -339,6 +420,16 @@ func (socket *mongoSocket) updateDeadline(which deadlineType) {
 
 // Close terminates the socket use.
 func (socket *mongoSocket) Close() {
+	socket.closeFor(PoolReasonPoolClosed)
+}
+
+// closeFor works like Close, reporting reason to the pool monitor.
+func (socket *mongoSocket) closeFor(reason string) {
+	socket.Lock()
+	if socket.closeReason == "" {
+		socket.closeReason = reason
+	}
+	socket.Unlock()
 	socket.kill(errors.New("Closed explicitly"), false)
 }
 
@@ -357,6 +448,17 @@ func (socket *mongoSocket) CloseAfterIdle() {
 	logf("Socket %p to %s: close after idle.", socket, socket.addr)
 }
 
+// noteRestart records on the socket server that it closed the socket
+// cleanly, which usually means it is restarting.
+func (socket *mongoSocket) noteRestart() {
+	socket.Lock()
+	server := socket.server
+	socket.Unlock()
+	if server != nil {
+		server.NoteRestart()
+	}
+}
+
 func (socket *mongoSocket) kill(err error, abend bool) {
 	socket.Lock()
 	if socket.dead != nil {
@@ -368,12 +470,20 @@ func (socket *mongoSocket) kill(err error, abend bool) {
 	socket.dead = err
 	socket.conn.Close()
 	stats.socketsAlive(-1)
+	releaseConn()
 	replyFuncs := socket.replyFuncs
 	socket.replyFuncs = make(map[uint32]replyFunc)
 	server := socket.server
 	socket.server = nil
 	socket.gotNonce.Broadcast()
+	reason := socket.closeReason
 	socket.Unlock()
+	if monitor := poolMonitor(); monitor != nil && monitor.ConnectionClosed != nil {
+		if abend || reason == "" {
+			reason = PoolReasonError
+		}
+		monitor.ConnectionClosed(&PoolEvent{ServerAddress: socket.addr, ConnectionId: socket.id, Reason: reason})
+	}
 	for _, replyFunc := range replyFuncs {
 		logf("Socket %p to %s: notifying replyFunc of closed socket: %s", socket, socket.addr, err.Error())
 		replyFunc(err, nil, -1, nil)
@@ -437,6 +547,9 @@ func (socket *mongoSocket) Query(ops ...interface{}) (err error) {
 	requests := make([]requestInfo, len(ops))
 	requestCount := 0
 
+	limits := socket.ServerInfo()
+	monitor := commandMonitor()
+
 	for _, op := range ops {
 		debugf("Socket %p to %s: serializing op: %#v", socket, socket.addr, op)
 		if qop, ok := op.(*queryOp); ok {
@@ -446,6 +559,8 @@ func (socket *mongoSocket) Query(ops ...interface{}) (err error) {
 		}
 		start := len(buf)
 		var replyFunc replyFunc
+		var requestId *uint32
+		var monitored *monitoredCommand
 		switch op := op.(type) {
 
 		case *updateOp:
@@ -459,10 +574,14 @@ func (socket *mongoSocket) Query(ops ...interface{}) (err error) {
 				return err
 			}
 			debugf("Socket %p to %s: serializing update document: %#v", socket, socket.addr, op.Update)
+			docStart := len(buf)
 			buf, err = addBSON(buf, op.Update)
 			if err != nil {
 				return err
 			}
+			if err = limits.checkDocSize(len(buf)-docStart, 0); err != nil {
+				return err
+			}
 
 		case *insertOp:
 			buf = addHeader(buf, 2002)
@@ -470,10 +589,14 @@ func (socket *mongoSocket) Query(ops ...interface{}) (err error) {
 			buf = addCString(buf, op.collection)
 			for _, doc := range op.documents {
 				debugf("Socket %p to %s: serializing document for insertion: %#v", socket, socket.addr, doc)
+				docStart := len(buf)
 				buf, err = addBSON(buf, doc)
 				if err != nil {
 					return err
 				}
+				if err = limits.checkDocSize(len(buf)-docStart, 0); err != nil {
+					return err
+				}
 			}
 
 		case *queryOp:
@@ -482,10 +605,18 @@ func (socket *mongoSocket) Query(ops ...interface{}) (err error) {
 			buf = addCString(buf, op.collection)
 			buf = addInt32(buf, op.skip)
 			buf = addInt32(buf, op.limit)
+			docStart := len(buf)
 			buf, err = addBSON(buf, op.finalQuery(socket))
 			if err != nil {
 				return err
 			}
+			// Commands carrying documents of the maximum size are still accepted.
+			if err = limits.checkDocSize(len(buf)-docStart, maxCommandOverhead); err != nil {
+				return err
+			}
+			if monitor != nil {
+				monitored = newMonitoredCommand(monitor, socket, op.collection, buf[docStart:])
+			}
 			if op.selector != nil {
 				buf, err = addBSON(buf, op.selector)
 				if err != nil {
@@ -493,6 +624,17 @@ func (socket *mongoSocket) Query(ops ...interface{}) (err error) {
 				}
 			}
 			replyFunc = op.replyFunc
+			requestId = &op.requestId
+			if op.txn != nil && replyFunc != nil {
+				replyFunc = op.txn.replyFunc(replyFunc)
+			}
+			op.txn = nil
+			if op.slowOps != nil && replyFunc != nil {
+				replyFunc = op.slowOps.replyFunc(socket, op.collection, buf[docStart:], replyFunc)
+			}
+			if monitored != nil {
+				replyFunc = monitored.replyFunc(replyFunc)
+			}
 
 		case *getMoreOp:
 			buf = addHeader(buf, 2005)
@@ -501,6 +643,7 @@ func (socket *mongoSocket) Query(ops ...interface{}) (err error) {
 			buf = addInt32(buf, op.limit)
 			buf = addInt64(buf, op.cursorId)
 			replyFunc = op.replyFunc
+			requestId = &op.requestId
 
 		case *deleteOp:
 			buf = addHeader(buf, 2006)
@@ -526,11 +669,16 @@ func (socket *mongoSocket) Query(ops ...interface{}) (err error) {
 		}
 
 		setInt32(buf, start, int32(len(buf)-start))
+		if max := limits.MaxMessageSizeBytes; max > 0 && len(buf)-start > max {
+			return fmt.Errorf("message exceeds maxMessageSizeBytes (%d > %d bytes)", len(buf)-start, max)
+		}
 
 		if replyFunc != nil {
 			request := &requests[requestCount]
 			request.replyFunc = replyFunc
 			request.bufferPos = start
+			request.monitored = monitored
+			request.requestId = requestId
 			requestCount++
 		}
 	}
@@ -565,9 +713,21 @@ func (socket *mongoSocket) Query(ops ...interface{}) (err error) {
 		request := &requests[i]
 		setInt32(buf, request.bufferPos+4, int32(requestId))
 		socket.replyFuncs[requestId] = request.replyFunc
+		if request.monitored != nil {
+			request.monitored.event.RequestId = requestId
+		}
+		if request.requestId != nil {
+			*request.requestId = requestId
+		}
 		requestId++
 	}
 	socket.Unlock()
+
+	for i := 0; i != requestCount; i++ {
+		if monitored := requests[i].monitored; monitored != nil {
+			monitored.start(monitored.event.RequestId)
+		}
+	}
 	debugf("Socket %p to %s: sending %d op(s) (%d bytes)", socket, socket.addr, len(ops), len(buf))
 
 	stats.sentOps(len(ops))
@@ -599,6 +759,11 @@ func (socket *mongoSocket) readLoop() {
 	for {
 		err := fill(conn, p)
 		if err != nil {
+			if err == io.EOF {
+				// Closed by the server between replies, as it does
+				// when shutting down for a restart.
+				socket.noteRestart()
+			}
 			socket.kill(err, true)
 			return
 		}
@@ -27,6 +27,7 @@
 package mgo
 
 import (
+	"errors"
 	"sync"
 	"time"
 )
@@ -34,6 +35,54 @@ import (
 var stats *Stats
 var statsMutex sync.Mutex
 
+var errGlobalConnLimit = errors.New("global connection limit reached")
+
+// Connections alive across all clusters, tracked even when stats are
+// disabled so that the global connection limit may be enforced.
+var globalConns int
+var globalConnLimit int
+
+// SetGlobalConnLimit limits the number of connections kept alive at any
+// given time to all servers across all clusters in the process. Once the
+// limit is reached, attempts to establish new connections fail until
+// some of the existing ones are closed. This is a backstop independent
+// from the per-server limit set with SetPoolLimit, useful for processes
+// connecting to many clusters. A limit of zero, the default, disables it.
+func SetGlobalConnLimit(n int) {
+	statsMutex.Lock()
+	globalConnLimit = n
+	statsMutex.Unlock()
+}
+
+// GlobalConnCount returns the number of connections currently alive to
+// all servers across all clusters in the process.
+func GlobalConnCount() int {
+	statsMutex.Lock()
+	n := globalConns
+	statsMutex.Unlock()
+	return n
+}
+
+// reserveConn accounts for a new connection about to be established,
+// failing if that would exceed the global connection limit.
+func reserveConn() error {
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+	if globalConnLimit > 0 && globalConns >= globalConnLimit {
+		return errGlobalConnLimit
+	}
+	globalConns++
+	return nil
+}
+
+// releaseConn accounts for a connection that was closed or couldn't be
+// established after being reserved.
+func releaseConn() {
+	statsMutex.Lock()
+	globalConns--
+	statsMutex.Unlock()
+}
+
 // SetStats enable database state monitoring
 func SetStats(enabled bool) {
 	statsMutex.Lock()
@@ -91,6 +140,87 @@ type Stats struct {
 	TimesWaitedForPool  int
 	TotalPoolWaitTime   time.Duration
 	PoolTimeouts        int
+
+	// PoolWaitHistogram counts the times waited for a socket to become
+	// available in a pool that reached its limit, including the waits that
+	// timed out, by how long they took. Each bucket counts the waits up to
+	// the respective bound returned by PoolWaitBounds and longer than the
+	// previous one, and the last bucket counts the waits longer than all
+	// bounds. Acquiring a socket without waiting isn't counted.
+	PoolWaitHistogram [len(poolWaitBounds) + 1]int
+	MaxPoolWaitTime   time.Duration
+
+	// Retries counts the operations retried after a transient failure,
+	// and RetriesDenied the ones which weren't because the retry budget
+	// of the cluster was exhausted. See DialInfo.RetryBudgetRatio.
+	Retries       int
+	RetriesDenied int
+}
+
+var poolWaitBounds = [...]time.Duration{
+	1 * time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	2 * time.Second,
+	5 * time.Second,
+}
+
+// PoolWaitBounds returns the upper bounds of the buckets of
+// Stats.PoolWaitHistogram, in increasing order.
+func PoolWaitBounds() []time.Duration {
+	bounds := make([]time.Duration, len(poolWaitBounds))
+	copy(bounds, poolWaitBounds[:])
+	return bounds
+}
+
+// PoolWaitPercentile returns an upper bound for the given percentile, from
+// 0 to 100, of the times waited for a socket to become available in a pool,
+// as estimated from PoolWaitHistogram: the bound of the bucket holding the
+// percentile, or MaxPoolWaitTime if that's lower or the percentile is held
+// by the last bucket. It returns zero if there were no waits.
+func (stats *Stats) PoolWaitPercentile(percentile float64) time.Duration {
+	total := 0
+	for _, n := range stats.PoolWaitHistogram {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := int(percentile / 100 * float64(total))
+	if rank >= total {
+		rank = total - 1
+	}
+	for i, n := range stats.PoolWaitHistogram {
+		if rank >= n {
+			rank -= n
+			continue
+		}
+		if i < len(poolWaitBounds) && poolWaitBounds[i] < stats.MaxPoolWaitTime {
+			return poolWaitBounds[i]
+		}
+		break
+	}
+	return stats.MaxPoolWaitTime
+}
+
+// noticePoolWait accounts for a wait for a socket to become available in
+// the histogram of pool waits. It must be called with statsMutex held.
+func (stats *Stats) noticePoolWait(waitTime time.Duration) {
+	i := 0
+	for i < len(poolWaitBounds) && waitTime > poolWaitBounds[i] {
+		i++
+	}
+	stats.PoolWaitHistogram[i]++
+	if waitTime > stats.MaxPoolWaitTime {
+		stats.MaxPoolWaitTime = waitTime
+	}
 }
 
 func (stats *Stats) cluster(delta int) {
@@ -168,6 +298,19 @@ func (stats *Stats) noticeSocketAcquisition(waitTime time.Duration) {
 		stats.TotalPoolWaitTime += waitTime
 		if waitTime > 0 {
 			stats.TimesWaitedForPool++
+			stats.noticePoolWait(waitTime)
+		}
+		statsMutex.Unlock()
+	}
+}
+
+func (stats *Stats) noticeRetry(allowed bool) {
+	if stats != nil {
+		statsMutex.Lock()
+		if allowed {
+			stats.Retries++
+		} else {
+			stats.RetriesDenied++
 		}
 		statsMutex.Unlock()
 	}
@@ -179,6 +322,7 @@ func (stats *Stats) noticePoolTimeout(waitTime time.Duration) {
 		stats.TimesWaitedForPool++
 		stats.PoolTimeouts++
 		stats.TotalPoolWaitTime += waitTime
+		stats.noticePoolWait(waitTime)
 		statsMutex.Unlock()
 	}
 }
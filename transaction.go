@@ -0,0 +1,247 @@
+package mgo
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+const maxTransactionRetries = 5
+
+var (
+	errTransactionInProgress     = errors.New("transaction already in progress")
+	errNoTransaction             = errors.New("no transaction in progress")
+	errTransactionsNotSupported  = errors.New("transactions require MongoDB 4.0 or newer")
+	errTransactionServerLost     = errors.New("connection to the server of the transaction in progress was lost")
+	errTransactionReadPreference = errors.New("read preference in a transaction must be primary")
+)
+
+// transaction holds the state of a server-side multi-document transaction
+// started on a session.
+type transaction struct {
+	m       sync.Mutex
+	socket  *mongoSocket
+	number  int64
+	started bool
+}
+
+// acquireSocket acquires the socket all operations within the transaction
+// are sent to. Once that socket is lost the transaction can't go on, as no
+// other server knows about it, so an error is returned instead.
+func (txn *transaction) acquireSocket() (*mongoSocket, error) {
+	socket := txn.socket
+	socket.Lock()
+	dead := socket.dead
+	socket.Unlock()
+	if dead != nil {
+		return nil, errTransactionServerLost
+	}
+	socket.Acquire()
+	return socket, nil
+}
+
+// StartTransaction starts a multi-document transaction on the session.
+//
+// The transaction runs within the logical session of the session, started
+// on the server or reused from a closed session if it has none yet, and all
+// operations performed on the session until the transaction is committed or
+// aborted are sent to the same primary socket, carrying the logical session
+// id and the transaction number. Commands run against the admin database
+// are sent over that socket as well, but outside of the transaction.
+// Reads are sent to the primary as well, regardless of the session mode,
+// and queries with a read preference of their own other than Primary fail.
+// Should the connection to the primary be lost, operations fail until the
+// transaction is aborted.
+//
+// Transactions require a replica set running MongoDB 4.0 or newer.
+//
+// Relevant documentation:
+//
+//     https://docs.mongodb.com/manual/core/transactions/
+//
+func (s *Session) StartTransaction() error {
+	s.m.RLock()
+	active := s.txn != nil
+	s.m.RUnlock()
+	if active {
+		return errTransactionInProgress
+	}
+
+	socket, err := s.acquireSocket(false)
+	if err != nil {
+		return err
+	}
+	if socket.ServerInfo().MaxWireVersion < 7 {
+		socket.Release()
+		return errTransactionsNotSupported
+	}
+	lsid, err := s.serverSession(socket)
+	if err != nil {
+		socket.Release()
+		return err
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.txn != nil {
+		socket.Release()
+		return errTransactionInProgress
+	}
+	lsid.txnNumber++
+	s.txn = &transaction{socket: socket, number: lsid.txnNumber}
+	debugf("Session %p started transaction %d", s, lsid.txnNumber)
+	return nil
+}
+
+// CommitTransaction commits the transaction in progress on the session.
+func (s *Session) CommitTransaction() error {
+	return s.endTransaction("commitTransaction")
+}
+
+// AbortTransaction aborts the transaction in progress on the session,
+// discarding all of the changes it performed.
+func (s *Session) AbortTransaction() error {
+	return s.endTransaction("abortTransaction")
+}
+
+func (s *Session) endTransaction(cmdName string) error {
+	s.m.Lock()
+	txn := s.txn
+	s.txn = nil
+	lsid := s.lsid
+	safeOp := s.safeOp
+	s.m.Unlock()
+	if txn == nil {
+		return errNoTransaction
+	}
+	defer txn.socket.Release()
+
+	txn.m.Lock()
+	started := txn.started
+	txn.m.Unlock()
+	if !started {
+		// Nothing was sent to the server, so there's nothing to end.
+		return nil
+	}
+
+	cmd := bson.D{
+		{Name: cmdName, Value: 1},
+		{Name: "lsid", Value: &lsid.id},
+		{Name: "txnNumber", Value: txn.number},
+		{Name: "autocommit", Value: false},
+	}
+	if safeOp != nil {
+		cmd = append(cmd, bson.DocElem{Name: "writeConcern", Value: safeOp.query.(*getLastError)})
+	}
+	return s.DB("admin").run(txn.socket, cmd, nil)
+}
+
+// RunTransaction runs fn within a transaction started on the session.
+// The transaction is committed if fn returns nil, and aborted otherwise.
+// If the server reports the failure as a transient transaction error,
+// the whole transaction, including the call to fn, is retried.
+func (s *Session) RunTransaction(fn func() error) (err error) {
+	for i := 0; i < maxTransactionRetries; i++ {
+		if err = s.StartTransaction(); err != nil {
+			return err
+		}
+		if err = fn(); err == nil {
+			err = s.CommitTransaction()
+		} else {
+			s.AbortTransaction()
+		}
+		if err == nil || !IsTransientTransactionError(err) {
+			return err
+		}
+		debugf("Session %p retrying transaction after transient error: %v", s, err)
+	}
+	return err
+}
+
+// IsTransientTransactionError returns whether err was labeled by the server
+// as a transient transaction error, meaning the transaction that failed may
+// be safely retried from the start.
+func IsTransientTransactionError(err error) bool {
+	if e, ok := err.(*QueryError); ok {
+		for _, label := range e.ErrorLabels {
+			if label == "TransientTransactionError" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// txnFields returns the transaction in progress on the session and the
+// fields that must be appended to commands sent within it, or nil if there
+// is none. The first command also starts the transaction on the server, so
+// it carries startTransaction until a reply to one of them was received.
+func (s *Session) txnFields() (*transaction, bson.D) {
+	s.m.RLock()
+	txn := s.txn
+	lsid := s.lsid
+	s.m.RUnlock()
+	if txn == nil {
+		return nil, nil
+	}
+	txn.m.Lock()
+	first := !txn.started
+	txn.m.Unlock()
+
+	fields := bson.D{
+		{Name: "lsid", Value: &lsid.id},
+		{Name: "txnNumber", Value: txn.number},
+	}
+	if first {
+		fields = append(fields, bson.DocElem{Name: "startTransaction", Value: true})
+	}
+	return txn, append(fields, bson.DocElem{Name: "autocommit", Value: false})
+}
+
+// replyFunc returns replyFunc wrapped to record that the transaction was
+// started on the server once a reply to a command sent within it arrives.
+func (txn *transaction) replyFunc(replyFunc replyFunc) replyFunc {
+	return func(err error, reply *replyOp, docNum int, docData []byte) {
+		if err == nil {
+			txn.m.Lock()
+			txn.started = true
+			txn.m.Unlock()
+		}
+		replyFunc(err, reply, docNum, docData)
+	}
+}
+
+// txnCommand returns whether the command op is about to send runs within
+// the transaction in progress. As with the logical session id, handshake,
+// authentication and session commands are left out, and so are commands
+// run against the admin database, which aren't allowed in transactions.
+func (op *queryOp) txnCommand() bool {
+	if !strings.HasSuffix(op.collection, ".$cmd") || strings.HasPrefix(op.collection, "admin.") {
+		return false
+	}
+	return !sessionFreeCommands[commandName(op.query)]
+}
+
+// appendTxnFields returns cmd with the given transaction fields appended.
+// The write concern of individual operations is dropped, as the server only
+// accepts it when the transaction is committed or aborted.
+func appendTxnFields(cmd interface{}, fields bson.D) interface{} {
+	var raw bson.RawD
+	data, err := bson.Marshal(cmd)
+	if err == nil {
+		err = bson.Unmarshal(data, &raw)
+	}
+	if err != nil {
+		// Leave it to the caller to report the marshalling error.
+		return cmd
+	}
+	doc := make(bson.D, 0, len(raw)+len(fields))
+	for _, elem := range raw {
+		if elem.Name != "writeConcern" {
+			doc = append(doc, bson.DocElem{Name: elem.Name, Value: elem.Value})
+		}
+	}
+	return append(doc, fields...)
+}